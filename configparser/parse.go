@@ -18,6 +18,7 @@
 package configparser
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/kylelemons/go-gypsy/yaml"
 	"github.com/uniqush/uniqush-conn/evthandler"
@@ -27,7 +28,11 @@ import (
 	"github.com/uniqush/uniqush-conn/proto/server"
 	"github.com/uniqush/uniqush-conn/push"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -36,11 +41,97 @@ type Config struct {
 	HttpAddr         string
 	Auth             server.Authenticator
 	ErrorHandler     evthandler.ErrorHandler
-	filename         string
-	srvConfig        map[string]*msgcenter.ServiceConfig
-	defaultConfig    *msgcenter.ServiceConfig
+
+	// If not nil, the listener should be wrapped by TLS.
+	TLSConfig *tls.Config
+
+	// Maps a hostname sent by TLS clients (through SNI)
+	// to the service which the connection belongs to.
+	ServiceByHost map[string]string
+
+	// Prefixed to the connection ids reported by this node.
+	NodeId string
+
+	// The region where this node runs, reported in login/logout
+	// events and connection details. Empty by default.
+	Region string
+
+	// If positive, new connections to low priority services are
+	// rejected once the process uses this many megabytes of memory.
+	MemoryLimit int
+
+	// If true, the services reading the same config, e.g. those
+	// without a section of their own, share one goroutine.
+	GroupServices bool
+
+	// If positive, at most this many connections go through
+	// the handshake at the same time.
+	MaxConcurrentHandshakes int
+
+	// If positive, new connections are rejected while this many
+	// connections have not finished the handshake.
+	MaxPendingConns int
+
+	// If positive, the server drains all connections on SIGTERM,
+	// and closes those left after this long before it exits.
+	ShutdownDeadline time.Duration
+
+	// If not nil, called for each accepted connection before the
+	// handshake. It cannot be set in the config file; programs
+	// embedding the server set it before the message center starts.
+	AcceptFilter msgcenter.AcceptFilter
+
+	// Options of the listening socket.
+	Listener ListenerConfig
+
+	// If not empty, the server listens on each of them
+	// instead of the default listener.
+	Listeners []ListenerConfig
+
+	filename      string
+	srvConfig     map[string]*msgcenter.ServiceConfig
+	defaultConfig *msgcenter.ServiceConfig
+}
+
+type ListenerConfig struct {
+	// Empty for the default listener, whose address is
+	// given from the command line.
+	Addr string
+
+	// If not nil, the listener should be wrapped by TLS.
+	TLSConfig     *tls.Config
+	ServiceByHost map[string]string
+
+	// Services allowed to connect through the listener.
+	// Empty means all services.
+	Services []string
+
+	// Set SO_REUSEPORT on the listening socket(s).
+	ReusePort bool
+
+	// Size of the accept backlog. Zero means the system default.
+	Backlog int
+
+	// Number of goroutines accepting connections concurrently.
+	// If ReusePort is set, each of them has its own socket.
+	NrAcceptors int
+
+	// If true, Nagle's algorithm is left on for accepted connections,
+	// trading latency for fewer packets. By default TCP_NODELAY is set.
+	Delay bool
+
+	// Sizes of the socket send/receive buffers of accepted
+	// connections in bytes. Zero means the system default.
+	SendBuffer int
+	RecvBuffer int
 }
 
+// Bounds of the socket buffer sizes in a listener's config.
+const (
+	minSocketBuffer = 4 << 10
+	maxSocketBuffer = 16 << 20
+)
+
 func (self *Config) AllServices() []string {
 	ret := make([]string, 0, len(self.srvConfig))
 	for srv, _ := range self.srvConfig {
@@ -66,6 +157,15 @@ func parseInt(node yaml.Node) (n int, err error) {
 	return
 }
 
+func parseBool(node yaml.Node) (b bool, err error) {
+	if scalar, ok := node.(yaml.Scalar); ok {
+		b, err = strconv.ParseBool(string(scalar))
+	} else {
+		err = fmt.Errorf("Not a scalar")
+	}
+	return
+}
+
 func parseString(node yaml.Node) (str string, err error) {
 	if node == nil {
 		str = ""
@@ -79,6 +179,24 @@ func parseString(node yaml.Node) (str string, err error) {
 	return
 }
 
+func parseStringList(node yaml.Node) (list []string, err error) {
+	l, ok := node.(yaml.List)
+	if !ok {
+		err = fmt.Errorf("Not a list")
+		return
+	}
+	list = make([]string, 0, len(l))
+	for _, n := range l {
+		var str string
+		str, err = parseString(n)
+		if err != nil {
+			return
+		}
+		list = append(list, str)
+	}
+	return
+}
+
 func parseDuration(node yaml.Node) (t time.Duration, err error) {
 	if scalar, ok := node.(yaml.Scalar); ok {
 		t, err = time.ParseDuration(string(scalar))
@@ -89,9 +207,12 @@ func parseDuration(node yaml.Node) (t time.Duration, err error) {
 }
 
 type webhookInfo struct {
-	url          string
-	timeout      time.Duration
-	defaultValue string
+	url              string
+	timeout          time.Duration
+	dialTimeout      time.Duration
+	defaultValue     string
+	maxResponseBytes int
+	deadLetterMaxAge time.Duration
 }
 
 func parseWebHook(node yaml.Node) (hook *webhookInfo, err error) {
@@ -114,6 +235,13 @@ func parseWebHook(node yaml.Node) (hook *webhookInfo, err error) {
 				return
 			}
 		}
+		if dialTimeout, ok := kv["dial-timeout"]; ok {
+			hook.dialTimeout, err = parseDuration(dialTimeout)
+			if err != nil {
+				err = fmt.Errorf("dial-timeout error: %v", err)
+				return
+			}
+		}
 		if defaultValue, ok := kv["default"]; ok {
 			hook.defaultValue, err = parseString(defaultValue)
 			if err != nil {
@@ -121,6 +249,20 @@ func parseWebHook(node yaml.Node) (hook *webhookInfo, err error) {
 				return
 			}
 		}
+		if maxBytes, ok := kv["max-response-bytes"]; ok {
+			hook.maxResponseBytes, err = parseInt(maxBytes)
+			if err != nil {
+				err = fmt.Errorf("max-response-bytes should be an integer")
+				return
+			}
+		}
+		if maxAge, ok := kv["dead-letter-max-age"]; ok {
+			hook.deadLetterMaxAge, err = parseDuration(maxAge)
+			if err != nil {
+				err = fmt.Errorf("dead-letter-max-age: %v", err)
+				return
+			}
+		}
 	} else {
 		err = fmt.Errorf("webhook should be a map")
 	}
@@ -135,8 +277,14 @@ func setWebHook(hd webhook.WebHook, node yaml.Node, timeout time.Duration) error
 	if hook.timeout < 0*time.Second {
 		hook.timeout = timeout
 	}
+	if hook.dialTimeout <= 0*time.Second {
+		hook.dialTimeout = hook.timeout
+	}
 	hd.SetTimeout(hook.timeout)
+	hd.SetDialTimeout(hook.dialTimeout)
 	hd.SetURL(hook.url)
+	hd.SetMaxResponseBytes(int64(hook.maxResponseBytes))
+	hd.SetDeadLetterMaxAge(hook.deadLetterMaxAge)
 	if hook.defaultValue == "allow" {
 		hd.SetDefault(200)
 	} else {
@@ -145,26 +293,100 @@ func setWebHook(hd webhook.WebHook, node yaml.Node, timeout time.Duration) error
 	return nil
 }
 
+// on-failure decides whether users are allowed (open) or denied (closed)
+// when the auth web hook cannot be reached. It defaults to closed. The
+// default value only applies if the url is none.
 func parseAuthHandler(node yaml.Node, timeout time.Duration) (h server.Authenticator, err error) {
 	hd := new(webhook.AuthHandler)
 	err = setWebHook(hd, node, timeout)
 	if err != nil {
 		return
 	}
+	if kv, ok := node.(yaml.Map); ok {
+		if fnode, ok := kv["on-failure"]; ok {
+			var onFailure string
+			onFailure, err = parseString(fnode)
+			if err != nil {
+				err = fmt.Errorf("on-failure: %v", err)
+				return
+			}
+			switch onFailure {
+			case "open":
+				hd.SetFailOpen(true)
+			case "closed":
+				hd.SetFailOpen(false)
+			default:
+				err = fmt.Errorf("on-failure should be either open or closed: %v", onFailure)
+				return
+			}
+		}
+	}
 	h = hd
 	return
 }
 
+// Besides the common fields of web hooks, the msg block may have
+// redact-headers, a list of header fields, and redact-body, which
+// are dropped from the messages posted to the web hook.
 func parseMessageHandler(node yaml.Node, timeout time.Duration) (h evthandler.MessageHandler, err error) {
 	hd := new(webhook.MessageHandler)
 	err = setWebHook(hd, node, timeout)
 	if err != nil {
 		return
 	}
+	if kv, ok := node.(yaml.Map); ok {
+		var headers []string
+		redactBody := false
+		if hnode, ok := kv["redact-headers"]; ok {
+			headers, err = parseStringList(hnode)
+			if err != nil {
+				err = fmt.Errorf("redact-headers: %v", err)
+				return
+			}
+		}
+		if bnode, ok := kv["redact-body"]; ok {
+			redactBody, err = parseBool(bnode)
+			if err != nil {
+				err = fmt.Errorf("redact-body: %v", err)
+				return
+			}
+		}
+		hd.SetRedaction(headers, redactBody)
+	}
 	h = hd
 	return
 }
 
+// The message-routes block has a header, whose value is the type of a
+// message, and routes, a map from each type to a msg web hook block.
+// Messages of other types go to the msg web hook.
+func parseMessageRoutes(node yaml.Node, timeout time.Duration) (header string, routes map[string]evthandler.MessageHandler, err error) {
+	kv, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("message routes should be a map")
+		return
+	}
+	header, err = parseString(kv["header"])
+	if err != nil || len(header) == 0 {
+		err = fmt.Errorf("header should be a non-empty string")
+		return
+	}
+	rnode, ok := kv["routes"].(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("routes should be a map")
+		return
+	}
+	routes = make(map[string]evthandler.MessageHandler, len(rnode))
+	for msgType, hnode := range rnode {
+		routes[msgType], err = parseMessageHandler(hnode, timeout)
+		if err != nil {
+			err = fmt.Errorf("route %v: %v", msgType, err)
+			return
+		}
+	}
+	return
+}
+
 func parseErrorHandler(node yaml.Node, timeout time.Duration) (h evthandler.ErrorHandler, err error) {
 	hd := new(webhook.ErrorHandler)
 	err = setWebHook(hd, node, timeout)
@@ -192,6 +414,16 @@ func parseForwardRequestHandler(node yaml.Node, timeout time.Duration) (h evthan
 		} else {
 			hd.SetMaxTTL(24 * time.Hour)
 		}
+		if patnode, ok := kv["group-pattern"]; ok {
+			pattern, e := parseString(patnode)
+			if e == nil {
+				e = hd.SetGroupPattern(pattern)
+			}
+			if e != nil {
+				err = fmt.Errorf("group-pattern: %v", e)
+				return
+			}
+		}
 	}
 	h = hd
 	return
@@ -237,6 +469,26 @@ func parseUnsubscribeHandler(node yaml.Node, timeout time.Duration) (h evthandle
 	return
 }
 
+func parseFallbackHandler(node yaml.Node, timeout time.Duration) (h evthandler.FallbackHandler, err error) {
+	hd := new(webhook.FallbackHandler)
+	err = setWebHook(hd, node, timeout)
+	if err != nil {
+		return
+	}
+	h = hd
+	return
+}
+
+func parseDeliveryHandler(node yaml.Node, timeout time.Duration) (h evthandler.DeliveryHandler, err error) {
+	hd := new(webhook.DeliveryHandler)
+	err = setWebHook(hd, node, timeout)
+	if err != nil {
+		return
+	}
+	h = hd
+	return
+}
+
 func parsePushHandler(node yaml.Node, timeout time.Duration) (h evthandler.PushHandler, err error) {
 	hd := new(webhook.PushHandler)
 	err = setWebHook(hd, node, timeout)
@@ -253,6 +505,23 @@ func parseUniqushPush(node yaml.Node, timeout time.Duration) (p push.Push, err e
 		err = fmt.Errorf("uniqush-push information should be a map")
 		return
 	}
+	if engineN, ok := kv["engine"]; ok {
+		var engine string
+		engine, err = parseString(engineN)
+		if err != nil {
+			err = fmt.Errorf("bad engine: %v", err)
+			return
+		}
+		switch engine {
+		case "uniqush-push":
+		case "mock":
+			p, err = parseMockPush(kv)
+			return
+		default:
+			err = fmt.Errorf("unknown engine: %v", engine)
+			return
+		}
+	}
 	addrN, ok := kv["addr"]
 	if !ok {
 		err = fmt.Errorf("cannot find addr field")
@@ -275,7 +544,244 @@ func parseUniqushPush(node yaml.Node, timeout time.Duration) (p push.Push, err e
 			return
 		}
 	}
-	p = push.NewUniqushPushClient(addr, timeout)
+	// Each kind of requests may have its own timeout,
+	// which defaults to the timeout above.
+	timeouts := &push.Timeouts{
+		Subscribe:        timeout,
+		Push:             timeout,
+		NrDeliveryPoints: timeout,
+	}
+	fields := map[string]*time.Duration{
+		"subscribe-timeout": &timeouts.Subscribe,
+		"push-timeout":      &timeouts.Push,
+		"nrdp-timeout":      &timeouts.NrDeliveryPoints,
+	}
+	for name, t := range fields {
+		if to, ok := kv[name]; ok {
+			*t, err = parseDuration(to)
+			if err != nil {
+				err = fmt.Errorf("bad %v: %v", name, err)
+				return
+			}
+		}
+	}
+	p = push.NewUniqushPushClientWithTimeouts(addr, timeouts)
+	return
+}
+
+// parseMockPush returns a push.MockPush, under which each user
+// has nrdp (one by default) delivery points.
+func parseMockPush(kv yaml.Map) (p push.Push, err error) {
+	nrdp := 1
+	if n, ok := kv["nrdp"]; ok {
+		nrdp, err = parseInt(n)
+		if err != nil {
+			err = fmt.Errorf("bad nrdp: %v", err)
+			return
+		}
+	}
+	p = push.NewMockPush(nrdp)
+	return
+}
+
+func parseCertificate(fields yaml.Map) (cert *tls.Certificate, err error) {
+	certFile, err := parseString(fields["cert"])
+	if err != nil {
+		return
+	}
+	keyFile, err := parseString(fields["key"])
+	if err != nil {
+		return
+	}
+	if len(certFile) == 0 && len(keyFile) == 0 {
+		return
+	}
+	c, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return
+	}
+	cert = &c
+	return
+}
+
+// The listeners block is a list of listener blocks:
+//
+//	listeners:
+//	  - addr: 0.0.0.0:8964
+//	    tls:
+//	      cert: cert.pem
+//	      key: key.pem
+//	    services:
+//	      - chat
+//	    reuse-port: true
+//	    backlog: 1024
+//	    acceptors: 4
+//	    no-delay: false
+//	    send-buffer: 262144
+//	    recv-buffer: 262144
+func parseListeners(node yaml.Node) (listeners []ListenerConfig, err error) {
+	list, ok := node.(yaml.List)
+	if !ok {
+		err = fmt.Errorf("listeners should be a list")
+		return
+	}
+	listeners = make([]ListenerConfig, 0, len(list))
+	for i, n := range list {
+		var conf ListenerConfig
+		conf, err = parseListener(n)
+		if err != nil {
+			err = fmt.Errorf("[listener=%v] %v", i, err)
+			return
+		}
+		if len(conf.Addr) == 0 {
+			err = fmt.Errorf("[listener=%v] no addr", i)
+			return
+		}
+		listeners = append(listeners, conf)
+	}
+	return
+}
+
+func parseListener(node yaml.Node) (conf ListenerConfig, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("listen should be a map")
+		return
+	}
+	for name, value := range fields {
+		switch name {
+		case "reuse-port":
+			fallthrough
+		case "reuse_port":
+			conf.ReusePort, err = parseBool(value)
+		case "backlog":
+			conf.Backlog, err = parseInt(value)
+		case "acceptors":
+			conf.NrAcceptors, err = parseInt(value)
+		case "no-delay":
+			fallthrough
+		case "no_delay":
+			var noDelay bool
+			noDelay, err = parseBool(value)
+			conf.Delay = !noDelay
+		case "send-buffer":
+			fallthrough
+		case "send_buffer":
+			conf.SendBuffer, err = parseInt(value)
+		case "recv-buffer":
+			fallthrough
+		case "recv_buffer":
+			conf.RecvBuffer, err = parseInt(value)
+		case "addr":
+			conf.Addr, err = parseString(value)
+		case "tls":
+			conf.TLSConfig, conf.ServiceByHost, err = parseTLS(value)
+		case "services":
+			conf.Services, err = parseStringList(value)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", name, err)
+			return
+		}
+	}
+	if conf.Backlog < 0 {
+		err = fmt.Errorf("[field=backlog] should not be negative")
+		return
+	}
+	if conf.NrAcceptors < 0 {
+		err = fmt.Errorf("[field=acceptors] should not be negative")
+		return
+	}
+	err = checkSocketBuffer("send-buffer", conf.SendBuffer)
+	if err != nil {
+		return
+	}
+	err = checkSocketBuffer("recv-buffer", conf.RecvBuffer)
+	return
+}
+
+func checkSocketBuffer(name string, size int) error {
+	if size == 0 {
+		return nil
+	}
+	if size < minSocketBuffer || size > maxSocketBuffer {
+		return fmt.Errorf("[field=%v] should be between %v and %v", name, minSocketBuffer, maxSocketBuffer)
+	}
+	return nil
+}
+
+// The tls block looks like:
+//
+//	tls:
+//	  cert: default-cert.pem
+//	  key: default-key.pem
+//	  hosts:
+//	    chat.example.com:
+//	      cert: chat-cert.pem
+//	      key: chat-key.pem
+//	      service: chat
+//
+// The certificate is selected by the hostname sent by the client
+// (through SNI). The default one is used if there is no match.
+func parseTLS(node yaml.Node) (conf *tls.Config, serviceByHost map[string]string, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("tls should be a map")
+		return
+	}
+	defaultCert, err := parseCertificate(fields)
+	if err != nil {
+		return
+	}
+	certs := make(map[string]*tls.Certificate, 10)
+	serviceByHost = make(map[string]string, 10)
+	if hostsNode, ok := fields["hosts"]; ok {
+		hosts, ok := hostsNode.(yaml.Map)
+		if !ok {
+			err = fmt.Errorf("hosts should be a map")
+			return
+		}
+		for host, hnode := range hosts {
+			host = strings.ToLower(host)
+			hfields, ok := hnode.(yaml.Map)
+			if !ok {
+				err = fmt.Errorf("[host=%v] should be a map", host)
+				return
+			}
+			var cert *tls.Certificate
+			cert, err = parseCertificate(hfields)
+			if err != nil {
+				err = fmt.Errorf("[host=%v] %v", host, err)
+				return
+			}
+			if cert != nil {
+				certs[host] = cert
+			}
+			if srvNode, ok := hfields["service"]; ok {
+				var srv string
+				srv, err = parseString(srvNode)
+				if err != nil {
+					err = fmt.Errorf("[host=%v] bad service: %v", host, err)
+					return
+				}
+				serviceByHost[host] = srv
+			}
+		}
+	}
+	if defaultCert == nil && len(certs) == 0 {
+		err = fmt.Errorf("no certificate")
+		return
+	}
+	conf = new(tls.Config)
+	conf.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if cert, ok := certs[strings.ToLower(hello.ServerName)]; ok {
+			return cert, nil
+		}
+		if defaultCert != nil {
+			return defaultCert, nil
+		}
+		return nil, fmt.Errorf("no certificate for %v", hello.ServerName)
+	}
 	return
 }
 
@@ -285,6 +791,10 @@ func parseCache(node yaml.Node) (cache msgcache.Cache, err error) {
 		addr := ""
 		password := ""
 		name := "0"
+		codecName := "json"
+		idgenName := "random"
+		keyPrefix := ""
+		prefixByService := false
 
 		for k, v := range fields {
 			switch k {
@@ -296,6 +806,18 @@ func parseCache(node yaml.Node) (cache msgcache.Cache, err error) {
 				password, err = parseString(v)
 			case "name":
 				name, err = parseString(v)
+			case "codec":
+				codecName, err = parseString(v)
+			case "ids":
+				idgenName, err = parseString(v)
+			case "key-prefix":
+				fallthrough
+			case "key_prefix":
+				keyPrefix, err = parseString(v)
+			case "prefix-by-service":
+				fallthrough
+			case "prefix_by_service":
+				prefixByService, err = parseBool(v)
 			}
 			if err != nil {
 				err = fmt.Errorf("[field=%v] %v", k, err)
@@ -312,13 +834,132 @@ func parseCache(node yaml.Node) (cache msgcache.Cache, err error) {
 			err = fmt.Errorf("invalid database name: %v", name)
 			return
 		}
-		cache = msgcache.NewRedisMessageCache(addr, password, db)
+		var codec msgcache.MessageCodec
+		codec, err = msgcache.GetCodec(codecName)
+		if err != nil {
+			return
+		}
+		var idgen msgcache.IdGenerator
+		idgen, err = msgcache.GetIdGenerator(idgenName)
+		if err != nil {
+			return
+		}
+		cache = msgcache.NewPrefixedRedisMessageCache(addr, password, db, codec, idgen, keyPrefix, prefixByService)
 	} else {
 		err = fmt.Errorf("database info should be a map")
 	}
 	return
 }
 
+// parseDeliveryPoints tells if delivery points are counted from
+// the subscription store (subscriptions) instead of the push service
+// (push).
+func parseDeliveryPoints(node yaml.Node) (fromSubscriptions bool, err error) {
+	str, err := parseString(node)
+	if err != nil {
+		return
+	}
+	switch str {
+	case "push":
+		return false, nil
+	case "subscriptions":
+		return true, nil
+	}
+	err = fmt.Errorf("should be either push or subscriptions: %v", str)
+	return
+}
+
+func parseSubscriptionStore(node yaml.Node) (store push.SubscriptionStore, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("subscription store info should be a map")
+		return
+	}
+	engine := "redis"
+	addr := ""
+	password := ""
+	name := "0"
+	for k, v := range fields {
+		switch k {
+		case "engine":
+			engine, err = parseString(v)
+		case "addr":
+			addr, err = parseString(v)
+		case "password":
+			password, err = parseString(v)
+		case "name":
+			name, err = parseString(v)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", k, err)
+			return
+		}
+	}
+	if engine != "redis" {
+		err = fmt.Errorf("database %v is not supported", engine)
+		return
+	}
+	db, err := strconv.Atoi(name)
+	if err != nil || db < 0 {
+		err = fmt.Errorf("invalid database name: %v", name)
+		return
+	}
+	store = push.NewRedisSubscriptionStore(addr, password, db)
+	return
+}
+
+func parseLogger(node yaml.Node) (logger msgcenter.Logger, err error) {
+	path, err := parseString(node)
+	if err != nil {
+		return
+	}
+	switch path {
+	case "stdout":
+		logger = msgcenter.NewTextLogger(os.Stdout)
+	case "stderr":
+		logger = msgcenter.NewTextLogger(os.Stderr)
+	default:
+		var f *os.File
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return
+		}
+		logger = msgcenter.NewTextLogger(f)
+	}
+	return
+}
+
+// parseAuditLogger reads the path of the audit file and, optionally,
+// the size in bytes beyond which it is rotated.
+func parseAuditLogger(node yaml.Node) (logger msgcenter.AuditLogger, err error) {
+	kv, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("audit should be a map")
+		return
+	}
+	path, err := parseString(kv["path"])
+	if err != nil {
+		err = fmt.Errorf("bad path: %v", err)
+		return
+	}
+	if len(path) == 0 {
+		err = fmt.Errorf("path is required")
+		return
+	}
+	maxSize := 0
+	if n, ok := kv["rotate-size"]; ok {
+		maxSize, err = parseInt(n)
+	} else if n, ok := kv["rotate_size"]; ok {
+		maxSize, err = parseInt(n)
+	}
+	if err != nil {
+		err = fmt.Errorf("bad rotate-size: %v", err)
+		return
+	}
+	logger, err = msgcenter.NewFileAuditLogger(path, int64(maxSize))
+	return
+}
+
 func parseService(service string, node yaml.Node, defaultConfig *msgcenter.ServiceConfig) (config *msgcenter.ServiceConfig, err error) {
 	if node == nil {
 		config = defaultConfig
@@ -344,11 +985,18 @@ func parseService(service string, node yaml.Node, defaultConfig *msgcenter.Servi
 	if defaultConfig != nil {
 		*config = *defaultConfig
 	}
+	// Delivery points are counted by the push service unless
+	// delivery-points is subscriptions.
+	countSubscriptions := false
 
 	for name, value := range fields {
 		switch name {
 		case "msg":
 			config.MessageHandler, err = parseMessageHandler(value, timeout)
+		case "message-routes":
+			fallthrough
+		case "message_routes":
+			config.MessageRouteHeader, config.MessageRoutes, err = parseMessageRoutes(value, timeout)
 		case "logout":
 			config.LogoutHandler, err = parseLogoutHandler(value, timeout)
 		case "login":
@@ -361,6 +1009,10 @@ func parseService(service string, node yaml.Node, defaultConfig *msgcenter.Servi
 			config.SubscribeHandler, err = parseSubscribeHandler(value, timeout)
 		case "unsubscribe":
 			config.UnsubscribeHandler, err = parseUnsubscribeHandler(value, timeout)
+		case "fallback":
+			config.FallbackHandler, err = parseFallbackHandler(value, timeout)
+		case "delivery":
+			config.DeliveryHandler, err = parseDeliveryHandler(value, timeout)
 		case "uniqush-push":
 			fallthrough
 		case "uniqush_push":
@@ -377,6 +1029,186 @@ func parseService(service string, node yaml.Node, defaultConfig *msgcenter.Servi
 			fallthrough
 		case "max_conns_per_user":
 			config.MaxNrConnsPerUser, err = parseInt(value)
+		case "reauth-interval":
+			fallthrough
+		case "reauth_interval":
+			config.ReAuthInterval, err = parseDuration(value)
+		case "max-conn-lifetime":
+			fallthrough
+		case "max_conn_lifetime":
+			config.MaxConnLifetime, err = parseDuration(value)
+		case "required-headers":
+			fallthrough
+		case "required_headers":
+			config.RequiredHeaders, err = parseStringList(value)
+		case "allowed-headers":
+			fallthrough
+		case "allowed_headers":
+			config.AllowedHeaders, err = parseStringList(value)
+		case "require-cache":
+			fallthrough
+		case "require_cache":
+			config.RequireCache, err = parseBool(value)
+		case "retry-after":
+			fallthrough
+		case "retry_after":
+			config.RetryAfter, err = parseDuration(value)
+		case "retry-after-jitter":
+			fallthrough
+		case "retry_after_jitter":
+			config.RetryAfterJitter, err = parseDuration(value)
+		case "max-subscribes":
+			fallthrough
+		case "max_subscribes":
+			config.MaxNrSubscribes, err = parseInt(value)
+		case "subscribe-interval":
+			fallthrough
+		case "subscribe_interval":
+			config.SubscribeInterval, err = parseDuration(value)
+		case "allow-forward":
+			fallthrough
+		case "allow_forward":
+			var allow bool
+			allow, err = parseBool(value)
+			config.DisallowForward = !allow
+		case "max-watches":
+			fallthrough
+		case "max_watches":
+			config.MaxNrWatches, err = parseInt(value)
+		case "max-extra-keys":
+			fallthrough
+		case "max_extra_keys":
+			config.MaxNrExtraKeys, err = parseInt(value)
+		case "max-extra-size":
+			fallthrough
+		case "max_extra_size":
+			config.MaxExtraSize, err = parseInt(value)
+		case "retry-failed-points":
+			fallthrough
+		case "retry_failed_points":
+			config.RetryFailedPushPoints, err = parseBool(value)
+		case "max-replay-age":
+			fallthrough
+		case "max_replay_age":
+			config.MaxReplayAge, err = parseDuration(value)
+		case "send-buffer-size":
+			fallthrough
+		case "send_buffer_size":
+			config.SendBufferSize, err = parseInt(value)
+		case "max-conn-messages":
+			fallthrough
+		case "max_conn_messages":
+			config.MaxNrConnMessages, err = parseInt(value)
+		case "conn-message-interval":
+			fallthrough
+		case "conn_message_interval":
+			config.ConnMessageInterval, err = parseDuration(value)
+		case "reap-stale-first":
+			fallthrough
+		case "reap_stale_first":
+			config.ReapStaleConns, err = parseBool(value)
+		case "min-heartbeat":
+			fallthrough
+		case "min_heartbeat":
+			config.MinHeartbeat, err = parseDuration(value)
+		case "max-heartbeat":
+			fallthrough
+		case "max_heartbeat":
+			config.MaxHeartbeat, err = parseDuration(value)
+		case "delete-on-receipt":
+			fallthrough
+		case "delete_on_receipt":
+			config.DeleteOnReceipt, err = parseBool(value)
+		case "session-retention":
+			fallthrough
+		case "session_retention":
+			config.SessionRetention, err = parseDuration(value)
+		case "max-sessions":
+			fallthrough
+		case "max_sessions":
+			config.MaxNrSessions, err = parseInt(value)
+		case "max-pushes-per-window":
+			fallthrough
+		case "max_pushes_per_window":
+			config.MaxPushesPerWindow, err = parseInt(value)
+		case "push-window":
+			fallthrough
+		case "push_window":
+			config.PushWindow, err = parseDuration(value)
+		case "sequence-messages":
+			fallthrough
+		case "sequence_messages":
+			config.SequenceMessages, err = parseBool(value)
+		case "send-dedup-window":
+			fallthrough
+		case "send_dedup_window":
+			config.SendDedupWindow, err = parseDuration(value)
+		case "max-cache-ttl":
+			fallthrough
+		case "max_cache_ttl":
+			config.MaxCacheTTL, err = parseDuration(value)
+		case "ack-before-delete":
+			fallthrough
+		case "ack_before_delete":
+			config.AckBeforeDelete, err = parseBool(value)
+		case "push-template":
+			fallthrough
+		case "push_template":
+			config.PushTemplate, err = parsePushTemplate(value)
+		case "on-malformed":
+			fallthrough
+		case "on_malformed":
+			config.SkipMalformedMessages, err = parseOnMalformed(value)
+		case "priority":
+			config.LowPriority, err = parsePriority(value)
+		case "visible-default":
+			fallthrough
+		case "visible_default":
+			var visible bool
+			visible, err = parseBool(value)
+			config.InvisibleByDefault = !visible
+		case "outbound-queue-size":
+			fallthrough
+		case "outbound_queue_size":
+			config.OutboundQueueSize, err = parseInt(value)
+		case "outbound-overflow":
+			fallthrough
+		case "outbound_overflow":
+			config.OutboundOverflow, err = parseOverflowPolicy(value)
+		case "dedup-window":
+			fallthrough
+		case "dedup_window":
+			config.DedupWindow, err = parseDuration(value)
+		case "max-msgs-per-day":
+			fallthrough
+		case "max_msgs_per_day":
+			config.MaxNrMsgsPerDay, err = parseInt(value)
+		case "cache-over-quota":
+			fallthrough
+		case "cache_over_quota":
+			config.CacheOverQuota, err = parseBool(value)
+		case "handshake-timeout":
+			fallthrough
+		case "handshake_timeout":
+			config.HandshakeTimeout, err = parseDuration(value)
+			if err == nil {
+				err = checkHandshakeTimeout(config.HandshakeTimeout)
+			}
+		case "shadow":
+			// The shadow service is resolved after all services are parsed.
+			_, err = parseString(value)
+		case "log":
+			config.Logger, err = parseLogger(value)
+		case "audit":
+			config.AuditLogger, err = parseAuditLogger(value)
+		case "subscription-store":
+			fallthrough
+		case "subscription_store":
+			config.SubscriptionStore, err = parseSubscriptionStore(value)
+		case "delivery-points":
+			fallthrough
+		case "delivery_points":
+			countSubscriptions, err = parseDeliveryPoints(value)
 		case "db":
 			config.MsgCache, err = parseCache(value)
 		case "err":
@@ -388,13 +1220,261 @@ func parseService(service string, node yaml.Node, defaultConfig *msgcenter.Servi
 			return
 		}
 	}
+	if countSubscriptions {
+		counter, ok := config.SubscriptionStore.(push.DeliveryPointCounter)
+		if !ok {
+			err = fmt.Errorf("[service=%v] delivery-points is subscriptions but there is no subscription-store", service)
+			config = nil
+			return
+		}
+		config.DeliveryPointCounter = counter
+	}
+	if config.RequireCache && config.MsgCache == nil {
+		err = fmt.Errorf("[service=%v] require-cache is set but there is no db", service)
+		config = nil
+		return
+	}
+	if config.DedupWindow > 0 && config.MsgCache == nil {
+		err = fmt.Errorf("[service=%v] dedup-window is set but there is no db", service)
+		config = nil
+		return
+	}
+	if config.MaxNrMsgsPerDay > 0 && config.MsgCache == nil {
+		err = fmt.Errorf("[service=%v] max-msgs-per-day is set but there is no db", service)
+		config = nil
+		return
+	}
+	err = setDeadLetterQueues(config)
+	if err != nil {
+		err = fmt.Errorf("[service=%v] %v", service, err)
+		config = nil
+		return
+	}
+	return
+}
+
+// deadLetterHandler is implemented by the web hooks
+// which could replay the events failed to be posted.
+type deadLetterHandler interface {
+	DeadLetterMaxAge() time.Duration
+	SetDeadLetterQueue(queue msgcache.DeadLetterQueue, kind string)
+}
+
+// regionSetter is implemented by the web hooks reporting
+// the region of this node.
+type regionSetter interface {
+	SetRegion(region string)
+}
+
+// setRegions tells the login/logout web hooks of all services
+// which region this node runs in.
+func setRegions(config *Config) {
+	configs := []*msgcenter.ServiceConfig{config.defaultConfig}
+	for _, sconf := range config.srvConfig {
+		configs = append(configs, sconf)
+	}
+	for _, sconf := range configs {
+		if sconf == nil {
+			continue
+		}
+		for _, h := range []interface{}{sconf.LoginHandler, sconf.LogoutHandler} {
+			if rs, ok := h.(regionSetter); ok {
+				rs.SetRegion(config.Region)
+			}
+		}
+	}
+}
+
+// setDeadLetterQueues lets the fire-and-forget web hooks with
+// dead-letter-max-age keep their failed events in the db.
+func setDeadLetterQueues(config *msgcenter.ServiceConfig) error {
+	handlers := map[string]interface{}{
+		"login":       config.LoginHandler,
+		"logout":      config.LogoutHandler,
+		"msg":         config.MessageHandler,
+		"err":         config.ErrorHandler,
+		"unsubscribe": config.UnsubscribeHandler,
+		"fallback":    config.FallbackHandler,
+		"delivery":    config.DeliveryHandler,
+	}
+	for msgType, h := range config.MessageRoutes {
+		handlers["msg:"+msgType] = h
+	}
+	for kind, h := range handlers {
+		hd, ok := h.(deadLetterHandler)
+		if !ok || hd.DeadLetterMaxAge() <= 0 {
+			continue
+		}
+		dlq, ok := config.MsgCache.(msgcache.DeadLetterQueue)
+		if !ok {
+			return fmt.Errorf("[field=%v] dead-letter-max-age is set but there is no db", kind)
+		}
+		hd.SetDeadLetterQueue(dlq, kind)
+	}
+	return nil
+}
+
+func shadowName(node yaml.Node) (name string, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		return
+	}
+	if value, ok := fields["shadow"]; ok {
+		name, err = parseString(value)
+	}
 	return
 }
 
+// resolveShadows links each service to the service named by its shadow
+// field. A service without a shadow field uses the one of the default
+// service, unless that would make the service shadow itself.
+func resolveShadows(config *Config, root yaml.Map) error {
+	defaultShadow, err := shadowName(root["default"])
+	if err != nil {
+		return fmt.Errorf("[service=default][field=shadow] %v", err)
+	}
+	for srv, sconf := range config.srvConfig {
+		if sconf != nil && sconf == config.defaultConfig {
+			// Don't change the default config shared by other services.
+			c := *sconf
+			config.srvConfig[srv] = &c
+		}
+	}
+	for srv, sconf := range config.srvConfig {
+		if sconf == nil {
+			continue
+		}
+		name, err := shadowName(root[srv])
+		if err != nil {
+			return fmt.Errorf("[service=%v][field=shadow] %v", srv, err)
+		}
+		if name == srv {
+			return fmt.Errorf("[service=%v][field=shadow] a service cannot shadow itself", srv)
+		}
+		if name == "" && defaultShadow != srv {
+			name = defaultShadow
+		}
+		if name == "" {
+			continue
+		}
+		shadow, ok := config.srvConfig[name]
+		if !ok {
+			return fmt.Errorf("[service=%v][field=shadow] unknown service %v", srv, name)
+		}
+		sconf.Shadow = shadow
+	}
+	if defaultShadow != "" && config.defaultConfig != nil {
+		shadow, ok := config.srvConfig[defaultShadow]
+		if !ok {
+			return fmt.Errorf("[service=default][field=shadow] unknown service %v", defaultShadow)
+		}
+		config.defaultConfig.Shadow = shadow
+	}
+	return nil
+}
+
+// Used if handshake-timeout is not in the config file.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// Longer handshake timeouts are most likely typos.
+const MaxHandshakeTimeout = 5 * time.Minute
+
+func parseOverflowPolicy(node yaml.Node) (policy msgcenter.OverflowPolicy, err error) {
+	str, err := parseString(node)
+	if err != nil {
+		return
+	}
+	for _, p := range []msgcenter.OverflowPolicy{msgcenter.OverflowDisconnect, msgcenter.OverflowDropOldest, msgcenter.OverflowDropNewest} {
+		if p.String() == str {
+			policy = p
+			return
+		}
+	}
+	err = fmt.Errorf("unknown overflow policy %v", str)
+	return
+}
+
+func parsePriority(node yaml.Node) (low bool, err error) {
+	str, err := parseString(node)
+	if err != nil {
+		return
+	}
+	switch str {
+	case "normal":
+		low = false
+	case "low":
+		low = true
+	default:
+		err = fmt.Errorf("unknown priority %v; should be normal or low", str)
+	}
+	return
+}
+
+func parsePushTemplate(node yaml.Node) (tmpl *msgcenter.PushTemplate, err error) {
+	kv, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("push template should be a map")
+		return
+	}
+	fields := make(map[string]string, len(kv))
+	for k, v := range kv {
+		fields[k], err = parseString(v)
+		if err != nil {
+			err = fmt.Errorf("[key=%v] %v", k, err)
+			return
+		}
+	}
+	return msgcenter.NewPushTemplate(fields)
+}
+
+func parseOnMalformed(node yaml.Node) (skip bool, err error) {
+	str, err := parseString(node)
+	if err != nil {
+		return
+	}
+	switch str {
+	case "disconnect":
+		skip = false
+	case "skip":
+		skip = true
+	default:
+		err = fmt.Errorf("unknown action %v; should be disconnect or skip", str)
+	}
+	return
+}
+
+// The node id "hostname" means the host name of the machine.
+func parseNodeId(node yaml.Node) (id string, err error) {
+	id, err = parseString(node)
+	if err != nil {
+		return
+	}
+	if id == "hostname" {
+		id, err = os.Hostname()
+	}
+	if strings.Contains(id, ":") || strings.Contains(id, "\n") {
+		err = fmt.Errorf("%q should not contain ':' or new line", id)
+	}
+	return
+}
+
+func checkHandshakeTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return fmt.Errorf("handshake timeout should be positive: %v", timeout)
+	}
+	if timeout > MaxHandshakeTimeout {
+		return fmt.Errorf("handshake timeout %v is longer than %v", timeout, MaxHandshakeTimeout)
+	}
+	return nil
+}
+
 func checkConfig(config *Config) error {
 	if config.Auth == nil {
 		return fmt.Errorf("No authentication url")
 	}
+	if err := checkHandshakeTimeout(config.HandshakeTimeout); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -403,9 +1483,86 @@ func Parse(filename string) (config *Config, err error) {
 	if err != nil {
 		return
 	}
-	root := file.Root
+	return parseRoot(file.Root, filename)
+}
+
+// Top level keys which are not services.
+var globalKeys = map[string]bool{
+	"auth":                      true,
+	"err":                       true,
+	"http-addr":                 true,
+	"http_addr":                 true,
+	"handshake-timeout":         true,
+	"handshake_timeout":         true,
+	"tls":                       true,
+	"node-id":                   true,
+	"node_id":                   true,
+	"region":                    true,
+	"group-services":            true,
+	"group_services":            true,
+	"memory-limit":              true,
+	"memory_limit":              true,
+	"max-concurrent-handshakes": true,
+	"max_concurrent_handshakes": true,
+	"max-pending-conns":         true,
+	"max_pending_conns":         true,
+	"graceful-shutdown":         true,
+	"graceful_shutdown":         true,
+	"listen":                    true,
+	"listeners":                 true,
+	"default":                   true,
+	"max-services":              true,
+	"max_services":              true,
+}
+
+// ParseDir reads all *.yaml files under the directory as if they were
+// one config file, so that each service can be kept in its own file.
+// A service, or a top level key like auth or default, may only be
+// defined in one of the files.
+func ParseDir(dir string) (config *Config, err error) {
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return
+	}
+	if len(filenames) == 0 {
+		err = fmt.Errorf("no config file under %v", dir)
+		return
+	}
+	sort.Strings(filenames)
+	root := make(yaml.Map, 16)
+	definedIn := make(map[string]string, 16)
+	for _, filename := range filenames {
+		var file *yaml.File
+		file, err = yaml.ReadFile(filename)
+		if err != nil {
+			return
+		}
+		t, ok := file.Root.(yaml.Map)
+		if !ok {
+			err = fmt.Errorf("%v: Top level should be a map", filename)
+			return
+		}
+		for key, node := range t {
+			// Both forms of a global key count as the same key.
+			name := key
+			if globalKeys[key] {
+				name = strings.Replace(key, "_", "-", -1)
+			}
+			if prev, ok := definedIn[name]; ok {
+				err = fmt.Errorf("%v is defined in both %v and %v", key, prev, filename)
+				return
+			}
+			definedIn[name] = filename
+			root[key] = node
+		}
+	}
+	return parseRoot(root, dir)
+}
+
+func parseRoot(root yaml.Node, filename string) (config *Config, err error) {
 	config = new(Config)
 	config.filename = filename
+	config.HandshakeTimeout = DefaultHandshakeTimeout
 	switch t := root.(type) {
 	case yaml.Map:
 		config.srvConfig = make(map[string]*msgcenter.ServiceConfig, len(t))
@@ -416,6 +1573,20 @@ func Parse(filename string) (config *Config, err error) {
 			config = nil
 			return
 		}
+		maxNrServices := 0
+		if mn, ok := t["max-services"]; ok {
+			maxNrServices, err = parseInt(mn)
+		} else if mn, ok := t["max_services"]; ok {
+			maxNrServices, err = parseInt(mn)
+		}
+		if err == nil && maxNrServices < 0 {
+			err = fmt.Errorf("should not be negative")
+		}
+		if err != nil {
+			err = fmt.Errorf("bad max-services: %v", err)
+			config = nil
+			return
+		}
 		for srv, node := range t {
 			switch srv {
 			case "auth":
@@ -450,9 +1621,101 @@ func Parse(filename string) (config *Config, err error) {
 					return
 				}
 				continue
+			case "tls":
+				config.TLSConfig, config.ServiceByHost, err = parseTLS(node)
+				if err != nil {
+					err = fmt.Errorf("tls: %v", err)
+					return
+				}
+				continue
+			case "node-id":
+				fallthrough
+			case "node_id":
+				config.NodeId, err = parseNodeId(node)
+				if err != nil {
+					err = fmt.Errorf("bad node id: %v", err)
+					return
+				}
+				continue
+			case "region":
+				config.Region, err = parseString(node)
+				if err != nil {
+					err = fmt.Errorf("bad region: %v", err)
+					return
+				}
+				continue
+			case "max-concurrent-handshakes":
+				fallthrough
+			case "max_concurrent_handshakes":
+				config.MaxConcurrentHandshakes, err = parseInt(node)
+				if err == nil && config.MaxConcurrentHandshakes < 0 {
+					err = fmt.Errorf("should not be negative")
+				}
+				if err != nil {
+					err = fmt.Errorf("bad max concurrent handshakes: %v", err)
+					return
+				}
+				continue
+			case "max-pending-conns":
+				fallthrough
+			case "max_pending_conns":
+				config.MaxPendingConns, err = parseInt(node)
+				if err == nil && config.MaxPendingConns < 0 {
+					err = fmt.Errorf("should not be negative")
+				}
+				if err != nil {
+					err = fmt.Errorf("bad max pending conns: %v", err)
+					return
+				}
+				continue
+			case "graceful-shutdown":
+				fallthrough
+			case "graceful_shutdown":
+				config.ShutdownDeadline, err = parseDuration(node)
+				if err != nil {
+					err = fmt.Errorf("bad graceful shutdown deadline: %v", err)
+					return
+				}
+				continue
+			case "group-services":
+				fallthrough
+			case "group_services":
+				config.GroupServices, err = parseBool(node)
+				if err != nil {
+					err = fmt.Errorf("bad group services: %v", err)
+					return
+				}
+				continue
+			case "memory-limit":
+				fallthrough
+			case "memory_limit":
+				config.MemoryLimit, err = parseInt(node)
+				if err != nil {
+					err = fmt.Errorf("bad memory limit: %v", err)
+					return
+				}
+				continue
+			case "listen":
+				config.Listener, err = parseListener(node)
+				if err != nil {
+					err = fmt.Errorf("listen: %v", err)
+					return
+				}
+				continue
+			case "listeners":
+				config.Listeners, err = parseListeners(node)
+				if err != nil {
+					err = fmt.Errorf("listeners: %v", err)
+					return
+				}
+				continue
 			case "default":
 				// Don't need to parse the default service again.
 				continue
+			case "max-services":
+				fallthrough
+			case "max_services":
+				continue
 			}
 			var sconf *msgcenter.ServiceConfig
 			sconf, err = parseService(srv, node, config.defaultConfig)
@@ -461,6 +1724,19 @@ func Parse(filename string) (config *Config, err error) {
 				return
 			}
 			config.srvConfig[srv] = sconf
+			if maxNrServices > 0 && len(config.srvConfig) > maxNrServices {
+				err = fmt.Errorf("too many services: more than %v services defined", maxNrServices)
+				config = nil
+				return
+			}
+		}
+		err = resolveShadows(config, t)
+		if err != nil {
+			config = nil
+			return
+		}
+		if len(config.Region) > 0 {
+			setRegions(config)
 		}
 	default:
 		err = fmt.Errorf("Top level should be a map")
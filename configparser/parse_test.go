@@ -18,8 +18,19 @@
 package configparser
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/uniqush/uniqush-conn/push"
+	"math/big"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func writeConfigFile(filename string) {
@@ -51,6 +62,7 @@ default:
     url: http://localhost:8080/fwd
     timeout: 3s
     max-ttl: 36h
+    group-pattern: ^group-
   subscribe:
     default: allow
     url: http://localhost:8080/subscribe
@@ -69,6 +81,11 @@ default:
   max-conns: 2048
   max-online-users: 2048
   max-conns-per-user: 10
+  required-headers:
+    - type
+  allowed-headers:
+    - title
+    - to
   db:
     engine: redis
     addr: 127.0.0.1:6379
@@ -87,8 +104,654 @@ func TestParse(t *testing.T) {
 	filename := "config.yaml"
 	writeConfigFile(filename)
 	defer deleteConfigFile(filename)
-	_, err := Parse(filename)
+	config, err := Parse(filename)
 	if err != nil {
 		t.Errorf("Error: %v\n", err)
+		return
+	}
+	srvConfig := config.ReadConfig("default")
+	if len(srvConfig.RequiredHeaders) != 1 || len(srvConfig.AllowedHeaders) != 2 {
+		t.Errorf("bad header schema: %v; %v", srvConfig.RequiredHeaders, srvConfig.AllowedHeaders)
+	}
+}
+
+func TestParseMaxServices(t *testing.T) {
+	filename := "config-max-services.yaml"
+	config := `
+max-services: 1
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+service1:
+  max-conns: 10
+service2:
+  max-conns: 10
+`
+	file, _ := os.Create(filename)
+	file.WriteString(config)
+	file.Close()
+	defer deleteConfigFile(filename)
+	_, err := Parse(filename)
+	if err == nil {
+		t.Errorf("should fail on too many services")
+	}
+
+	file, _ = os.Create(filename)
+	file.WriteString(strings.Replace(config, "max-services: 1", "max-services: -1", 1))
+	file.Close()
+	_, err = Parse(filename)
+	if err == nil {
+		t.Errorf("should fail on negative max-services")
+	}
+}
+
+func writeCertFiles(host, certFile, keyFile string) error {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	certOut, err := os.Create(certFile)
+	if err != nil {
+		return err
+	}
+	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	certOut.Close()
+	keyOut, err := os.Create(keyFile)
+	if err != nil {
+		return err
+	}
+	pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	keyOut.Close()
+	return nil
+}
+
+func TestParseTLS(t *testing.T) {
+	filename := "config-tls.yaml"
+	config := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+tls:
+  cert: default-cert.pem
+  key: default-key.pem
+  hosts:
+    chat.example.com:
+      cert: chat-cert.pem
+      key: chat-key.pem
+      service: chat
+`
+	file, _ := os.Create(filename)
+	file.WriteString(config)
+	file.Close()
+	defer deleteConfigFile(filename)
+	for _, name := range []string{"default", "chat"} {
+		err := writeCertFiles(name+".example.com", name+"-cert.pem", name+"-key.pem")
+		defer os.Remove(name + "-cert.pem")
+		defer os.Remove(name + "-key.pem")
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+	}
+	c, err := Parse(filename)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if c.TLSConfig == nil {
+		t.Errorf("no tls config")
+		return
+	}
+	if c.ServiceByHost["chat.example.com"] != "chat" {
+		t.Errorf("chat.example.com should be mapped to chat")
+	}
+	for host, cn := range map[string]string{
+		"chat.example.com":  "chat.example.com",
+		"CHAT.example.com":  "chat.example.com",
+		"other.example.com": "default.example.com",
+	} {
+		cert, err := c.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			continue
+		}
+		x, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			continue
+		}
+		if x.Subject.CommonName != cn {
+			t.Errorf("[host=%v] wrong certificate: %v", host, x.Subject.CommonName)
+		}
+	}
+}
+
+func TestParseRequireCache(t *testing.T) {
+	filename := "config-require-cache.yaml"
+	config := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+service:
+  require-cache: true
+`
+	file, _ := os.Create(filename)
+	file.WriteString(config)
+	file.Close()
+	defer deleteConfigFile(filename)
+	_, err := Parse(filename)
+	if err == nil {
+		t.Errorf("should fail without db")
+	}
+}
+
+func TestParseShadow(t *testing.T) {
+	filename := "config-shadow.yaml"
+	config := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+service:
+  shadow: service-test
+  max-conns: 10
+service-test:
+  max-conns: 20
+`
+	file, _ := os.Create(filename)
+	file.WriteString(config)
+	file.Close()
+	defer deleteConfigFile(filename)
+	c, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := c.ReadConfig("service")
+	if srv.Shadow == nil {
+		t.Fatalf("service should have a shadow")
+	}
+	if srv.Shadow != c.ReadConfig("service-test") {
+		t.Errorf("wrong shadow service")
+	}
+	if c.ReadConfig("service-test").Shadow != nil {
+		t.Errorf("service-test should not have a shadow")
+	}
+}
+
+func TestParseDeadLetterWithoutCache(t *testing.T) {
+	filename := "config-dead-letter.yaml"
+	config := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+service:
+  login:
+    url: http://localhost:8080/login
+    dead-letter-max-age: 24h
+`
+	file, _ := os.Create(filename)
+	file.WriteString(config)
+	file.Close()
+	defer deleteConfigFile(filename)
+	_, err := Parse(filename)
+	if err == nil {
+		t.Errorf("should fail without db")
+	}
+}
+
+func TestParseUnknownShadow(t *testing.T) {
+	filename := "config-unknown-shadow.yaml"
+	config := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+service:
+  shadow: nosuchservice
+`
+	file, _ := os.Create(filename)
+	file.WriteString(config)
+	file.Close()
+	defer deleteConfigFile(filename)
+	_, err := Parse(filename)
+	if err == nil {
+		t.Errorf("should fail with an unknown shadow service")
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	filename := "config-priority.yaml"
+	config := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+memory-limit: 512
+service:
+  priority: low
+service-test:
+  priority: normal
+`
+	file, _ := os.Create(filename)
+	file.WriteString(config)
+	file.Close()
+	defer deleteConfigFile(filename)
+	c, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MemoryLimit != 512 {
+		t.Errorf("wrong memory limit: %v", c.MemoryLimit)
+	}
+	if !c.ReadConfig("service").LowPriority {
+		t.Errorf("service should be of low priority")
+	}
+	if c.ReadConfig("service-test").LowPriority {
+		t.Errorf("service-test should be of normal priority")
+	}
+}
+
+func TestParseListener(t *testing.T) {
+	filename := "config-listen.yaml"
+	config := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+listen:
+  reuse-port: true
+  backlog: 4096
+  acceptors: 4
+  no-delay: false
+  send-buffer: 65536
+  recv-buffer: 131072
+`
+	file, _ := os.Create(filename)
+	file.WriteString(config)
+	file.Close()
+	defer deleteConfigFile(filename)
+	c, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Listener.ReusePort || c.Listener.Backlog != 4096 || c.Listener.NrAcceptors != 4 {
+		t.Errorf("bad listener config: %+v", c.Listener)
+	}
+	if !c.Listener.Delay || c.Listener.SendBuffer != 65536 || c.Listener.RecvBuffer != 131072 {
+		t.Errorf("bad socket options: %+v", c.Listener)
+	}
+}
+
+func TestParseListenerBadBuffer(t *testing.T) {
+	filename := "config-listen-buffer.yaml"
+	header := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+listen:
+`
+	defer deleteConfigFile(filename)
+	for _, opt := range []string{"send-buffer: 1", "recv-buffer: 1073741824"} {
+		file, _ := os.Create(filename)
+		file.WriteString(header + "  " + opt + "\n")
+		file.Close()
+		if _, err := Parse(filename); err == nil {
+			t.Errorf("%q should be invalid", opt)
+		}
+	}
+}
+
+func TestParseListeners(t *testing.T) {
+	filename := "config-listeners.yaml"
+	config := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+listeners:
+  - addr: 10.0.0.1:8964
+    services:
+      - internal
+  - addr: 0.0.0.0:8965
+    acceptors: 2
+`
+	file, _ := os.Create(filename)
+	file.WriteString(config)
+	file.Close()
+	defer deleteConfigFile(filename)
+	c, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Listeners) != 2 {
+		t.Fatalf("should have 2 listeners: %v", len(c.Listeners))
+	}
+	internal := c.Listeners[0]
+	if internal.Addr != "10.0.0.1:8964" || len(internal.Services) != 1 || internal.Services[0] != "internal" {
+		t.Errorf("bad internal listener: %+v", internal)
+	}
+	public := c.Listeners[1]
+	if public.Addr != "0.0.0.0:8965" || len(public.Services) != 0 || public.NrAcceptors != 2 {
+		t.Errorf("bad public listener: %+v", public)
+	}
+}
+
+func TestParseHandshakeTimeout(t *testing.T) {
+	filename := "config-handshake-timeout.yaml"
+	header := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+`
+	cases := map[string]bool{
+		"":                                     true,
+		"handshake-timeout: 30s\n":             true,
+		"handshake-timeout: 0s\n":              false,
+		"handshake-timeout: -1s\n":             false,
+		"handshake-timeout: 1h\n":              false,
+		"service:\n  handshake-timeout: 30s\n": true,
+		"service:\n  handshake-timeout: 0s\n":  false,
+		"service:\n  handshake-timeout: 1h\n":  false,
+	}
+	defer deleteConfigFile(filename)
+	for config, ok := range cases {
+		file, _ := os.Create(filename)
+		file.WriteString(header + config)
+		file.Close()
+		c, err := Parse(filename)
+		if ok && err != nil {
+			t.Errorf("%q should be valid: %v", config, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("%q should be invalid", config)
+		}
+		if config == "" && err == nil && c.HandshakeTimeout != DefaultHandshakeTimeout {
+			t.Errorf("should use the default handshake timeout: %v", c.HandshakeTimeout)
+		}
+		if config == "service:\n  handshake-timeout: 30s\n" && err == nil {
+			if srv := c.ReadConfig("service"); srv == nil || srv.HandshakeTimeout != 30*time.Second {
+				t.Errorf("should override the handshake timeout of the service")
+			}
+		}
+	}
+}
+
+func TestParseMaxConcurrentHandshakes(t *testing.T) {
+	filename := "config-max-handshakes.yaml"
+	header := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+`
+	cases := map[string]int{
+		"":                                 0,
+		"max-concurrent-handshakes: 100\n": 100,
+		"max-concurrent-handshakes: -1\n":  -1,
+	}
+	defer deleteConfigFile(filename)
+	for config, n := range cases {
+		file, _ := os.Create(filename)
+		file.WriteString(header + config)
+		file.Close()
+		c, err := Parse(filename)
+		if n < 0 {
+			if err == nil {
+				t.Errorf("%q should be invalid", config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q should be valid: %v", config, err)
+			continue
+		}
+		if c.MaxConcurrentHandshakes != n {
+			t.Errorf("%q: wrong limit %v", config, c.MaxConcurrentHandshakes)
+		}
+	}
+}
+
+func TestParseNodeId(t *testing.T) {
+	filename := "config-node-id.yaml"
+	header := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+`
+	hostname, _ := os.Hostname()
+	cases := map[string]string{
+		"":                    "",
+		"node-id: node1\n":    "node1",
+		"node_id: hostname\n": hostname,
+	}
+	defer deleteConfigFile(filename)
+	for config, id := range cases {
+		file, _ := os.Create(filename)
+		file.WriteString(header + config)
+		file.Close()
+		c, err := Parse(filename)
+		if err != nil {
+			t.Errorf("%q should be valid: %v", config, err)
+			continue
+		}
+		if c.NodeId != id {
+			t.Errorf("%q: expected node id %q; got %q", config, id, c.NodeId)
+		}
+	}
+	file, _ := os.Create(filename)
+	file.WriteString(header + "node-id: a:b\n")
+	file.Close()
+	if _, err := Parse(filename); err == nil {
+		t.Errorf("node id with ':' should be invalid")
+	}
+}
+
+func TestParseAuthOnFailure(t *testing.T) {
+	filename := "config-auth-on-failure.yaml"
+	// Nothing listens on port 1, so the web hook is unreachable.
+	cases := map[string]bool{
+		"":                       false,
+		"  on-failure: closed\n": false,
+		"  on-failure: open\n":   true,
+	}
+	defer deleteConfigFile(filename)
+	for config, pass := range cases {
+		file, _ := os.Create(filename)
+		file.WriteString("auth:\n  default: disallow\n  url: http://127.0.0.1:1/auth\n" + config)
+		file.Close()
+		c, err := Parse(filename)
+		if err != nil {
+			t.Errorf("%q should be valid: %v", config, err)
+			continue
+		}
+		ok, _ := c.Auth.Authenticate("service", "user", "token", "127.0.0.1:1234", nil)
+		if ok != pass {
+			t.Errorf("%q: authentication should return %v", config, pass)
+		}
+	}
+	file, _ := os.Create(filename)
+	file.WriteString("auth:\n  url: http://127.0.0.1:1/auth\n  on-failure: maybe\n")
+	file.Close()
+	if _, err := Parse(filename); err == nil {
+		t.Errorf("bad on-failure should be invalid")
+	}
+}
+
+func TestParseDir(t *testing.T) {
+	dir := "config-dir"
+	os.Mkdir(dir, 0755)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"main.yaml": `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+http-addr: 127.0.0.1:8088
+default:
+  max-conns: 10
+`,
+		"chat.yaml": `
+chat:
+  max-conns: 20
+`,
+		"game.yaml": `
+game:
+  shadow: chat
+`,
+	}
+	for name, content := range files {
+		file, _ := os.Create(filepath.Join(dir, name))
+		file.WriteString(content)
+		file.Close()
+	}
+	config, err := ParseDir(dir)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if n := len(config.AllServices()); n != 2 {
+		t.Errorf("should have 2 services: %v", n)
+	}
+	chat := config.ReadConfig("chat")
+	game := config.ReadConfig("game")
+	if chat.MaxNrConns != 20 || game.MaxNrConns != 10 || game.Shadow != chat {
+		t.Errorf("bad services: %+v %+v", chat, game)
+	}
+
+	dups := []string{"another:\n  max-conns: 1\nchat:\n  max-conns: 1\n", "http_addr: 127.0.0.1:8080\n"}
+	for _, content := range dups {
+		file, _ := os.Create(filepath.Join(dir, "dup.yaml"))
+		file.WriteString(content)
+		file.Close()
+		_, err = ParseDir(dir)
+		if err == nil {
+			t.Errorf("%q: duplicated keys should be invalid", content)
+		}
+	}
+}
+
+func TestParseMessageRoutes(t *testing.T) {
+	filename := "config-message-routes.yaml"
+	config := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+service:
+  msg:
+    url: http://localhost:8080/msg
+  message-routes:
+    header: type
+    routes:
+      chat:
+        url: http://localhost:8080/chat
+      presence:
+        url: http://localhost:8080/presence
+`
+	file, _ := os.Create(filename)
+	file.WriteString(config)
+	file.Close()
+	defer deleteConfigFile(filename)
+	c, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvConfig := c.ReadConfig("service")
+	if srvConfig.MessageRouteHeader != "type" || len(srvConfig.MessageRoutes) != 2 {
+		t.Errorf("bad message routes: %v %v", srvConfig.MessageRouteHeader, srvConfig.MessageRoutes)
+	}
+	if _, ok := srvConfig.MessageRoutes["chat"]; !ok {
+		t.Errorf("should route chat messages: %v", srvConfig.MessageRoutes)
+	}
+}
+
+func TestParseMockPush(t *testing.T) {
+	filename := "config-mock-push.yaml"
+	config := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+service:
+  uniqush-push:
+    engine: mock
+    nrdp: 2
+`
+	file, _ := os.Create(filename)
+	file.WriteString(config)
+	file.Close()
+	defer deleteConfigFile(filename)
+	c, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvConfig := c.ReadConfig("service")
+	p, ok := srvConfig.PushService.(*push.MockPush)
+	if !ok {
+		t.Fatalf("should use the mock push: %T", srvConfig.PushService)
+	}
+	if n := p.NrDeliveryPoints("service", "alice"); n != 2 {
+		t.Errorf("wrong number of delivery points: %v", n)
+	}
+	p.Push("service", "alice", map[string]string{"notif.msg": "hello"}, []string{"1"})
+	pushes := p.Pushes()
+	if len(pushes) != 1 || pushes[0].Info["notif.msg"] != "hello" || pushes[0].MsgIds[0] != "1" {
+		t.Errorf("the push should be recorded: %v", pushes)
+	}
+}
+
+func TestParseRegion(t *testing.T) {
+	filename := "config-region.yaml"
+	config := `
+region: eu-west
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+service:
+  login:
+    url: http://localhost:8080/login
+`
+	file, _ := os.Create(filename)
+	file.WriteString(config)
+	file.Close()
+	defer deleteConfigFile(filename)
+	c, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Region != "eu-west" {
+		t.Errorf("wrong region: %q", c.Region)
+	}
+}
+
+func TestParseAudit(t *testing.T) {
+	filename := "config-audit.yaml"
+	auditFile := "audit-test.log"
+	config := `
+auth:
+  default: disallow
+  url: http://localhost:8080/auth
+service:
+  audit:
+    path: ` + auditFile + `
+    rotate-size: 1048576
+`
+	file, _ := os.Create(filename)
+	file.WriteString(config)
+	file.Close()
+	defer deleteConfigFile(filename)
+	defer os.Remove(auditFile)
+	c, err := Parse(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ReadConfig("service").AuditLogger == nil {
+		t.Errorf("should have an audit logger")
+	}
+	if _, err := os.Stat(auditFile); err != nil {
+		t.Errorf("the audit file should be created: %v", err)
 	}
 }
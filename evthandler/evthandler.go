@@ -40,6 +40,20 @@ type ForwardRequestHandler interface {
 	MaxTTL() time.Duration
 }
 
+// A ForwardRequestHandler may also implement GroupForwardRequestHandler
+// so that a message could be forwarded to all members of a group.
+type GroupForwardRequestHandler interface {
+	ForwardRequestHandler
+
+	// IsGroup returns true if the receiver is a group.
+	IsGroup(receiver string) bool
+
+	// ForwardToGroup returns the members of the group who should
+	// receive the forwarded message. Returns nil if the message
+	// should not be forwarded.
+	ForwardToGroup(fwd *server.ForwardRequest) []string
+}
+
 type ErrorHandler interface {
 	OnError(service, username, connId, addr string, err error)
 }
@@ -55,3 +69,27 @@ type UnsubscribeHandler interface {
 type PushHandler interface {
 	ShouldPush(service, username string, info map[string]string) bool
 }
+
+// FallbackHandler is told about the messages which should be pushed
+// to a user without any delivery point, so that they could be sent
+// through other channels, e.g. email or SMS.
+type FallbackHandler interface {
+	OnFallback(service, username string, msg *proto.Message)
+}
+
+// The outcomes reported to a DeliveryHandler.
+const (
+	// The message was written to nrConns visible connections.
+	DeliveredOnline = "delivered"
+	// No visible connection took the message, so it was cached
+	// for the user to fetch later.
+	DeliveryCached = "cached"
+	// The message was neither delivered nor cached.
+	DeliveryFailed = "failed"
+)
+
+// DeliveryHandler is told how each message sent to a user ended up:
+// delivered in-band, cached for an offline user, or failed.
+type DeliveryHandler interface {
+	OnDelivery(service, username string, msg *proto.Message, outcome string, nrConns int)
+}
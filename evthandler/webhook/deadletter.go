@@ -0,0 +1,139 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"time"
+)
+
+// Bounds of the interval between two attempts to replay a dead letter.
+// It doubles after each failure.
+const (
+	minReplayInterval = time.Second
+	maxReplayInterval = 5 * time.Minute
+)
+
+// A deadLetter is an event failed to be posted.
+type deadLetter struct {
+	// Unix time when the event first failed.
+	Since int64           `json:"since"`
+	Data  json.RawMessage `json:"data"`
+}
+
+type deadLetterQueue struct {
+	queue  msgcache.DeadLetterQueue
+	name   string
+	maxAge time.Duration
+}
+
+func (self *webHook) SetDeadLetterMaxAge(maxAge time.Duration) {
+	self.deadLetterMaxAge = maxAge
+}
+
+func (self *webHook) DeadLetterMaxAge() time.Duration {
+	return self.deadLetterMaxAge
+}
+
+// SetDeadLetterQueue makes the events failed to be posted recorded
+// in the queue and replayed in the background, until they are
+// accepted by the web hook or older than the max age. It does
+// nothing if the max age is not positive, or a queue has been set.
+// Events are delivered at least once, and may be out of order.
+func (self *webHook) SetDeadLetterQueue(queue msgcache.DeadLetterQueue, kind string) {
+	if self.deadLetterMaxAge <= 0 || self.dlq != nil {
+		return
+	}
+	self.dlq = &deadLetterQueue{
+		queue:  queue,
+		name:   fmt.Sprintf("webhook:%v:%v", kind, self.URL),
+		maxAge: self.deadLetterMaxAge,
+	}
+	go self.replayDeadLetters()
+}
+
+// NrDeadLetters returns the number of events waiting to be replayed.
+func (self *webHook) NrDeadLetters() int {
+	if self.dlq == nil {
+		return 0
+	}
+	n, _ := self.dlq.queue.NrDeadLetters(self.dlq.name)
+	return n
+}
+
+// notify posts the event. If it fails, the event is
+// recorded in the dead letter queue, if any.
+func (self *webHook) notify(data interface{}) {
+	status, err := self.tryPost(data, nil)
+	if self.dlq == nil || (err == nil && status < 500) {
+		return
+	}
+	jdata, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	self.pushDeadLetter(&deadLetter{Since: time.Now().Unix(), Data: jdata})
+}
+
+func (self *webHook) pushDeadLetter(letter *deadLetter) {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return
+	}
+	self.dlq.queue.PushDeadLetter(self.dlq.name, data)
+}
+
+// replayDeadLetter replays the oldest dead letter and
+// returns false if there is nothing to replay or it fails.
+func (self *webHook) replayDeadLetter() bool {
+	data, err := self.dlq.queue.PopDeadLetter(self.dlq.name)
+	if err != nil || data == nil {
+		return false
+	}
+	letter := new(deadLetter)
+	if json.Unmarshal(data, letter) != nil {
+		// Drop it. It will never be delivered.
+		return true
+	}
+	if time.Since(time.Unix(letter.Since, 0)) > self.dlq.maxAge {
+		return true
+	}
+	status, err := self.tryPost(letter.Data, nil)
+	if err != nil || status >= 500 {
+		self.pushDeadLetter(letter)
+		return false
+	}
+	return true
+}
+
+func (self *webHook) replayDeadLetters() {
+	interval := minReplayInterval
+	for {
+		if self.replayDeadLetter() {
+			interval = minReplayInterval
+			continue
+		}
+		time.Sleep(interval)
+		interval *= 2
+		if interval > maxReplayInterval {
+			interval = maxReplayInterval
+		}
+	}
+}
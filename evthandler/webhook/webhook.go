@@ -22,67 +22,168 @@ import (
 	"encoding/json"
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/server"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"regexp"
+	"sync"
 	"time"
 )
 
 type WebHook interface {
 	SetURL(url string)
 	SetTimeout(timeout time.Duration)
+	SetDialTimeout(timeout time.Duration)
 	SetDefault(d int)
+	SetMaxResponseBytes(n int64)
+	SetDeadLetterMaxAge(maxAge time.Duration)
+	SetHTTPClient(client *http.Client)
 }
 
+// Only the first DefaultMaxResponseBytes bytes of
+// a response body will be read by default.
+const DefaultMaxResponseBytes = 64 * 1024
+
+// Idle connections kept to each web hook for reuse.
+const maxIdleConnsPerHost = 32
+
 type webHook struct {
-	URL     string
-	Timeout time.Duration
-	Default int
+	URL string
+
+	// Timeout limits the whole request, including connecting to the
+	// web hook, and DialTimeout limits connecting only. DialTimeout
+	// defaults to Timeout. Zero means no limit.
+	Timeout     time.Duration
+	DialTimeout time.Duration
+	Default     int
+
+	// 0 means DefaultMaxResponseBytes
+	MaxResponseBytes int64
+
+	deadLetterMaxAge time.Duration
+	dlq              *deadLetterQueue
+
+	// Built from the timeouts on first use and reused afterwards,
+	// unless a client is set by SetHTTPClient.
+	clientLock   sync.Mutex
+	client       *http.Client
+	customClient bool
+}
+
+func (self *webHook) SetMaxResponseBytes(n int64) {
+	self.MaxResponseBytes = n
 }
 
 func (self *webHook) SetURL(url string) {
 	self.URL = url
+	self.resetClient()
 }
 
 func (self *webHook) SetTimeout(timeout time.Duration) {
 	self.Timeout = timeout
+	self.resetClient()
+}
+
+func (self *webHook) SetDialTimeout(timeout time.Duration) {
+	self.DialTimeout = timeout
+	self.resetClient()
+}
+
+// SetHTTPClient makes the web hook post through the client, e.g. one
+// with its own TLS or proxy settings, instead of the one built from
+// the timeouts. nil restores the default client.
+func (self *webHook) SetHTTPClient(client *http.Client) {
+	self.clientLock.Lock()
+	defer self.clientLock.Unlock()
+	self.client = client
+	self.customClient = client != nil
+}
+
+// resetClient drops the default client, so that
+// it will be built again with the new settings.
+func (self *webHook) resetClient() {
+	self.clientLock.Lock()
+	defer self.clientLock.Unlock()
+	if !self.customClient {
+		self.client = nil
+	}
+}
+
+// httpClient returns the client shared by all requests
+// to the web hook, which keeps the connections alive.
+func (self *webHook) httpClient() *http.Client {
+	self.clientLock.Lock()
+	defer self.clientLock.Unlock()
+	if self.client != nil {
+		return self.client
+	}
+	dialTimeout := self.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = self.Timeout
+	}
+	self.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: dialTimeout}).DialContext,
+			MaxIdleConnsPerHost: maxIdleConnsPerHost,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: self.Timeout,
+	}
+	return self.client
 }
 
 func (self *webHook) SetDefault(d int) {
 	self.Default = d
 }
 
-func timeoutDialler(ns time.Duration) func(net, addr string) (c net.Conn, err error) {
-	return func(netw, addr string) (net.Conn, error) {
-		c, err := net.Dial(netw, addr)
-		if err != nil {
-			return nil, err
-		}
-		if ns.Seconds() > 0.0 {
-			c.SetDeadline(time.Now().Add(ns))
-		}
-		return c, nil
+func (self *webHook) post(data interface{}) int {
+	return self.postThenDecode(data, nil)
+}
+
+// postThenDecode posts the data and decodes the response body into
+// result if result is not nil and the status code is 200.
+// Returns 0 if the body cannot be decoded.
+func (self *webHook) postThenDecode(data interface{}, result interface{}) int {
+	status, err := self.tryPost(data, result)
+	if err != nil {
+		return self.Default
 	}
+	return status
 }
 
-func (self *webHook) post(data interface{}) int {
+// tryPost is like postThenDecode, except that it returns an error
+// instead of the default value if the web hook cannot be reached.
+// If no URL is configured, the default value is returned with no error.
+func (self *webHook) tryPost(data interface{}, result interface{}) (status int, err error) {
 	if len(self.URL) == 0 || self.URL == "none" {
-		return self.Default
+		status = self.Default
+		return
 	}
 	jdata, err := json.Marshal(data)
 	if err != nil {
-		return self.Default
+		return
 	}
-	c := http.Client{
-		Transport: &http.Transport{
-			Dial: timeoutDialler(self.Timeout),
-		},
-	}
-	resp, err := c.Post(self.URL, "application/json", bytes.NewReader(jdata))
+	resp, err := self.httpClient().Post(self.URL, "application/json", bytes.NewReader(jdata))
 	if err != nil {
-		return self.Default
+		return
 	}
 	defer resp.Body.Close()
-	return resp.StatusCode
+	// Drain what is left, so that the connection can be reused.
+	defer io.Copy(ioutil.Discard, io.LimitReader(resp.Body, DefaultMaxResponseBytes))
+	status = resp.StatusCode
+	if result == nil || status != 200 {
+		return
+	}
+	maxBytes := self.MaxResponseBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxResponseBytes
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, maxBytes)).Decode(result) != nil {
+		status = 0
+	}
+	return
 }
 
 type loginEvent struct {
@@ -90,14 +191,21 @@ type loginEvent struct {
 	Username string `json:"username"`
 	ConnID   string `json:"connId"`
 	Addr     string `json:"addr"`
+	Region   string `json:"region,omitempty"`
 }
 
 type LoginHandler struct {
 	webHook
+	region string
+}
+
+// SetRegion sets the region of this node reported with each login.
+func (self *LoginHandler) SetRegion(region string) {
+	self.region = region
 }
 
 func (self *LoginHandler) OnLogin(service, username, connId, addr string) {
-	self.post(&loginEvent{service, username, connId, addr})
+	self.notify(&loginEvent{service, username, connId, addr, self.region})
 }
 
 type logoutEvent struct {
@@ -106,14 +214,21 @@ type logoutEvent struct {
 	ConnID   string `json:"connId"`
 	Addr     string `json:"addr"`
 	Reason   string `json:"reason"`
+	Region   string `json:"region,omitempty"`
 }
 
 type LogoutHandler struct {
 	webHook
+	region string
+}
+
+// SetRegion sets the region of this node reported with each logout.
+func (self *LogoutHandler) SetRegion(region string) {
+	self.region = region
 }
 
 func (self *LogoutHandler) OnLogout(service, username, connId, addr string, reason error) {
-	self.post(&logoutEvent{service, username, connId, addr, reason.Error()})
+	self.notify(&logoutEvent{service, username, connId, addr, reason.Error(), self.region})
 }
 
 type messageEvent struct {
@@ -123,13 +238,46 @@ type messageEvent struct {
 
 type MessageHandler struct {
 	webHook
+	redactHeaders []string
+	redactBody    bool
+}
+
+// SetRedaction makes the handler drop the header fields, and the
+// body if redactBody is true, from the messages posted to the web
+// hook. The messages delivered to the users are not affected.
+func (self *MessageHandler) SetRedaction(headers []string, redactBody bool) {
+	self.redactHeaders = headers
+	self.redactBody = redactBody
+}
+
+// redact returns a copy of the message without the redacted fields,
+// or the message itself if there is nothing to redact.
+func (self *MessageHandler) redact(msg *proto.Message) *proto.Message {
+	if msg == nil || (len(self.redactHeaders) == 0 && !self.redactBody) {
+		return msg
+	}
+	ret := new(proto.Message)
+	*ret = *msg
+	if self.redactBody {
+		ret.Body = nil
+	}
+	if len(self.redactHeaders) > 0 && len(msg.Header) > 0 {
+		ret.Header = make(map[string]string, len(msg.Header))
+		for k, v := range msg.Header {
+			ret.Header[k] = v
+		}
+		for _, k := range self.redactHeaders {
+			delete(ret.Header, k)
+		}
+	}
+	return ret
 }
 
 func (self *MessageHandler) OnMessage(connId string, msg *proto.Message) {
 	evt := new(messageEvent)
 	evt.ConnID = connId
-	evt.Msg = msg
-	self.post(evt)
+	evt.Msg = self.redact(msg)
+	self.notify(evt)
 }
 
 type errorEvent struct {
@@ -145,12 +293,40 @@ type ErrorHandler struct {
 }
 
 func (self *ErrorHandler) OnError(service, username, connId, addr string, reason error) {
-	self.post(&errorEvent{service, username, connId, addr, reason.Error()})
+	self.notify(&errorEvent{service, username, connId, addr, reason.Error()})
 }
 
 type ForwardRequestHandler struct {
 	webHook
-	maxTTL time.Duration
+	maxTTL       time.Duration
+	groupPattern *regexp.Regexp
+}
+
+// For a receiver matching the group pattern, the web hook should
+// reply a JSON array containing the members who should receive
+// the message.
+func (self *ForwardRequestHandler) SetGroupPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	self.groupPattern = re
+	return nil
+}
+
+func (self *ForwardRequestHandler) IsGroup(receiver string) bool {
+	if self.groupPattern == nil {
+		return false
+	}
+	return self.groupPattern.MatchString(receiver)
+}
+
+func (self *ForwardRequestHandler) ForwardToGroup(fwd *server.ForwardRequest) []string {
+	var members []string
+	if self.postThenDecode(fwd, &members) != 200 {
+		return nil
+	}
+	return members
 }
 
 func (self *ForwardRequestHandler) ShouldForward(fwd *server.ForwardRequest) bool {
@@ -170,19 +346,38 @@ type authEvent struct {
 	Username string `json:"username"`
 	Token    string `json:"token"`
 	Addr     string `json:"addr"`
+
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type AuthHandler struct {
 	webHook
+	failOpen bool
+}
+
+// SetFailOpen decides what happens if the web hook cannot be reached,
+// e.g. it times out. By default (fail-closed), all users are denied
+// during an outage of the web hook. With fail-open, all users are
+// allowed instead, including those with bad tokens, trading security
+// for availability. Either way, a user is denied if the web hook replies
+// with a status other than 200.
+func (self *AuthHandler) SetFailOpen(failOpen bool) {
+	self.failOpen = failOpen
 }
 
-func (self *AuthHandler) Authenticate(srv, usr, token, addr string) (pass bool, err error) {
+func (self *AuthHandler) Authenticate(srv, usr, token, addr string, labels map[string]string) (pass bool, err error) {
 	evt := new(authEvent)
 	evt.Service = srv
 	evt.Username = usr
 	evt.Token = token
 	evt.Addr = addr
-	pass = self.post(evt) == 200
+	evt.Labels = labels
+	status, e := self.tryPost(evt, nil)
+	if e != nil {
+		pass = self.failOpen
+		return
+	}
+	pass = status == 200
 	return
 }
 
@@ -216,6 +411,36 @@ func (self *PushHandler) ShouldPush(service, username string, info map[string]st
 	return self.post(evt) == 200
 }
 
+type fallbackEvent struct {
+	Service  string         `json:"service"`
+	Username string         `json:"username"`
+	Msg      *proto.Message `json:"msg"`
+}
+
+type FallbackHandler struct {
+	webHook
+}
+
+func (self *FallbackHandler) OnFallback(service, username string, msg *proto.Message) {
+	self.notify(&fallbackEvent{service, username, msg})
+}
+
+type deliveryEvent struct {
+	Service  string         `json:"service"`
+	Username string         `json:"username"`
+	Msg      *proto.Message `json:"msg"`
+	Outcome  string         `json:"outcome"`
+	NrConns  int            `json:"nrConns"`
+}
+
+type DeliveryHandler struct {
+	webHook
+}
+
+func (self *DeliveryHandler) OnDelivery(service, username string, msg *proto.Message, outcome string, nrConns int) {
+	self.notify(&deliveryEvent{service, username, msg, outcome, nrConns})
+}
+
 type UnsubscribeHandler struct {
 	webHook
 }
@@ -225,6 +450,6 @@ func (self *UnsubscribeHandler) OnUnsubscribe(service, username string, info map
 	evt.Service = service
 	evt.Username = username
 	evt.Info = info
-	self.post(evt)
+	self.notify(evt)
 	return
 }
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMessageRedaction(t *testing.T) {
+	evtChan := make(chan *messageEvent, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		evt := new(messageEvent)
+		json.NewDecoder(r.Body).Decode(evt)
+		evtChan <- evt
+	}))
+	defer ts.Close()
+
+	hd := new(MessageHandler)
+	hd.SetURL(ts.URL)
+	hd.SetTimeout(time.Second)
+	hd.SetRedaction([]string{"location"}, true)
+
+	msg := &proto.Message{
+		Header: map[string]string{"location": "home", "title": "hello"},
+		Body:   []byte("secret"),
+	}
+	hd.OnMessage("conn", msg)
+	evt := <-evtChan
+	if _, ok := evt.Msg.Header["location"]; ok || len(evt.Msg.Body) != 0 {
+		t.Errorf("should be redacted: %+v", evt.Msg)
+	}
+	if evt.Msg.Header["title"] != "hello" {
+		t.Errorf("should keep other headers: %+v", evt.Msg)
+	}
+	if msg.Header["location"] != "home" || string(msg.Body) != "secret" {
+		t.Errorf("the original message should not be changed: %+v", msg)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer ts.Close()
+
+	hd := new(webHook)
+	hd.SetURL(ts.URL)
+	hd.SetTimeout(100 * time.Millisecond)
+	hd.SetDialTimeout(time.Minute)
+	start := time.Now()
+	if _, err := hd.tryPost("hello", nil); err == nil {
+		t.Errorf("the request should time out")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("the request should time out after 100ms: %v", d)
+	}
+}
+
+func TestLoginRegion(t *testing.T) {
+	events := make(chan map[string]string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		evt := make(map[string]string)
+		json.NewDecoder(r.Body).Decode(&evt)
+		events <- evt
+	}))
+	defer ts.Close()
+
+	login := new(LoginHandler)
+	login.SetURL(ts.URL)
+	login.SetRegion("eu-west")
+	login.OnLogin("service", "alice", "conn", "addr")
+	if evt := <-events; evt["region"] != "eu-west" || evt["username"] != "alice" {
+		t.Errorf("the login should carry the region: %v", evt)
+	}
+
+	logout := new(LogoutHandler)
+	logout.SetURL(ts.URL)
+	logout.OnLogout("service", "alice", "conn", "addr", errors.New("bye"))
+	if evt := <-events; len(evt["region"]) > 0 {
+		t.Errorf("no region should be reported by default: %v", evt)
+	}
+}
+
+func TestConnReuse(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	nrConns := 0
+	var lock sync.Mutex
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			lock.Lock()
+			nrConns++
+			lock.Unlock()
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	hd := new(webHook)
+	hd.SetURL(ts.URL)
+	hd.SetTimeout(time.Second)
+	for i := 0; i < 5; i++ {
+		if _, err := hd.tryPost("hello", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if nrConns != 1 {
+		t.Errorf("the connection should be reused: %v connections", nrConns)
+	}
+}
+
+// countingTransport counts the requests going through it.
+type countingTransport struct {
+	n int
+}
+
+func (self *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	self.n++
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestSetHTTPClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	transport := new(countingTransport)
+	hd := new(webHook)
+	hd.SetHTTPClient(&http.Client{Transport: transport})
+	hd.SetURL(ts.URL)
+	hd.SetTimeout(time.Second)
+	if _, err := hd.tryPost("hello", nil); err != nil {
+		t.Fatal(err)
+	}
+	if transport.n != 1 {
+		t.Errorf("the custom client should be used: %v", transport.n)
+	}
+}
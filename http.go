@@ -19,6 +19,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/uniqush/uniqush-conn/msgcenter"
 	"github.com/uniqush/uniqush-conn/proto"
@@ -33,6 +34,13 @@ type sendMessageRequest struct {
 	Header   map[string]string `json:"header,omitempty"`
 	Body     []byte            `json:"body,omitempty"`
 	TTL      string            `json:"ttl,omitempty"`
+
+	// Don't push the message if the user was active within this window.
+	ActiveWindow string `json:"activeWindow,omitempty"`
+
+	// Only send the message to the connection active last, if it was
+	// active within this duration. activeWindow is ignored if set.
+	ActiveConn string `json:"activeConn,omitempty"`
 }
 
 func parseJson(input io.Reader) (req *sendMessageRequest, err error) {
@@ -69,6 +77,16 @@ func (self *RequestProcessor) sendMessage(req *sendMessageRequest) (errs []error
 		}
 	}
 
+	var window time.Duration
+	if len(req.ActiveWindow) > 0 {
+		var e error
+		window, e = time.ParseDuration(req.ActiveWindow)
+		if e != nil {
+			errs = append(errs, e)
+			return
+		}
+	}
+
 	msg := new(proto.Message)
 	msg.Header = make(map[string]string, len(req.Header))
 	extra := make(map[string]string, len(req.Header))
@@ -92,10 +110,63 @@ func (self *RequestProcessor) sendMessage(req *sendMessageRequest) (errs []error
 		return
 	}
 
-	res = self.center.SendMessage(req.Service, req.Username, msg, extra, ttl)
+	if len(req.ActiveConn) > 0 {
+		recent, e := time.ParseDuration(req.ActiveConn)
+		if e != nil {
+			errs = append(errs, e)
+			return
+		}
+		res = self.center.SendToActiveConn(req.Service, req.Username, msg, extra, ttl, recent)
+		return
+	}
+	res = self.center.SendMessageUnlessActive(req.Service, req.Username, msg, extra, ttl, window)
 	return
 }
 
+// httpError is the body of a failed admin request. Like
+// msgcenter.Result, it carries a code so that callers need not
+// match the error string.
+type httpError struct {
+	Err  string `json:"err"`
+	Code string `json:"code"`
+}
+
+// writeError replies to an admin request with err as JSON.
+func writeError(w http.ResponseWriter, status int, code string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&httpError{Err: err.Error(), Code: code})
+}
+
+// writeJson replies to an admin request with v as JSON.
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// httpResult is the body of msgcenter.Result, with Err as a string.
+type httpResult struct {
+	Err     string               `json:"err,omitempty"`
+	ConnId  string               `json:"connId,omitempty"`
+	Visible bool                 `json:"visible"`
+	Code    msgcenter.ResultCode `json:"code"`
+	Backlog int                  `json:"backlog,omitempty"`
+}
+
+// writeCenterError replies with an error returned by the message center.
+func writeCenterError(w http.ResponseWriter, err error) {
+	switch err {
+	case msgcenter.ErrNoService:
+		writeError(w, http.StatusNotFound, "no-service", err)
+	case msgcenter.ErrNoCache, msgcenter.ErrPushNotTracked, msgcenter.ErrNoSequencer, msgcenter.ErrNoPushService:
+		writeError(w, http.StatusNotImplemented, "not-supported", err)
+	default:
+		writeError(w, http.StatusInternalServerError, "internal", err)
+	}
+}
+
+var errPostOnly = errors.New("POST only")
+
 type HttpRequestProcessor struct {
 	RequestProcessor
 	addr string
@@ -112,21 +183,71 @@ func (self *HttpRequestProcessor) ServeHTTP(w http.ResponseWriter, r *http.Reque
 	defer r.Body.Close()
 	req, err := parseJson(r.Body)
 	if err != nil {
-		fmt.Fprintf(w, "Invalid input: %v\r\n", err)
+		writeError(w, http.StatusBadRequest, "bad-request", fmt.Errorf("invalid input: %v", err))
 		return
 	}
 	errs, res := self.sendMessage(req)
-	for _, e := range errs {
-		fmt.Fprintf(w, "%v\r\n", e)
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "bad-request", errs[0])
+		return
 	}
-	for _, r := range res {
-		fmt.Fprintf(w, "%v\r\n", r)
+	results := make([]*httpResult, len(res))
+	for i, r := range res {
+		results[i] = &httpResult{
+			ConnId:  r.ConnId,
+			Visible: r.Visible,
+			Code:    r.Code,
+			Backlog: r.Backlog,
+		}
+		if r.Err != nil {
+			results[i].Err = r.Err.Error()
+		}
 	}
+	writeJson(w, results)
 	return
 }
 
+// Serves the statistics of the message cache of each service.
+func (self *HttpRequestProcessor) serveCacheStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := self.center.CacheStats()
+	if err != nil {
+		writeCenterError(w, err)
+		return
+	}
+	writeJson(w, stats)
+}
+
+// Retries the pushes of a service which failed, e.g. after the push
+// service recovers from an outage.
+func (self *HttpRequestProcessor) retryPushes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method-not-allowed", errPostOnly)
+		return
+	}
+	stats, err := self.center.RetryPendingPushes(r.FormValue("service"))
+	if err != nil {
+		writeCenterError(w, err)
+		return
+	}
+	writeJson(w, stats)
+}
+
+// Serves the sequence number of the last message sent to a user.
+func (self *HttpRequestProcessor) serveSeq(w http.ResponseWriter, r *http.Request) {
+	seq, err := self.center.CurrentSeq(r.FormValue("service"), r.FormValue("username"))
+	if err != nil {
+		writeCenterError(w, err)
+		return
+	}
+	writeJson(w, map[string]int64{"seq": seq})
+}
+
 func (self *HttpRequestProcessor) Start() error {
 	http.Handle("/send.json", self)
+	http.HandleFunc("/cachestats.json", self.serveCacheStats)
+	http.HandleFunc("/retrypushes.json", self.retryPushes)
+	http.HandleFunc("/seq.json", self.serveSeq)
+	http.Handle("/metrics", self.center.MetricsHandler())
 	err := http.ListenAndServe(self.addr, nil)
 	return err
 }
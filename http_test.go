@@ -0,0 +1,85 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestProcessor() *HttpRequestProcessor {
+	center := msgcenter.NewMessageCenter(nil, nil, nil, time.Second, nil, nil)
+	return NewHttpRequestProcessor("", center)
+}
+
+func checkJsonError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	if w.Code != status {
+		t.Errorf("status should be %v: %v", status, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("bad Content-Type: %q", ct)
+	}
+	var herr httpError
+	if err := json.Unmarshal(w.Body.Bytes(), &herr); err != nil {
+		t.Fatalf("bad body %q: %v", w.Body.String(), err)
+	}
+	if herr.Code != code || len(herr.Err) == 0 {
+		t.Errorf("bad error: %+v", herr)
+	}
+}
+
+func TestSendBadInput(t *testing.T) {
+	proc := newTestProcessor()
+	for _, body := range []string{
+		"not json",
+		`{"service": "service", "username": "alice", "ttl": "forever", "body": "aGVsbG8="}`,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/send.json", strings.NewReader(body))
+		proc.ServeHTTP(w, r)
+		checkJsonError(t, w, http.StatusBadRequest, "bad-request")
+	}
+}
+
+func TestSeqNoService(t *testing.T) {
+	proc := newTestProcessor()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/seq.json?service=nosuch&username=alice", nil)
+	proc.serveSeq(w, r)
+	checkJsonError(t, w, http.StatusNotFound, "no-service")
+}
+
+func TestSendResults(t *testing.T) {
+	proc := newTestProcessor()
+	w := httptest.NewRecorder()
+	body := `{"service": "nosuch", "username": "alice", "body": "aGVsbG8="}`
+	r := httptest.NewRequest("POST", "/send.json", strings.NewReader(body))
+	proc.ServeHTTP(w, r)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("bad Content-Type: %q", ct)
+	}
+	var results []*httpResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || results == nil {
+		t.Errorf("results should be a JSON array %q: %v", w.Body.String(), err)
+	}
+}
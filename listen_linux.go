@@ -0,0 +1,85 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"github.com/uniqush/uniqush-conn/configparser"
+	"net"
+	"os"
+	"syscall"
+)
+
+// SO_REUSEPORT is not defined in package syscall on linux.
+const soReusePort = 0xf
+
+// listen creates a TCP listener on addr with the socket options in conf.
+// Go's net package does not allow us to set the accept backlog, so the
+// socket is set up by hand.
+func listen(addr string, conf configparser.ListenerConfig) (ln net.Listener, err error) {
+	if !conf.ReusePort && conf.Backlog <= 0 {
+		return net.Listen("tcp", addr)
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return
+	}
+	family := syscall.AF_INET
+	var sa syscall.Sockaddr
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil || tcpAddr.IP == nil {
+		sa4 := &syscall.SockaddrInet4{Port: tcpAddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: tcpAddr.Port}
+		copy(sa6.Addr[:], tcpAddr.IP.To16())
+		sa = sa6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err != nil {
+		return
+	}
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), "tcp:"+addr)
+	// FileListener dups the descriptor, so we always close ours.
+	defer f.Close()
+
+	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err != nil {
+		return
+	}
+	if conf.ReusePort {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1)
+		if err != nil {
+			return
+		}
+	}
+	err = syscall.Bind(fd, sa)
+	if err != nil {
+		return
+	}
+	backlog := conf.Backlog
+	if backlog <= 0 {
+		backlog = syscall.SOMAXCONN
+	}
+	err = syscall.Listen(fd, backlog)
+	if err != nil {
+		return
+	}
+	return net.FileListener(f)
+}
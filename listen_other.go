@@ -0,0 +1,39 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/configparser"
+	"net"
+)
+
+var errReusePort = errors.New("reuse-port is not supported on this platform")
+
+// listen creates a TCP listener on addr. The accept backlog cannot
+// be changed on this platform and uses the system default.
+func listen(addr string, conf configparser.ListenerConfig) (ln net.Listener, err error) {
+	if conf.ReusePort {
+		err = errReusePort
+		return
+	}
+	return net.Listen("tcp", addr)
+}
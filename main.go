@@ -18,7 +18,9 @@
 package main
 
 import (
+	"context"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"flag"
@@ -28,6 +30,9 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func readPrivateKey(keyFileName string) (priv *rsa.PrivateKey, err error) {
@@ -45,25 +50,130 @@ func readPrivateKey(keyFileName string) (priv *rsa.PrivateKey, err error) {
 }
 
 var argvKeyFile = flag.String("key", "key.pem", "private key")
-var argvConfigFile = flag.String("config", "config.yaml", "config file path")
+var argvConfigFile = flag.String("config", "config.yaml", "config file path, or a directory of *.yaml config files")
+
+var argvHandoffFile = flag.String("handoff", "", "file used to hand off connections to a new instance")
 
 // In memory of the blood on the square.
 var argvPort = flag.Int("port", 0x2304, "port number")
 
-func main() {
-	flag.Parse()
-	ln, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", *argvPort))
+func importHandoff(center *msgcenter.MessageCenter, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return center.ImportExpectedConns(f)
+}
+
+// On SIGUSR2, write all connections into the handoff file
+// and drain them so that they can reconnect to the new instance.
+func waitHandoff(center *msgcenter.MessageCenter, filename string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	for _ = range ch {
+		f, err := os.Create(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Handoff error: %v\n", err)
+			continue
+		}
+		err = center.ExportConns(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Handoff error: %v\n", err)
+			continue
+		}
+		n := center.Drain()
+		fmt.Fprintf(os.Stderr, "Drained %v connections\n", n)
+	}
+}
+
+// On SIGTERM, drain all connections, giving them up to
+// the deadline to go, then exit.
+func waitShutdown(center *msgcenter.MessageCenter, deadline time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	<-ch
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	n, err := center.Shutdown(ctx)
+	cancel()
+	fmt.Fprintf(os.Stderr, "Closed %v connections\n", n)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Network error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Shutdown error: %v\n", err)
+	}
+	os.Exit(0)
+}
+
+// tcpOptListener applies the per-listener socket
+// options to each accepted connection.
+type tcpOptListener struct {
+	net.Listener
+	conf configparser.ListenerConfig
+}
+
+func (self *tcpOptListener) Accept() (c net.Conn, err error) {
+	c, err = self.Listener.Accept()
+	if err != nil {
+		return
+	}
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
 		return
 	}
+	err = tc.SetNoDelay(!self.conf.Delay)
+	if err == nil && self.conf.SendBuffer > 0 {
+		err = tc.SetWriteBuffer(self.conf.SendBuffer)
+	}
+	if err == nil && self.conf.RecvBuffer > 0 {
+		err = tc.SetReadBuffer(self.conf.RecvBuffer)
+	}
+	if err != nil {
+		c.Close()
+		c = nil
+	}
+	return
+}
+
+// listenAll creates the sockets of the listener. With SO_REUSEPORT,
+// each acceptor has its own socket and the kernel balances connections
+// among them.
+func listenAll(conf configparser.ListenerConfig) (lns []net.Listener, err error) {
+	n := 1
+	if conf.ReusePort && conf.NrAcceptors > 1 {
+		n = conf.NrAcceptors
+	}
+	lns = make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		var ln net.Listener
+		ln, err = listen(conf.Addr, conf)
+		if err != nil {
+			return
+		}
+		ln = &tcpOptListener{Listener: ln, conf: conf}
+		if conf.TLSConfig != nil {
+			ln = tls.NewListener(ln, conf.TLSConfig)
+		}
+		lns = append(lns, ln)
+	}
+	return
+}
 
+func main() {
+	flag.Parse()
 	privkey, err := readPrivateKey(*argvKeyFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Key error: %v\n", err)
 		return
 	}
-	config, err := configparser.Parse(*argvConfigFile)
+	var config *configparser.Config
+	if fi, e := os.Stat(*argvConfigFile); e == nil && fi.IsDir() {
+		config, err = configparser.ParseDir(*argvConfigFile)
+	} else {
+		config, err = configparser.Parse(*argvConfigFile)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Config error: %v\n", err)
 		return
@@ -73,12 +183,59 @@ func main() {
 		return
 	}
 
-	center := msgcenter.NewMessageCenter(ln, privkey, config.ErrorHandler, config.HandshakeTimeout, config.Auth, config)
+	listeners := config.Listeners
+	if len(listeners) == 0 {
+		l := config.Listener
+		l.Addr = fmt.Sprintf("0.0.0.0:%v", *argvPort)
+		l.TLSConfig = config.TLSConfig
+		l.ServiceByHost = config.ServiceByHost
+		listeners = []configparser.ListenerConfig{l}
+	}
+
+	center := msgcenter.NewMessageCenter(nil, privkey, config.ErrorHandler, config.HandshakeTimeout, config.Auth, config)
+	serviceByHost := make(map[string]string, 10)
+	for _, l := range listeners {
+		lns, err := listenAll(l)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Network error: %v\n", err)
+			return
+		}
+		nrAcceptors := l.NrAcceptors
+		if len(lns) > 1 {
+			nrAcceptors = 1
+		}
+		for _, ln := range lns {
+			center.AddListener(ln, nrAcceptors, l.Services)
+		}
+		for host, srv := range l.ServiceByHost {
+			serviceByHost[host] = srv
+		}
+	}
+	center.SetServiceByHost(serviceByHost)
+	center.SetNodeId(config.NodeId)
+	center.SetRegion(config.Region)
+	center.SetGroupServices(config.GroupServices)
+	center.SetMaxConcurrentHandshakes(config.MaxConcurrentHandshakes)
+	center.SetMaxPendingConns(config.MaxPendingConns)
+	center.SetAcceptFilter(config.AcceptFilter)
+	if config.MemoryLimit > 0 {
+		center.SetLoadShedder(msgcenter.MemoryLoadShedder(uint64(config.MemoryLimit) << 20))
+	}
 
 	srvs := config.AllServices()
 	for _, srv := range srvs {
 		center.AddService(srv)
 	}
+	if len(*argvHandoffFile) > 0 {
+		err = importHandoff(center, *argvHandoffFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Handoff error: %v\n", err)
+		}
+		go waitHandoff(center, *argvHandoffFile)
+	}
+	if config.ShutdownDeadline > 0 {
+		go waitShutdown(center, config.ShutdownDeadline)
+	}
 	proc := NewHttpRequestProcessor(config.HttpAddr, center)
 	go center.Start()
 	err = proc.Start()
@@ -18,6 +18,7 @@
 package msgcache
 
 import (
+	"errors"
 	"github.com/uniqush/uniqush-conn/proto"
 	"time"
 )
@@ -26,3 +27,133 @@ type Cache interface {
 	CacheMessage(service, username string, msg *proto.Message, ttl time.Duration) (id string, err error)
 	GetThenDel(service, username, id string) (msg *proto.Message, err error)
 }
+
+// Getter retrieves cached messages without deleting them.
+type Getter interface {
+	// Get retrieves the message without deleting it.
+	Get(service, username, id string) (msg *proto.Message, err error)
+}
+
+// Deleter removes cached messages without retrieving them.
+// Without it, messages are removed by GetThenDel.
+type Deleter interface {
+	// Delete removes the message without retrieving it.
+	// Deleting a message which does not exist is not an error.
+	Delete(service, username, id string) error
+}
+
+// Claimer lets several workers take the messages cached for a user.
+type Claimer interface {
+	// ClaimMessages removes and returns up to max messages cached for
+	// the user. Each message is returned to at most one caller, even
+	// if several of them claim the messages of the user at once.
+	ClaimMessages(service, username string, max int) (msgs []*proto.Message, err error)
+}
+
+// StatsReporter reports the size of the messages cached for each service.
+type StatsReporter interface {
+	// CacheStats returns the number and the total size of the
+	// messages cached for all users of the service. It may be slow,
+	// and is meant for capacity planning.
+	CacheStats(service string) (stats *CacheStats, err error)
+}
+
+type CacheStats struct {
+	NrMessages int64 `json:"nrMessages"`
+	NrBytes    int64 `json:"nrBytes"`
+}
+
+var ErrNotSynced = errors.New("cached message is not retrievable")
+
+// BacklogCounter counts the messages cached for each user.
+type BacklogCounter interface {
+	// Number of messages cached for the user and not retrieved yet.
+	BacklogCount(service, username string) (n int, err error)
+}
+
+// Syncer is implemented by caches whose messages may not be retrievable
+// right after they are cached, e.g. if they are written to a replica.
+// Messages in other caches are retrievable once CacheMessage returns.
+type Syncer interface {
+	// Sync returns nil once the messages with the ids can be
+	// retrieved by GetThenDel, or ErrNotSynced if any of them
+	// cannot be retrieved.
+	Sync(service, username string, ids []string) error
+}
+
+// QuotaCounter counts the messages delivered to each user per day.
+type QuotaCounter interface {
+	// IncrDailyCount increases the number of messages delivered to the
+	// user on the day (in UTC) of t, and returns the new value.
+	IncrDailyCount(service, username string, t time.Time) (n int, err error)
+}
+
+// PushCounter counts the notifications pushed to each user
+// within fixed windows of time.
+type PushCounter interface {
+	// IncrPushCount increases the number of notifications pushed to
+	// the user within the window containing t, and returns the new value.
+	// Windows start at multiples of their length since the zero time.
+	IncrPushCount(service, username string, window time.Duration, t time.Time) (n int, err error)
+
+	// PushCount returns the number of notifications pushed to the user
+	// within the window containing t. It is available until another
+	// window has passed after the end of the window.
+	PushCount(service, username string, window time.Duration, t time.Time) (n int, err error)
+}
+
+// Sequencer assigns increasing sequence numbers to
+// the messages sent to each user.
+type Sequencer interface {
+	// NextSeq increases the sequence number of the user and returns
+	// the new value. The first sequence number of a user is 1.
+	NextSeq(service, username string) (seq int64, err error)
+
+	// CurrentSeq returns the last sequence number assigned to the
+	// user, or 0 if none has been assigned.
+	CurrentSeq(service, username string) (seq int64, err error)
+}
+
+// DeadLetterQueue keeps the data which failed to be delivered,
+// e.g. the events posted to an unreachable web hook, so that they
+// could be delivered later.
+type DeadLetterQueue interface {
+	PushDeadLetter(queue string, data []byte) error
+
+	// PopDeadLetter removes and returns the oldest data
+	// in the queue, or nil if the queue is empty.
+	PopDeadLetter(queue string) (data []byte, err error)
+
+	NrDeadLetters(queue string) (n int, err error)
+}
+
+// PushTracker records the cached messages whose push notification
+// failed, so that the push could be retried later.
+type PushTracker interface {
+	// SetPushFailed records whether the push notification about the
+	// cached messages with the ids failed. The ids are those of a
+	// single push and are retried together.
+	SetPushFailed(service, username string, ids []string, failed bool) error
+
+	// FailedPushes returns all pushes of the service recorded as failed.
+	FailedPushes(service string) (pushes []*FailedPush, err error)
+}
+
+type FailedPush struct {
+	Username string
+	Ids      []string
+}
+
+// AgeTracker records when each message was cached.
+type AgeTracker interface {
+	// CachedAt returns the time when the message was cached, or the
+	// zero time if it is unknown, e.g. the message has expired.
+	CachedAt(service, username, id string) (t time.Time, err error)
+}
+
+// Deduplicator remembers the ids of the messages seen recently.
+type Deduplicator interface {
+	// SeenBefore records the id and tells if the same id has been
+	// recorded for the user within the window.
+	SeenBefore(service, username, id string, window time.Duration) (seen bool, err error)
+}
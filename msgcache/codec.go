@@ -0,0 +1,107 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"sync"
+)
+
+// MessageCodec defines how a message is stored in the cache.
+type MessageCodec interface {
+	Marshal(msg *proto.Message) (data []byte, err error)
+	Unmarshal(data []byte) (msg *proto.Message, err error)
+}
+
+// JSON. Easy to debug. It is the default codec.
+type jsonCodec struct{}
+
+func (self *jsonCodec) Marshal(msg *proto.Message) (data []byte, err error) {
+	data, err = json.Marshal(msg)
+	return
+}
+
+func (self *jsonCodec) Unmarshal(data []byte) (msg *proto.Message, err error) {
+	msg = new(proto.Message)
+	err = json.Unmarshal(data, msg)
+	if err != nil {
+		msg = nil
+		return
+	}
+	return
+}
+
+// Same format as the one used on the wire.
+// Id, sender and sender's service are stored as the command's parameters.
+type binaryCodec struct{}
+
+func (self *binaryCodec) Marshal(msg *proto.Message) (data []byte, err error) {
+	cmd := new(proto.Command)
+	cmd.Type = proto.CMD_DATA
+	cmd.Params = []string{msg.Id, msg.Sender, msg.SenderService}
+	cmd.Message = msg
+	data, err = cmd.Marshal()
+	return
+}
+
+func (self *binaryCodec) Unmarshal(data []byte) (msg *proto.Message, err error) {
+	cmd, err := proto.UnmarshalCommand(data)
+	if err != nil {
+		return
+	}
+	if cmd == nil || len(cmd.Params) != 3 {
+		err = proto.ErrMalformedCommand
+		return
+	}
+	msg = cmd.Message
+	if msg == nil {
+		msg = new(proto.Message)
+	}
+	msg.Id = cmd.Params[0]
+	msg.Sender = cmd.Params[1]
+	msg.SenderService = cmd.Params[2]
+	return
+}
+
+var codecsLock sync.RWMutex
+var codecs = map[string]MessageCodec{
+	"json":   &jsonCodec{},
+	"binary": &binaryCodec{},
+}
+
+// RegisterCodec makes a codec available by the provided name.
+// It will replace any codec registered with the same name.
+func RegisterCodec(name string, codec MessageCodec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[name] = codec
+}
+
+// GetCodec returns the codec registered with the name.
+// "json" and "binary" are always available.
+func GetCodec(name string) (codec MessageCodec, err error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	codec, ok := codecs[name]
+	if !ok {
+		err = fmt.Errorf("unknown codec: %v", name)
+	}
+	return
+}
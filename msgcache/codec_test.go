@@ -0,0 +1,66 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"testing"
+)
+
+func testCodec(name string, t *testing.T) {
+	codec, err := GetCodec(name)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	msgs := multiRandomMessage(10)
+	msgs[0].Id = "id"
+	msgs[1].Sender = "sender"
+	msgs[1].SenderService = "service"
+	msgs[2].Body = nil
+	msgs[3].Header = nil
+	for i, msg := range msgs {
+		data, err := codec.Marshal(msg)
+		if err != nil {
+			t.Errorf("Marshal error: %v", err)
+			return
+		}
+		m, err := codec.Unmarshal(data)
+		if err != nil {
+			t.Errorf("Unmarshal error: %v", err)
+			return
+		}
+		if !m.Eq(msg) {
+			t.Errorf("[codec=%v] %vth message does not same", name, i)
+		}
+	}
+}
+
+func TestJsonCodec(t *testing.T) {
+	testCodec("json", t)
+}
+
+func TestBinaryCodec(t *testing.T) {
+	testCodec("binary", t)
+}
+
+func TestUnknownCodec(t *testing.T) {
+	_, err := GetCodec("no-such-codec")
+	if err == nil {
+		t.Errorf("should not find the codec")
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdGenerator generates the ids of the cached messages.
+// The ids should be unique for each user.
+type IdGenerator interface {
+	NewId() string
+}
+
+// The default generator. Ids are unix time in nanoseconds followed
+// by random numbers. They are not sortable as strings.
+type randomIdGenerator struct{}
+
+func (self *randomIdGenerator) NewId() string {
+	return fmt.Sprintf("%v-%v-%v", time.Now().UnixNano(), rand.Int63(), rand.Int63())
+}
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator generates ULIDs: 26 characters of which the first 10
+// encode the time in milliseconds. Ids sort by the time they were
+// generated, even within the same millisecond.
+type ulidGenerator struct {
+	lock   sync.Mutex
+	lastMs uint64
+	hi     uint16 // higher 16 bits of the 80 bits randomness
+	lo     uint64
+}
+
+func (self *ulidGenerator) NewId() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if ms <= self.lastMs {
+		// Keep the ids ordered if the clock does not move forward.
+		ms = self.lastMs
+		self.lo++
+		if self.lo == 0 {
+			self.hi++
+		}
+	} else {
+		self.lastMs = ms
+		self.hi = uint16(rand.Int63())
+		self.lo = uint64(rand.Int63())<<1 ^ uint64(rand.Int63())
+	}
+
+	var buf [26]byte
+	for i := 9; i >= 0; i-- {
+		buf[i] = crockfordBase32[ms&31]
+		ms >>= 5
+	}
+	hi := uint64(self.hi)
+	for i := 0; i < 16; i++ {
+		s := uint(75 - 5*i)
+		var c uint64
+		if s >= 64 {
+			c = hi >> (s - 64)
+		} else {
+			c = self.lo>>s | hi<<(64-s)
+		}
+		buf[10+i] = crockfordBase32[c&31]
+	}
+	return string(buf[:])
+}
+
+// ULIDTime returns the time encoded in an id generated by "ulid".
+func ULIDTime(id string) (t time.Time, err error) {
+	if len(id) != 26 {
+		err = fmt.Errorf("bad ulid: %v", id)
+		return
+	}
+	var ms uint64
+	for i := 0; i < 10; i++ {
+		d := strings.IndexByte(crockfordBase32, id[i])
+		if d < 0 {
+			err = fmt.Errorf("bad ulid: %v", id)
+			return
+		}
+		ms = ms<<5 | uint64(d)
+	}
+	t = time.Unix(0, int64(ms)*int64(time.Millisecond))
+	return
+}
+
+var idGeneratorsLock sync.RWMutex
+var idGenerators = map[string]IdGenerator{
+	"random": &randomIdGenerator{},
+	"ulid":   &ulidGenerator{},
+}
+
+// RegisterIdGenerator makes an id generator available by the provided
+// name. It will replace any generator registered with the same name.
+func RegisterIdGenerator(name string, gen IdGenerator) {
+	idGeneratorsLock.Lock()
+	defer idGeneratorsLock.Unlock()
+	idGenerators[name] = gen
+}
+
+// GetIdGenerator returns the id generator registered with the name.
+// "random" and "ulid" are always available.
+func GetIdGenerator(name string) (gen IdGenerator, err error) {
+	idGeneratorsLock.RLock()
+	defer idGeneratorsLock.RUnlock()
+	gen, ok := idGenerators[name]
+	if !ok {
+		err = fmt.Errorf("unknown id generator: %v", name)
+	}
+	return
+}
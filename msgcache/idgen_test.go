@@ -0,0 +1,87 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestULIDOrdered(t *testing.T) {
+	gen, err := GetIdGenerator("ulid")
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	N := 1000
+	ids := make([]string, N)
+	for i := 0; i < N; i++ {
+		ids[i] = gen.NewId()
+	}
+	if !sort.StringsAreSorted(ids) {
+		t.Errorf("ids are not sorted")
+	}
+	seen := make(map[string]bool, N)
+	for _, id := range ids {
+		if seen[id] {
+			t.Errorf("duplicated id: %v", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestULIDTime(t *testing.T) {
+	gen, _ := GetIdGenerator("ulid")
+	before := time.Now().Add(-time.Millisecond)
+	id := gen.NewId()
+	after := time.Now()
+	ts, err := ULIDTime(id)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if ts.Before(before) || ts.After(after) {
+		t.Errorf("%v is not between %v and %v", ts, before, after)
+	}
+	if _, err = ULIDTime("not-an-id"); err == nil {
+		t.Errorf("should not parse a bad id")
+	}
+}
+
+func TestCacheWithULID(t *testing.T) {
+	gen, _ := GetIdGenerator("ulid")
+	cache := NewRedisMessageCache("", "", 1, nil, gen)
+	msg := randomMessage()
+	id, err := cache.CacheMessage("srv", "usr", msg, time.Hour)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if _, err = ULIDTime(id); err != nil {
+		t.Errorf("should be a ulid: %v", id)
+	}
+	m, err := cache.GetThenDel("srv", "usr", id)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if m == nil || !m.Eq(msg) {
+		t.Errorf("should retrieve the same message")
+	}
+}
@@ -18,19 +18,34 @@
 package msgcache
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"github.com/uniqush/uniqush-conn/proto"
-	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type redisMessageCache struct {
-	pool *redis.Pool
+	pool  *redis.Pool
+	codec MessageCodec
+	idgen IdGenerator
+
+	keyPrefix       string
+	prefixByService bool
+}
+
+// If codec is nil, messages will be stored as JSON.
+// If idgen is nil, the "random" id generator will be used.
+func NewRedisMessageCache(addr, password string, db int, codec MessageCodec, idgen IdGenerator) Cache {
+	return NewPrefixedRedisMessageCache(addr, password, db, codec, idgen, "", false)
 }
 
-func NewRedisMessageCache(addr, password string, db int) Cache {
+// NewPrefixedRedisMessageCache is like NewRedisMessageCache, but all keys
+// start with keyPrefix. If prefixByService is true, keys of each service
+// are further prefixed with the service name, so that services sharing
+// the same database never see each other's data.
+func NewPrefixedRedisMessageCache(addr, password string, db int, codec MessageCodec, idgen IdGenerator, keyPrefix string, prefixByService bool) Cache {
 	if len(addr) == 0 {
 		addr = "localhost:6379"
 	}
@@ -67,17 +82,32 @@ func NewRedisMessageCache(addr, password string, db int) Cache {
 		TestOnBorrow: testOnBorrow,
 	}
 
+	if codec == nil {
+		codec = &jsonCodec{}
+	}
+	if idgen == nil {
+		idgen = &randomIdGenerator{}
+	}
+
 	ret := new(redisMessageCache)
 	ret.pool = pool
+	ret.codec = codec
+	ret.idgen = idgen
+	ret.keyPrefix = keyPrefix
+	ret.prefixByService = prefixByService
 	return ret
 }
 
-func randomId() string {
-	return fmt.Sprintf("%v-%v-%v", time.Now().UnixNano(), rand.Int63(), rand.Int63())
+// prefix returns the prefix of the keys of the service.
+func (self *redisMessageCache) prefix(service string) string {
+	if self.prefixByService {
+		return self.keyPrefix + service + ":"
+	}
+	return self.keyPrefix
 }
 
 func (self *redisMessageCache) CacheMessage(service, username string, msg *proto.Message, ttl time.Duration) (id string, err error) {
-	id = randomId()
+	id = self.idgen.NewId()
 	err = self.set(service, username, id, msg, ttl)
 	if err != nil {
 		id = ""
@@ -91,48 +121,501 @@ func (self *redisMessageCache) GetThenDel(service, username, id string) (msg *pr
 	return
 }
 
-func msgKey(service, username, id string) string {
-	return fmt.Sprintf("mcache:%v:%v:%v", service, username, id)
+func (self *redisMessageCache) Get(service, username, id string) (msg *proto.Message, err error) {
+	return self.get(service, username, id)
+}
+
+func (self *redisMessageCache) Delete(service, username, id string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+	err = conn.Send("DEL", self.msgKey(service, username, id), self.msgTimeKey(service, username, id))
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	err = conn.Send("ZREM", self.msgIdxKey(service, username), id)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (self *redisMessageCache) deadLetterKey(queue string) string {
+	return fmt.Sprintf("%vdlq:%v", self.keyPrefix, queue)
+}
+
+func (self *redisMessageCache) PushDeadLetter(queue string, data []byte) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("LPUSH", self.deadLetterKey(queue), data)
+	return err
+}
+
+func (self *redisMessageCache) PopDeadLetter(queue string) (data []byte, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	data, err = redis.Bytes(conn.Do("RPOP", self.deadLetterKey(queue)))
+	if err == redis.ErrNil {
+		data = nil
+		err = nil
+	}
+	return
 }
 
-func msgMarshal(msg *proto.Message) (data []byte, err error) {
-	data, err = json.Marshal(msg)
+func (self *redisMessageCache) NrDeadLetters(queue string) (n int, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	n, err = redis.Int(conn.Do("LLEN", self.deadLetterKey(queue)))
 	return
 }
 
-func msgUnmarshal(data []byte) (msg *proto.Message, err error) {
-	msg = new(proto.Message)
-	err = json.Unmarshal(data, msg)
+func (self *redisMessageCache) msgKey(service, username, id string) string {
+	return fmt.Sprintf("%vmcache:%v:%v:%v", self.prefix(service), service, username, id)
+}
+
+// The unix time in milliseconds when the message was cached.
+// It expires with the message.
+func (self *redisMessageCache) msgTimeKey(service, username, id string) string {
+	return fmt.Sprintf("%vmcache-at:%v:%v:%v", self.prefix(service), service, username, id)
+}
+
+func (self *redisMessageCache) CachedAt(service, username, id string) (t time.Time, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("GET", self.msgTimeKey(service, username, id))
+	if err != nil || reply == nil {
+		return
+	}
+	ms, err := redis.Int64(reply, err)
 	if err != nil {
-		msg = nil
 		return
 	}
+	t = time.Unix(0, ms*int64(time.Millisecond))
 	return
 }
 
-func (self *redisMessageCache) set(service, username, id string, msg *proto.Message, ttl time.Duration) error {
-	key := msgKey(service, username, id)
+// A sorted set of the ids of the messages cached for the user.
+// The score is the unix time when the message expires, or +inf.
+// The set expires with the message expiring last.
+func (self *redisMessageCache) msgIdxKey(service, username string) string {
+	return fmt.Sprintf("%vmcache-idx:%v:%v", self.prefix(service), service, username)
+}
+
+func (self *redisMessageCache) BacklogCount(service, username string) (n int, err error) {
+	key := self.msgIdxKey(service, username)
 	conn := self.pool.Get()
 	defer conn.Close()
 
-	data, err := msgMarshal(msg)
+	// Remove the expired ones first.
+	_, err = conn.Do("ZREMRANGEBYSCORE", key, "-inf", time.Now().Unix())
+	if err != nil {
+		return
+	}
+	n, err = redis.Int(conn.Do("ZCARD", key))
+	return
+}
+
+func (self *redisMessageCache) Sync(service, username string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	for _, id := range ids {
+		err := conn.Send("EXISTS", self.msgKey(service, username, id))
+		if err != nil {
+			return err
+		}
+	}
+	err := conn.Flush()
 	if err != nil {
 		return err
 	}
+	for _ = range ids {
+		exists, err := redis.Bool(conn.Receive())
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotSynced
+		}
+	}
+	return nil
+}
+
+// ClaimMessages deletes the messages one by one in transactions. A message
+// claimed by someone else in the meantime is skipped, so fewer than max
+// messages may be returned even if there are more in the cache.
+func (self *redisMessageCache) ClaimMessages(service, username string, max int) (msgs []*proto.Message, err error) {
+	if max <= 0 {
+		return
+	}
+	conn := self.pool.Get()
+	ids, err := redis.Strings(conn.Do("ZRANGEBYSCORE", self.msgIdxKey(service, username), time.Now().Unix(), "+inf", "LIMIT", 0, max))
+	conn.Close()
+	if err != nil {
+		return
+	}
+	msgs = make([]*proto.Message, 0, len(ids))
+	for _, id := range ids {
+		var msg *proto.Message
+		msg, err = self.del(service, username, id)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		msg.Id = id
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+// Number of keys scanned in each round of CacheStats.
+const statsScanCount = 1000
+
+// CacheStats walks through the messages with SCAN, so that redis is not
+// blocked as it would be by KEYS. The result is approximate if messages
+// are added or removed in the meantime.
+func (self *redisMessageCache) CacheStats(service string) (stats *CacheStats, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	stats = new(CacheStats)
+	pattern := fmt.Sprintf("%vmcache:%v:*", self.prefix(service), service)
+	cursor := "0"
+	for {
+		var reply []interface{}
+		reply, err = redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", statsScanCount))
+		if err != nil {
+			return
+		}
+		if len(reply) != 2 {
+			err = fmt.Errorf("bad reply: %v", reply)
+			return
+		}
+		cursor, err = redis.String(reply[0], nil)
+		if err != nil {
+			return
+		}
+		var keys []string
+		keys, err = redis.Strings(reply[1], nil)
+		if err != nil {
+			return
+		}
+		for _, key := range keys {
+			err = conn.Send("STRLEN", key)
+			if err != nil {
+				return
+			}
+		}
+		err = conn.Flush()
+		if err != nil {
+			return
+		}
+		for _ = range keys {
+			var n int64
+			n, err = redis.Int64(conn.Receive())
+			if err != nil {
+				return
+			}
+			// The message expired after it was scanned.
+			if n == 0 {
+				continue
+			}
+			stats.NrMessages++
+			stats.NrBytes += n
+		}
+		if cursor == "0" {
+			return
+		}
+	}
+}
+
+// The number of messages delivered to the user on the day.
+func (self *redisMessageCache) quotaKey(service, username string, t time.Time) string {
+	return fmt.Sprintf("%vmcache-quota:%v:%v:%v", self.prefix(service), service, username, t.UTC().Format("20060102"))
+}
+
+func (self *redisMessageCache) IncrDailyCount(service, username string, t time.Time) (n int, err error) {
+	key := self.quotaKey(service, username, t)
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return
+	}
+	err = conn.Send("INCR", key)
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	// The key is useless once the day is over.
+	err = conn.Send("EXPIRE", key, 24*60*60)
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return
+	}
+	if len(reply) != 2 {
+		err = fmt.Errorf("bad reply: %v", reply)
+		return
+	}
+	n, err = redis.Int(reply[0], nil)
+	return
+}
+
+// The last sequence number assigned to the user. It never expires.
+func (self *redisMessageCache) seqKey(service, username string) string {
+	return fmt.Sprintf("%vmcache-seq:%v:%v", self.prefix(service), service, username)
+}
+
+func (self *redisMessageCache) NextSeq(service, username string) (seq int64, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	seq, err = redis.Int64(conn.Do("INCR", self.seqKey(service, username)))
+	return
+}
+
+func (self *redisMessageCache) CurrentSeq(service, username string) (seq int64, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	seq, err = redis.Int64(conn.Do("GET", self.seqKey(service, username)))
+	if err == redis.ErrNil {
+		seq = 0
+		err = nil
+	}
+	return
+}
+
+// The number of notifications pushed to the user within the window.
+func (self *redisMessageCache) pushCountKey(service, username string, window time.Duration, t time.Time) string {
+	start := t.Truncate(window).UnixNano() / int64(time.Millisecond)
+	return fmt.Sprintf("%vmcache-pushcount:%v:%v:%v", self.prefix(service), service, username, start)
+}
+
+func (self *redisMessageCache) IncrPushCount(service, username string, window time.Duration, t time.Time) (n int, err error) {
+	key := self.pushCountKey(service, username, window, t)
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return
+	}
+	err = conn.Send("INCR", key)
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	// Keep the key for another window so that
+	// it can be read after the window is over.
+	ms := int64(2 * window / time.Millisecond)
+	if ms <= 0 {
+		ms = 1
+	}
+	err = conn.Send("PEXPIRE", key, ms)
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return
+	}
+	if len(reply) != 2 {
+		err = fmt.Errorf("bad reply: %v", reply)
+		return
+	}
+	n, err = redis.Int(reply[0], nil)
+	return
+}
 
-	if ttl.Seconds() <= 0.0 {
-		_, err = conn.Do("SET", key, data)
+func (self *redisMessageCache) PushCount(service, username string, window time.Duration, t time.Time) (n int, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	n, err = redis.Int(conn.Do("GET", self.pushCountKey(service, username, window, t)))
+	if err == redis.ErrNil {
+		n = 0
+		err = nil
+	}
+	return
+}
+
+// A sorted set of the pushes which failed. Each member is the username
+// followed by the ids of the messages, separated by newlines. The score
+// is the unix time when the push failed.
+func (self *redisMessageCache) pushFailKey(service string) string {
+	return fmt.Sprintf("%vmcache-pushfail:%v", self.prefix(service), service)
+}
+
+func (self *redisMessageCache) SetPushFailed(service, username string, ids []string, failed bool) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	member := strings.Join(append([]string{username}, ids...), "\n")
+	conn := self.pool.Get()
+	defer conn.Close()
+	var err error
+	if failed {
+		_, err = conn.Do("ZADD", self.pushFailKey(service), time.Now().Unix(), member)
 	} else {
-		_, err = conn.Do("SETEX", key, int64(ttl.Seconds()), data)
+		_, err = conn.Do("ZREM", self.pushFailKey(service), member)
 	}
+	return err
+}
+
+func (self *redisMessageCache) FailedPushes(service string) (pushes []*FailedPush, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+	members, err := redis.Strings(conn.Do("ZRANGE", self.pushFailKey(service), 0, -1))
+	if err != nil {
+		return
+	}
+	pushes = make([]*FailedPush, 0, len(members))
+	for _, member := range members {
+		fields := strings.Split(member, "\n")
+		if len(fields) < 2 {
+			continue
+		}
+		pushes = append(pushes, &FailedPush{Username: fields[0], Ids: fields[1:]})
+	}
+	return
+}
+
+func (self *redisMessageCache) dedupKey(service, username, id string) string {
+	return fmt.Sprintf("%vmcache-dedup:%v:%v:%v", self.prefix(service), service, username, id)
+}
+
+func (self *redisMessageCache) SeenBefore(service, username, id string, window time.Duration) (seen bool, err error) {
+	key := self.dedupKey(service, username, id)
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	ms := int64(window / time.Millisecond)
+	if ms <= 0 {
+		ms = 1
+	}
+	// SET NX replies nil if the key is already there.
+	reply, err := conn.Do("SET", key, 1, "PX", ms, "NX")
+	if err != nil {
+		return
+	}
+	seen = reply == nil
+	return
+}
+
+// idxExpireAt returns the unix time when the message expiring last in
+// the index expires, zero if the index is empty, or -1 if a message in
+// the index never expires.
+func (self *redisMessageCache) idxExpireAt(conn redis.Conn, idxKey string) (t int64, err error) {
+	reply, err := redis.Strings(conn.Do("ZREVRANGE", idxKey, 0, 0, "WITHSCORES"))
+	if err != nil || len(reply) != 2 {
+		return
+	}
+	if strings.HasSuffix(reply[1], "inf") {
+		t = -1
+		return
+	}
+	score, err := strconv.ParseFloat(reply[1], 64)
+	t = int64(score)
+	return
+}
+
+func (self *redisMessageCache) set(service, username, id string, msg *proto.Message, ttl time.Duration) error {
+	key := self.msgKey(service, username, id)
+	idxKey := self.msgIdxKey(service, username)
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	data, err := self.codec.Marshal(msg)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	for {
+		// The index expires with the message expiring last. It is
+		// watched so that a message cached in the meantime does not
+		// outlive the index.
+		_, err = conn.Do("WATCH", idxKey)
+		if err != nil {
+			return err
+		}
+		var idxExpire int64
+		idxExpire, err = self.idxExpireAt(conn, idxKey)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		err = conn.Send("MULTI")
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		now := time.Now()
+		timeKey := self.msgTimeKey(service, username, id)
+		cachedAt := now.UnixNano() / int64(time.Millisecond)
+		var expire interface{}
+		if ttl.Seconds() <= 0.0 {
+			err = conn.Send("SET", key, data)
+			if err == nil {
+				err = conn.Send("SET", timeKey, cachedAt)
+			}
+			expire = "+inf"
+			idxExpire = -1
+		} else {
+			err = conn.Send("SETEX", key, int64(ttl.Seconds()), data)
+			if err == nil {
+				err = conn.Send("SETEX", timeKey, int64(ttl.Seconds()), cachedAt)
+			}
+			t := now.Add(ttl).Unix()
+			expire = t
+			if idxExpire >= 0 && idxExpire < t {
+				idxExpire = t
+			}
+		}
+		if err == nil {
+			err = conn.Send("ZADD", idxKey, expire, id)
+		}
+		if err == nil {
+			if idxExpire < 0 {
+				// A message in the index never expires.
+				err = conn.Send("PERSIST", idxKey)
+			} else {
+				err = conn.Send("EXPIREAT", idxKey, idxExpire+1)
+			}
+		}
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+		var replies []interface{}
+		replies, err = redis.Values(conn.Do("EXEC"))
+		// The index was changed after it was watched.
+		if err == redis.ErrNil || (err == nil && len(replies) == 0) {
+			continue
+		}
+		return err
+	}
 }
 
 func (self *redisMessageCache) get(service, username, id string) (msg *proto.Message, err error) {
-	key := msgKey(service, username, id)
+	key := self.msgKey(service, username, id)
 	conn := self.pool.Get()
 	defer conn.Close()
 
@@ -147,12 +630,12 @@ func (self *redisMessageCache) get(service, username, id string) (msg *proto.Mes
 	if err != nil {
 		return
 	}
-	msg, err = msgUnmarshal(data)
+	msg, err = self.codec.Unmarshal(data)
 	return
 }
 
 func (self *redisMessageCache) del(service, username, id string) (msg *proto.Message, err error) {
-	key := msgKey(service, username, id)
+	key := self.msgKey(service, username, id)
 	conn := self.pool.Get()
 	defer conn.Close()
 
@@ -165,7 +648,12 @@ func (self *redisMessageCache) del(service, username, id string) (msg *proto.Mes
 		conn.Do("DISCARD")
 		return
 	}
-	err = conn.Send("DEL", key)
+	err = conn.Send("DEL", key, self.msgTimeKey(service, username, id))
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	err = conn.Send("ZREM", self.msgIdxKey(service, username), id)
 	if err != nil {
 		conn.Do("DISCARD")
 		return
@@ -179,7 +667,7 @@ func (self *redisMessageCache) del(service, username, id string) (msg *proto.Mes
 	if err != nil {
 		return
 	}
-	if len(bulkReply) != 2 {
+	if len(bulkReply) != 3 {
 		return
 	}
 	if bulkReply[0] == nil {
@@ -192,6 +680,6 @@ func (self *redisMessageCache) del(service, username, id string) (msg *proto.Mes
 	if len(data) == 0 {
 		return
 	}
-	msg, err = msgUnmarshal(data)
+	msg, err = self.codec.Unmarshal(data)
 	return
 }
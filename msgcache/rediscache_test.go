@@ -19,9 +19,11 @@ package msgcache
 
 import (
 	"crypto/rand"
+	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"github.com/uniqush/uniqush-conn/proto"
 	"io"
+	"sync"
 	"testing"
 	"time"
 )
@@ -50,7 +52,7 @@ func getCache() Cache {
 	c.Do("SELECT", db)
 	c.Do("FLUSHDB")
 	c.Close()
-	return NewRedisMessageCache("", "", db)
+	return NewRedisMessageCache("", "", db, nil, nil)
 }
 
 func TestGetSetMessage(t *testing.T) {
@@ -122,3 +124,388 @@ func TestGetSetMailTTL(t *testing.T) {
 		}
 	}
 }
+
+func TestBacklogCount(t *testing.T) {
+	N := 10
+	msgs := multiRandomMessage(N)
+	cache := getCache()
+	counter := cache.(BacklogCounter)
+	srv := "srv"
+	usr := "usr"
+
+	ids := make([]string, N)
+	for i, msg := range msgs {
+		id, err := cache.CacheMessage(srv, usr, msg, 0*time.Second)
+		if err != nil {
+			t.Errorf("Set error: %v", err)
+			return
+		}
+		ids[i] = id
+	}
+	n, err := counter.BacklogCount(srv, usr)
+	if err != nil {
+		t.Errorf("Count error: %v", err)
+		return
+	}
+	if n != N {
+		t.Errorf("backlog should be %v: %v", N, n)
+	}
+	for i, id := range ids {
+		cache.GetThenDel(srv, usr, id)
+		n, err = counter.BacklogCount(srv, usr)
+		if err != nil {
+			t.Errorf("Count error: %v", err)
+			return
+		}
+		if n != N-i-1 {
+			t.Errorf("backlog should be %v: %v", N-i-1, n)
+		}
+	}
+}
+
+func TestBacklogIndexExpires(t *testing.T) {
+	cache := getCache()
+	srv := "srv"
+	usr := "usr"
+	c, err := redis.Dial("tcp", "localhost:6379")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Do("SELECT", 1)
+	idxTTL := func() int {
+		ttl, err := redis.Int(c.Do("TTL", "mcache-idx:srv:usr"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ttl
+	}
+
+	cache.CacheMessage(srv, usr, randomMessage(), 2*time.Hour)
+	if ttl := idxTTL(); ttl <= 3600 || ttl > 2*3600+1 {
+		t.Errorf("the index should expire with the message: %v", ttl)
+	}
+	// A message expiring earlier does not shorten the TTL.
+	cache.CacheMessage(srv, usr, randomMessage(), time.Hour)
+	if ttl := idxTTL(); ttl <= 3600 {
+		t.Errorf("the index should expire with the last message: %v", ttl)
+	}
+	cache.CacheMessage(srv, usr, randomMessage(), 0)
+	if ttl := idxTTL(); ttl != -1 {
+		t.Errorf("the index should never expire: %v", ttl)
+	}
+	cache.CacheMessage(srv, usr, randomMessage(), time.Hour)
+	if ttl := idxTTL(); ttl != -1 {
+		t.Errorf("the index should still never expire: %v", ttl)
+	}
+}
+
+func TestIncrDailyCount(t *testing.T) {
+	N := 10
+	counter, ok := getCache().(QuotaCounter)
+	if !ok {
+		t.Fatalf("redis cache should be a quota counter")
+	}
+	srv := "srv"
+	usr := "usr"
+	today := time.Date(2013, time.October, 1, 23, 59, 0, 0, time.UTC)
+
+	for i := 1; i <= N; i++ {
+		n, err := counter.IncrDailyCount(srv, usr, today)
+		if err != nil {
+			t.Errorf("Incr error: %v", err)
+			return
+		}
+		if n != i {
+			t.Errorf("count should be %v: %v", i, n)
+		}
+	}
+
+	// The counter starts over on the next day.
+	n, err := counter.IncrDailyCount(srv, usr, today.Add(2*time.Minute))
+	if err != nil {
+		t.Errorf("Incr error: %v", err)
+		return
+	}
+	if n != 1 {
+		t.Errorf("count should be reset on the next day: %v", n)
+	}
+
+	n, err = counter.IncrDailyCount(srv, "other", today)
+	if err != nil {
+		t.Errorf("Incr error: %v", err)
+		return
+	}
+	if n != 1 {
+		t.Errorf("count should be per user: %v", n)
+	}
+}
+
+func TestSeenBefore(t *testing.T) {
+	dedup, ok := getCache().(Deduplicator)
+	if !ok {
+		t.Fatalf("redis cache should be a deduplicator")
+	}
+	srv := "srv"
+	usr := "usr"
+	window := 500 * time.Millisecond
+
+	seen, err := dedup.SeenBefore(srv, usr, "id", window)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if seen {
+		t.Errorf("a new id should not be seen")
+	}
+
+	// A duplicate within the window.
+	seen, err = dedup.SeenBefore(srv, usr, "id", window)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if !seen {
+		t.Errorf("a duplicate id within the window should be seen")
+	}
+
+	seen, _ = dedup.SeenBefore(srv, "other", "id", window)
+	if seen {
+		t.Errorf("ids should be per user")
+	}
+
+	// A duplicate outside the window.
+	time.Sleep(2 * window)
+	seen, err = dedup.SeenBefore(srv, usr, "id", window)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if seen {
+		t.Errorf("a duplicate id outside the window should not be seen")
+	}
+}
+
+func TestSync(t *testing.T) {
+	N := 5
+	msgs := multiRandomMessage(N)
+	cache := getCache()
+	syncer := cache.(Syncer)
+	srv := "srv"
+	usr := "usr"
+
+	ids := make([]string, N)
+	for i, msg := range msgs {
+		id, err := cache.CacheMessage(srv, usr, msg, 0*time.Second)
+		if err != nil {
+			t.Errorf("Set error: %v", err)
+			return
+		}
+		ids[i] = id
+	}
+	err := syncer.Sync(srv, usr, ids)
+	if err != nil {
+		t.Errorf("Sync error: %v", err)
+	}
+	cache.GetThenDel(srv, usr, ids[0])
+	err = syncer.Sync(srv, usr, ids)
+	if err != ErrNotSynced {
+		t.Errorf("retrieved message should not be synced: %v", err)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	N := 5
+	msgs := multiRandomMessage(N)
+	cache := getCache()
+	var size int64
+	for i, msg := range msgs {
+		usr := fmt.Sprintf("usr%v", i%2)
+		_, err := cache.CacheMessage("srv", usr, msg, time.Hour)
+		if err != nil {
+			t.Errorf("Set error: %v", err)
+			return
+		}
+		data, _ := (&jsonCodec{}).Marshal(msg)
+		size += int64(len(data))
+	}
+	cache.CacheMessage("another-srv", "usr", msgs[0], time.Hour)
+
+	stats, err := cache.(StatsReporter).CacheStats("srv")
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if stats.NrMessages != int64(N) || stats.NrBytes != size {
+		t.Errorf("expected %v messages of %v bytes: %+v", N, size, stats)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	N := 3
+	msgs := multiRandomMessage(N)
+	cache := getCache()
+	srv := "srv"
+	usr := "usr"
+	ids := make([]string, N)
+	for i, msg := range msgs {
+		id, err := cache.CacheMessage(srv, usr, msg, 0*time.Second)
+		if err != nil {
+			t.Errorf("Set error: %v", err)
+			return
+		}
+		ids[i] = id
+	}
+	deleter := cache.(Deleter)
+	err := deleter.Delete(srv, usr, ids[0])
+	if err != nil {
+		t.Errorf("Delete error: %v", err)
+		return
+	}
+	// Deleting it again is fine.
+	err = deleter.Delete(srv, usr, ids[0])
+	if err != nil {
+		t.Errorf("Delete error: %v", err)
+		return
+	}
+	m, err := cache.GetThenDel(srv, usr, ids[0])
+	if err != nil || m != nil {
+		t.Errorf("deleted message should be gone: %v %v", m, err)
+	}
+	n, err := cache.(BacklogCounter).BacklogCount(srv, usr)
+	if err != nil || n != N-1 {
+		t.Errorf("backlog should be %v: %v %v", N-1, n, err)
+	}
+}
+
+func TestDeadLetterQueue(t *testing.T) {
+	dlq := getCache().(DeadLetterQueue)
+	queue := "webhook"
+	letters := []string{"first", "second", "third"}
+	for _, l := range letters {
+		if err := dlq.PushDeadLetter(queue, []byte(l)); err != nil {
+			t.Errorf("Push error: %v", err)
+			return
+		}
+	}
+	n, err := dlq.NrDeadLetters(queue)
+	if err != nil || n != len(letters) {
+		t.Errorf("should have %v letters: %v %v", len(letters), n, err)
+	}
+	for _, l := range letters {
+		data, err := dlq.PopDeadLetter(queue)
+		if err != nil || string(data) != l {
+			t.Errorf("should pop %q: %q %v", l, data, err)
+		}
+	}
+	data, err := dlq.PopDeadLetter(queue)
+	if err != nil || data != nil {
+		t.Errorf("queue should be empty: %q %v", data, err)
+	}
+}
+
+func TestPrefixByService(t *testing.T) {
+	getCache()
+	cache := NewPrefixedRedisMessageCache("", "", 1, nil, nil, "app:", true)
+	srv := "srv"
+	usr := "usr"
+	id, err := cache.CacheMessage(srv, usr, randomMessage(), 0)
+	if err != nil {
+		t.Errorf("Set error: %v", err)
+		return
+	}
+
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	defer c.Close()
+	c.Do("SELECT", 1)
+	key := fmt.Sprintf("app:%v:mcache:%v:%v:%v", srv, srv, usr, id)
+	exists, err := redis.Bool(c.Do("EXISTS", key))
+	if err != nil || !exists {
+		t.Errorf("%v should exist: %v", key, err)
+	}
+
+	stats, err := cache.(StatsReporter).CacheStats(srv)
+	if err != nil || stats.NrMessages != 1 {
+		t.Errorf("should have one message: %+v %v", stats, err)
+	}
+	msg, err := cache.GetThenDel(srv, usr, id)
+	if err != nil || msg == nil {
+		t.Errorf("should get the message: %v", err)
+	}
+}
+
+func TestConcurrentClaims(t *testing.T) {
+	N := 50
+	M := 5
+	cache := getCache()
+	srv := "srv"
+	usr := "usr"
+	for _, msg := range multiRandomMessage(N) {
+		if _, err := cache.CacheMessage(srv, usr, msg, 0); err != nil {
+			t.Errorf("Set error: %v", err)
+			return
+		}
+	}
+
+	var lock sync.Mutex
+	claimed := make(map[string]int, N)
+	wg := new(sync.WaitGroup)
+	wg.Add(M)
+	for i := 0; i < M; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				msgs, err := cache.(Claimer).ClaimMessages(srv, usr, 3)
+				if err != nil {
+					t.Errorf("Claim error: %v", err)
+					return
+				}
+				if len(msgs) == 0 {
+					return
+				}
+				lock.Lock()
+				for _, msg := range msgs {
+					claimed[msg.Id]++
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(claimed) != N {
+		t.Errorf("should claim %v messages: %v", N, len(claimed))
+	}
+	for id, n := range claimed {
+		if n != 1 {
+			t.Errorf("message %v claimed %v times", id, n)
+		}
+	}
+	n, err := cache.(BacklogCounter).BacklogCount(srv, usr)
+	if err != nil || n != 0 {
+		t.Errorf("backlog should be empty: %v %v", n, err)
+	}
+}
+
+func TestCachedAt(t *testing.T) {
+	cache := getCache()
+	tracker := cache.(AgeTracker)
+	srv := "srv"
+	usr := "usr"
+	before := time.Now().Truncate(time.Millisecond)
+	id, err := cache.CacheMessage(srv, usr, randomMessage(), time.Hour)
+	if err != nil {
+		t.Fatalf("Set error: %v", err)
+	}
+	at, err := tracker.CachedAt(srv, usr, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at.Before(before) || at.After(time.Now()) {
+		t.Errorf("bad time: %v", at)
+	}
+	cache.GetThenDel(srv, usr, id)
+	at, err = tracker.CachedAt(srv, usr, id)
+	if err != nil || !at.IsZero() {
+		t.Errorf("the time should be gone with the message: %v %v", at, err)
+	}
+}
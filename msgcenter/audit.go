@@ -0,0 +1,154 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"os"
+	"sync"
+	"time"
+)
+
+// Directions of the messages given to an AuditLogger.
+const (
+	// Received from a connection.
+	AuditInbound = "in"
+	// Written to a connection.
+	AuditOutbound = "out"
+)
+
+// AuditLogger keeps a durable record of the messages read from and
+// written to the connections of a service. It is called synchronously
+// as the messages are routed, so it should return quickly. Errors are
+// reported to the ErrorHandler of the service.
+type AuditLogger interface {
+	Audit(t time.Time, direction, service, username, connId string, msg *proto.Message) error
+}
+
+type auditEntry struct {
+	Time          time.Time         `json:"time"`
+	Direction     string            `json:"dir"`
+	Service       string            `json:"service"`
+	Username      string            `json:"username"`
+	ConnId        string            `json:"conn"`
+	Id            string            `json:"id,omitempty"`
+	Sender        string            `json:"sender,omitempty"`
+	SenderService string            `json:"senderService,omitempty"`
+	Header        map[string]string `json:"header,omitempty"`
+	Body          []byte            `json:"body,omitempty"`
+}
+
+type fileAuditLogger struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+// NewFileAuditLogger returns an AuditLogger which appends one JSON
+// object per message to the file at path. Once the file would grow
+// beyond maxSize bytes, it is renamed to path.<unix time in ns> and
+// a new file is started. A non-positive maxSize means no rotation.
+func NewFileAuditLogger(path string, maxSize int64) (AuditLogger, error) {
+	ret := new(fileAuditLogger)
+	ret.path = path
+	ret.maxSize = maxSize
+	err := ret.open()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (self *fileAuditLogger) open() error {
+	f, err := os.OpenFile(self.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	self.file = f
+	self.size = info.Size()
+	return nil
+}
+
+func (self *fileAuditLogger) rotate() error {
+	err := self.file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(self.path, fmt.Sprintf("%v.%v", self.path, time.Now().UnixNano()))
+	if err != nil {
+		// Keep appending to the old file.
+		if e := self.open(); e != nil {
+			return e
+		}
+		return err
+	}
+	return self.open()
+}
+
+func (self *fileAuditLogger) Audit(t time.Time, direction, service, username, connId string, msg *proto.Message) error {
+	entry := &auditEntry{
+		Time:      t,
+		Direction: direction,
+		Service:   service,
+		Username:  username,
+		ConnId:    connId,
+	}
+	if msg != nil {
+		entry.Id = msg.Id
+		entry.Sender = msg.Sender
+		entry.SenderService = msg.SenderService
+		entry.Header = msg.Header
+		entry.Body = msg.Body
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.maxSize > 0 && self.size > 0 && self.size+int64(len(data)) > self.maxSize {
+		err = self.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := self.file.Write(data)
+	self.size += int64(n)
+	return err
+}
+
+func (self *serviceCenter) audit(direction string, conn MinimalConn, msg *proto.Message) {
+	if self.config == nil || self.config.AuditLogger == nil {
+		return
+	}
+	err := self.config.AuditLogger.Audit(time.Now(), direction, self.serviceName, conn.Username(), self.connId(conn), msg)
+	if err != nil {
+		self.reportError(self.serviceName, conn.Username(), self.connId(conn), "", err)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"sync"
+)
+
+// At most this many requests are sent to the push service at the same
+// time. The push service lock is held for one batch of this size, so
+// that normal subscriptions are not blocked by a long bulk subscription.
+const maxNrBulkSubscribers = 16
+
+type SubscribeFailure struct {
+	Request *server.SubscribeRequest
+	Err     error
+}
+
+// BulkSubscribeError is returned by BulkSubscribe if some of the
+// requests failed. Other requests have been processed.
+type BulkSubscribeError struct {
+	Failures []*SubscribeFailure
+}
+
+func (self *BulkSubscribeError) Error() string {
+	return fmt.Sprintf("%v subscribe requests failed. first error: %v",
+		len(self.Failures), self.Failures[0].Err)
+}
+
+// Requests returns the failed requests so that they can be retried.
+func (self *BulkSubscribeError) Requests() []*server.SubscribeRequest {
+	ret := make([]*server.SubscribeRequest, len(self.Failures))
+	for i, f := range self.Failures {
+		ret[i] = f.Request
+	}
+	return ret
+}
+
+func (self *serviceCenter) subscribeOrFail(req *server.SubscribeRequest) (err error) {
+	if req.Subscribe {
+		err = self.config.PushService.Subscribe(req.Service, req.Username, req.Params)
+	} else {
+		err = self.config.PushService.Unsubscribe(req.Service, req.Username, req.Params)
+	}
+	if err != nil || self.config.SubscriptionStore == nil {
+		return
+	}
+	if req.Subscribe {
+		err = self.config.SubscriptionStore.Subscribe(req.Service, req.Username, req.Params)
+	} else {
+		err = self.config.SubscriptionStore.Unsubscribe(req.Service, req.Username, req.Params)
+	}
+	return
+}
+
+// bulkSubscribe sends the requests to the push service, bypassing
+// subReqChan, and returns the requests which failed.
+func (self *serviceCenter) bulkSubscribe(reqs []*server.SubscribeRequest) []*SubscribeFailure {
+	var failures []*SubscribeFailure
+	if self.config == nil || self.config.PushService == nil {
+		for _, req := range reqs {
+			failures = append(failures, &SubscribeFailure{Request: req, Err: ErrNoPushService})
+		}
+		return failures
+	}
+	var lock sync.Mutex
+	for start := 0; start < len(reqs); start += maxNrBulkSubscribers {
+		end := start + maxNrBulkSubscribers
+		if end > len(reqs) {
+			end = len(reqs)
+		}
+		var wg sync.WaitGroup
+		self.pushServiceLock.Lock()
+		for _, req := range reqs[start:end] {
+			wg.Add(1)
+			go func(req *server.SubscribeRequest) {
+				defer wg.Done()
+				err := self.subscribeOrFail(req)
+				if err == nil {
+					return
+				}
+				lock.Lock()
+				failures = append(failures, &SubscribeFailure{Request: req, Err: err})
+				lock.Unlock()
+			}(req)
+		}
+		wg.Wait()
+		self.pushServiceLock.Unlock()
+	}
+	return failures
+}
+
+// BulkSubscribe processes a large number of subscribe (or unsubscribe)
+// requests at once. It is meant for provisioning users, e.g. when
+// migrating a tenant. If some requests failed, the returned error is
+// a *BulkSubscribeError which lists them.
+func (self *MessageCenter) BulkSubscribe(reqs []*server.SubscribeRequest) error {
+	byService := make(map[string][]*server.SubscribeRequest, 1)
+	for _, req := range reqs {
+		if req == nil {
+			continue
+		}
+		byService[req.Service] = append(byService[req.Service], req)
+	}
+	var failures []*SubscribeFailure
+	for service, sreqs := range byService {
+		center, err := self.getServiceCenter(service)
+		if err != nil {
+			for _, req := range sreqs {
+				failures = append(failures, &SubscribeFailure{Request: req, Err: err})
+			}
+			continue
+		}
+		failures = append(failures, center.bulkSubscribe(sreqs)...)
+	}
+	if len(failures) > 0 {
+		return &BulkSubscribeError{Failures: failures}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ConnEventType int
+
+const (
+	ConnEventConnect ConnEventType = iota
+	ConnEventDisconnect
+)
+
+func (self ConnEventType) String() string {
+	switch self {
+	case ConnEventConnect:
+		return "connect"
+	case ConnEventDisconnect:
+		return "disconnect"
+	}
+	return fmt.Sprintf("ConnEventType(%d)", int(self))
+}
+
+func (self ConnEventType) MarshalText() ([]byte, error) {
+	return []byte(self.String()), nil
+}
+
+// ConnEvent tells that a connection is added to or removed from a service.
+type ConnEvent struct {
+	Type     ConnEventType `json:"type"`
+	Service  string        `json:"service"`
+	Username string        `json:"username"`
+	ConnId   string        `json:"connId"`
+	Addr     string        `json:"addr"`
+	Time     time.Time     `json:"time"`
+}
+
+// Number of events buffered for each subscriber. Further
+// events are dropped until the subscriber catches up.
+const connEventBufSize = 64
+
+type connEventHub struct {
+	// Accessed atomically. Keep it at the beginning for alignment.
+	nrDropped int64
+
+	lock   sync.Mutex
+	nextId int
+	subs   map[int]chan ConnEvent
+}
+
+func (self *connEventHub) subscribe() (<-chan ConnEvent, func()) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.subs == nil {
+		self.subs = make(map[int]chan ConnEvent, 4)
+	}
+	id := self.nextId
+	self.nextId++
+	ch := make(chan ConnEvent, connEventBufSize)
+	self.subs[id] = ch
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			self.lock.Lock()
+			defer self.lock.Unlock()
+			delete(self.subs, id)
+			close(ch)
+		})
+	}
+	return ch, unsubscribe
+}
+
+// publish never blocks. The event is dropped for the
+// subscribers whose buffers are full.
+func (self *connEventHub) publish(evt ConnEvent) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, ch := range self.subs {
+		select {
+		case ch <- evt:
+		default:
+			atomic.AddInt64(&self.nrDropped, 1)
+		}
+	}
+}
+
+func (self *connEventHub) hasSubscribers() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.subs) > 0
+}
+
+func (self *connEventHub) dropped() int64 {
+	return atomic.LoadInt64(&self.nrDropped)
+}
+
+func (self *serviceCenter) publishConnEvent(typ ConnEventType, conn server.Conn) {
+	if !self.connEvents.hasSubscribers() {
+		return
+	}
+	evt := ConnEvent{
+		Type:     typ,
+		Service:  conn.Service(),
+		Username: conn.Username(),
+		ConnId:   self.connId(conn),
+		Time:     time.Now(),
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		evt.Addr = addr.String()
+	}
+	self.connEvents.publish(evt)
+}
+
+// Subscribe returns a channel receiving an event whenever a connection
+// is added to or removed from the service, and a function to stop
+// receiving them, which closes the channel. Events are dropped, rather
+// than slowing down the service, if the channel is not drained in time.
+func (self *serviceCenter) Subscribe() (<-chan ConnEvent, func()) {
+	return self.connEvents.subscribe()
+}
+
+// SubscribeConnEvents is like Subscribe of the service.
+func (self *MessageCenter) SubscribeConnEvents(service string) (<-chan ConnEvent, func(), error) {
+	center, err := self.getServiceCenter(service)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, unsubscribe := center.Subscribe()
+	return ch, unsubscribe, nil
+}
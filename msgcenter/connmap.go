@@ -22,36 +22,98 @@ import (
 	"github.com/petar/GoLLRB/llrb"
 )
 
-type minimalConn interface {
+// MinimalConn is what a ConnMap needs to know about a connection.
+// The connections stored by the service center are server.Conn.
+type MinimalConn interface {
 	Username() string
 	UniqId() string
 }
 
-type connMap interface {
-	AddConn(conn minimalConn, maxNrConnsPerUser int, maxNrUsers int) error
-	GetConn(username string) []minimalConn
-	DelConn(conn minimalConn) bool
+// ConnMap keeps the connections of a service, grouped by username.
+// It is only accessed by the goroutine processing the service's
+// events, so an implementation needs no locking by itself.
+type ConnMap interface {
+	// AddConn adds the connection. Adding a connection whose UniqId
+	// is already under the user is a no-op and returns nil. It
+	// returns ErrTooManyUsers if the user has no connection and the
+	// map already has maxNrUsers users, or ErrTooManyConnForThisUser
+	// if the user already has maxNrConnsPerUser connections. A
+	// non-positive limit means no limit. Both limits apply to the
+	// whole map, not to a shard of it.
+	AddConn(conn MinimalConn, maxNrConnsPerUser int, maxNrUsers int) error
+
+	// GetConn returns the connections under the user, or nil if there
+	// is none. The caller must not modify the returned slice.
+	GetConn(username string) []MinimalConn
+
+	// DelConn removes the connection with the same username and UniqId,
+	// and returns false if there is no such connection.
+	DelConn(conn MinimalConn) bool
+
+	AllConns() []MinimalConn
+
+	// Stats fills in the fields about the map. The others are
+	// filled by the service center.
+	Stats() *ConnMapStats
 }
 
-type connListItem struct {
-	name string
-	list []minimalConn
+// A ConnMapFactory creates the ConnMap of a service.
+type ConnMapFactory func() ConnMap
+
+// ConnMapStats contains statistics of the connections under a service.
+type ConnMapStats struct {
+	NrUsers int `json:"nrUsers"`
+	NrConns int `json:"nrConns"`
+
+	// The max number of connections under a single user.
+	MaxNrConnsPerUser int `json:"maxNrConnsPerUser"`
+
+	// Number of items in the underlying tree, if any.
+	TreeLen int `json:"treeLen"`
+
+	// Number of operations since the map was created.
+	NrAddConn int64 `json:"nrAddConn"`
+	NrDelConn int64 `json:"nrDelConn"`
+	NrGetConn int64 `json:"nrGetConn"`
+
+	// Number of goroutines still pushing notifications to offline
+	// users. It is filled by the service center, not the map.
+	NrPendingPushes int64 `json:"nrPendingPushes"`
+
+	// Number of notifications sent to the push service, and the number
+	// of them failed. Filled by the service center.
+	NrPushes     int64 `json:"nrPushes"`
+	NrPushErrors int64 `json:"nrPushErrors"`
+
+	// Total size of messages received from/sent to the clients,
+	// including the closed connections. Filled by the service center.
+	BytesReceived int64 `json:"bytesReceived"`
+	BytesSent     int64 `json:"bytesSent"`
+
+	// Number of events failed to be posted to the web hooks and
+	// waiting to be replayed. Filled by the service center.
+	NrDeadLetters int `json:"nrDeadLetters"`
+
+	// Number of connect/disconnect events dropped because
+	// the subscribers were too slow. Filled by the service center.
+	NrDroppedConnEvents int64 `json:"nrDroppedConnEvents"`
 }
 
-func (self *connListItem) key() string {
-	if len(self.list) == 0 {
-		return self.name
-	}
-	return connKey(self.list[0])
+// connListItem is the node of a user in the tree. It is keyed by the
+// username only, so that its position in the tree does not depend on
+// the connections in the list, which change as they come and go.
+type connListItem struct {
+	name string
+	list []MinimalConn
 }
 
 func (self *connListItem) Less(than llrb.Item) bool {
-	selfKey := llrb.String(self.key())
-	thanKey := llrb.String(than.(*connListItem).key())
+	selfKey := llrb.String(self.name)
+	thanKey := llrb.String(than.(*connListItem).name)
 	return selfKey.Less(thanKey)
 }
 
-func connKey(conn minimalConn) string {
+func connKey(conn MinimalConn) string {
 	return conn.Username()
 }
 
@@ -60,7 +122,7 @@ func getKey(a interface{}) string {
 	switch t := a.(type) {
 	case string:
 		return t
-	case []minimalConn:
+	case []MinimalConn:
 		if len(t) > 0 {
 			return connKey(t[0])
 		}
@@ -77,10 +139,19 @@ func lessConnList(a, b interface{}) bool {
 */
 
 type treeBasedConnMap struct {
-	tree *llrb.LLRB
+	tree      *llrb.LLRB
+	nrConns   int
+	nrAddConn int64
+	nrDelConn int64
+	nrGetConn int64
+}
+
+func (self *treeBasedConnMap) GetConn(user string) []MinimalConn {
+	self.nrGetConn++
+	return self.getConn(user)
 }
 
-func (self *treeBasedConnMap) GetConn(user string) []minimalConn {
+func (self *treeBasedConnMap) getConn(user string) []MinimalConn {
 	key := &connListItem{name: user, list: nil}
 	clif := self.tree.Get(key)
 	cl, ok := clif.(*connListItem)
@@ -93,17 +164,18 @@ func (self *treeBasedConnMap) GetConn(user string) []minimalConn {
 var ErrTooManyUsers = errors.New("too many users")
 var ErrTooManyConnForThisUser = errors.New("too many connections under this user")
 
-func (self *treeBasedConnMap) AddConn(conn minimalConn, maxNrConnsPerUser int, maxNrUsers int) error {
+func (self *treeBasedConnMap) AddConn(conn MinimalConn, maxNrConnsPerUser int, maxNrUsers int) error {
 	if conn == nil {
 		return nil
 	}
-	var cl []minimalConn
-	cl = self.GetConn(connKey(conn))
+	self.nrAddConn++
+	var cl []MinimalConn
+	cl = self.getConn(connKey(conn))
 	if cl == nil {
 		if maxNrUsers > 0 && self.tree.Len() >= maxNrUsers {
 			return ErrTooManyUsers
 		}
-		cl = make([]minimalConn, 0, 3)
+		cl = make([]MinimalConn, 0, 3)
 	}
 	if maxNrConnsPerUser > 0 && len(cl) >= maxNrConnsPerUser {
 		return ErrTooManyConnForThisUser
@@ -114,23 +186,25 @@ func (self *treeBasedConnMap) AddConn(conn minimalConn, maxNrConnsPerUser int, m
 		}
 	}
 	cl = append(cl, conn)
-	key := &connListItem{name: "", list: cl}
+	key := &connListItem{name: connKey(conn), list: cl}
 	self.tree.ReplaceOrInsert(key)
+	self.nrConns++
 	return nil
 }
 
-func (self *treeBasedConnMap) DelConn(conn minimalConn) bool {
+func (self *treeBasedConnMap) DelConn(conn MinimalConn) bool {
 	if conn == nil {
 		return false
 	}
-	cl := self.GetConn(connKey(conn))
+	self.nrDelConn++
+	cl := self.getConn(connKey(conn))
 	if cl == nil {
 		return false
 	}
 	i := -1
-	var c minimalConn
-	for i, c = range cl {
+	for j, c := range cl {
 		if c.UniqId() == conn.UniqId() {
+			i = j
 			break
 		}
 	}
@@ -143,6 +217,7 @@ func (self *treeBasedConnMap) DelConn(conn minimalConn) bool {
 		if c == nil {
 			return false
 		}
+		self.nrConns--
 		return true
 	}
 	cl[i] = cl[len(cl)-1]
@@ -153,10 +228,49 @@ func (self *treeBasedConnMap) DelConn(conn minimalConn) bool {
 	} else {
 		self.tree.ReplaceOrInsert(key)
 	}
+	self.nrConns--
 	return true
 }
 
-func newTreeBasedConnMap() connMap {
+func (self *treeBasedConnMap) Stats() *ConnMapStats {
+	ret := new(ConnMapStats)
+	ret.NrUsers = self.tree.Len()
+	ret.NrConns = self.nrConns
+	ret.TreeLen = self.tree.Len()
+	ret.NrAddConn = self.nrAddConn
+	ret.NrDelConn = self.nrDelConn
+	ret.NrGetConn = self.nrGetConn
+	if self.tree.Len() == 0 {
+		return ret
+	}
+	self.tree.AscendGreaterOrEqual(self.tree.Min(), func(i llrb.Item) bool {
+		if cl, ok := i.(*connListItem); ok {
+			if len(cl.list) > ret.MaxNrConnsPerUser {
+				ret.MaxNrConnsPerUser = len(cl.list)
+			}
+		}
+		return true
+	})
+	return ret
+}
+
+func (self *treeBasedConnMap) AllConns() []MinimalConn {
+	ret := make([]MinimalConn, 0, self.tree.Len())
+	if self.tree.Len() == 0 {
+		return ret
+	}
+	self.tree.AscendGreaterOrEqual(self.tree.Min(), func(i llrb.Item) bool {
+		if cl, ok := i.(*connListItem); ok {
+			ret = append(ret, cl.list...)
+		}
+		return true
+	})
+	return ret
+}
+
+// NewTreeBasedConnMap returns the default ConnMap,
+// which keeps the users in a red-black tree.
+func NewTreeBasedConnMap() ConnMap {
 	ret := new(treeBasedConnMap)
 	ret.tree = llrb.New()
 	return ret
@@ -19,6 +19,8 @@ package msgcenter
 
 import (
 	"fmt"
+	"github.com/petar/GoLLRB/llrb"
+	"math/rand"
 	"testing"
 )
 
@@ -39,7 +41,7 @@ type connGenerator struct {
 	nextId int
 }
 
-func (self *connGenerator) nextConn() minimalConn {
+func (self *connGenerator) nextConn() MinimalConn {
 	usr := fmt.Sprintf("user-%v", self.nextId)
 	self.nextId++
 	return &fakeConn{username: usr}
@@ -47,9 +49,9 @@ func (self *connGenerator) nextConn() minimalConn {
 
 func TestInsertConnMap(t *testing.T) {
 	N := 10
-	cmap := newTreeBasedConnMap()
+	cmap := NewTreeBasedConnMap()
 	g := new(connGenerator)
-	conns := make([]minimalConn, N)
+	conns := make([]MinimalConn, N)
 	for i, _ := range conns {
 		c := g.nextConn()
 		err := cmap.AddConn(c, 0, 0)
@@ -73,9 +75,9 @@ func TestInsertConnMap(t *testing.T) {
 func TestInsertDupConnMap(t *testing.T) {
 	N := 10
 	M := 2
-	cmap := newTreeBasedConnMap()
+	cmap := NewTreeBasedConnMap()
 	g := new(connGenerator)
-	conns := make([]minimalConn, N)
+	conns := make([]MinimalConn, N)
 	for i, _ := range conns {
 		c := g.nextConn()
 
@@ -105,9 +107,9 @@ func TestInsertDupConnMap(t *testing.T) {
 
 func TestDeleteConnMap(t *testing.T) {
 	N := 10
-	cmap := newTreeBasedConnMap()
+	cmap := NewTreeBasedConnMap()
 	g := new(connGenerator)
-	conns := make([]minimalConn, N)
+	conns := make([]MinimalConn, N)
 	users := make([]string, N)
 	for i, _ := range conns {
 		c := g.nextConn()
@@ -145,9 +147,9 @@ func TestDeleteConnMap(t *testing.T) {
 func TestDeleteDupConnMap(t *testing.T) {
 	N := 10
 	M := 2
-	cmap := newTreeBasedConnMap()
+	cmap := NewTreeBasedConnMap()
 	g := new(connGenerator)
-	conns := make([]minimalConn, N)
+	conns := make([]MinimalConn, N)
 	for i, _ := range conns {
 		c := g.nextConn()
 
@@ -183,3 +185,154 @@ func TestDeleteDupConnMap(t *testing.T) {
 		}
 	}
 }
+
+func TestAllConnsConnMap(t *testing.T) {
+	N := 10
+	M := 2
+	cmap := NewTreeBasedConnMap()
+	if len(cmap.AllConns()) != 0 {
+		t.Errorf("empty map should have no connection")
+	}
+	g := new(connGenerator)
+	for i := 0; i < N; i++ {
+		c := g.nextConn()
+		for j := 0; j < M; j++ {
+			fc := &fakeConn{username: c.Username(), n: j}
+			err := cmap.AddConn(fc, 0, 0)
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+		}
+	}
+	conns := cmap.AllConns()
+	if len(conns) != N*M {
+		t.Errorf("should have %v connections: nr conns=%v", N*M, len(conns))
+	}
+	seen := make(map[string]bool, N*M)
+	for _, c := range conns {
+		if seen[c.UniqId()] {
+			t.Errorf("duplicated connection %v", c.UniqId())
+		}
+		seen[c.UniqId()] = true
+	}
+}
+
+func TestConnMapStats(t *testing.T) {
+	N := 10
+	M := 3
+	cmap := NewTreeBasedConnMap()
+	g := new(connGenerator)
+	for i := 0; i < N; i++ {
+		c := g.nextConn()
+		// user-i has i%M+1 connections
+		for j := 0; j <= i%M; j++ {
+			fc := &fakeConn{username: c.Username(), n: j}
+			cmap.AddConn(fc, 0, 0)
+		}
+	}
+	stats := cmap.Stats()
+	if stats.NrUsers != N || stats.TreeLen != N {
+		t.Errorf("should have %v users: %v", N, stats.NrUsers)
+	}
+	if stats.MaxNrConnsPerUser != M {
+		t.Errorf("max nr conns per user should be %v: %v", M, stats.MaxNrConnsPerUser)
+	}
+	nrConns := stats.NrConns
+	if nrConns != int(stats.NrAddConn) {
+		t.Errorf("nr conns %v != nr adds %v", nrConns, stats.NrAddConn)
+	}
+	cmap.DelConn(&fakeConn{username: "user-0", n: 0})
+	stats = cmap.Stats()
+	if stats.NrConns != nrConns-1 || stats.NrUsers != N-1 || stats.NrDelConn != 1 {
+		t.Errorf("bad stats after deletion: %+v", stats)
+	}
+}
+
+// countingConnMap counts the connections added through it.
+type countingConnMap struct {
+	ConnMap
+	nrAdded int
+}
+
+func (self *countingConnMap) AddConn(conn MinimalConn, maxNrConnsPerUser int, maxNrUsers int) error {
+	self.nrAdded++
+	return self.ConnMap.AddConn(conn, maxNrConnsPerUser, maxNrUsers)
+}
+
+func TestConnMapFactory(t *testing.T) {
+	cmap := &countingConnMap{ConnMap: NewTreeBasedConnMap()}
+	conf := &ServiceConfig{NewConnMap: func() ConnMap { return cmap }}
+	center := newServiceCenter("service", conf, nil, nil)
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: &aliceConn{}, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(center.UserConns("alice")) != 1 {
+		t.Errorf("alice should be connected")
+	}
+	if cmap.nrAdded != 1 {
+		t.Errorf("the map from the factory should be used")
+	}
+}
+
+func TestConnMapOrder(t *testing.T) {
+	N := 50
+	M := 4
+	cmap := NewTreeBasedConnMap().(*treeBasedConnMap)
+	r := rand.New(rand.NewSource(1))
+	// username -> n -> whether the connection is in the map
+	expected := make(map[string]map[int]bool, N)
+	for i := 0; i < 5000; i++ {
+		u := fmt.Sprintf("user-%v", r.Intn(N))
+		n := r.Intn(M)
+		if expected[u] == nil {
+			expected[u] = make(map[int]bool, M)
+		}
+		c := &fakeConn{username: u, n: n}
+		if r.Intn(2) == 0 {
+			if err := cmap.AddConn(c, 0, 0); err != nil {
+				t.Fatal(err)
+			}
+			expected[u][n] = true
+		} else {
+			deleted := cmap.DelConn(c)
+			if deleted != expected[u][n] {
+				t.Fatalf("DelConn(%v) returned %v", c.UniqId(), deleted)
+			}
+			delete(expected[u], n)
+		}
+
+		for user, ns := range expected {
+			cs := cmap.GetConn(user)
+			if len(cs) != len(ns) {
+				t.Fatalf("user %v should have %v connections: %v", user, len(ns), len(cs))
+			}
+			for _, conn := range cs {
+				if !ns[conn.(*fakeConn).n] || conn.Username() != user {
+					t.Fatalf("user %v should not have %v", user, conn.UniqId())
+				}
+			}
+		}
+		last := ""
+		nrUsers := 0
+		cmap.tree.AscendRange(&connListItem{name: "user-"}, &connListItem{name: "user."}, func(i llrb.Item) bool {
+			cl := i.(*connListItem)
+			if cl.name <= last {
+				t.Fatalf("%v is after %v", cl.name, last)
+			}
+			for _, conn := range cl.list {
+				if conn.Username() != cl.name {
+					t.Fatalf("%v is under %v", conn.UniqId(), cl.name)
+				}
+			}
+			last = cl.name
+			nrUsers++
+			return true
+		})
+		if nrUsers != cmap.Stats().NrUsers {
+			t.Fatalf("iterated %v users out of %v", nrUsers, cmap.Stats().NrUsers)
+		}
+	}
+}
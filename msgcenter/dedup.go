@@ -0,0 +1,117 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"sync"
+	"time"
+)
+
+// Remember at most this many ids sent to each connection.
+const maxNrSentIds = 1024
+
+type sentId struct {
+	id     string
+	sentAt time.Time
+}
+
+// dedupConn does not write a message to the connection if a message
+// with the same id was written to it within the window.
+type dedupConn struct {
+	server.Conn
+	window time.Duration
+
+	// Held while writing, so that the same message
+	// written at the same time is only written once.
+	lock   sync.Mutex
+	sentAt map[string]time.Time
+	// Ids in the order they were sent.
+	sent []sentId
+}
+
+func newDedupConn(conn server.Conn, window time.Duration) *dedupConn {
+	ret := new(dedupConn)
+	ret.Conn = conn
+	ret.window = window
+	ret.sentAt = make(map[string]time.Time, 16)
+	return ret
+}
+
+// outboundId returns the id identifying the message when it is sent,
+// or an empty string if the message does not have one.
+func outboundId(msg *proto.Message) string {
+	if len(msg.Id) > 0 {
+		return msg.Id
+	}
+	return msg.Header[ClientMsgIdHeader]
+}
+
+// forget removes the ids sent before the window,
+// and the oldest ones beyond maxNrSentIds.
+func (self *dedupConn) forget(now time.Time) {
+	n := 0
+	for _, s := range self.sent {
+		if now.Sub(s.sentAt) <= self.window && len(self.sent)-n <= maxNrSentIds {
+			break
+		}
+		if self.sentAt[s.id] == s.sentAt {
+			delete(self.sentAt, s.id)
+		}
+		n++
+	}
+	self.sent = self.sent[n:]
+}
+
+// SendMessage writes the message unless it was written recently,
+// in which case it returns no error as the client has it already.
+func (self *dedupConn) SendMessage(msg *proto.Message, extra map[string]string, ttl time.Duration) (id string, err error) {
+	return self.send(msg, func() (string, error) {
+		return self.Conn.SendMessage(msg, extra, ttl)
+	})
+}
+
+// SendRawMessage is like SendMessage. The message is identified by msg.
+func (self *dedupConn) SendRawMessage(raw []byte, msg *proto.Message, extra map[string]string, ttl time.Duration) (id string, err error) {
+	return self.send(msg, func() (string, error) {
+		return self.Conn.SendRawMessage(raw, msg, extra, ttl)
+	})
+}
+
+// send calls write unless the message was written recently.
+func (self *dedupConn) send(msg *proto.Message, write func() (string, error)) (id string, err error) {
+	msgId := outboundId(msg)
+	if len(msgId) == 0 {
+		return write()
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	self.forget(now)
+	if _, ok := self.sentAt[msgId]; ok {
+		return
+	}
+	id, err = write()
+	if err != nil {
+		return
+	}
+	self.sentAt[msgId] = now
+	self.sent = append(self.sent, sentId{id: msgId, sentAt: now})
+	return
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"sync"
+)
+
+// serviceState is the part of a service kept by the goroutine
+// processing it.
+type serviceState struct {
+	connMap ConnMap
+	nrConns int
+
+	// Senders waiting for the users to come online.
+	waiters map[string][]chan bool
+
+	// Traffic of the closed connections.
+	closedBytesReceived int64
+	closedBytesSent     int64
+
+	// The users each connection watches the presence of,
+	// and the connections watching each user.
+	watching map[server.Conn]map[string]bool
+	watchers map[string]map[server.Conn]bool
+
+	// Writers of the presence to each watching connection.
+	presence map[server.Conn]*presenceWriter
+}
+
+func newServiceState(connMap ConnMap) *serviceState {
+	ret := new(serviceState)
+	ret.connMap = connMap
+	ret.waiters = make(map[string][]chan bool, 16)
+	ret.watching = make(map[server.Conn]map[string]bool)
+	ret.watchers = make(map[string]map[server.Conn]bool)
+	ret.presence = make(map[server.Conn]*presenceWriter)
+	return ret
+}
+
+// serviceGroup is a set of services processed by one goroutine. They
+// share the ServiceConfig, but each of them keeps its own connections,
+// limits and statistics.
+type serviceGroup struct {
+	lock    sync.RWMutex
+	members map[string]*serviceCenter
+}
+
+func newServiceGroup(center *serviceCenter) *serviceGroup {
+	ret := new(serviceGroup)
+	ret.members = map[string]*serviceCenter{center.serviceName: center}
+	return ret
+}
+
+// member returns the center of the service if it is in the group of
+// self, or self otherwise.
+func (self *serviceCenter) member(service string) *serviceCenter {
+	self.group.lock.RLock()
+	defer self.group.lock.RUnlock()
+	if center, ok := self.group.members[service]; ok {
+		return center
+	}
+	return self
+}
+
+// join returns a center of the service which is processed by the
+// goroutine of self, with the same config.
+func (self *serviceCenter) join(serviceName string) *serviceCenter {
+	ret := new(serviceCenter)
+	ret.init(serviceName, self.config, self.auth, self.fwdChan)
+
+	ret.connIn = self.connIn
+	ret.connLeave = self.connLeave
+	ret.writeReqChan = self.writeReqChan
+	ret.subReqChan = self.subReqChan
+	ret.connListChan = self.connListChan
+	ret.drainChan = self.drainChan
+	ret.statsChan = self.statsChan
+	ret.bcastChan = self.bcastChan
+	ret.cancelWaitChan = self.cancelWaitChan
+	ret.detailsChan = self.detailsChan
+	ret.watchReqChan = self.watchReqChan
+
+	ret.group = self.group
+	self.group.lock.Lock()
+	defer self.group.lock.Unlock()
+	self.group.members[serviceName] = ret
+	return ret
+}
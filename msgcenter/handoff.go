@@ -0,0 +1,161 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ConnDescriptor describes a connection served by a message center.
+//
+// During a handoff, the old instance exports the descriptors of all
+// its connections (as a JSON array) and the new instance imports
+// them before the old instance drains its connections. The clients
+// are then expected to reconnect to the new instance.
+type ConnDescriptor struct {
+	Service  string `json:"service"`
+	Username string `json:"username"`
+	ConnId   string `json:"connId"`
+	Addr     string `json:"addr,omitempty"`
+	Visible  bool   `json:"visible"`
+
+	BytesReceived int64 `json:"bytesReceived"`
+	BytesSent     int64 `json:"bytesSent"`
+}
+
+func expectedKey(service, username string) string {
+	return fmt.Sprintf("%v:%v", service, username)
+}
+
+func (self *MessageCenter) allServiceCenters() []*serviceCenter {
+	self.srvCentersLock.Lock()
+	defer self.srvCentersLock.Unlock()
+	ret := make([]*serviceCenter, 0, len(self.serviceCenterMap))
+	for _, center := range self.serviceCenterMap {
+		ret = append(ret, center)
+	}
+	return ret
+}
+
+// AllConns returns the descriptors of all connections.
+func (self *MessageCenter) AllConns() []*ConnDescriptor {
+	ret := make([]*ConnDescriptor, 0, 1024)
+	for _, center := range self.allServiceCenters() {
+		for _, conn := range center.AllConns() {
+			d := new(ConnDescriptor)
+			d.Service = conn.Service()
+			d.Username = conn.Username()
+			d.ConnId = center.connId(conn)
+			if addr := conn.RemoteAddr(); addr != nil {
+				d.Addr = addr.String()
+			}
+			d.Visible = conn.Visible()
+			d.BytesReceived = conn.BytesReceived()
+			d.BytesSent = conn.BytesSent()
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+// ExportConns writes the descriptors of all connections into w.
+func (self *MessageCenter) ExportConns(w io.Writer) error {
+	return json.NewEncoder(w).Encode(self.AllConns())
+}
+
+// ImportExpectedConns reads the descriptors written by ExportConns
+// and expects the connections to come back. The service centers
+// of the imported services are created immediately.
+func (self *MessageCenter) ImportExpectedConns(r io.Reader) error {
+	var descs []*ConnDescriptor
+	err := json.NewDecoder(r).Decode(&descs)
+	if err != nil {
+		return err
+	}
+	for _, d := range descs {
+		if d == nil {
+			continue
+		}
+		_, err = self.getServiceCenter(d.Service)
+		if err != nil {
+			return fmt.Errorf("[Service=%v] %v", d.Service, err)
+		}
+	}
+	self.expectedLock.Lock()
+	defer self.expectedLock.Unlock()
+	for _, d := range descs {
+		if d == nil {
+			continue
+		}
+		self.expectedConns[expectedKey(d.Service, d.Username)]++
+	}
+	return nil
+}
+
+func (self *MessageCenter) connArrived(service, username string) {
+	self.expectedLock.Lock()
+	defer self.expectedLock.Unlock()
+	key := expectedKey(service, username)
+	if n, ok := self.expectedConns[key]; ok {
+		if n <= 1 {
+			delete(self.expectedConns, key)
+		} else {
+			self.expectedConns[key] = n - 1
+		}
+	}
+}
+
+// NrExpectedConns returns the number of imported connections
+// which have not come back yet.
+func (self *MessageCenter) NrExpectedConns() int {
+	self.expectedLock.Lock()
+	defer self.expectedLock.Unlock()
+	n := 0
+	for _, c := range self.expectedConns {
+		n += c
+	}
+	return n
+}
+
+// DrainUser closes all connections under the user.
+func (self *MessageCenter) DrainUser(service, username string) int {
+	self.srvCentersLock.Lock()
+	center, ok := self.serviceCenterMap[service]
+	self.srvCentersLock.Unlock()
+	if !ok {
+		return 0
+	}
+	return center.DrainUser(username)
+}
+
+// Drain closes all connections and returns the number of connections closed.
+func (self *MessageCenter) Drain() int {
+	n := 0
+	for _, center := range self.allServiceCenters() {
+		users := make(map[string]bool, 128)
+		for _, conn := range center.AllConns() {
+			users[conn.Username()] = true
+		}
+		for usr, _ := range users {
+			n += center.DrainUser(usr)
+		}
+	}
+	return n
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var ErrTooManyHandshakes = errors.New("too many concurrent handshakes")
+var ErrTooManyPendingConns = errors.New("too many connections pending handshake")
+
+// AcceptFilter decides whether a connection coming from remoteAddr
+// is accepted, before the handshake and the Authenticator. The service
+// is not known until the handshake, so service is the only service
+// allowed on the listener, or empty if the listener serves several.
+// If the connection is rejected, reason tells why.
+type AcceptFilter func(remoteAddr net.Addr, service string) (accept bool, reason string)
+
+// SetAcceptFilter sets the filter applied to every connection right
+// after it is accepted, e.g. to drop connections from blocked
+// addresses or during maintenance without going through the auth web
+// hook. Rejected connections are closed and reported with the reason.
+// The filter is called by the accepting goroutines, so it should be
+// fast. nil, the default, accepts all connections. It should be called
+// before Start.
+func (self *MessageCenter) SetAcceptFilter(filter AcceptFilter) {
+	self.acceptFilter = filter
+}
+
+// filterConn returns a non-nil error if the connection is rejected
+// by the accept filter.
+func (self *MessageCenter) filterConn(c net.Conn, l *listener) error {
+	if self.acceptFilter == nil {
+		return nil
+	}
+	service := ""
+	if len(l.services) == 1 {
+		for srv := range l.services {
+			service = srv
+		}
+	}
+	if ok, reason := self.acceptFilter(c.RemoteAddr(), service); !ok {
+		return fmt.Errorf("connection rejected: %v", reason)
+	}
+	return nil
+}
+
+// handshakeTimeout returns the HandshakeTimeout of the service, or
+// zero if it is not set. It does not add the service.
+func (self *MessageCenter) handshakeTimeout(srv string) time.Duration {
+	self.srvCentersLock.Lock()
+	center, ok := self.serviceCenterMap[srv]
+	self.srvCentersLock.Unlock()
+	var config *ServiceConfig
+	if ok {
+		config = center.config
+	} else if self.srvConfReader != nil {
+		config = self.srvConfReader.ReadConfig(srv)
+	}
+	if config == nil {
+		return 0
+	}
+	return config.HandshakeTimeout
+}
+
+// deadlineAuth moves the deadline of the handshake of conn to the
+// HandshakeTimeout of the service, if it is set, before the client
+// is authenticated.
+type deadlineAuth struct {
+	server.Authenticator
+	center *MessageCenter
+	conn   net.Conn
+	start  time.Time
+}
+
+func (self *deadlineAuth) Authenticate(srv, usr, token, addr string, labels map[string]string) (bool, error) {
+	if timeout := self.center.handshakeTimeout(srv); timeout > 0 {
+		self.conn.SetDeadline(self.start.Add(timeout))
+	}
+	return self.Authenticator.Authenticate(srv, usr, token, addr, labels)
+}
+
+// SetMaxConcurrentHandshakes limits the number of connections going
+// through the handshake, including the call to the Authenticator, so
+// that a reconnect storm does not overwhelm the auth web hook. Beyond
+// the limit, connections wait for a free slot up to the handshake
+// timeout, then are closed and reported with ErrTooManyHandshakes.
+// Zero means no limit. It should be called before Start.
+func (self *MessageCenter) SetMaxConcurrentHandshakes(n int) {
+	if n <= 0 {
+		self.handshakeSlots = nil
+		return
+	}
+	self.handshakeSlots = make(chan bool, n)
+}
+
+// acquireHandshake returns false if no slot becomes free within
+// the handshake timeout.
+func (self *MessageCenter) acquireHandshake() bool {
+	if self.handshakeSlots == nil {
+		return true
+	}
+	select {
+	case self.handshakeSlots <- true:
+		return true
+	default:
+	}
+	timer := time.NewTimer(self.authtimeout)
+	defer timer.Stop()
+	select {
+	case self.handshakeSlots <- true:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (self *MessageCenter) releaseHandshake() {
+	if self.handshakeSlots != nil {
+		<-self.handshakeSlots
+	}
+}
+
+// SetMaxPendingConns limits the number of accepted connections which
+// have not finished the handshake, including those waiting for a
+// handshake slot. Beyond the limit, new connections are closed right
+// after they are accepted and reported with ErrTooManyPendingConns.
+// Unlike the limits of services, it counts connections before they
+// are authenticated. Zero means no limit. It should be called before
+// Start.
+func (self *MessageCenter) SetMaxPendingConns(n int) {
+	if n < 0 {
+		n = 0
+	}
+	self.maxPendingConns = int64(n)
+}
+
+// admitPending counts an accepted connection as pending, unless
+// there are too many pending connections already.
+func (self *MessageCenter) admitPending() bool {
+	if self.maxPendingConns <= 0 {
+		return true
+	}
+	if atomic.AddInt64(&self.nrPendingConns, 1) > self.maxPendingConns {
+		atomic.AddInt64(&self.nrPendingConns, -1)
+		return false
+	}
+	return true
+}
+
+func (self *MessageCenter) releasePending() {
+	if self.maxPendingConns > 0 {
+		atomic.AddInt64(&self.nrPendingConns, -1)
+	}
+}
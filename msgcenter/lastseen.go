@@ -0,0 +1,79 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"sync"
+	"time"
+)
+
+// Entries older than this are removed from time to time,
+// so windows longer than this are not supported.
+const maxLastSeenAge = 24 * time.Hour
+
+// Sweep the stale entries once every lastSeenSweepInterval updates.
+const lastSeenSweepInterval = 1024
+
+// lastSeenMap records the last time each user was active.
+type lastSeenMap struct {
+	lock      sync.Mutex
+	lastSeen  map[string]time.Time
+	nrUpdates int
+}
+
+func newLastSeenMap() *lastSeenMap {
+	ret := new(lastSeenMap)
+	ret.lastSeen = make(map[string]time.Time, 1024)
+	return ret
+}
+
+func (self *lastSeenMap) sweep(now time.Time) {
+	for username, t := range self.lastSeen {
+		if now.Sub(t) > maxLastSeenAge {
+			delete(self.lastSeen, username)
+		}
+	}
+}
+
+func (self *lastSeenMap) update(username string, now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lastSeen[username] = now
+	self.nrUpdates++
+	if self.nrUpdates%lastSeenSweepInterval == 0 {
+		self.sweep(now)
+	}
+}
+
+func (self *lastSeenMap) get(username string) (t time.Time, ok bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	t, ok = self.lastSeen[username]
+	return
+}
+
+// activeWithin tells if the user was active within the window before now.
+func (self *lastSeenMap) activeWithin(username string, window time.Duration, now time.Time) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	t, ok := self.lastSeen[username]
+	if !ok {
+		return false
+	}
+	return now.Sub(t) <= window
+}
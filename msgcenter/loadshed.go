@@ -0,0 +1,62 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var ErrLoadShed = errors.New("server is under pressure; low priority service is not accepting connections")
+
+// A LoadShedder reports whether the server is under pressure. While it
+// returns true, new connections to low priority services are rejected.
+type LoadShedder func() bool
+
+// How often MemoryLoadShedder reads the memory statistics,
+// which stops the world.
+const memStatsInterval = time.Second
+
+// MemoryLoadShedder returns a LoadShedder which reports pressure once
+// the memory obtained from the OS, excluding what has been released
+// back, reaches limit bytes.
+func MemoryLoadShedder(limit uint64) LoadShedder {
+	var lock sync.Mutex
+	var lastRead time.Time
+	var inUse uint64
+	return func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		if time.Since(lastRead) >= memStatsInterval {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			inUse = stats.Sys - stats.HeapReleased
+			lastRead = time.Now()
+		}
+		return inUse >= limit
+	}
+}
+
+// SetLoadShedder sets the LoadShedder consulted by the services
+// whose config has LowPriority set. It should be called before
+// any service is added.
+func (self *MessageCenter) SetLoadShedder(shed LoadShedder) {
+	self.shed = shed
+}
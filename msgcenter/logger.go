@@ -0,0 +1,81 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nu7hatch/gouuid"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Logger receives structured log entries. Each entry is an event name
+// with a set of fields. Entries about the same message share the same
+// "trace" field, so that a message can be followed across stages.
+type Logger interface {
+	Log(event string, fields map[string]string)
+}
+
+type textLogger struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewTextLogger returns a logger which writes one line per entry:
+// the time, the event name and the fields as key=value pairs sorted
+// by the key.
+func NewTextLogger(w io.Writer) Logger {
+	ret := new(textLogger)
+	ret.w = w
+	return ret
+}
+
+func (self *textLogger) Log(event string, fields map[string]string) {
+	keys := make([]string, 0, len(fields))
+	for k, _ := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v %v", time.Now().Format(time.RFC3339), event)
+	for _, k := range keys {
+		fmt.Fprintf(&buf, " %v=%q", k, fields[k])
+	}
+	buf.WriteByte('\n')
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.w.Write(buf.Bytes())
+}
+
+// traceId returns the id used to correlate the log entries of a message.
+func traceId(msg *proto.Message) string {
+	if msg != nil && len(msg.Id) > 0 {
+		return msg.Id
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return fmt.Sprintf("%v", time.Now().UnixNano())
+	}
+	return id.String()
+}
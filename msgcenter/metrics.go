@@ -0,0 +1,93 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type metric struct {
+	name  string
+	typ   string
+	help  string
+	value func(stats *ConnMapStats) int64
+}
+
+var metrics = []*metric{
+	{"uniqush_conn_connections", "gauge", "Number of connections.",
+		func(s *ConnMapStats) int64 { return int64(s.NrConns) }},
+	{"uniqush_conn_users", "gauge", "Number of users with at least one connection.",
+		func(s *ConnMapStats) int64 { return int64(s.NrUsers) }},
+	{"uniqush_conn_max_connections_per_user", "gauge", "Max number of connections under a single user.",
+		func(s *ConnMapStats) int64 { return int64(s.MaxNrConnsPerUser) }},
+	{"uniqush_conn_connections_added_total", "counter", "Number of connections added.",
+		func(s *ConnMapStats) int64 { return s.NrAddConn }},
+	{"uniqush_conn_connections_removed_total", "counter", "Number of connections removed.",
+		func(s *ConnMapStats) int64 { return s.NrDelConn }},
+	{"uniqush_conn_pending_pushes", "gauge", "Number of notifications being pushed.",
+		func(s *ConnMapStats) int64 { return s.NrPendingPushes }},
+	{"uniqush_conn_pushes_total", "counter", "Number of notifications sent to the push service.",
+		func(s *ConnMapStats) int64 { return s.NrPushes }},
+	{"uniqush_conn_push_errors_total", "counter", "Number of notifications failed to push.",
+		func(s *ConnMapStats) int64 { return s.NrPushErrors }},
+	{"uniqush_conn_received_bytes_total", "counter", "Total size of messages received from clients.",
+		func(s *ConnMapStats) int64 { return s.BytesReceived }},
+	{"uniqush_conn_sent_bytes_total", "counter", "Total size of messages sent to clients.",
+		func(s *ConnMapStats) int64 { return s.BytesSent }},
+	{"uniqush_conn_dead_letters", "gauge", "Number of web hook events waiting to be replayed.",
+		func(s *ConnMapStats) int64 { return int64(s.NrDeadLetters) }},
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteMetrics writes the statistics of all services
+// in the Prometheus text exposition format.
+func WriteMetrics(w *bufio.Writer, stats map[string]*ConnMapStats) error {
+	services := make([]string, 0, len(stats))
+	for srv := range stats {
+		services = append(services, srv)
+	}
+	sort.Strings(services)
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %v %v\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %v %v\n", m.name, m.typ)
+		for _, srv := range services {
+			fmt.Fprintf(w, "%v{service=\"%v\"} %v\n", m.name, labelEscaper.Replace(srv), m.value(stats[srv]))
+		}
+	}
+	return w.Flush()
+}
+
+type metricsHandler struct {
+	center *MessageCenter
+}
+
+// MetricsHandler serves the statistics of all services
+// in the Prometheus text exposition format.
+func (self *MessageCenter) MetricsHandler() http.Handler {
+	return &metricsHandler{center: self}
+}
+
+func (self *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteMetrics(bufio.NewWriter(w), self.center.Stats())
+}
@@ -19,9 +19,11 @@ package msgcenter
 
 import (
 	"crypto/rsa"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/uniqush/uniqush-conn/evthandler"
+	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/server"
 	"net"
@@ -36,17 +38,114 @@ type ServiceConfigReader interface {
 	ReadConfig(srv string) *ServiceConfig
 }
 
+type listener struct {
+	ln          net.Listener
+	nrAcceptors int
+
+	// Services allowed to connect through this listener.
+	// nil means all services.
+	services map[string]bool
+}
+
 type MessageCenter struct {
+	// Number of accepted connections which have not finished
+	// the handshake. Only counted if maxPendingConns is positive.
+	nrPendingConns  int64
+	maxPendingConns int64
+
+	// Set once Shutdown is called.
+	closing int32
+
 	srvCentersLock   sync.Mutex
 	serviceCenterMap map[string]*serviceCenter
 
-	ln            net.Listener
+	listeners     []*listener
 	auth          server.Authenticator
 	authtimeout   time.Duration
 	fwdChan       chan *server.ForwardRequest
 	privkey       *rsa.PrivateKey
 	errHandler    evthandler.ErrorHandler
 	srvConfReader ServiceConfigReader
+
+	expectedLock  sync.Mutex
+	expectedConns map[string]int
+
+	serviceByHost map[string]string
+	nodeId        string
+	region        string
+	shed          LoadShedder
+
+	// If not nil, services reading the same ServiceConfig
+	// are processed by the same goroutine.
+	groups map[*ServiceConfig]*serviceCenter
+
+	// Each connection in the handshake takes a slot.
+	// nil means no limit.
+	handshakeSlots chan bool
+
+	// nil means all connections are accepted.
+	acceptFilter AcceptFilter
+}
+
+func namespacedConnId(nodeId, connId string) string {
+	if len(nodeId) == 0 {
+		return connId
+	}
+	return fmt.Sprintf("%v:%v", nodeId, connId)
+}
+
+// SetNodeId sets the id of this node. If it is not empty, the ids of the
+// connections in events, results and descriptors become "nodeId:connId",
+// so that connections on different nodes can be told apart. It should
+// be called before any service is added.
+func (self *MessageCenter) SetNodeId(nodeId string) {
+	self.nodeId = nodeId
+}
+
+// SetRegion sets the region where this node runs, which is reported
+// in the details of each connection. It should be called before any
+// service is added.
+func (self *MessageCenter) SetRegion(region string) {
+	self.region = region
+}
+
+// SetGroupServices decides whether services reading the same
+// *ServiceConfig, e.g. those using the default config, share one
+// goroutine instead of having one each. Each service still keeps its
+// own connections and limits. It should be called before any service
+// is added.
+func (self *MessageCenter) SetGroupServices(group bool) {
+	if group {
+		self.groups = make(map[*ServiceConfig]*serviceCenter)
+	} else {
+		self.groups = nil
+	}
+}
+
+// newServiceCenter creates the center of the service. The caller
+// should hold srvCentersLock.
+func (self *MessageCenter) newServiceCenter(srv string, config *ServiceConfig) *serviceCenter {
+	if self.groups == nil {
+		return newServiceCenter(srv, config, self.auth, self.fwdChan)
+	}
+	if owner, ok := self.groups[config]; ok {
+		return owner.join(srv)
+	}
+	center := newServiceCenter(srv, config, self.auth, self.fwdChan)
+	self.groups[config] = center
+	return center
+}
+
+// addCenterLocked creates the center of the service with the settings
+// of the message center and adds it. The caller should hold
+// srvCentersLock.
+func (self *MessageCenter) addCenterLocked(srv string, config *ServiceConfig) *serviceCenter {
+	center := self.newServiceCenter(srv, config)
+	center.nodeId = self.nodeId
+	center.region = self.region
+	center.shed = self.shed
+	self.serviceCenterMap[srv] = center
+	return center
 }
 
 func (self *MessageCenter) reportError(service, username, connId, addr string, err error) {
@@ -64,6 +163,9 @@ func (self *MessageCenter) process() {
 			center, ok := self.serviceCenterMap[srv]
 			self.srvCentersLock.Unlock()
 			if !ok {
+				if fwdreq.Reply != nil {
+					fwdreq.Reply(false, 0)
+				}
 				continue
 			}
 			center.ReceiveForward(fwdreq)
@@ -74,18 +176,50 @@ func (self *MessageCenter) process() {
 func (self *MessageCenter) AddService(srv string) *serviceCenter {
 	self.srvCentersLock.Lock()
 	defer self.srvCentersLock.Unlock()
-	config := self.srvConfReader.ReadConfig(srv)
+	var config *ServiceConfig
+	if self.srvConfReader != nil {
+		config = self.srvConfReader.ReadConfig(srv)
+	}
 	if config == nil {
 		self.reportError(srv, "", "", "", fmt.Errorf("cannot find service's config"))
 		return nil
 	}
-	center := newServiceCenter(srv, config, self.fwdChan)
-	self.serviceCenterMap[srv] = center
-	return center
+	return self.addCenterLocked(srv, config)
 }
 
-func (self *MessageCenter) serveConn(c net.Conn) {
-	conn, err := server.AuthConn(c, self.privkey, self.auth, self.authtimeout)
+// RegisterService adds the service with the config, which is validated
+// first, regardless of the ServiceConfigReader. It may be called while
+// the center is running.
+func (self *MessageCenter) RegisterService(srv string, config *ServiceConfig) error {
+	if len(srv) == 0 || strings.Contains(srv, ":") || strings.Contains(srv, "\n") {
+		return fmt.Errorf("bad service name: %q", srv)
+	}
+	if config == nil {
+		return fmt.Errorf("[service=%v] no config", srv)
+	}
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("[service=%v] %v", srv, err)
+	}
+	self.srvCentersLock.Lock()
+	defer self.srvCentersLock.Unlock()
+	if _, ok := self.serviceCenterMap[srv]; ok {
+		return ErrServiceExists
+	}
+	self.addCenterLocked(srv, config)
+	return nil
+}
+
+func (self *MessageCenter) serveConn(c net.Conn, services map[string]bool) {
+	if !self.acquireHandshake() {
+		self.releasePending()
+		self.reportError("", "", "", c.RemoteAddr().String(), ErrTooManyHandshakes)
+		c.Close()
+		return
+	}
+	auth := &deadlineAuth{Authenticator: self.auth, center: self, conn: c, start: time.Now()}
+	conn, err := server.AuthConn(c, self.privkey, auth, self.authtimeout)
+	self.releaseHandshake()
+	self.releasePending()
 	if err != nil {
 		self.reportError("", "", "", c.RemoteAddr().String(), err)
 		c.Close()
@@ -96,54 +230,388 @@ func (self *MessageCenter) serveConn(c net.Conn) {
 		self.reportError(srv, "", "", c.RemoteAddr().String(), fmt.Errorf("bad service name"))
 		return
 	}
+	if services != nil && !services[srv] {
+		self.reportError(srv, conn.Username(), "", c.RemoteAddr().String(), fmt.Errorf("service %v is not allowed on %v", srv, c.LocalAddr()))
+		conn.Close()
+		return
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		host := strings.ToLower(tc.ConnectionState().ServerName)
+		if hostSrv, ok := self.serviceByHost[host]; ok && hostSrv != srv {
+			self.reportError(srv, conn.Username(), "", c.RemoteAddr().String(), fmt.Errorf("service %v is not served under host %v", srv, host))
+			conn.Close()
+			return
+		}
+	}
+
+	center, err := self.getServiceCenter(srv)
+	if err != nil {
+		self.reportError(srv, "", "", c.RemoteAddr().String(), err)
+		return
+	}
 
+	err = center.NewConn(conn)
+	if err != nil {
+		self.reportError(srv, conn.Username(), "", c.RemoteAddr().String(), err)
+		return
+	}
+	self.connArrived(srv, conn.Username())
+}
+
+// getServiceCenter returns the service center of the service,
+// creating one if it is not there yet.
+func (self *MessageCenter) getServiceCenter(srv string) (center *serviceCenter, err error) {
 	self.srvCentersLock.Lock()
+	defer self.srvCentersLock.Unlock()
 	center, ok := self.serviceCenterMap[srv]
+	if ok {
+		return
+	}
+	var config *ServiceConfig
+	if self.srvConfReader != nil {
+		config = self.srvConfReader.ReadConfig(srv)
+	}
+	if config == nil {
+		err = fmt.Errorf("cannot find service's config")
+		return
+	}
+	center = self.addCenterLocked(srv, config)
+	return
+}
+
+// validateSend checks the username and the extra fields of a message
+// to send, and returns the result rejecting it if they are invalid.
+func validateSend(username string, extra map[string]string) []*Result {
+	if len(username) == 0 || strings.Contains(username, ":") || strings.Contains(username, "\n") {
+		return []*Result{&Result{Err: fmt.Errorf("[Username=%v] bad username", username), Code: ResultBadRequest}}
+	}
+	if err := checkExtra(extra); err != nil {
+		return []*Result{&Result{Err: err, Code: ResultBadRequest}}
+	}
+	return nil
+}
+
+func (self *MessageCenter) SendMessage(service, username string, msg *proto.Message, extra map[string]string, ttl time.Duration) []*Result {
+	return self.SendMessageUnlessActive(service, username, msg, extra, ttl, 0)
+}
+
+// SendMessageUnlessActive sends the message like SendMessage. But if the
+// user has no online connection and was active (sent a message) within
+// the window, no notification will be pushed. A non-positive window
+// means always pushing.
+func (self *MessageCenter) SendMessageUnlessActive(service, username string, msg *proto.Message, extra map[string]string, ttl time.Duration, window time.Duration) []*Result {
+	if res := validateSend(username, extra); res != nil {
+		return res
+	}
+	self.srvCentersLock.Lock()
+	center, ok := self.serviceCenterMap[service]
+	self.srvCentersLock.Unlock()
+
 	if !ok {
-		config := self.srvConfReader.ReadConfig(srv)
-		if config == nil {
-			self.reportError(srv, "", "", c.RemoteAddr().String(), fmt.Errorf("cannot find service's config"))
-			self.srvCentersLock.Unlock()
-			return
+		return nil
+	}
+	res := center.SendMessageUnlessActive(username, msg, extra, ttl, window)
+	for _, r := range res {
+		if r.Err == nil && r.Visible {
+			return res
 		}
-		center = newServiceCenter(srv, config, self.fwdChan)
-		self.serviceCenterMap[srv] = center
 	}
+
+	// The user is offline.
+	n, err := center.BacklogCount(username)
+	if err == nil && n > 0 {
+		res = append(res, &Result{Backlog: n})
+	}
+	return res
+}
+
+// SendToActiveConn sends the message to the connection the user used
+// last, e.g. to ring only the device in the hands of the user. If no
+// connection of the user was active (sent or received anything) within
+// recent, the message is sent like SendMessage: to all connections, or
+// pushed if the user is offline.
+func (self *MessageCenter) SendToActiveConn(service, username string, msg *proto.Message, extra map[string]string, ttl time.Duration, recent time.Duration) []*Result {
+	if res := validateSend(username, extra); res != nil {
+		return res
+	}
+	self.srvCentersLock.Lock()
+	center, ok := self.serviceCenterMap[service]
 	self.srvCentersLock.Unlock()
 
-	err = center.NewConn(conn)
+	if !ok {
+		return nil
+	}
+	return center.SendToActiveConn(username, msg, extra, ttl, recent)
+}
+
+// SendRawMessage sends a message received already marshaled, e.g.
+// from another system, to the user. raw is a CMD_DATA command (see
+// proto.UnmarshalRawMessage), which is written to the connections of
+// the user as is, saving encoding it for each of them. It is only
+// decoded once to be routed, and pushed if the user is offline.
+// Malformed messages are rejected with ResultBadRequest.
+func (self *MessageCenter) SendRawMessage(service, username string, raw []byte, extra map[string]string, ttl time.Duration) []*Result {
+	if res := validateSend(username, extra); res != nil {
+		return res
+	}
+	msg, err := proto.UnmarshalRawMessage(raw)
 	if err != nil {
-		self.reportError(srv, conn.Username(), "", c.RemoteAddr().String(), err)
+		res := []*Result{&Result{Err: err, Code: ResultBadRequest}}
+		return res
+	}
+	self.srvCentersLock.Lock()
+	center, ok := self.serviceCenterMap[service]
+	self.srvCentersLock.Unlock()
+
+	if !ok {
+		return nil
 	}
+	return center.SendRawMessage(username, raw, msg, extra, ttl)
 }
 
-func (self *MessageCenter) SendMessage(service, username string, msg *proto.Message, extra map[string]string, ttl time.Duration) []*Result {
+// TrySendMessage sends the message like SendMessage, but returns
+// ErrBusy rather than blocking if the service has too many messages
+// waiting to be routed. See ServiceConfig.SendBufferSize.
+func (self *MessageCenter) TrySendMessage(service, username string, msg *proto.Message, extra map[string]string, ttl time.Duration) ([]*Result, error) {
+	if res := validateSend(username, extra); res != nil {
+		return res, nil
+	}
+	self.srvCentersLock.Lock()
+	center, ok := self.serviceCenterMap[service]
+	self.srvCentersLock.Unlock()
+
+	if !ok {
+		return nil, nil
+	}
+	return center.TrySendMessage(username, msg, extra, ttl)
+}
+
+// SendMessageWithSummary sends the message like SendMessage,
+// and summarizes the results.
+func (self *MessageCenter) SendMessageWithSummary(service, username string, msg *proto.Message, extra map[string]string, ttl time.Duration) ([]*Result, *DeliverySummary) {
+	res := self.SendMessage(service, username, msg, extra, ttl)
+	return res, Summarize(res)
+}
+
+// SendAndWaitDelivered sends the message and waits until a connection
+// of the user receives it, or returns ErrDeliveryTimeout after timeout.
+func (self *MessageCenter) SendAndWaitDelivered(service, username string, msg *proto.Message, timeout time.Duration) (*Result, error) {
 	if len(username) == 0 || strings.Contains(username, ":") || strings.Contains(username, "\n") {
-		res := []*Result{&Result{fmt.Errorf("[Service=%v] bad username", username), "", false}}
+		return nil, fmt.Errorf("[Username=%v] Invalid Username", username)
+	}
+	center, err := self.getServiceCenter(service)
+	if err != nil {
+		return nil, err
+	}
+	return center.SendAndWaitDelivered(username, msg, timeout)
+}
+
+// BroadcastFilter sends the message to the connections under the
+// service for which pred returns true.
+func (self *MessageCenter) BroadcastFilter(service string, pred func(ConnInfo) bool, msg *proto.Message, extra map[string]string, ttl time.Duration) []*Result {
+	if pred == nil {
+		return nil
+	}
+	if err := checkExtra(extra); err != nil {
+		res := []*Result{&Result{Err: err, Code: ResultBadRequest}}
 		return res
 	}
 	self.srvCentersLock.Lock()
 	center, ok := self.serviceCenterMap[service]
 	self.srvCentersLock.Unlock()
-
 	if !ok {
 		return nil
 	}
-	return center.SendMessage(username, msg, extra, ttl)
+	return center.BroadcastFilter(pred, msg, extra, ttl)
 }
 
-func (self *MessageCenter) Start() {
-	go self.process()
+// ConnDetails returns everything known about a connection, for
+// debugging.
+func (self *MessageCenter) ConnDetails(service, username, uniqId string) (*ConnDetails, error) {
+	center, err := self.getServiceCenter(service)
+	if err != nil {
+		return nil, err
+	}
+	return center.ConnDetails(username, uniqId)
+}
+
+// SetConnPriority sets the priority of a connection, so that messages
+// to the user are written to it before the connections with lower
+// priorities, e.g. for the device in the foreground.
+func (self *MessageCenter) SetConnPriority(service, username, uniqId string, priority int) error {
+	center, err := self.getServiceCenter(service)
+	if err != nil {
+		return err
+	}
+	return center.SetConnPriority(username, uniqId, priority)
+}
+
+// ResyncSubscriptions replays the subscriptions recorded for the service
+// to its push service. It returns the number of subscriptions replayed.
+func (self *MessageCenter) ResyncSubscriptions(service string) (n int, err error) {
+	center, err := self.getServiceCenter(service)
+	if err != nil {
+		return
+	}
+	return center.ResyncSubscriptions()
+}
+
+// RetryPendingPushes pushes the notifications of the service which
+// failed earlier again. It needs a message cache which implements
+// msgcache.PushTracker and msgcache.Getter.
+func (self *MessageCenter) RetryPendingPushes(service string) (stats *PushRetryStats, err error) {
+	self.srvCentersLock.Lock()
+	center, ok := self.serviceCenterMap[service]
+	self.srvCentersLock.Unlock()
+	if !ok {
+		err = ErrNoService
+		return
+	}
+	return center.RetryPendingPushes()
+}
+
+// CurrentSeq returns the sequence number of the last message sent to
+// the user, which clients compare with the last one they received to
+// tell if they missed any message.
+func (self *MessageCenter) CurrentSeq(service, username string) (seq int64, err error) {
+	self.srvCentersLock.Lock()
+	center, ok := self.serviceCenterMap[service]
+	self.srvCentersLock.Unlock()
+	if !ok {
+		err = ErrNoService
+		return
+	}
+	return center.CurrentSeq(username)
+}
+
+// UserTraffic returns the total number of bytes received from and
+// sent to all connections under the user.
+func (self *MessageCenter) UserTraffic(service, username string) (received, sent int64) {
+	self.srvCentersLock.Lock()
+	center, ok := self.serviceCenterMap[service]
+	self.srvCentersLock.Unlock()
+	if !ok {
+		return
+	}
+	for _, conn := range center.UserConns(username) {
+		received += conn.BytesReceived()
+		sent += conn.BytesSent()
+	}
+	return
+}
+
+// BacklogCount returns the number of messages cached for the user
+// which have not been retrieved yet, or 0 if the message cache of the
+// service does not implement msgcache.BacklogCounter.
+func (self *MessageCenter) BacklogCount(service, username string) (n int, err error) {
+	self.srvCentersLock.Lock()
+	center, ok := self.serviceCenterMap[service]
+	self.srvCentersLock.Unlock()
+	if !ok {
+		err = ErrNoService
+		return
+	}
+	return center.BacklogCount(username)
+}
+
+// Stats returns the statistics of the connections under each service.
+func (self *MessageCenter) Stats() map[string]*ConnMapStats {
+	self.srvCentersLock.Lock()
+	centers := make(map[string]*serviceCenter, len(self.serviceCenterMap))
+	for srv, center := range self.serviceCenterMap {
+		centers[srv] = center
+	}
+	self.srvCentersLock.Unlock()
+
+	ret := make(map[string]*ConnMapStats, len(centers))
+	for srv, center := range centers {
+		ret[srv] = center.Stats()
+	}
+	return ret
+}
+
+// CacheStats returns the statistics of the messages cached
+// for each service. Services without a cache, or whose cache does not
+// implement msgcache.StatsReporter, are skipped.
+func (self *MessageCenter) CacheStats() (map[string]*msgcache.CacheStats, error) {
+	centers := self.allServiceCenters()
+	ret := make(map[string]*msgcache.CacheStats, len(centers))
+	for _, center := range centers {
+		stats, err := center.CacheStats()
+		if err == ErrNoCache || err == ErrNoCacheStats {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[service=%v] %v", center.serviceName, err)
+		}
+		ret[center.serviceName] = stats
+	}
+	return ret, nil
+}
+
+// SetServiceByHost restricts the connections from TLS clients
+// asking for the host (through SNI) to the corresponding service.
+func (self *MessageCenter) SetServiceByHost(serviceByHost map[string]string) {
+	self.serviceByHost = serviceByHost
+}
+
+// AddListener makes the message center accept connections from ln as
+// well, with nrAcceptors goroutines calling Accept concurrently. If
+// services is not empty, only those services are allowed to connect
+// through ln. It should be called before Start.
+func (self *MessageCenter) AddListener(ln net.Listener, nrAcceptors int, services []string) {
+	l := new(listener)
+	l.ln = ln
+	l.nrAcceptors = nrAcceptors
+	if l.nrAcceptors < 1 {
+		l.nrAcceptors = 1
+	}
+	if len(services) > 0 {
+		l.services = make(map[string]bool, len(services))
+		for _, srv := range services {
+			l.services[srv] = true
+		}
+	}
+	self.listeners = append(self.listeners, l)
+}
+
+func (self *MessageCenter) accept(l *listener) {
 	for {
-		conn, err := self.ln.Accept()
+		conn, err := l.ln.Accept()
 		if err != nil {
-			self.reportError("", "", "", self.ln.Addr().String(), err)
+			if self.shuttingDown() {
+				return
+			}
+			self.reportError("", "", "", l.ln.Addr().String(), err)
+			continue
+		}
+		if err := self.filterConn(conn, l); err != nil {
+			self.reportError("", "", "", conn.RemoteAddr().String(), err)
+			conn.Close()
 			continue
 		}
-		go self.serveConn(conn)
+		if !self.admitPending() {
+			self.reportError("", "", "", conn.RemoteAddr().String(), ErrTooManyPendingConns)
+			conn.Close()
+			continue
+		}
+		go self.serveConn(conn, l.services)
 	}
 }
 
+func (self *MessageCenter) Start() {
+	go self.process()
+	for _, l := range self.listeners {
+		for i := 0; i < l.nrAcceptors; i++ {
+			go self.accept(l)
+		}
+	}
+	// Accepting goes on forever.
+	select {}
+}
+
+// ln may be nil if all listeners are added by AddListener, and
+// srvConfReader may be nil if all services are added by RegisterService.
 func NewMessageCenter(ln net.Listener,
 	privkey *rsa.PrivateKey,
 	errHandler evthandler.ErrorHandler,
@@ -152,7 +620,9 @@ func NewMessageCenter(ln net.Listener,
 	srvConfReader ServiceConfigReader) *MessageCenter {
 
 	self := new(MessageCenter)
-	self.ln = ln
+	if ln != nil {
+		self.AddListener(ln, 1, nil)
+	}
 	self.auth = auth
 	self.authtimeout = authtimeout
 	self.fwdChan = make(chan *server.ForwardRequest)
@@ -160,5 +630,6 @@ func NewMessageCenter(ln net.Listener,
 	self.errHandler = errHandler
 	self.srvConfReader = srvConfReader
 	self.serviceCenterMap = make(map[string]*serviceCenter, 128)
+	self.expectedConns = make(map[string]int, 128)
 	return self
 }
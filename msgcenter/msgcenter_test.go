@@ -18,16 +18,29 @@
 package msgcenter
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/evthandler"
 	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"github.com/uniqush/uniqush-conn/push"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -38,12 +51,12 @@ func getCache() msgcache.Cache {
 	c.Do("SELECT", db)
 	c.Do("FLUSHDB")
 	c.Close()
-	return msgcache.NewRedisMessageCache("", "", db)
+	return msgcache.NewRedisMessageCache("", "", db, nil, nil)
 }
 
 type alwaysAllowAuth struct{}
 
-func (self *alwaysAllowAuth) Authenticate(service, user, token, addr string) (bool, error) {
+func (self *alwaysAllowAuth) Authenticate(service, user, token, addr string, labels map[string]string) (bool, error) {
 	return true, nil
 }
 
@@ -185,8 +198,59 @@ func TestServerSendToClients(t *testing.T) {
 	wg.Wait()
 }
 
-func receiveAndCompareMessages(msgChan <-chan *proto.Message, msgs map[string]*proto.Message, errChan chan<- error) {
+func TestBroadcastFilter(t *testing.T) {
+	addr := "127.0.0.1:8966"
+	N := 10
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	go center.Start()
+
+	wg := new(sync.WaitGroup)
+	msg := randomMessage()
+	selected := make(map[string]bool, N)
+
+	for i := 0; i < N; i++ {
+		username := fmt.Sprintf("user-%v", i)
+		conn, err := connectServer(addr, username, pubkey, nil)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		if i%2 != 0 {
+			continue
+		}
+		selected[username] = true
+		wg.Add(1)
+		go func() {
+			testClientReceived(conn, errChan, msg)
+			wg.Done()
+		}()
+	}
+	pred := func(info ConnInfo) bool {
+		return selected[info.Username]
+	}
+	res := center.BroadcastFilter("service", pred, msg, nil, 0*time.Second)
+	if len(res) != len(selected) {
+		t.Errorf("should send to %v connections: %v", len(selected), len(res))
+	}
+	for _, r := range res {
+		if r.Err != nil {
+			t.Errorf("Error: %v", r.Err)
+		}
+	}
+	wg.Wait()
+}
+
+func receiveAndCompareMessages(msgChan <-chan *proto.Message, msgs map[string]*proto.Message, errChan chan<- error, received *sync.WaitGroup) {
 	for msg := range msgChan {
+		received.Done()
 		if m, ok := msgs[msg.Sender]; ok {
 			if !m.EqContent(msg) {
 				errChan <- fmt.Errorf("user %v should receive %v; but got %v", msg.Sender, m, msg)
@@ -227,17 +291,2562 @@ func TestClientsSendToServer(t *testing.T) {
 		clients[i] = client
 	}
 
-	go receiveAndCompareMessages(msgChan, msgs, errChan)
+	received := new(sync.WaitGroup)
+	received.Add(N)
+	go receiveAndCompareMessages(msgChan, msgs, errChan, received)
 	defer close(msgChan)
 
 	wg := new(sync.WaitGroup)
 	wg.Add(N)
 	for _, client := range clients {
 		msg := msgs[client.Username()]
+		conn := client
 		go func() {
-			client.SendMessage(msg)
+			conn.SendMessage(msg)
 			wg.Done()
 		}()
 	}
 	wg.Wait()
+
+	// Don't close msgChan until all messages are reported.
+	received.Wait()
+}
+
+func TestReservedExtraKeys(t *testing.T) {
+	good := map[string]string{"notif.msg": "hello", "title": "hi"}
+	if err := checkExtra(good); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	for _, k := range []string{"uniqush.sender", "notif.uniqush.msgsize"} {
+		bad := map[string]string{"notif.msg": "hello", k: "spoofed"}
+		if err := checkExtra(bad); err == nil {
+			t.Errorf("%v should be rejected", k)
+		}
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+	config := new(ServiceConfig)
+	config.RequiredHeaders = []string{"aaa"}
+	config.AllowedHeaders = []string{"aa"}
+	center := &serviceCenter{config: config}
+
+	msg := randomMessage()
+	if err := center.checkHeader(msg); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	delete(msg.Header, "aaa")
+	if err := center.checkHeader(msg); err == nil {
+		t.Errorf("should reject message without required header")
+	}
+	msg = randomMessage()
+	msg.Header["other"] = "value"
+	if err := center.checkHeader(msg); err == nil {
+		t.Errorf("should reject message with disallowed header")
+	}
+}
+
+func TestDailyQuota(t *testing.T) {
+	N := 3
+	conf := &ServiceConfig{
+		MsgCache:        getCache(),
+		MaxNrMsgsPerDay: N,
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	for i := 0; i < N; i++ {
+		res := center.SendMessage("user", randomMessage(), nil, 0*time.Second)
+		for _, r := range res {
+			if r.Err == ErrQuotaExceeded {
+				t.Errorf("%vth message should not exceed the quota", i)
+			}
+		}
+	}
+	res := center.SendMessage("user", randomMessage(), nil, 0*time.Second)
+	if len(res) != 1 || res[0].Err != ErrQuotaExceeded {
+		t.Errorf("the quota should be exceeded: %v", res)
+	}
+	res = center.SendMessage("other", randomMessage(), nil, 0*time.Second)
+	if len(res) != 0 {
+		t.Errorf("the quota should be per user: %v", res)
+	}
+}
+
+type countingPush struct {
+	lock sync.Mutex
+	subs map[string]int
+
+	// Subscribing this user fails.
+	fail string
+
+	// The info of the last notification pushed.
+	info map[string]string
+}
+
+var errSubscribe = errors.New("subscribe failed")
+
+func (self *countingPush) Subscribe(service, username string, info map[string]string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if username == self.fail {
+		return errSubscribe
+	}
+	self.subs[username]++
+	return nil
+}
+
+func (self *countingPush) Unsubscribe(service, username string, info map[string]string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.subs[username]--
+	return nil
+}
+
+func (self *countingPush) Push(service, username string, info map[string]string, msgIds []string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.info = info
+	return nil
+}
+
+func (self *countingPush) NrDeliveryPoints(service, username string) int {
+	return 0
+}
+
+func TestResyncSubscriptions(t *testing.T) {
+	getCache() // flush the database
+	pushService := &countingPush{subs: make(map[string]int, 2)}
+	conf := &ServiceConfig{
+		PushService:       pushService,
+		SubscriptionStore: push.NewRedisSubscriptionStore("", "", 1),
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	reqs := []*server.SubscribeRequest{
+		{Subscribe: true, Service: "service", Username: "alice", Params: map[string]string{"regid": "1"}},
+		{Subscribe: true, Service: "service", Username: "alice", Params: map[string]string{"regid": "2"}},
+		{Subscribe: true, Service: "service", Username: "bob", Params: map[string]string{"regid": "3"}},
+		{Subscribe: false, Service: "service", Username: "alice", Params: map[string]string{"regid": "1"}},
+	}
+	for _, req := range reqs {
+		center.subReqChan <- req
+	}
+	// Make sure all subscriptions are processed.
+	center.Stats()
+
+	// The push service lost all its data.
+	pushService.subs = make(map[string]int, 2)
+	n, err := center.ResyncSubscriptions()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("should resync 2 subscriptions: %v", n)
+	}
+	if pushService.subs["alice"] != 1 || pushService.subs["bob"] != 1 {
+		t.Errorf("bad subscriptions: %v", pushService.subs)
+	}
+}
+
+func TestBulkSubscribe(t *testing.T) {
+	pushService := &countingPush{subs: make(map[string]int, 10), fail: "mallory"}
+	conf := &ServiceConfig{
+		PushService: pushService,
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	var reqs []*server.SubscribeRequest
+	N := 100
+	for i := 0; i < N; i++ {
+		reqs = append(reqs, &server.SubscribeRequest{
+			Subscribe: true,
+			Service:   "service",
+			Username:  fmt.Sprintf("user%v", i%10),
+			Params:    map[string]string{"regid": fmt.Sprint(i)},
+		})
+	}
+	reqs = append(reqs, &server.SubscribeRequest{Subscribe: true, Service: "service", Username: "mallory"})
+	failures := center.bulkSubscribe(reqs)
+	if len(failures) != 1 || failures[0].Request.Username != "mallory" || failures[0].Err != errSubscribe {
+		t.Errorf("only mallory should fail: %v", failures)
+	}
+	for i := 0; i < 10; i++ {
+		if n := pushService.subs[fmt.Sprintf("user%v", i)]; n != N/10 {
+			t.Errorf("user%v should have %v subscriptions: %v", i, N/10, n)
+		}
+	}
+}
+
+type blockingPushHandler struct {
+	release chan bool
+}
+
+func (self *blockingPushHandler) ShouldPush(service, username string, info map[string]string) bool {
+	<-self.release
+	return false
+}
+
+func TestNrPendingPushes(t *testing.T) {
+	handler := &blockingPushHandler{release: make(chan bool)}
+	conf := &ServiceConfig{
+		PushHandler: handler,
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	N := 3
+	for i := 0; i < N; i++ {
+		center.SendMessage("offline-user", randomMessage(), nil, 0*time.Second)
+	}
+	if n := center.Stats().NrPendingPushes; n != int64(N) {
+		t.Errorf("should have %v pending pushes: %v", N, n)
+	}
+	close(handler.release)
+	for i := 0; i < 100; i++ {
+		if center.Stats().NrPendingPushes == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("pending pushes should be zero: %v", center.Stats().NrPendingPushes)
+}
+
+func TestSuppressPushForActiveUser(t *testing.T) {
+	handler := &blockingPushHandler{release: make(chan bool)}
+	defer close(handler.release)
+	conf := &ServiceConfig{
+		PushHandler: handler,
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	center.lastSeen.update("user", time.Now().Add(-1*time.Minute))
+
+	center.SendMessageUnlessActive("user", randomMessage(), nil, 0*time.Second, 5*time.Minute)
+	if n := center.Stats().NrPendingPushes; n != 0 {
+		t.Errorf("should not push to an active user: %v", n)
+	}
+	center.SendMessageUnlessActive("user", randomMessage(), nil, 0*time.Second, 30*time.Second)
+	if n := center.Stats().NrPendingPushes; n != 1 {
+		t.Errorf("should push to a user inactive within the window: %v", n)
+	}
+	center.SendMessageUnlessActive("other", randomMessage(), nil, 0*time.Second, 5*time.Minute)
+	if n := center.Stats().NrPendingPushes; n != 2 {
+		t.Errorf("should push to a user never seen: %v", n)
+	}
+}
+
+type recordingLogger struct {
+	lock    sync.Mutex
+	entries map[string]map[string]string
+}
+
+func (self *recordingLogger) Log(event string, fields map[string]string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.entries[event] = fields
+}
+
+func TestLogRouted(t *testing.T) {
+	logger := &recordingLogger{entries: make(map[string]map[string]string, 4)}
+	conf := &ServiceConfig{
+		Logger: logger,
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	msg := randomMessage()
+	msg.Id = "msgid"
+	center.SendMessage("user", msg, nil, 0*time.Second)
+
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	fields, ok := logger.entries["routed"]
+	if !ok {
+		t.Errorf("routed should be logged")
+		return
+	}
+	if fields["trace"] != msg.Id || fields["username"] != "user" || fields["conns"] != "0" {
+		t.Errorf("bad fields: %v", fields)
+	}
+}
+
+func TestListenerServices(t *testing.T) {
+	addr := "127.0.0.1:8967"
+	errChan := make(chan error, 10)
+	center, pubkey, err := getMessageCenter("127.0.0.1:8968", nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	center.AddListener(ln, 1, []string{"other-service"})
+	go center.Start()
+
+	conn, err := connectServer(addr, "user", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer conn.Close()
+	_, err = conn.ReadMessage()
+	if err == nil {
+		t.Errorf("the connection should be closed")
+	}
+	select {
+	case err = <-errChan:
+	case <-time.After(3 * time.Second):
+		t.Errorf("the rejection should be reported")
+	}
+}
+
+func TestSendAndWaitDelivered(t *testing.T) {
+	addr := "127.0.0.1:8969"
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	go center.Start()
+
+	_, err = center.SendAndWaitDelivered("service", "nobody", randomMessage(), 100*time.Millisecond)
+	if err != ErrDeliveryTimeout {
+		t.Errorf("should time out: %v", err)
+	}
+
+	msg := randomMessage()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		res, err := center.SendAndWaitDelivered("service", "late-user", msg, 10*time.Second)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		if res == nil || len(res.ConnId) == 0 {
+			t.Errorf("bad result: %v", res)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	conn, err := connectServer(addr, "late-user", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer conn.Close()
+	testClientReceived(conn, errChan, msg)
+	<-done
+}
+
+func TestSendAndWaitDeliveredOnce(t *testing.T) {
+	cache := getCache()
+	conf := &ServiceConfig{MsgCache: cache, SequenceMessages: true, MaxNrMsgsPerDay: 1}
+	center := newServiceCenter("service", conf, nil, nil)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		_, err := center.SendAndWaitDelivered("alice", randomMessage(), 10*time.Second)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	conn := new(headerConn)
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if len(conn.headers) != 1 || conn.headers[0][SeqHeader] != "1" {
+		t.Errorf("the message should be numbered once: %v", conn.headers)
+	}
+	if seq, err := center.CurrentSeq("alice"); err != nil || seq != 1 {
+		t.Errorf("one sequence number should be assigned: %v %v", seq, err)
+	}
+	n, err := cache.(msgcache.QuotaCounter).IncrDailyCount("service", "alice", time.Now())
+	if err != nil || n != 2 {
+		t.Errorf("the message should be counted once: %v %v", n, err)
+	}
+}
+
+func TestConnDetails(t *testing.T) {
+	addr := "127.0.0.1:8970"
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	center.SetNodeId("node1")
+	go center.Start()
+
+	conn, err := connectServer(addr, "alice", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	srvCenter, _ := center.getServiceCenter("service")
+	var conns []server.Conn
+	for i := 0; i < 100 && len(conns) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		conns = srvCenter.UserConns("alice")
+	}
+	if len(conns) != 1 {
+		t.Errorf("should have one connection: %v", len(conns))
+		return
+	}
+	details, err := center.ConnDetails("service", "alice", "node1:"+conns[0].UniqId())
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if details.Username != "alice" || details.ConnId != "node1:"+conns[0].UniqId() {
+		t.Errorf("bad details: %+v", details)
+	}
+	if details.ConnectedAt.IsZero() || time.Since(details.ConnectedAt) > time.Minute {
+		t.Errorf("bad connection time: %v", details.ConnectedAt)
+	}
+	if len(details.TLSVersion) != 0 {
+		t.Errorf("should not use TLS: %v", details.TLSVersion)
+	}
+
+	_, err = center.ConnDetails("service", "alice", "no-such-conn")
+	if err != ErrNoConn {
+		t.Errorf("should not find the connection: %v", err)
+	}
+}
+
+// aliceConn is a connection of alice which does nothing.
+type aliceConn struct {
+	server.Conn
+}
+
+func (self *aliceConn) Service() string {
+	return "service"
+}
+
+func (self *aliceConn) Username() string {
+	return "alice"
+}
+
+func (self *aliceConn) UniqId() string {
+	return "1"
+}
+
+func (self *aliceConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (self *aliceConn) Visible() bool {
+	return true
+}
+
+func (self *aliceConn) Close() error {
+	return nil
+}
+
+func (self *aliceConn) Ping() error {
+	return nil
+}
+
+func (self *aliceConn) BytesReceived() int64 {
+	return 0
+}
+
+func (self *aliceConn) BytesSent() int64 {
+	return 0
+}
+
+func (self *aliceConn) ProposedHeartbeat() time.Duration {
+	return 0
+}
+
+func (self *aliceConn) Priority() int {
+	return 0
+}
+
+func (self *aliceConn) LastActive() time.Time {
+	return time.Time{}
+}
+
+type slowConn struct {
+	aliceConn
+	entered chan *proto.Message
+	release chan bool
+}
+
+func (self *slowConn) SendMessage(msg *proto.Message, extra map[string]string, ttl time.Duration) (string, error) {
+	self.entered <- msg
+	<-self.release
+	return "", nil
+}
+
+func TestOutboundQueueOverflow(t *testing.T) {
+	msgs := []*proto.Message{randomMessage(), randomMessage(), randomMessage()}
+	// The message the client receives after msgs[0].
+	expected := map[OverflowPolicy]*proto.Message{
+		OverflowDropOldest: msgs[2],
+		OverflowDropNewest: msgs[1],
+		OverflowDisconnect: msgs[1],
+	}
+	for policy, next := range expected {
+		errChan := make(chan error, 10)
+		conf := &ServiceConfig{ErrorHandler: &chanReporter{errChan: errChan}}
+		center := newServiceCenter("service", conf, nil, nil)
+		slow := &slowConn{entered: make(chan *proto.Message), release: make(chan bool)}
+		conn := newQueuedConn(slow, 1, policy, center)
+
+		conn.SendMessage(msgs[0], nil, time.Hour)
+		// The connection is now blocked in writing msgs[0].
+		<-slow.entered
+		conn.SendMessage(msgs[1], nil, time.Hour)
+		_, err := conn.SendMessage(msgs[2], nil, time.Hour)
+		if policy == OverflowDisconnect {
+			if err != ErrOutboundQueueFull {
+				t.Errorf("%v: should return an error: %v", policy, err)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("%v: Error: %v", policy, err)
+			}
+			select {
+			case <-errChan:
+			case <-time.After(time.Second):
+				t.Errorf("%v: overflow should be reported", policy)
+			}
+		}
+		slow.release <- true
+		if msg := <-slow.entered; !msg.Eq(next) {
+			t.Errorf("%v: received a wrong message", policy)
+		}
+		conn.Close()
+		slow.release <- true
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	cases := []struct {
+		results []*Result
+		summary DeliverySummary
+	}{
+		{nil, DeliverySummary{Status: DeliveredToNone}},
+		{
+			[]*Result{{Backlog: 3}},
+			DeliverySummary{Status: DeliveredToNone},
+		},
+		{
+			[]*Result{{ConnId: "1", Visible: true}, {ConnId: "2", Visible: true}},
+			DeliverySummary{Status: DeliveredToAll, NrDelivered: 2},
+		},
+		{
+			[]*Result{{ConnId: "1", Visible: true}, {ConnId: "2"}},
+			DeliverySummary{Status: DeliveredToSome, NrDelivered: 1, NrOffline: 1},
+		},
+		{
+			[]*Result{{ConnId: "1", Visible: true}, {ConnId: "2", Err: io.EOF}},
+			DeliverySummary{Status: DeliveredToSome, NrDelivered: 1, NrFailed: 1},
+		},
+		{
+			[]*Result{{ConnId: "1"}, {ConnId: "2", Err: io.EOF}},
+			DeliverySummary{Status: DeliveredToNone, NrOffline: 1, NrFailed: 1},
+		},
+	}
+	for i, c := range cases {
+		if s := Summarize(c.results); *s != c.summary {
+			t.Errorf("case %v: expected %+v; got %+v", i, c.summary, *s)
+		}
+	}
+}
+
+type alwaysForward struct{}
+
+func (self *alwaysForward) ShouldForward(fwdreq *server.ForwardRequest) bool {
+	return true
+}
+
+func (self *alwaysForward) MaxTTL() time.Duration {
+	return 24 * time.Hour
+}
+
+func TestForwardResult(t *testing.T) {
+	addr := "127.0.0.1:8971"
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	srvCenter, _ := center.getServiceCenter("service")
+	srvCenter.config.ForwardRequestHandler = &alwaysForward{}
+	go center.Start()
+
+	bob, err := connectServer(addr, "bob", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer bob.Close()
+	alice, err := connectServer(addr, "alice", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer alice.Close()
+	resChan := make(chan *client.ForwardResult)
+	alice.SetForwardResultChannel(resChan)
+	go func() {
+		for {
+			if _, err := alice.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for len(srvCenter.UserConns("bob")) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	msg := randomMessage()
+	expected := []client.ForwardResult{
+		{Id: "1", Accepted: true, NrDelivered: 1},
+		{Id: "2", Accepted: true, NrDelivered: 0},
+		{Id: "3", Accepted: false, NrDelivered: 0},
+	}
+	alice.ForwardRequestWithId("1", "bob", "", msg, time.Hour)
+	alice.ForwardRequestWithId("2", "nobody", "", msg, time.Hour)
+	alice.ForwardRequestWithId("3", "bob", "no-such-service", msg, time.Hour)
+	for _, e := range expected {
+		select {
+		case res := <-resChan:
+			if *res != e {
+				t.Errorf("expected %+v; got %+v", e, *res)
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("no result of request %v", e.Id)
+			return
+		}
+	}
+	m, err := bob.ReadMessage()
+	if err != nil {
+		t.Errorf("bob should receive the message: %v", err)
+		return
+	}
+	if m.Header[ForwardedHeader] != "true" {
+		t.Errorf("the message should be tagged as forwarded: %v", m.Header)
+	}
+	delete(m.Header, ForwardedHeader)
+	if !m.EqContent(msg) {
+		t.Errorf("bob should receive the message")
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	stats := map[string]*ConnMapStats{
+		"chat": &ConnMapStats{NrConns: 3, NrUsers: 2, NrPushes: 5, BytesSent: 100},
+		"game": &ConnMapStats{NrConns: 1, NrUsers: 1},
+	}
+	var buf bytes.Buffer
+	err := WriteMetrics(bufio.NewWriter(&buf), stats)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	out := buf.String()
+	expected := []string{
+		"# TYPE uniqush_conn_connections gauge\n",
+		"uniqush_conn_connections{service=\"chat\"} 3\n",
+		"uniqush_conn_connections{service=\"game\"} 1\n",
+		"uniqush_conn_users{service=\"chat\"} 2\n",
+		"# TYPE uniqush_conn_pushes_total counter\n",
+		"uniqush_conn_pushes_total{service=\"chat\"} 5\n",
+		"uniqush_conn_sent_bytes_total{service=\"chat\"} 100\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %q in:\n%v", line, out)
+		}
+	}
+}
+
+type temporaryError struct{}
+
+func (self *temporaryError) Error() string {
+	return "try again"
+}
+
+func (self *temporaryError) Temporary() bool {
+	return true
+}
+
+// flakyConn fails with the errors before sending a message.
+type flakyConn struct {
+	aliceConn
+	errs   []error
+	nrSent int
+}
+
+func (self *flakyConn) SendMessage(msg *proto.Message, extra map[string]string, ttl time.Duration) (string, error) {
+	if len(self.errs) > 0 {
+		err := self.errs[0]
+		self.errs = self.errs[1:]
+		return "", err
+	}
+	self.nrSent++
+	return "", nil
+}
+
+func TestRetryableWriteError(t *testing.T) {
+	center := newServiceCenter("service", nil, nil, nil)
+	conn := &flakyConn{errs: []error{&temporaryError{}}}
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+
+	res := center.SendMessage("alice", randomMessage(), nil, time.Hour)
+	if len(res) != 1 || res[0].Err != nil {
+		t.Errorf("should succeed after retrying: %v", res)
+	}
+	if conn.nrSent != 1 {
+		t.Errorf("should send the message once: %v", conn.nrSent)
+	}
+
+	// Retry only once.
+	conn.errs = []error{&temporaryError{}, &temporaryError{}}
+	res = center.SendMessage("alice", randomMessage(), nil, time.Hour)
+	if len(res) != 1 || res[0].Err == nil {
+		t.Errorf("should fail: %v", res)
+	}
+	// The connection is removed in the background.
+	n := 1
+	for i := 0; i < 100 && n > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = len(center.UserConns("alice"))
+	}
+	if n != 0 {
+		t.Errorf("the connection should be removed: %v", n)
+	}
+}
+
+func TestResultCode(t *testing.T) {
+	center := newServiceCenter("service", nil, nil, nil)
+	conn := &flakyConn{errs: []error{io.EOF}}
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	res := center.SendMessage("alice", randomMessage(), nil, time.Hour)
+	if len(res) != 1 || res[0].Code != ResultConnClosed {
+		t.Errorf("should be %v: %v", ResultConnClosed, res)
+		return
+	}
+	if !strings.Contains(res[0].Error(), `"code":"conn-closed"`) {
+		t.Errorf("the code should be marshaled: %v", res[0].Error())
+	}
+
+	cases := map[error]ResultCode{
+		nil:                     ResultOK,
+		proto.ErrTooManyHeaders: ResultTooLarge,
+		ErrOutboundQueueFull:    ResultQueueFull,
+		errors.New("other"):     ResultWriteFailed,
+	}
+	for err, code := range cases {
+		if c := resultCode(err); c != code {
+			t.Errorf("%v should be %v; got %v", err, code, c)
+		}
+	}
+}
+
+func TestDrainCloseReason(t *testing.T) {
+	addr := "127.0.0.1:8972"
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	go center.Start()
+
+	conn, err := connectServer(addr, "alice", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer conn.Close()
+	srvCenter, _ := center.getServiceCenter("service")
+	for len(srvCenter.UserConns("alice")) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := center.DrainUser("service", "alice"); n != 1 {
+		t.Errorf("should drain one connection: %v", n)
+	}
+	_, err = conn.ReadMessage()
+	if cerr, ok := err.(*proto.CloseError); !ok || cerr.Code != proto.CloseDrained {
+		t.Errorf("should be closed as drained: %v", err)
+	}
+}
+
+func TestDisplaySender(t *testing.T) {
+	msg := &proto.Message{
+		Sender:        "bob",
+		SenderService: "service",
+		Header: map[string]string{
+			DisplaySenderHeader:     "Team Alpha",
+			"notif.uniqush.msgsize": "1",
+		},
+	}
+	info := getPushInfo(msg, nil, true)
+	if info["uniqush.sender"] != "Team Alpha" {
+		t.Errorf("the display sender should be shown: %v", info)
+	}
+	if info["uniqush.original-sender"] != "bob" {
+		t.Errorf("the real sender should be kept: %v", info)
+	}
+	if _, ok := info[DisplaySenderHeader]; ok {
+		t.Errorf("the header should be consumed: %v", info)
+	}
+
+	msg = &proto.Message{Sender: "bob", SenderService: "service"}
+	info = getPushInfo(msg, nil, true)
+	if info["uniqush.sender"] != "bob" {
+		t.Errorf("the sender should be shown by default: %v", info)
+	}
+	if _, ok := info["uniqush.original-sender"]; ok {
+		t.Errorf("no original sender without the header: %v", info)
+	}
+}
+
+func TestRewritePushInfo(t *testing.T) {
+	pushService := &countingPush{subs: make(map[string]int, 1)}
+	conf := &ServiceConfig{
+		PushService: pushService,
+		RewritePushInfo: func(service, username string, info map[string]string) map[string]string {
+			info["sender-id"] = service + "-sender"
+			return info
+		},
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	err := center.pushNotif("service", "alice", randomMessage(), nil, []string{"1"}, false)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if pushService.info["sender-id"] != "service-sender" {
+		t.Errorf("info is not rewritten: %v", pushService.info)
+	}
+	if _, ok := pushService.info["notif.uniqush.msgsize"]; !ok {
+		t.Errorf("should keep other fields: %v", pushService.info)
+	}
+}
+
+// deadConn is a connection of alice whose peer has gone.
+type deadConn struct {
+	aliceConn
+	closed bool
+}
+
+func (self *deadConn) UniqId() string {
+	return "dead"
+}
+
+func (self *deadConn) Ping() error {
+	return io.EOF
+}
+
+func (self *deadConn) Close() error {
+	self.closed = true
+	return nil
+}
+
+func TestReapStaleConns(t *testing.T) {
+	for _, reap := range []bool{false, true} {
+		conf := &ServiceConfig{MaxNrConnsPerUser: 1, ReapStaleConns: reap}
+		center := newServiceCenter("service", conf, nil, nil)
+		dead := &deadConn{}
+		errChan := make(chan error)
+		center.connIn <- &eventConnIn{conn: dead, errChan: errChan}
+		if err := <-errChan; err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		center.connIn <- &eventConnIn{conn: &aliceConn{}, errChan: errChan}
+		err := <-errChan
+		if !reap {
+			if err != ErrTooManyConnForThisUser {
+				t.Errorf("should reject the new connection: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("should accept the new connection: %v", err)
+		}
+		conns := center.UserConns("alice")
+		if len(conns) != 1 || conns[0].UniqId() != "1" || !dead.closed {
+			t.Errorf("the dead connection should be replaced")
+		}
+	}
+}
+
+// hangingConn is a connection of alice whose ping blocks
+// until its peer is found dead.
+type hangingConn struct {
+	deadConn
+	dead chan bool
+}
+
+func (self *hangingConn) Ping() error {
+	<-self.dead
+	return io.EOF
+}
+
+func TestReapStaleConnsNotBlocking(t *testing.T) {
+	conf := &ServiceConfig{MaxNrConnsPerUser: 1, ReapStaleConns: true}
+	center := newServiceCenter("service", conf, nil, nil)
+	hanging := &hangingConn{dead: make(chan bool)}
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: hanging, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	center.connIn <- &eventConnIn{conn: &aliceConn{}, errChan: errChan}
+
+	listed := make(chan []server.Conn)
+	go func() {
+		listed <- center.UserConns("alice")
+	}()
+	select {
+	case <-listed:
+	case <-time.After(time.Second):
+		t.Fatal("the service should not wait for the ping")
+	}
+	close(hanging.dead)
+	if err := <-errChan; err != nil {
+		t.Errorf("should accept the new connection: %v", err)
+	}
+	conns := center.UserConns("alice")
+	if len(conns) != 1 || conns[0].UniqId() != "1" {
+		t.Errorf("the dead connection should be replaced")
+	}
+}
+
+// rejectedConn is a connection of alice which records why it was closed.
+type rejectedConn struct {
+	aliceConn
+	code proto.CloseCode
+}
+
+func (self *rejectedConn) CloseWithReason(code proto.CloseCode, reason string, retryAfter time.Duration) error {
+	self.code = code
+	return nil
+}
+
+// stuckConn is a connection of alice whose client never reads,
+// so that writing the reason of closing it blocks.
+type stuckConn struct {
+	aliceConn
+	release chan bool
+}
+
+func (self *stuckConn) CloseWithReason(code proto.CloseCode, reason string, retryAfter time.Duration) error {
+	<-self.release
+	return nil
+}
+
+func TestLeaveNotBlockedByClose(t *testing.T) {
+	center := newServiceCenter("service", &ServiceConfig{}, nil, nil)
+	conn := &stuckConn{release: make(chan bool)}
+	defer close(conn.release)
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	center.connLeave <- &eventConnLeave{conn: conn, err: ErrConnDrained, code: proto.CloseDrained}
+
+	done := make(chan []server.Conn)
+	go func() {
+		done <- center.UserConns("alice")
+	}()
+	select {
+	case conns := <-done:
+		if len(conns) != 0 {
+			t.Errorf("the connection should be removed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the service should not wait for the connection to close")
+	}
+}
+
+func TestLoadShed(t *testing.T) {
+	errChan := make(chan error, 1)
+	conf := &ServiceConfig{LowPriority: true, ErrorHandler: &chanReporter{errChan: errChan}}
+	center := newServiceCenter("service", conf, nil, nil)
+	center.shed = func() bool { return true }
+	conn := &rejectedConn{}
+	if err := center.NewConn(conn); err != ErrLoadShed {
+		t.Errorf("should shed the connection: %v", err)
+	}
+	if conn.code != proto.CloseCapacity {
+		t.Errorf("wrong close code: %v", conn.code)
+	}
+	select {
+	case err := <-errChan:
+		if !strings.Contains(err.Error(), ErrLoadShed.Error()) {
+			t.Errorf("wrong error reported: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the shed connection should be reported")
+	}
+}
+
+// heartbeatConn proposes a heartbeat interval.
+type heartbeatConn struct {
+	rejectedConn
+	proposed time.Duration
+}
+
+func (self *heartbeatConn) ProposedHeartbeat() time.Duration {
+	return self.proposed
+}
+
+func TestHeartbeatBounds(t *testing.T) {
+	conf := &ServiceConfig{MinHeartbeat: time.Minute, MaxHeartbeat: 10 * time.Minute}
+	center := newServiceCenter("service", conf, nil, nil)
+	for _, hb := range []time.Duration{time.Second, time.Hour} {
+		conn := &heartbeatConn{proposed: hb}
+		if err := center.NewConn(conn); err != ErrBadHeartbeat {
+			t.Errorf("heartbeat %v should be rejected: %v", hb, err)
+		}
+	}
+	cases := map[time.Duration]bool{
+		time.Minute:      true,
+		5 * time.Minute:  true,
+		10 * time.Minute: true,
+		time.Second:      false,
+		time.Hour:        false,
+	}
+	for hb, allowed := range cases {
+		if center.heartbeatAllowed(hb) != allowed {
+			t.Errorf("heartbeat %v: allowed should be %v", hb, allowed)
+		}
+	}
+}
+
+type allowPushHandler struct{}
+
+func (self *allowPushHandler) ShouldPush(service, username string, info map[string]string) bool {
+	return true
+}
+
+type chanFallbackHandler struct {
+	users chan string
+}
+
+func (self *chanFallbackHandler) OnFallback(service, username string, msg *proto.Message) {
+	self.users <- username
+}
+
+func TestFallbackWithoutDeliveryPoints(t *testing.T) {
+	fallback := &chanFallbackHandler{users: make(chan string, 1)}
+	conf := &ServiceConfig{
+		PushHandler:     &allowPushHandler{},
+		PushService:     &countingPush{subs: make(map[string]int)},
+		FallbackHandler: fallback,
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	center.SendMessage("offline-user", randomMessage(), nil, 0*time.Second)
+	select {
+	case usr := <-fallback.users:
+		if usr != "offline-user" {
+			t.Errorf("wrong user: %v", usr)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the fallback handler should be called")
+	}
+}
+
+func TestSubscribeConnEvents(t *testing.T) {
+	center := newServiceCenter("service", nil, nil, nil)
+	events, unsubscribe := center.Subscribe()
+	// Never drained.
+	_, unsubscribeSlow := center.Subscribe()
+	defer unsubscribeSlow()
+
+	errChan := make(chan error)
+	conn := &deadConn{}
+	for i := 0; i < connEventBufSize+1; i++ {
+		center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+		if err := <-errChan; err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		evt := <-events
+		if evt.Type != ConnEventConnect || evt.Username != "alice" || evt.ConnId != "dead" {
+			t.Errorf("bad event: %+v", evt)
+		}
+		center.connLeave <- &eventConnLeave{conn: conn}
+		evt = <-events
+		if evt.Type != ConnEventDisconnect || evt.ConnId != "dead" {
+			t.Errorf("bad event: %+v", evt)
+		}
+	}
+	if n := center.Stats().NrDroppedConnEvents; n != connEventBufSize+2 {
+		t.Errorf("should drop the events of the slow subscriber: %v", n)
+	}
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Errorf("the channel should be closed")
+	}
+}
+
+// agedConn is a connection of alice established long ago.
+type agedConn struct {
+	aliceConn
+	connectedAt time.Time
+	closed      chan proto.CloseCode
+}
+
+func (self *agedConn) ConnectedAt() time.Time {
+	return self.connectedAt
+}
+
+func (self *agedConn) CloseWithReason(code proto.CloseCode, reason string, retryAfter time.Duration) error {
+	self.closed <- code
+	return nil
+}
+
+func TestMaxConnLifetime(t *testing.T) {
+	center := newServiceCenter("service", nil, nil, nil)
+	conn := &agedConn{connectedAt: time.Now().Add(-time.Hour), closed: make(chan proto.CloseCode, 1)}
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+
+	done := make(chan bool)
+	defer close(done)
+	go center.expire(conn, time.Minute, done)
+	select {
+	case code := <-conn.closed:
+		if code != proto.CloseMaxLifetime {
+			t.Errorf("wrong close code: %v", code)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the connection should be closed")
+	}
+	if conns := center.UserConns("alice"); len(conns) != 0 {
+		t.Errorf("the connection should be removed: %v", len(conns))
+	}
+}
+
+func TestServiceConfigBuilder(t *testing.T) {
+	reporter := &chanReporter{}
+	config, err := NewServiceConfig().
+		Handler(reporter).
+		Set(func(c *ServiceConfig) { c.MaxNrConnsPerUser = 2 }).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MessageHandler != reporter || config.ErrorHandler != reporter {
+		t.Errorf("the reporter should handle messages and errors")
+	}
+	if config.LoginHandler != nil || config.MaxNrConnsPerUser != 2 {
+		t.Errorf("bad config: %+v", config)
+	}
+
+	_, err = NewServiceConfig().Set(func(c *ServiceConfig) { c.RequireCache = true }).Build()
+	if err == nil {
+		t.Errorf("RequireCache without MsgCache should be invalid")
+	}
+	_, err = NewServiceConfig().Set(func(c *ServiceConfig) {
+		c.MinHeartbeat = time.Hour
+		c.MaxHeartbeat = time.Minute
+	}).Build()
+	if err == nil {
+		t.Errorf("MinHeartbeat longer than MaxHeartbeat should be invalid")
+	}
+}
+
+func TestRegisterService(t *testing.T) {
+	center := NewMessageCenter(nil, nil, nil, time.Second, nil, nil)
+	if _, err := center.getServiceCenter("service"); err == nil {
+		t.Errorf("service should not be found without a config")
+	}
+	config, _ := NewServiceConfig().Build()
+	if err := center.RegisterService("service", config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := center.getServiceCenter("service"); err != nil {
+		t.Errorf("service should be registered: %v", err)
+	}
+	if err := center.RegisterService("service", config); err != ErrServiceExists {
+		t.Errorf("service should not be registered twice: %v", err)
+	}
+	if err := center.RegisterService("bad:service", config); err == nil {
+		t.Errorf("bad service name should be rejected")
+	}
+}
+
+// orderedConn records the order in which connections receive messages.
+type orderedConn struct {
+	aliceConn
+	id         string
+	priority   int
+	lastActive time.Time
+	order      *[]string
+}
+
+func (self *orderedConn) UniqId() string {
+	return self.id
+}
+
+func (self *orderedConn) SetPriority(priority int) {
+	self.priority = priority
+}
+
+func (self *orderedConn) Priority() int {
+	return self.priority
+}
+
+func (self *orderedConn) LastActive() time.Time {
+	return self.lastActive
+}
+
+func (self *orderedConn) SendMessage(msg *proto.Message, extra map[string]string, ttl time.Duration) (string, error) {
+	*self.order = append(*self.order, self.id)
+	return "", nil
+}
+
+func TestWritePriority(t *testing.T) {
+	center := newServiceCenter("service", &ServiceConfig{MaxNrConnsPerUser: 3}, nil, nil)
+	var order []string
+	now := time.Now()
+	conns := []*orderedConn{
+		&orderedConn{id: "idle", lastActive: now.Add(-time.Hour), order: &order},
+		&orderedConn{id: "active", lastActive: now, order: &order},
+		&orderedConn{id: "pinned", lastActive: now.Add(-2 * time.Hour), order: &order},
+	}
+	errChan := make(chan error)
+	for _, conn := range conns {
+		center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+		if err := <-errChan; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := center.SetConnPriority("alice", "pinned", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := center.SetConnPriority("alice", "nosuchconn", 1); err != ErrNoConn {
+		t.Errorf("should not find the connection: %v", err)
+	}
+	center.SendMessage("alice", randomMessage(), nil, time.Hour)
+	expected := []string{"pinned", "active", "idle"}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Errorf("should write in order %v: %v", expected, order)
+	}
+}
+
+func TestMaxConcurrentHandshakes(t *testing.T) {
+	errChan := make(chan error, 1)
+	center := NewMessageCenter(nil, nil, &chanReporter{errChan: errChan}, 100*time.Millisecond, nil, nil)
+	center.SetMaxConcurrentHandshakes(1)
+	// Another connection is in the handshake.
+	if !center.acquireHandshake() {
+		t.Fatal("should get the only slot")
+	}
+
+	c, peer := net.Pipe()
+	defer peer.Close()
+	done := make(chan bool)
+	go func() {
+		center.serveConn(c, nil)
+		close(done)
+	}()
+	select {
+	case err := <-errChan:
+		if !strings.Contains(err.Error(), ErrTooManyHandshakes.Error()) {
+			t.Errorf("wrong error reported: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the connection should be rejected")
+	}
+	<-done
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the connection should be closed: %v", err)
+	}
+
+	center.releaseHandshake()
+	if !center.acquireHandshake() {
+		t.Errorf("the slot should be free")
+	}
+}
+
+func TestPushTemplate(t *testing.T) {
+	tmpl, err := NewPushTemplate(map[string]string{
+		"notif.title": "header.subject",
+		"notif.body":  "info.notif.msg",
+		"notif.kind":  "'chat'",
+		"notif.from":  "sender",
+		"notif.none":  "header.nosuchheader",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	center := newServiceCenter("service", &ServiceConfig{PushTemplate: tmpl}, nil, nil)
+	msg := &proto.Message{
+		Sender:        "bob",
+		SenderService: "service",
+		Header:        map[string]string{"subject": "Hi", "title": "Hello"},
+	}
+	info := center.pushInfo(msg, map[string]string{"notif.sound": "ding"}, false)
+	expected := map[string]string{
+		"notif.title":           "Hi",
+		"notif.body":            "Hello",
+		"notif.kind":            "chat",
+		"notif.from":            "bob",
+		"notif.uniqush.msgsize": fmt.Sprint(msg.Size()),
+	}
+	if fmt.Sprint(info) != fmt.Sprint(expected) {
+		t.Errorf("should be %v: %v", expected, info)
+	}
+
+	for _, fields := range []map[string]string{
+		{"notif.title": "footer.subject"},
+		{"notif.uniqush.msgsize": "'1'"},
+	} {
+		if _, err := NewPushTemplate(fields); err == nil {
+			t.Errorf("%v should be invalid", fields)
+		}
+	}
+}
+
+func TestMaxCacheTTL(t *testing.T) {
+	center := newServiceCenter("service", &ServiceConfig{MaxCacheTTL: time.Hour}, nil, nil)
+	cases := map[time.Duration]time.Duration{
+		0:                time.Hour,
+		time.Minute:      time.Minute,
+		time.Hour:        time.Hour,
+		24 * time.Hour:   time.Hour,
+		-1 * time.Second: time.Hour,
+	}
+	for ttl, expected := range cases {
+		if got := center.cacheTTL(ttl); got != expected {
+			t.Errorf("TTL %v should be clamped to %v: %v", ttl, expected, got)
+		}
+	}
+	center = newServiceCenter("service", nil, nil, nil)
+	if got := center.cacheTTL(24 * time.Hour); got != 24*time.Hour {
+		t.Errorf("TTL should not be clamped without MaxCacheTTL: %v", got)
+	}
+}
+
+// sessionConn is a connection supplying a session id.
+type sessionConn struct {
+	orderedConn
+	sessionId string
+	visible   bool
+}
+
+func (self *sessionConn) Labels() map[string]string {
+	return map[string]string{SessionIdLabel: self.sessionId}
+}
+
+func (self *sessionConn) Visible() bool {
+	return self.visible
+}
+
+func (self *sessionConn) SetDefaultVisibility(visible bool) {
+	self.visible = visible
+}
+
+func TestResumeSession(t *testing.T) {
+	center := newServiceCenter("service", &ServiceConfig{SessionRetention: time.Hour}, nil, nil)
+	old := &sessionConn{orderedConn: orderedConn{id: "old"}, sessionId: "s1", visible: false}
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: old, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	if err := center.SetConnPriority("alice", "old", 5); err != nil {
+		t.Fatal(err)
+	}
+	center.connLeave <- &eventConnLeave{conn: old}
+	// Wait for the connection to leave.
+	center.Stats()
+
+	other := &sessionConn{orderedConn: orderedConn{id: "other"}, sessionId: "s2", visible: true}
+	center.resumeSession(other)
+	if other.Priority() != 0 || !other.Visible() {
+		t.Errorf("should not resume another session: %+v", other)
+	}
+
+	resumed := &sessionConn{orderedConn: orderedConn{id: "new"}, sessionId: "s1", visible: true}
+	center.resumeSession(resumed)
+	if resumed.Priority() != 5 || resumed.Visible() {
+		t.Errorf("should resume the session: %+v", resumed)
+	}
+
+	again := &sessionConn{orderedConn: orderedConn{id: "again"}, sessionId: "s1", visible: true}
+	center.resumeSession(again)
+	if again.Priority() != 0 {
+		t.Errorf("a session should only be resumed once: %+v", again)
+	}
+}
+
+func TestSessionRetention(t *testing.T) {
+	store := newSessionStore(time.Minute, 2)
+	now := time.Now()
+	store.save("alice", "s1", &sessionState{priority: 1, savedAt: now.Add(-2 * time.Minute)})
+	if _, ok := store.take("alice", "s1", now); ok {
+		t.Errorf("an expired session should not be resumed")
+	}
+	store.save("alice", "s1", &sessionState{priority: 1, savedAt: now.Add(-time.Second)})
+	store.save("alice", "s2", &sessionState{priority: 2, savedAt: now})
+	store.save("bob", "s1", &sessionState{priority: 3, savedAt: now})
+	if _, ok := store.take("alice", "s1", now); ok {
+		t.Errorf("the oldest session should be evicted")
+	}
+	if state, ok := store.take("bob", "s1", now); !ok || state.priority != 3 {
+		t.Errorf("should resume bob's session: %v %v", state, ok)
+	}
+}
+
+// flakyPush is a push service which fails while it is down.
+type flakyPush struct {
+	countingPush
+	down   int32
+	nrIds  int
+	pushed chan bool
+}
+
+func (self *flakyPush) Push(service, username string, info map[string]string, msgIds []string) error {
+	self.lock.Lock()
+	self.nrIds += len(msgIds)
+	self.lock.Unlock()
+	defer func() { self.pushed <- true }()
+	if atomic.LoadInt32(&self.down) != 0 {
+		return errors.New("push service is down")
+	}
+	return nil
+}
+
+func (self *flakyPush) NrDeliveryPoints(service, username string) int {
+	return 2
+}
+
+func TestRetryPendingPushes(t *testing.T) {
+	pushService := &flakyPush{down: 1, pushed: make(chan bool, 10)}
+	cache := getCache()
+	conf := &ServiceConfig{
+		MsgCache:    cache,
+		PushService: pushService,
+		PushHandler: &allowPushHandler{},
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	center.SendMessage("alice", randomMessage(), nil, time.Hour)
+	<-pushService.pushed
+	// Wait for the failure to be recorded.
+	var pushes []*msgcache.FailedPush
+	for i := 0; i < 100 && len(pushes) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		pushes, _ = cache.(msgcache.PushTracker).FailedPushes("service")
+	}
+	if len(pushes) != 1 || len(pushes[0].Ids) != 2 || pushes[0].Username != "alice" {
+		t.Fatalf("the failed push should be recorded: %v", pushes)
+	}
+
+	stats, err := center.RetryPendingPushes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NrRetried != 1 || stats.NrFailed != 1 {
+		t.Errorf("the push should fail again: %+v", stats)
+	}
+
+	atomic.StoreInt32(&pushService.down, 0)
+	stats, err = center.RetryPendingPushes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NrRetried != 1 || stats.NrFailed != 0 {
+		t.Errorf("the push should succeed: %+v", stats)
+	}
+	if pushService.nrIds != 6 {
+		t.Errorf("should push both ids each time: %v", pushService.nrIds)
+	}
+	stats, err = center.RetryPendingPushes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NrRetried != 0 {
+		t.Errorf("nothing should be left to retry: %+v", stats)
+	}
+
+	cache.(msgcache.PushTracker).SetPushFailed("service", "bob", []string{"nosuchmsg"}, true)
+	stats, err = center.RetryPendingPushes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NrRetried != 0 || stats.NrExpired != 1 {
+		t.Errorf("a push of expired messages should not be retried: %+v", stats)
+	}
+}
+
+// recordingPush sends the info of each notification pushed to a channel.
+type recordingPush struct {
+	countingPush
+	pushes chan map[string]string
+}
+
+func (self *recordingPush) Push(service, username string, info map[string]string, msgIds []string) error {
+	self.pushes <- info
+	return nil
+}
+
+func (self *recordingPush) NrDeliveryPoints(service, username string) int {
+	return 1
+}
+
+func TestCoalescePushes(t *testing.T) {
+	pushService := &recordingPush{pushes: make(chan map[string]string, 10)}
+	window := 500 * time.Millisecond
+	conf := &ServiceConfig{
+		MsgCache:           getCache(),
+		PushService:        pushService,
+		PushHandler:        &allowPushHandler{},
+		MaxPushesPerWindow: 2,
+		PushWindow:         window,
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	// Start at the beginning of a window.
+	now := time.Now()
+	time.Sleep(now.Truncate(window).Add(window).Sub(now))
+	for i := 0; i < 5; i++ {
+		center.SendMessage("alice", randomMessage(), nil, time.Hour)
+	}
+
+	nrCoalesced := ""
+	for i := 0; i < 3; i++ {
+		select {
+		case info := <-pushService.pushes:
+			if n, ok := info["notif.uniqush.nrcoalesced"]; ok {
+				nrCoalesced = n
+			}
+		case <-time.After(2 * window):
+			t.Fatalf("should push 3 notifications, got %v", i)
+		}
+	}
+	if nrCoalesced != "3" {
+		t.Errorf("should coalesce 3 notifications: %v", nrCoalesced)
+	}
+	select {
+	case info := <-pushService.pushes:
+		t.Errorf("should not push more notifications: %v", info)
+	case <-time.After(window):
+	}
+}
+
+// headerConn records the headers of the messages sent to it.
+type headerConn struct {
+	aliceConn
+	headers []map[string]string
+}
+
+func (self *headerConn) SendMessage(msg *proto.Message, extra map[string]string, ttl time.Duration) (string, error) {
+	self.headers = append(self.headers, msg.Header)
+	return "", nil
+}
+
+func TestSequenceMessages(t *testing.T) {
+	conf := &ServiceConfig{MsgCache: getCache(), SequenceMessages: true}
+	center := newServiceCenter("service", conf, nil, nil)
+	if seq, err := center.CurrentSeq("alice"); err != nil || seq != 0 {
+		t.Errorf("no message has been sent: %v %v", seq, err)
+	}
+	conn := new(headerConn)
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	msg := &proto.Message{Header: map[string]string{"title": "hello"}}
+	for i := 0; i < 3; i++ {
+		center.SendMessage("alice", msg, nil, time.Hour)
+	}
+	if _, ok := msg.Header[SeqHeader]; ok {
+		t.Errorf("the message sent should not be changed: %v", msg.Header)
+	}
+	if len(conn.headers) != 3 {
+		t.Fatalf("should receive 3 messages: %v", len(conn.headers))
+	}
+	for i, header := range conn.headers {
+		if header[SeqHeader] != fmt.Sprint(i+1) || header["title"] != "hello" {
+			t.Errorf("wrong header of message %v: %v", i, header)
+		}
+	}
+	if seq, err := center.CurrentSeq("alice"); err != nil || seq != 3 {
+		t.Errorf("the current sequence number should be 3: %v %v", seq, err)
+	}
+}
+
+func TestRetryPendingPushesUnknownService(t *testing.T) {
+	center := NewMessageCenter(nil, nil, nil, time.Second, nil, &nolimitServiceConfigReader{})
+	if _, err := center.RetryPendingPushes("nosuchservice"); err != ErrNoService {
+		t.Errorf("should not find the service: %v", err)
+	}
+	if len(center.serviceCenterMap) != 0 {
+		t.Errorf("should not add the service")
+	}
+}
+
+func TestCurrentSeqUnknownService(t *testing.T) {
+	center := NewMessageCenter(nil, nil, nil, time.Second, nil, &nolimitServiceConfigReader{})
+	if _, err := center.CurrentSeq("nosuchservice", "alice"); err != ErrNoService {
+		t.Errorf("should not find the service: %v", err)
+	}
+	if len(center.serviceCenterMap) != 0 {
+		t.Errorf("should not add the service")
+	}
+}
+
+func TestMaxPendingConns(t *testing.T) {
+	errChan := make(chan error, 10)
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	center := NewMessageCenter(nil, privkey, &chanReporter{errChan: errChan}, time.Second, nil, nil)
+	center.SetMaxPendingConns(1)
+	ln, err := net.Listen("tcp", "127.0.0.1:8973")
+	if err != nil {
+		t.Fatal(err)
+	}
+	center.AddListener(ln, 1, nil)
+	go center.Start()
+
+	// Never finishes the handshake.
+	pending, err := net.Dial("tcp", "127.0.0.1:8973")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pending.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	rejected, err := net.Dial("tcp", "127.0.0.1:8973")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	select {
+	case err := <-errChan:
+		if !strings.Contains(err.Error(), ErrTooManyPendingConns.Error()) {
+			t.Errorf("wrong error reported: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the connection should be rejected")
+	}
+	rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the connection should be closed: %v", err)
+	}
+}
+
+func TestPendingConnsReleasedOnHandshakeLimit(t *testing.T) {
+	errChan := make(chan error, 10)
+	center := NewMessageCenter(nil, nil, &chanReporter{errChan: errChan}, 100*time.Millisecond, nil, nil)
+	center.SetMaxConcurrentHandshakes(1)
+	center.SetMaxPendingConns(2)
+	// Another connection is in the handshake.
+	if !center.acquireHandshake() {
+		t.Fatal("should get the only slot")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:8976")
+	if err != nil {
+		t.Fatal(err)
+	}
+	center.AddListener(ln, 1, nil)
+	go center.Start()
+
+	// Each connection times out waiting for the handshake slot, which
+	// should give back its pending slot as well.
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:8976")
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-errChan:
+			if !strings.Contains(err.Error(), ErrTooManyHandshakes.Error()) {
+				t.Errorf("connection %v: wrong error reported: %v", i, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("connection %v should be rejected", i)
+		}
+		conn.Close()
+	}
+	if n := atomic.LoadInt64(&center.nrPendingConns); n != 0 {
+		t.Errorf("%v connections are still counted as pending", n)
+	}
+}
+
+func TestAcceptFilter(t *testing.T) {
+	errChan := make(chan error, 10)
+	center := NewMessageCenter(nil, nil, &chanReporter{errChan: errChan}, time.Second, nil, nil)
+	filtered := make(chan string, 1)
+	center.SetAcceptFilter(func(remoteAddr net.Addr, service string) (bool, string) {
+		filtered <- service
+		return false, "under maintenance"
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:8975")
+	if err != nil {
+		t.Fatal(err)
+	}
+	center.AddListener(ln, 1, []string{"service"})
+	go center.Start()
+
+	rejected, err := net.Dial("tcp", "127.0.0.1:8975")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	select {
+	case srv := <-filtered:
+		if srv != "service" {
+			t.Errorf("wrong service: %q", srv)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the filter should be called")
+	}
+	select {
+	case err := <-errChan:
+		if !strings.Contains(err.Error(), "under maintenance") {
+			t.Errorf("wrong error reported: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the connection should be rejected")
+	}
+	rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the connection should be closed: %v", err)
+	}
+}
+
+type fixedDeliveryPoints int
+
+func (self fixedDeliveryPoints) NrDeliveryPoints(service, username string) int {
+	return int(self)
+}
+
+func TestDeliveryPointCounter(t *testing.T) {
+	conf := &ServiceConfig{PushService: &recordingPush{}}
+	center := newServiceCenter("service", conf, nil, nil)
+	if n := center.nrDeliveryPoints("service", "alice"); n != 1 {
+		t.Errorf("should be counted by the push service: %v", n)
+	}
+	conf = &ServiceConfig{PushService: &recordingPush{}, DeliveryPointCounter: fixedDeliveryPoints(3)}
+	center = newServiceCenter("service", conf, nil, nil)
+	if n := center.nrDeliveryPoints("service", "alice"); n != 3 {
+		t.Errorf("should be counted by the counter: %v", n)
+	}
+}
+
+func TestSendDedup(t *testing.T) {
+	conn := new(headerConn)
+	dconn := newDedupConn(conn, 100*time.Millisecond)
+	msg := &proto.Message{Id: "1", Header: map[string]string{"title": "hello"}}
+	dconn.SendMessage(msg, nil, time.Hour)
+	dconn.SendMessage(msg, nil, time.Hour)
+	if len(conn.headers) != 1 {
+		t.Errorf("a duplicate should not be written: %v writes", len(conn.headers))
+	}
+
+	noId := &proto.Message{Header: map[string]string{"title": "hello"}}
+	dconn.SendMessage(noId, nil, time.Hour)
+	dconn.SendMessage(noId, nil, time.Hour)
+	if len(conn.headers) != 3 {
+		t.Errorf("messages without id should always be written: %v writes", len(conn.headers))
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	dconn.SendMessage(msg, nil, time.Hour)
+	if len(conn.headers) != 4 {
+		t.Errorf("should be written again after the window: %v writes", len(conn.headers))
+	}
+}
+
+func TestForwardedHeader(t *testing.T) {
+	center := newServiceCenter("service", &ServiceConfig{ForwardRequestHandler: &alwaysForward{}}, nil, nil)
+	conn := new(headerConn)
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	msg := &proto.Message{
+		Sender:        "bob",
+		SenderService: "service",
+		Header:        map[string]string{"title": "hello"},
+	}
+	center.ReceiveForward(&server.ForwardRequest{Receiver: "alice", ReceiverService: "service", TTL: time.Hour, Message: msg})
+	if len(conn.headers) != 1 {
+		t.Fatalf("the message should be forwarded: %v", len(conn.headers))
+	}
+	if conn.headers[0][ForwardedHeader] != "true" || conn.headers[0]["title"] != "hello" {
+		t.Errorf("the forwarded message should be tagged: %v", conn.headers[0])
+	}
+	info := center.pushInfo(msg, nil, true)
+	if info[ForwardedHeader] != "true" || info["uniqush.sender"] != "bob" {
+		t.Errorf("the push info should be tagged: %v", info)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	addr := "127.0.0.1:8974"
+	errChan := make(chan error, 10)
+	center, pubkey, err := getMessageCenter(addr, nil, errChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go center.Start()
+
+	conn, err := connectServer(addr, "alice", pubkey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	srvCenter, _ := center.getServiceCenter("service")
+	for len(srvCenter.UserConns("alice")) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	n, err := center.Shutdown(ctx)
+	if err != nil || n != 1 {
+		t.Errorf("should drain the connection: %v %v", n, err)
+	}
+	if _, err := conn.ReadMessage(); err == nil {
+		t.Errorf("the connection should be closed")
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Errorf("should not accept connections any more")
+	}
+}
+
+// chanMessageHandler sends the messages it receives to a channel.
+type chanMessageHandler chan *proto.Message
+
+func (self chanMessageHandler) OnMessage(connId string, msg *proto.Message) {
+	self <- msg
+}
+
+func TestMessageRoutes(t *testing.T) {
+	def := make(chanMessageHandler, 1)
+	chat := make(chanMessageHandler, 1)
+	conf := &ServiceConfig{
+		MessageHandler:     def,
+		MessageRouteHeader: "type",
+		MessageRoutes:      map[string]evthandler.MessageHandler{"chat": chat},
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	cases := []struct {
+		msgType string
+		handler chanMessageHandler
+	}{
+		{"chat", chat},
+		{"telemetry", def},
+		{"", def},
+	}
+	for _, c := range cases {
+		msg := &proto.Message{Header: map[string]string{}}
+		if len(c.msgType) > 0 {
+			msg.Header["type"] = c.msgType
+		}
+		center.reportMessage("conn", msg)
+		select {
+		case m := <-c.handler:
+			if m != msg {
+				t.Errorf("%q: wrong message", c.msgType)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%q: routed to the wrong handler", c.msgType)
+		}
+	}
+}
+
+type deliveryOutcome struct {
+	username string
+	outcome  string
+	nrConns  int
+}
+
+// chanDeliveryHandler sends the outcome of each message to a channel.
+type chanDeliveryHandler chan *deliveryOutcome
+
+func (self chanDeliveryHandler) OnDelivery(service, username string, msg *proto.Message, outcome string, nrConns int) {
+	self <- &deliveryOutcome{username, outcome, nrConns}
+}
+
+func TestDeliveryHandler(t *testing.T) {
+	outcomes := make(chanDeliveryHandler, 1)
+	conf := &ServiceConfig{
+		MsgCache:        getCache(),
+		PushService:     &recordingPush{pushes: make(chan map[string]string, 10)},
+		PushHandler:     &allowPushHandler{},
+		DeliveryHandler: outcomes,
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	conn := new(headerConn)
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	msg := &proto.Message{Header: map[string]string{"title": "hello"}}
+	expected := []*deliveryOutcome{
+		{"alice", evthandler.DeliveredOnline, 1},
+		{"bob", evthandler.DeliveryCached, 0},
+	}
+	for _, e := range expected {
+		center.SendMessage(e.username, msg, nil, time.Hour)
+		select {
+		case o := <-outcomes:
+			if *o != *e {
+				t.Errorf("%v: got %+v", e.username, o)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v: no outcome reported", e.username)
+		}
+	}
+
+	conf.PushHandler = nil
+	center.SendMessage("carol", msg, nil, time.Hour)
+	select {
+	case o := <-outcomes:
+		if o.outcome != evthandler.DeliveryFailed {
+			t.Errorf("a message not pushed should fail: %+v", o)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no outcome reported")
+	}
+}
+
+// floodConn keeps sending messages as fast as it can.
+type floodConn struct {
+	aliceConn
+	closed chan proto.CloseCode
+}
+
+func (self *floodConn) SetForwardRequestChannel(fwdChan chan<- *server.ForwardRequest) {}
+func (self *floodConn) SetSubscribeRequestChan(ch chan<- *server.SubscribeRequest)     {}
+func (self *floodConn) SetDeleteOnReceipt(d bool)                                      {}
+func (self *floodConn) SetAckBeforeDelete(a bool)                                      {}
+func (self *floodConn) SetMaxReplayAge(maxAge time.Duration)                           {}
+
+func (self *floodConn) ReadMessage() (*proto.Message, error) {
+	return &proto.Message{Header: map[string]string{"title": "hello"}}, nil
+}
+
+func (self *floodConn) CloseWithReason(code proto.CloseCode, reason string, retryAfter time.Duration) error {
+	self.closed <- code
+	return nil
+}
+
+func TestConnMessageRateLimit(t *testing.T) {
+	msgChan := make(chan *proto.Message, 10)
+	errChan := make(chan error, 10)
+	chr := &chanReporter{msgChan, errChan}
+	conf := &ServiceConfig{
+		MessageHandler:      chr,
+		ErrorHandler:        chr,
+		MaxNrConnMessages:   3,
+		ConnMessageInterval: time.Hour,
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	conn := &floodConn{closed: make(chan proto.CloseCode, 1)}
+	go center.serveConn(conn)
+	select {
+	case code := <-conn.closed:
+		if code != proto.CloseRateLimited {
+			t.Errorf("wrong close code: %v", code)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the connection should be closed")
+	}
+	select {
+	case err := <-errChan:
+		if !strings.Contains(err.Error(), ErrTooManyMessages.Error()) {
+			t.Errorf("wrong error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the violation should be reported")
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-msgChan:
+		case <-time.After(time.Second):
+			t.Fatalf("message %v should be received", i)
+		}
+	}
+	select {
+	case <-msgChan:
+		t.Errorf("should not receive messages beyond the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// blockingConn blocks in SendMessage until release is closed.
+type blockingConn struct {
+	aliceConn
+	sending chan bool
+	release chan bool
+}
+
+func (self *blockingConn) SendMessage(msg *proto.Message, extra map[string]string, ttl time.Duration) (string, error) {
+	self.sending <- true
+	<-self.release
+	return "", nil
+}
+
+func TestTrySendMessage(t *testing.T) {
+	center := newServiceCenter("service", &ServiceConfig{SendBufferSize: 1}, nil, nil)
+	conn := &blockingConn{sending: make(chan bool, 10), release: make(chan bool)}
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	msg := &proto.Message{Header: map[string]string{"title": "hello"}}
+
+	// The first message keeps the service busy and the second one
+	// fills the buffer.
+	done := make(chan bool)
+	go func() {
+		center.SendMessage("alice", msg, nil, time.Hour)
+		done <- true
+	}()
+	<-conn.sending
+	go func() {
+		center.SendMessage("alice", msg, nil, time.Hour)
+		done <- true
+	}()
+	for len(center.writeReqChan) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := center.TrySendMessage("alice", msg, nil, time.Hour); err != ErrBusy {
+		t.Errorf("should be busy: %v", err)
+	}
+
+	close(conn.release)
+	<-done
+	<-done
+	res, err := center.TrySendMessage("alice", msg, nil, time.Hour)
+	if err != nil || len(res) != 1 || res[0].Err != nil {
+		t.Errorf("should send the message: %v %v", res, err)
+	}
+}
+
+func TestDisallowForward(t *testing.T) {
+	errChan := make(chan error, 1)
+	conf := &ServiceConfig{
+		ForwardRequestHandler: &alwaysForward{},
+		ErrorHandler:          &chanReporter{nil, errChan},
+		DisallowForward:       true,
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	conn := new(headerConn)
+	connErr := make(chan error)
+	center.connIn <- &eventConnIn{conn: conn, errChan: connErr}
+	if err := <-connErr; err != nil {
+		t.Fatal(err)
+	}
+	msg := &proto.Message{
+		Sender:        "bob",
+		SenderService: "service",
+		Header:        map[string]string{"title": "hello"},
+	}
+	accepted := true
+	center.ReceiveForward(&server.ForwardRequest{
+		Receiver:        "alice",
+		ReceiverService: "service",
+		TTL:             time.Hour,
+		Message:         msg,
+		Reply: func(ok bool, n int) {
+			accepted = ok
+		},
+	})
+	if accepted || len(conn.headers) != 0 {
+		t.Errorf("the message should not be forwarded: %v %v", accepted, len(conn.headers))
+	}
+	select {
+	case err := <-errChan:
+		if !strings.Contains(err.Error(), ErrForwardNotAllowed.Error()) {
+			t.Errorf("wrong error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the attempt should be reported")
+	}
+}
+
+// sharedConfigReader returns the same config for all services.
+type sharedConfigReader struct {
+	config *ServiceConfig
+}
+
+func (self *sharedConfigReader) ReadConfig(service string) *ServiceConfig {
+	return self.config
+}
+
+// otherServiceConn is a connection of alice in another service.
+type otherServiceConn struct {
+	headerConn
+}
+
+func (self *otherServiceConn) Service() string {
+	return "other"
+}
+
+func TestGroupServices(t *testing.T) {
+	center := NewMessageCenter(nil, nil, nil, time.Second, nil, &sharedConfigReader{new(ServiceConfig)})
+	center.SetGroupServices(true)
+	srv := center.AddService("service")
+	other := center.AddService("other")
+	if srv.group != other.group || srv.writeReqChan != other.writeReqChan {
+		t.Fatal("the services should share the goroutine")
+	}
+
+	conn := new(headerConn)
+	otherConn := new(otherServiceConn)
+	errChan := make(chan error)
+	srv.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	other.connIn <- &eventConnIn{conn: otherConn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.UserConns("alice")) != 1 || len(other.UserConns("alice")) != 1 {
+		t.Errorf("each service should keep its own connections: %v %v",
+			len(srv.UserConns("alice")), len(other.UserConns("alice")))
+	}
+
+	msg := &proto.Message{Header: map[string]string{"title": "hello"}}
+	other.SendMessage("alice", msg, nil, time.Hour)
+	if len(conn.headers) != 0 || len(otherConn.headers) != 1 {
+		t.Errorf("the message should only reach the other service: %v %v", len(conn.headers), len(otherConn.headers))
+	}
+}
+
+type presence struct {
+	username string
+	online   bool
+}
+
+type watcherConn struct {
+	aliceConn
+	presence chan *presence
+}
+
+func (self *watcherConn) Username() string {
+	return "bob"
+}
+
+func (self *watcherConn) UniqId() string {
+	return "2"
+}
+
+func (self *watcherConn) WritePresence(username string, online bool) error {
+	self.presence <- &presence{username, online}
+	return nil
+}
+
+func TestPresence(t *testing.T) {
+	config := &ServiceConfig{MaxNrWatches: 1}
+	srv := newServiceCenter("service", config, nil, nil)
+	watcher := &watcherConn{presence: make(chan *presence, 4)}
+	errChan := make(chan error)
+	srv.connIn <- &eventConnIn{conn: watcher, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	srv.watchReqChan <- &server.WatchRequest{
+		Watch:    true,
+		Service:  "service",
+		Username: "bob",
+		ConnId:   "2",
+		Users:    []string{"alice", "carol"},
+	}
+	if p := <-watcher.presence; p.username != "alice" || p.online {
+		t.Errorf("alice should be offline: %+v", p)
+	}
+
+	alice := new(aliceConn)
+	srv.connIn <- &eventConnIn{conn: alice, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	if p := <-watcher.presence; p.username != "alice" || !p.online {
+		t.Errorf("alice should be online: %+v", p)
+	}
+	srv.connLeave <- &eventConnLeave{conn: alice}
+	if p := <-watcher.presence; p.username != "alice" || p.online {
+		t.Errorf("alice should be offline: %+v", p)
+	}
+
+	srv.watchReqChan <- &server.WatchRequest{Service: "service", Username: "bob", ConnId: "2", Users: []string{"alice"}}
+	srv.connIn <- &eventConnIn{conn: alice, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-watcher.presence:
+		t.Errorf("unwatched presence: %+v", p)
+	default:
+	}
+}
+
+func TestSlowWatcher(t *testing.T) {
+	srv := newServiceCenter("service", &ServiceConfig{MaxNrWatches: 1}, nil, nil)
+	// Nobody reads the presence written to the watcher.
+	watcher := &watcherConn{presence: make(chan *presence)}
+	errChan := make(chan error)
+	srv.connIn <- &eventConnIn{conn: watcher, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	srv.watchReqChan <- &server.WatchRequest{Watch: true, Service: "service", Username: "bob", ConnId: "2", Users: []string{"alice"}}
+
+	done := make(chan bool)
+	go func() {
+		alice := new(aliceConn)
+		srv.connIn <- &eventConnIn{conn: alice, errChan: errChan}
+		<-errChan
+		srv.connLeave <- &eventConnLeave{conn: alice}
+		srv.UserConns("alice")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the service should not wait for the watcher")
+	}
+	if p := <-watcher.presence; p.username != "alice" {
+		t.Errorf("wrong presence: %+v", p)
+	}
+}
+
+func TestSendToActiveConn(t *testing.T) {
+	center := newServiceCenter("service", &ServiceConfig{MaxNrConnsPerUser: 2}, nil, nil)
+	var order []string
+	now := time.Now()
+	conns := []*orderedConn{
+		&orderedConn{id: "idle", lastActive: now.Add(-time.Hour), order: &order},
+		&orderedConn{id: "active", lastActive: now.Add(-time.Minute), order: &order},
+	}
+	errChan := make(chan error)
+	for _, conn := range conns {
+		center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+		if err := <-errChan; err != nil {
+			t.Fatal(err)
+		}
+	}
+	center.SendToActiveConn("alice", randomMessage(), nil, time.Hour, 10*time.Minute)
+	if fmt.Sprint(order) != "[active]" {
+		t.Errorf("should only write to the active connection: %v", order)
+	}
+
+	// No connection was active recently.
+	order = nil
+	center.SendToActiveConn("alice", randomMessage(), nil, time.Hour, time.Second)
+	if len(order) != 2 {
+		t.Errorf("should write to all connections: %v", order)
+	}
+}
+
+func TestExtraSize(t *testing.T) {
+	config := &ServiceConfig{MaxNrExtraKeys: 2, MaxExtraSize: 16}
+	center := newServiceCenter("service", config, nil, nil)
+	conn := new(headerConn)
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	extra := map[string]string{"notif.a": "1", "notif.b": "2", "notif.c": "3"}
+	res := center.SendMessage("alice", randomMessage(), extra, time.Hour)
+	if len(res) != 1 || res[0].Err != ErrExtraTooLarge || res[0].Code != ResultTooLarge {
+		t.Errorf("too many keys should be rejected: %v", res)
+	}
+	extra = map[string]string{"notif.a": "a long long value"}
+	res = center.SendMessage("alice", randomMessage(), extra, time.Hour)
+	if len(res) != 1 || res[0].Err != ErrExtraTooLarge {
+		t.Errorf("too long values should be rejected: %v", res)
+	}
+	if len(conn.headers) != 0 {
+		t.Errorf("rejected messages should not be sent")
+	}
+	extra = map[string]string{"notif.a": "1", "uniqush.sender": "a reserved key is not counted"}
+	res = center.SendMessage("alice", randomMessage(), extra, time.Hour)
+	if len(res) != 1 || res[0].Err != nil {
+		t.Errorf("the message should be sent: %v", res)
+	}
+
+	extra = map[string]string{"notif.a": "1", "notif.b": "a long long value", "notif.c": "3", "uniqush.sender": "bob"}
+	center.clampExtra(extra)
+	if len(extra) != 3 || extra["notif.a"] != "1" || extra["notif.c"] != "3" || extra["uniqush.sender"] != "bob" {
+		t.Errorf("bad clamped extra: %v", extra)
+	}
+}
+
+func TestAuditLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	logger, err := NewFileAuditLogger(path, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	center := newServiceCenter("service", &ServiceConfig{AuditLogger: logger}, nil, nil)
+	conn := new(headerConn)
+	errChan := make(chan error)
+	center.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &proto.Message{Id: "1", Header: map[string]string{"title": "hello"}, Body: []byte("body")}
+	center.SendMessage("alice", msg, nil, time.Hour)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry auditEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		t.Fatalf("bad entry %q: %v", data, err)
+	}
+	if entry.Direction != AuditOutbound || entry.Username != "alice" || entry.ConnId != center.connId(conn) ||
+		entry.Id != "1" || entry.Header["title"] != "hello" || string(entry.Body) != "body" {
+		t.Errorf("bad entry: %+v", entry)
+	}
+
+	// The file is rotated before it grows beyond 300 bytes.
+	for i := 0; i < 5; i++ {
+		center.SendMessage("alice", msg, nil, time.Hour)
+	}
+	files, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Errorf("the file should be rotated: %v", files)
+	}
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 300 {
+			t.Errorf("%v is too large: %v bytes", f, info.Size())
+		}
+	}
+}
+
+// partialPush fails to push to the second delivery point.
+type partialPush struct {
+	countingPush
+}
+
+func (self *partialPush) Push(service, username string, info map[string]string, msgIds []string) error {
+	return nil
+}
+
+func (self *partialPush) PushDetailed(service, username string, info map[string]string, msgIds []string) ([]*push.PushResult, error) {
+	res := make([]*push.PushResult, len(msgIds))
+	for i, id := range msgIds {
+		res[i] = &push.PushResult{MsgId: id, DeliveryPoint: fmt.Sprint(i)}
+	}
+	res[1].Err = errors.New("bad token")
+	return res, nil
+}
+
+func (self *partialPush) NrDeliveryPoints(service, username string) int {
+	return 2
+}
+
+type chanErrorHandler chan error
+
+func (self chanErrorHandler) OnError(service, username, connId, addr string, err error) {
+	self <- err
+}
+
+func TestPartialPush(t *testing.T) {
+	cache := getCache()
+	errChan := make(chanErrorHandler, 10)
+	conf := &ServiceConfig{
+		MsgCache:              cache,
+		PushService:           new(partialPush),
+		ErrorHandler:          errChan,
+		RetryFailedPushPoints: true,
+	}
+	center := newServiceCenter("service", conf, nil, nil)
+	err := center.pushNotif("service", "alice", randomMessage(), nil, []string{"1", "2"}, false)
+	if err != nil {
+		t.Errorf("a partial failure should not fail the push: %v", err)
+	}
+	perr, ok := (<-errChan).(*PartialPushError)
+	if !ok || perr.NrPoints != 2 || len(perr.Failed) != 1 || perr.Failed[0].MsgId != "2" {
+		t.Errorf("should report the partial failure: %v", perr)
+	}
+	pushes, _ := cache.(msgcache.PushTracker).FailedPushes("service")
+	if len(pushes) != 1 || len(pushes[0].Ids) != 1 || pushes[0].Ids[0] != "2" {
+		t.Errorf("only the failed message should be retried: %v", pushes)
+	}
+}
+
+type rawConn struct {
+	aliceConn
+	raws chan []byte
+}
+
+func (self *rawConn) SendRawMessage(raw []byte, msg *proto.Message, extra map[string]string, ttl time.Duration) (string, error) {
+	self.raws <- raw
+	return "", nil
+}
+
+func TestSendRawMessage(t *testing.T) {
+	center := NewMessageCenter(nil, nil, nil, time.Second, nil, &sharedConfigReader{new(ServiceConfig)})
+	srv := center.AddService("service")
+	conn := &rawConn{raws: make(chan []byte, 1)}
+	errChan := make(chan error)
+	srv.connIn <- &eventConnIn{conn: conn, errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &proto.Command{Type: proto.CMD_DATA, Message: randomMessage()}
+	raw, err := cmd.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := center.SendRawMessage("service", "alice", raw, nil, time.Hour)
+	if len(res) != 1 || res[0].Err != nil {
+		t.Errorf("the message should be sent: %v", res)
+	}
+	if sent := <-conn.raws; !bytes.Equal(sent, raw) {
+		t.Errorf("the raw message should be written as is")
+	}
+
+	res = center.SendRawMessage("service", "alice", raw[:3], nil, time.Hour)
+	if len(res) != 1 || res[0].Code != ResultBadRequest {
+		t.Errorf("a malformed message should be rejected: %v", res)
+	}
+}
+
+func TestSendRawMessageDedup(t *testing.T) {
+	center := NewMessageCenter(nil, nil, nil, time.Second, nil, &sharedConfigReader{&ServiceConfig{SendDedupWindow: time.Hour}})
+	srv := center.AddService("service")
+	conn := &rawConn{raws: make(chan []byte, 2)}
+	errChan := make(chan error)
+	srv.connIn <- &eventConnIn{conn: newDedupConn(conn, time.Hour), errChan: errChan}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	msg := randomMessage()
+	msg.Header[ClientMsgIdHeader] = "1"
+	cmd := &proto.Command{Type: proto.CMD_DATA, Message: msg}
+	raw, err := cmd.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		res := center.SendRawMessage("service", "alice", raw, nil, time.Hour)
+		if len(res) != 1 || res[0].Err != nil {
+			t.Errorf("the message should be sent: %v", res)
+		}
+	}
+	if n := len(conn.raws); n != 1 {
+		t.Errorf("a duplicate should not be written: %v writes", n)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	oldCenter, oldPubkey, err := getMessageCenter("127.0.0.1:8977", nil, errChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go oldCenter.Start()
+	newCenter, newPubkey, err := getMessageCenter("127.0.0.1:8978", nil, errChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go newCenter.Start()
+
+	conn, err := connectServer("127.0.0.1:8977", "alice", oldPubkey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	buf := new(bytes.Buffer)
+	if err := oldCenter.ExportConns(buf); err != nil {
+		t.Fatal(err)
+	}
+	var descs []*ConnDescriptor
+	if err := json.Unmarshal(buf.Bytes(), &descs); err != nil {
+		t.Fatalf("bad format %q: %v", buf.String(), err)
+	}
+	if len(descs) != 1 || descs[0].Service != "service" || descs[0].Username != "alice" || len(descs[0].ConnId) == 0 {
+		t.Errorf("bad descriptors: %q", buf.String())
+	}
+
+	if err := newCenter.ImportExpectedConns(buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := newCenter.NrExpectedConns(); n != 1 {
+		t.Errorf("should expect one connection: %v", n)
+	}
+	if n := oldCenter.Drain(); n != 1 {
+		t.Errorf("should drain one connection: %v", n)
+	}
+	conn.Close()
+
+	conn, err = connectServer("127.0.0.1:8978", "alice", newPubkey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n := newCenter.NrExpectedConns(); n != 0 {
+		t.Errorf("the connection should be back: %v", n)
+	}
 }
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy decides what to do with a message sent to
+// a connection whose outbound queue is full.
+type OverflowPolicy int
+
+const (
+	// Close the connection. The client may fetch the
+	// cached messages after reconnecting.
+	OverflowDisconnect OverflowPolicy = iota
+	OverflowDropOldest
+	OverflowDropNewest
+)
+
+func (self OverflowPolicy) String() string {
+	switch self {
+	case OverflowDisconnect:
+		return "disconnect"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDropNewest:
+		return "drop-newest"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(self))
+}
+
+var ErrOutboundQueueFull = errors.New("outbound queue is full")
+
+type outboundMessage struct {
+	msg   *proto.Message
+	extra map[string]string
+	ttl   time.Duration
+
+	// If not nil, msg marshaled. See server.Conn.SendRawMessage.
+	raw []byte
+}
+
+// queuedConn sends messages to the client in its own goroutine,
+// so that a slow client does not block the service center.
+type queuedConn struct {
+	server.Conn
+	queue    chan *outboundMessage
+	policy   OverflowPolicy
+	center   *serviceCenter
+	quit     chan bool
+	quitOnce sync.Once
+}
+
+func newQueuedConn(conn server.Conn, size int, policy OverflowPolicy, center *serviceCenter) *queuedConn {
+	ret := new(queuedConn)
+	ret.Conn = conn
+	ret.queue = make(chan *outboundMessage, size)
+	ret.policy = policy
+	ret.center = center
+	ret.quit = make(chan bool)
+	go ret.run()
+	return ret
+}
+
+func (self *queuedConn) run() {
+	for {
+		select {
+		case out := <-self.queue:
+			var err error
+			if out.raw != nil {
+				_, err = sendRawMessage(self.Conn, out.raw, out.msg, out.extra, out.ttl)
+			} else {
+				_, err = sendMessage(self.Conn, out.msg, out.extra, out.ttl)
+			}
+			if err != nil {
+				self.reportError(err)
+				// The reading goroutine will then find the connection closed.
+				self.Close()
+				return
+			}
+		case <-self.quit:
+			return
+		}
+	}
+}
+
+func (self *queuedConn) reportError(err error) {
+	self.center.reportError(self.Service(), self.Username(), self.center.connId(self), self.RemoteAddr().String(), err)
+}
+
+// SendMessage queues the message. The returned id is always empty.
+func (self *queuedConn) SendMessage(msg *proto.Message, extra map[string]string, ttl time.Duration) (id string, err error) {
+	return "", self.enqueue(&outboundMessage{msg: msg, extra: extra, ttl: ttl})
+}
+
+// SendRawMessage queues the message like SendMessage.
+func (self *queuedConn) SendRawMessage(raw []byte, msg *proto.Message, extra map[string]string, ttl time.Duration) (id string, err error) {
+	return "", self.enqueue(&outboundMessage{msg: msg, extra: extra, ttl: ttl, raw: raw})
+}
+
+func (self *queuedConn) enqueue(out *outboundMessage) (err error) {
+	select {
+	case self.queue <- out:
+		return
+	default:
+	}
+	switch self.policy {
+	case OverflowDropOldest:
+		select {
+		case <-self.queue:
+		default:
+		}
+		select {
+		case self.queue <- out:
+		default:
+			// The queue was filled again in the meantime.
+		}
+		self.reportError(fmt.Errorf("%v: dropped the oldest message", ErrOutboundQueueFull))
+	case OverflowDropNewest:
+		self.reportError(fmt.Errorf("%v: dropped the newest message", ErrOutboundQueueFull))
+	default:
+		// The caller removes the connection.
+		err = ErrOutboundQueueFull
+	}
+	return
+}
+
+func (self *queuedConn) stop() {
+	self.quitOnce.Do(func() {
+		close(self.quit)
+	})
+}
+
+func (self *queuedConn) Close() error {
+	self.stop()
+	return self.Conn.Close()
+}
+
+func (self *queuedConn) CloseWithReason(code proto.CloseCode, reason string, retryAfter time.Duration) error {
+	self.stop()
+	return self.Conn.CloseWithReason(code, reason, retryAfter)
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"sync"
+)
+
+// presenceWriter writes the presence of the users watched by a
+// connection in its own goroutine, so that a slow watcher does not
+// block the service center. Only the latest presence of each user
+// is kept until it is written.
+type presenceWriter struct {
+	conn    server.Conn
+	center  *serviceCenter
+	lock    sync.Mutex
+	pending map[string]bool
+	wake    chan bool
+	quit    chan bool
+}
+
+func newPresenceWriter(conn server.Conn, center *serviceCenter) *presenceWriter {
+	ret := new(presenceWriter)
+	ret.conn = conn
+	ret.center = center
+	ret.pending = make(map[string]bool, 4)
+	ret.wake = make(chan bool, 1)
+	ret.quit = make(chan bool)
+	go ret.run()
+	return ret
+}
+
+func (self *presenceWriter) write(username string, online bool) {
+	self.lock.Lock()
+	self.pending[username] = online
+	self.lock.Unlock()
+	select {
+	case self.wake <- true:
+	default:
+	}
+}
+
+func (self *presenceWriter) run() {
+	for {
+		select {
+		case <-self.wake:
+		case <-self.quit:
+			return
+		}
+		self.lock.Lock()
+		pending := self.pending
+		self.pending = make(map[string]bool, len(pending))
+		self.lock.Unlock()
+		for username, online := range pending {
+			if err := self.conn.WritePresence(username, online); err != nil {
+				conn := self.conn
+				self.center.reportError(conn.Service(), conn.Username(), self.center.connId(conn), conn.RemoteAddr().String(), err)
+				return
+			}
+		}
+	}
+}
+
+func (self *presenceWriter) stop() {
+	close(self.quit)
+}
+
+// watch lets the connection watch the users, as long as it watches
+// no more than max users. It returns the users newly watched, and
+// ErrTooManyWatches if some of the users are left out.
+func (self *serviceState) watch(conn server.Conn, users []string, max int) (added []string, err error) {
+	watching := self.watching[conn]
+	if watching == nil {
+		watching = make(map[string]bool, len(users))
+		self.watching[conn] = watching
+	}
+	for _, username := range users {
+		if watching[username] {
+			continue
+		}
+		if len(watching) >= max {
+			err = ErrTooManyWatches
+			break
+		}
+		watching[username] = true
+		watchers := self.watchers[username]
+		if watchers == nil {
+			watchers = make(map[server.Conn]bool, 4)
+			self.watchers[username] = watchers
+		}
+		watchers[conn] = true
+		added = append(added, username)
+	}
+	return
+}
+
+func (self *serviceState) unwatch(conn server.Conn, users []string) {
+	watching := self.watching[conn]
+	for _, username := range users {
+		if !watching[username] {
+			continue
+		}
+		delete(watching, username)
+		delete(self.watchers[username], conn)
+		if len(self.watchers[username]) == 0 {
+			delete(self.watchers, username)
+		}
+	}
+	if len(watching) == 0 {
+		delete(self.watching, conn)
+		if w, ok := self.presence[conn]; ok {
+			w.stop()
+			delete(self.presence, conn)
+		}
+	}
+}
+
+// forget removes all the watches of a closed connection.
+func (self *serviceState) forget(conn server.Conn) {
+	watching := self.watching[conn]
+	if len(watching) == 0 {
+		return
+	}
+	users := make([]string, 0, len(watching))
+	for username := range watching {
+		users = append(users, username)
+	}
+	self.unwatch(conn, users)
+}
+
+func (self *serviceState) isOnline(username string) bool {
+	return len(self.connMap.GetConn(username)) > 0
+}
+
+// findConn returns the connection of the user with the uniq id.
+func (self *serviceState) findConn(username, uniqId string) server.Conn {
+	for _, conn := range self.connMap.GetConn(username) {
+		if conn.UniqId() != uniqId {
+			continue
+		}
+		if sconn, ok := conn.(server.Conn); ok {
+			return sconn
+		}
+	}
+	return nil
+}
+
+// presenceTo returns the writer of the presence to the watching
+// connection, starting one if there is none.
+func (self *serviceCenter) presenceTo(st *serviceState, conn server.Conn) *presenceWriter {
+	w, ok := st.presence[conn]
+	if !ok {
+		w = newPresenceWriter(conn, self)
+		st.presence[conn] = w
+	}
+	return w
+}
+
+// notifyPresence tells the connections watching the user that the user
+// came online or went offline.
+func (self *serviceCenter) notifyPresence(st *serviceState, username string, online bool) {
+	for conn := range st.watchers[username] {
+		self.presenceTo(st, conn).write(username, online)
+	}
+}
+
+func (self *serviceCenter) processWatch(st *serviceState, req *server.WatchRequest) {
+	conn := st.findConn(req.Username, req.ConnId)
+	if conn == nil {
+		return
+	}
+	if !req.Watch {
+		st.unwatch(conn, req.Users)
+		return
+	}
+	added, err := st.watch(conn, req.Users, self.config.MaxNrWatches)
+	if err != nil {
+		self.reportError(conn.Service(), conn.Username(), self.connId(conn), conn.RemoteAddr().String(), err)
+	}
+	// Tell the current presence of the users newly watched.
+	for _, username := range added {
+		self.presenceTo(st, conn).write(username, st.isOnline(username))
+	}
+}
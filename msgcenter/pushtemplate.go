@@ -0,0 +1,115 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"strings"
+)
+
+// A PushTemplate builds the info of the notifications pushed for a
+// service, instead of the info built by default. It maps each key of
+// the info to the source of its value, which is one of:
+//
+//	header.NAME     the header NAME of the message
+//	info.NAME       the field NAME of the info built by default
+//	sender          the sender of the message
+//	sender-service  the service of the sender
+//	body            the body of the message
+//	'TEXT'          the text itself
+//
+// A key is left out if its source has no value. Reserved fields, like
+// notif.uniqush.msgsize, are always kept.
+type PushTemplate struct {
+	fields map[string]pushSource
+}
+
+type pushSource func(msg *proto.Message, info map[string]string) (value string, ok bool)
+
+func NewPushTemplate(fields map[string]string) (*PushTemplate, error) {
+	ret := &PushTemplate{fields: make(map[string]pushSource, len(fields))}
+	for key, expr := range fields {
+		if isReservedExtra(key) {
+			return nil, fmt.Errorf("invalid key %v: keys starting with %v are reserved", key, strings.Join(reservedExtraPrefixes, " or "))
+		}
+		src, err := parsePushSource(expr)
+		if err != nil {
+			return nil, fmt.Errorf("[key=%v] %v", key, err)
+		}
+		ret.fields[key] = src
+	}
+	return ret, nil
+}
+
+func parsePushSource(expr string) (src pushSource, err error) {
+	switch {
+	case len(expr) >= 2 && strings.HasPrefix(expr, "'") && strings.HasSuffix(expr, "'"):
+		text := expr[1 : len(expr)-1]
+		src = func(msg *proto.Message, info map[string]string) (string, bool) {
+			return text, true
+		}
+	case strings.HasPrefix(expr, "header.") && len(expr) > len("header."):
+		name := expr[len("header."):]
+		src = func(msg *proto.Message, info map[string]string) (v string, ok bool) {
+			v, ok = msg.Header[name]
+			return
+		}
+	case strings.HasPrefix(expr, "info.") && len(expr) > len("info."):
+		name := expr[len("info."):]
+		src = func(msg *proto.Message, info map[string]string) (v string, ok bool) {
+			v, ok = info[name]
+			return
+		}
+	case expr == "sender":
+		src = func(msg *proto.Message, info map[string]string) (string, bool) {
+			return msg.Sender, len(msg.Sender) > 0
+		}
+	case expr == "sender-service":
+		src = func(msg *proto.Message, info map[string]string) (string, bool) {
+			return msg.SenderService, len(msg.SenderService) > 0
+		}
+	case expr == "body":
+		src = func(msg *proto.Message, info map[string]string) (string, bool) {
+			return string(msg.Body), len(msg.Body) > 0
+		}
+	default:
+		err = fmt.Errorf("unknown source %q", expr)
+	}
+	return
+}
+
+// Apply returns the info built from the message and the info built by
+// default, which is not modified.
+func (self *PushTemplate) Apply(msg *proto.Message, info map[string]string) map[string]string {
+	ret := make(map[string]string, len(self.fields)+len(info))
+	for k, v := range info {
+		for _, prefix := range reservedExtraPrefixes {
+			if strings.HasPrefix(k, prefix) {
+				ret[k] = v
+				break
+			}
+		}
+	}
+	for key, src := range self.fields {
+		if v, ok := src(msg, info); ok {
+			ret[key] = v
+		}
+	}
+	return ret
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"sync"
+	"time"
+)
+
+// Keep at most this many sessions unless
+// ServiceConfig.MaxNrSessions says otherwise.
+const defaultMaxNrSessions = 10000
+
+// sessionState is the state of a connection which is restored when
+// the client reconnects with the same session id.
+type sessionState struct {
+	priority int
+	visible  bool
+	savedAt  time.Time
+}
+
+// sessionStore keeps the state of closed connections for a while,
+// keyed by the user and the session id supplied by the client.
+type sessionStore struct {
+	lock      sync.Mutex
+	sessions  map[string]*sessionState
+	retention time.Duration
+	max       int
+}
+
+func newSessionStore(retention time.Duration, max int) *sessionStore {
+	ret := new(sessionStore)
+	ret.sessions = make(map[string]*sessionState)
+	ret.retention = retention
+	ret.max = max
+	if ret.max <= 0 {
+		ret.max = defaultMaxNrSessions
+	}
+	return ret
+}
+
+func sessionKey(username, sessionId string) string {
+	return username + "\n" + sessionId
+}
+
+func (self *sessionStore) sweep(now time.Time) {
+	for key, state := range self.sessions {
+		if now.Sub(state.savedAt) > self.retention {
+			delete(self.sessions, key)
+		}
+	}
+}
+
+// evictOldest removes the session saved earliest.
+func (self *sessionStore) evictOldest() {
+	var oldest string
+	var oldestAt time.Time
+	for key, state := range self.sessions {
+		if len(oldest) == 0 || state.savedAt.Before(oldestAt) {
+			oldest = key
+			oldestAt = state.savedAt
+		}
+	}
+	delete(self.sessions, oldest)
+}
+
+func (self *sessionStore) save(username, sessionId string, state *sessionState) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.sessions) >= self.max {
+		self.sweep(state.savedAt)
+	}
+	if len(self.sessions) >= self.max {
+		self.evictOldest()
+	}
+	self.sessions[sessionKey(username, sessionId)] = state
+}
+
+// take removes the session and returns its state,
+// unless the session does not exist or has expired.
+func (self *sessionStore) take(username, sessionId string, now time.Time) (state *sessionState, ok bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := sessionKey(username, sessionId)
+	state, ok = self.sessions[key]
+	if !ok {
+		return
+	}
+	delete(self.sessions, key)
+	if now.Sub(state.savedAt) > self.retention {
+		return nil, false
+	}
+	return
+}
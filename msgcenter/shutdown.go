@@ -0,0 +1,78 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// How often Shutdown checks for connections left.
+const shutdownPollInterval = 100 * time.Millisecond
+
+func (self *MessageCenter) shuttingDown() bool {
+	return atomic.LoadInt32(&self.closing) != 0
+}
+
+func (self *MessageCenter) nrConns() int {
+	n := 0
+	for _, center := range self.allServiceCenters() {
+		n += center.Stats().NrConns
+	}
+	return n
+}
+
+// closeAll closes all connections without telling the
+// clients, and returns the number of connections closed.
+func (self *MessageCenter) closeAll() int {
+	n := 0
+	for _, center := range self.allServiceCenters() {
+		for _, conn := range center.AllConns() {
+			conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// Shutdown stops accepting connections and drains all connections of
+// all services, telling the clients to reconnect, e.g. to another
+// instance. Connections which finish the handshake in the meantime
+// are drained as well. Once ctx is done, the connections left are
+// closed and ctx.Err() is returned. It returns the number of
+// connections closed.
+func (self *MessageCenter) Shutdown(ctx context.Context) (n int, err error) {
+	atomic.StoreInt32(&self.closing, 1)
+	for _, l := range self.listeners {
+		l.ln.Close()
+	}
+	n = self.Drain()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for self.nrConns() > 0 {
+		select {
+		case <-ctx.Done():
+			n += self.closeAll()
+			return n, ctx.Err()
+		case <-ticker.C:
+			n += self.Drain()
+		}
+	}
+	return
+}
@@ -18,6 +18,7 @@
 package msgcenter
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,25 +27,44 @@ import (
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/server"
 	"github.com/uniqush/uniqush-conn/push"
+	"io"
+	"math/rand"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type eventConnIn struct {
 	errChan chan error
 	conn    server.Conn
+
+	// Set once the stale connections of the user have
+	// been reaped to make room for the connection.
+	reaped bool
 }
 
 type eventConnLeave struct {
 	conn server.Conn
 	err  error
+
+	// If it is not proto.CloseUnknown, the server closes the
+	// connection and tells the client the reason.
+	code proto.CloseCode
 }
 
 type Result struct {
 	Err     error  `json:"err,omitempty"`
 	ConnId  string `json:"connId,omitempty"`
 	Visible bool   `json:"visible"`
+
+	// Classifies Err, so that callers need not match its string.
+	Code ResultCode `json:"code"`
+
+	// Number of messages cached for an offline user.
+	// The message being sent may not be counted yet.
+	Backlog int `json:"backlog,omitempty"`
 }
 
 func (self *Result) Error() string {
@@ -52,57 +72,612 @@ func (self *Result) Error() string {
 	return string(b)
 }
 
+type ResultCode int
+
+const (
+	ResultOK ResultCode = iota
+	// Writing to the connection failed for some other reason.
+	ResultWriteFailed
+	// The connection has been closed by the peer.
+	ResultConnClosed
+	// The message has too many headers or parameters,
+	// or is too large to be sent in one command.
+	ResultTooLarge
+	ResultQuotaExceeded
+	// The outbound queue of the connection is full.
+	ResultQueueFull
+	// The username or the extra fields are invalid.
+	ResultBadRequest
+)
+
+func (self ResultCode) String() string {
+	switch self {
+	case ResultOK:
+		return "ok"
+	case ResultWriteFailed:
+		return "write-failed"
+	case ResultConnClosed:
+		return "conn-closed"
+	case ResultTooLarge:
+		return "too-large"
+	case ResultQuotaExceeded:
+		return "quota-exceeded"
+	case ResultQueueFull:
+		return "queue-full"
+	case ResultBadRequest:
+		return "bad-request"
+	}
+	return fmt.Sprintf("ResultCode(%d)", int(self))
+}
+
+func (self ResultCode) MarshalText() ([]byte, error) {
+	return []byte(self.String()), nil
+}
+
+// resultCode classifies the error of writing a message to a connection.
+func resultCode(err error) ResultCode {
+	switch err {
+	case nil:
+		return ResultOK
+	case io.EOF, io.ErrUnexpectedEOF, io.ErrClosedPipe:
+		return ResultConnClosed
+	case proto.ErrTooManyHeaders, proto.ErrTooManyParams, proto.ErrCommandTooLarge:
+		return ResultTooLarge
+	case ErrQuotaExceeded:
+		return ResultQuotaExceeded
+	case ErrOutboundQueueFull:
+		return ResultQueueFull
+	}
+	return ResultWriteFailed
+}
+
+type DeliveryStatus int
+
+const (
+	// No visible connection received the message.
+	DeliveredToNone DeliveryStatus = iota
+	// Some connections received the message, but not all of them.
+	DeliveredToSome
+	// All connections of the user received the message
+	// and all of them are visible.
+	DeliveredToAll
+)
+
+func (self DeliveryStatus) String() string {
+	switch self {
+	case DeliveredToNone:
+		return "none"
+	case DeliveredToSome:
+		return "some"
+	case DeliveredToAll:
+		return "all"
+	}
+	return fmt.Sprintf("DeliveryStatus(%d)", int(self))
+}
+
+func (self DeliveryStatus) MarshalText() ([]byte, error) {
+	return []byte(self.String()), nil
+}
+
+// DeliverySummary aggregates the results of sending
+// a message to all connections of a user.
+type DeliverySummary struct {
+	Status DeliveryStatus `json:"status"`
+
+	// Number of visible connections which received the message.
+	NrDelivered int `json:"delivered"`
+
+	// Number of invisible connections which received the message.
+	// Like a user without connection, it may be pushed.
+	NrOffline int `json:"offline"`
+
+	// Number of connections failed to receive the message.
+	NrFailed int `json:"failed"`
+}
+
+// Summarize aggregates the results returned by SendMessage.
+func Summarize(results []*Result) *DeliverySummary {
+	ret := new(DeliverySummary)
+	for _, r := range results {
+		if r == nil {
+			continue
+		}
+		switch {
+		case r.Err != nil:
+			ret.NrFailed++
+		case len(r.ConnId) == 0:
+			// Not about a connection, e.g. the backlog.
+		case r.Visible:
+			ret.NrDelivered++
+		default:
+			ret.NrOffline++
+		}
+	}
+	if ret.NrDelivered > 0 {
+		ret.Status = DeliveredToSome
+		if ret.NrFailed == 0 && ret.NrOffline == 0 {
+			ret.Status = DeliveredToAll
+		}
+	}
+	return ret
+}
+
 type ServiceConfig struct {
 	MaxNrConns        int
 	MaxNrUsers        int
 	MaxNrConnsPerUser int
 
+	// Re-authenticate each connection periodically with the most
+	// recent token provided by the client. 0 means never.
+	ReAuthInterval time.Duration
+
+	// Connections older than MaxConnLifetime are closed with
+	// ErrMaxLifetime so that the clients reconnect. Each connection
+	// is closed at a random point within the last tenth of the limit,
+	// lest all the clients reconnect at once. 0 means no limit.
+	MaxConnLifetime time.Duration
+
+	// Messages sent from clients must contain all required headers.
+	// If AllowedHeaders is not empty, any header other than the
+	// required and the allowed ones is not allowed.
+	RequiredHeaders []string
+	AllowedHeaders  []string
+
 	MsgCache msgcache.Cache
 
+	// If true, connections will be rejected when there is no MsgCache.
+	RequireCache bool
+
+	// If positive, connections rejected because the service is full
+	// will be told to wait for RetryAfter, plus a random delay up to
+	// RetryAfterJitter, before reconnecting.
+	RetryAfter       time.Duration
+	RetryAfterJitter time.Duration
+
+	// Maximum number of subscribe/unsubscribe requests a connection
+	// may send within SubscribeInterval (one minute if zero).
+	// Connections exceeding the limit will be closed.
+	// Zero means no limit.
+	MaxNrSubscribes   int
+	SubscribeInterval time.Duration
+
+	// Maximum number of messages a single connection may send
+	// within ConnMessageInterval (one second if zero). Connections
+	// exceeding the limit will be closed and reported to the
+	// ErrorHandler. Zero means no limit.
+	MaxNrConnMessages   int
+	ConnMessageInterval time.Duration
+
+	// Maximum number of users of the service whose presence one
+	// connection may watch. Zero means connections cannot watch
+	// anyone.
+	MaxNrWatches int
+
+	// If positive, messages from clients carrying the same
+	// ClientMsgIdHeader within the window are considered as retries
+	// and dropped. It requires a MsgCache which implements
+	// msgcache.Deduplicator.
+	DedupWindow time.Duration
+
+	// If true, each message sent to a user carries an increasing
+	// sequence number of the user in SeqHeader, both when delivered
+	// and when cached, so that clients could tell if they missed any
+	// message. Broadcast messages are not numbered. It requires a
+	// MsgCache which implements msgcache.Sequencer.
+	SequenceMessages bool
+
+	// If positive, a message is not written to a connection again if
+	// a message with the same id was written to it within the window.
+	// The id is the Id of the message, or its ClientMsgIdHeader if it
+	// has no Id. Messages with neither are always written.
+	SendDedupWindow time.Duration
+
+	// Maximum number of messages delivered to a user per day.
+	// Zero means no limit. It requires a MsgCache which
+	// implements msgcache.QuotaCounter.
+	MaxNrMsgsPerDay int
+
+	// If positive, at most MaxPushesPerWindow notifications are pushed
+	// to a user within each PushWindow (one minute by default). The
+	// messages beyond that are still cached, but instead of a push for
+	// each of them, a single notification with their number is pushed
+	// at the end of the window. It requires a MsgCache which implements
+	// msgcache.PushCounter.
+	MaxPushesPerWindow int
+	PushWindow         time.Duration
+
+	// If true and the PushService tells that a notification failed
+	// for some delivery points of the user (see push.DetailedPush),
+	// only the messages pushed to those delivery points are retried
+	// by RetryPendingPushes. Otherwise, a notification is retried only
+	// if it failed for all the delivery points. Either way, partial
+	// failures are reported as PartialPushError. uniqush-push cannot
+	// tell which message went to which delivery point, so this has no
+	// effect with it.
+	RetryFailedPushPoints bool
+
+	// If true, messages exceeding the quota will still be
+	// cached so that the user could retrieve them later.
+	CacheOverQuota bool
+
+	// If true, when a user reaches MaxNrConnsPerUser, the existing
+	// connections of the user are pinged and the dead ones are removed
+	// to make room for the new connection. Useful when many clients
+	// reconnect before their old connections time out.
+	ReapStaleConns bool
+
+	// If true, new connections are rejected with ErrLoadShed while
+	// the LoadShedder of the MessageCenter reports pressure, leaving
+	// the resources to the other services.
+	LowPriority bool
+
+	// If true, the cached copy of a message is deleted once a client
+	// of the user acknowledges it with a receipt, so that it is
+	// neither retrieved again nor reported as an unread push.
+	DeleteOnReceipt bool
+
+	// If true, a cached message retrieved by a client, e.g. after a
+	// notification carrying its id is pushed, is only deleted once
+	// the client acknowledges it with a receipt. Messages never
+	// acknowledged are left to expire with their TTL. It requires a
+	// MsgCache which implements msgcache.Getter.
+	AckBeforeDelete bool
+
+	// Cached messages older than MaxReplayAge, e.g. a typing indicator
+	// from an hour ago, are deleted rather than sent when a client
+	// retrieves them. It requires a MsgCache which implements
+	// msgcache.AgeTracker. Zero means replaying every message within
+	// its TTL.
+	MaxReplayAge time.Duration
+
+	// If positive, the priority and the visibility of a connection are
+	// kept for SessionRetention after it is closed. A client which
+	// reconnects within that time with the same SessionIdLabel gets
+	// them back. At most MaxNrSessions sessions are kept; zero means
+	// a default of 10000.
+	SessionRetention time.Duration
+	MaxNrSessions    int
+
+	// If positive, messages are cached for at most MaxCacheTTL, including
+	// those sent with no TTL, which would otherwise never expire. It
+	// applies to all messages to the service. A forwarded message has its
+	// TTL clamped to the MaxTTL of the ForwardRequestHandler first, so the
+	// shorter of the two wins. Zero means no limit.
+	MaxCacheTTL time.Duration
+
+	// Bounds of the heartbeat intervals proposed by clients.
+	// Connections proposing an interval out of them are rejected
+	// with ErrBadHeartbeat. Zero means no bound.
+	MinHeartbeat time.Duration
+	MaxHeartbeat time.Duration
+
+	// If positive, it replaces the handshake timeout of the message
+	// center for the connections to the service. The service is only
+	// known once the client sends it, so it applies from then on, to
+	// the call to the Authenticator, but the timeout is counted from
+	// the beginning of the handshake.
+	HandshakeTimeout time.Duration
+
+	// If true, a message from a client which cannot be decoded is
+	// reported to the ErrorHandler and skipped. Otherwise, the
+	// connection is closed after the report.
+	SkipMalformedMessages bool
+
+	// If true, no message is forwarded to the users of the service,
+	// whatever the ForwardRequestHandler says, and each attempt is
+	// reported to the ErrorHandler.
+	DisallowForward bool
+
+	// If true, connections start invisible until the clients say
+	// otherwise, so that they never suppress notifications pushed
+	// to the user, e.g. for monitoring tools.
+	InvisibleByDefault bool
+
+	// If positive, messages to each connection are queued and written
+	// in the background. OutboundOverflow decides what happens when more
+	// than OutboundQueueSize messages are waiting. Zero means messages
+	// are written synchronously.
+	OutboundQueueSize int
+	OutboundOverflow  OverflowPolicy
+
+	// Number of messages which may wait to be routed before
+	// SendMessage blocks and TrySendMessage fails with ErrBusy.
+	// Zero means each sender waits for the service to take its
+	// message. Messages from one sender are still routed in order,
+	// but a buffered message is routed after the connections which
+	// joined or left while it was waiting, e.g. it may reach a
+	// connection made after it was sent.
+	SendBufferSize int
+
+	// Limits of the extra map given to SendMessage, which is cached
+	// and pushed with the message: the number of keys, and the total
+	// length of the keys and values in bytes. Keys reserved by
+	// uniqush-conn are not counted. Messages with a larger extra map
+	// are rejected with ErrExtraTooLarge. The extra map of a message
+	// forwarded from a client is clamped instead. Zero means no limit.
+	MaxNrExtraKeys int
+	MaxExtraSize   int
+
+	// Creates the map keeping the connections of the service, e.g. to
+	// shard the connections. NewTreeBasedConnMap is used if it is nil.
+	NewConnMap ConnMapFactory
+
+	// The event handlers of the shadow config receive copies of the
+	// events of this service. Their decisions are ignored.
+	Shadow *ServiceConfig
+
 	LoginHandler          evthandler.LoginHandler
 	LogoutHandler         evthandler.LogoutHandler
 	MessageHandler        evthandler.MessageHandler
 	ForwardRequestHandler evthandler.ForwardRequestHandler
 	ErrorHandler          evthandler.ErrorHandler
 
+	// A message from a client whose MessageRouteHeader is a key of
+	// MessageRoutes goes to that handler instead of MessageHandler.
+	MessageRouteHeader string
+	MessageRoutes      map[string]evthandler.MessageHandler
+
 	// Push related web hooks
 	SubscribeHandler   evthandler.SubscribeHandler
 	UnsubscribeHandler evthandler.UnsubscribeHandler
 	PushHandler        evthandler.PushHandler
 
+	// Called if the PushHandler allows pushing a message to an
+	// offline user, but the user has no delivery point.
+	FallbackHandler evthandler.FallbackHandler
+
+	// Told whether each message was delivered in-band, cached for
+	// an offline user or failed.
+	DeliveryHandler evthandler.DeliveryHandler
+
 	PushService push.Push
+
+	// If not nil, the info of each notification is built by the
+	// template instead of the default logic of uniqush-conn.
+	PushTemplate *PushTemplate
+
+	// If not nil, it may modify (or replace) the info of each
+	// notification right before it is sent to the PushService.
+	RewritePushInfo func(service, username string, info map[string]string) map[string]string
+
+	// If not nil, the lifecycle of messages is logged here.
+	Logger Logger
+
+	// If not nil, every message read from or written to a
+	// connection of the service is recorded by the AuditLogger.
+	AuditLogger AuditLogger
+
+	// If not nil, subscriptions sent to the PushService are recorded
+	// here and can be replayed by ResyncSubscriptions.
+	SubscriptionStore push.SubscriptionStore
+
+	// If not nil, it counts the delivery points of offline users
+	// instead of PushService, e.g. from the local SubscriptionStore,
+	// which saves a request to the push service for each message.
+	DeliveryPointCounter push.DeliveryPointCounter
 }
 
+// Clients set this header to a unique id of the message, so that the
+// server can drop the message when the client resends it.
+const ClientMsgIdHeader = "client-msg-id"
+
+// Messages forwarded from another user carry this header set to
+// "true", and their push notifications carry it in the info. The
+// original sender is in the Sender and SenderService of the message.
+const ForwardedHeader = "uniqush.forwarded"
+
+// The sequence number of a message sent to the user.
+// See ServiceConfig.SequenceMessages.
+const SeqHeader = "uniqush.seq"
+
+// Clients set this label when authenticating to resume the session of
+// an earlier connection. See ServiceConfig.SessionRetention.
+const SessionIdLabel = "session-id"
+
+// If a forwarded message has this header, its value is shown as the
+// sender (uniqush.sender) in the push notification, e.g. the name of
+// a group. The real sender is kept in uniqush.original-sender.
+const DisplaySenderHeader = "notif.display-sender"
+
 type writeMessageRequest struct {
+	service string
 	user    string
 	msg     *proto.Message
 	ttl     time.Duration
 	extra   map[string]string
 	resChan chan<- []*Result
+
+	// If positive, don't push the message if the
+	// user was active within the window.
+	activeWindow time.Duration
+
+	// If not nil, the message will not be pushed. Instead, if no
+	// connection received the message, waiter will be closed when
+	// a new connection of the user arrives.
+	waiter chan bool
+
+	// If positive, only the most recently active visible connection
+	// is written to, if it was active within this duration.
+	recent time.Duration
+
+	// If not nil, msg marshaled, which is written to the
+	// connections as is. See SendRawMessage.
+	raw []byte
+}
+
+type cancelWaitRequest struct {
+	service  string
+	username string
+	waiter   chan bool
+}
+
+type connListRequest struct {
+	service  string
+	username string // empty: all users
+	resChan  chan<- []server.Conn
+}
+
+type statsRequest struct {
+	service string
+	resChan chan<- *ConnMapStats
+}
+
+type drainRequest struct {
+	service  string
+	username string
+	resChan  chan<- int
+}
+
+// ConnInfo is the information of a connection exposed to the
+// predicate of BroadcastFilter.
+type ConnInfo struct {
+	Service  string
+	Username string
+	ConnId   string
+	Addr     string
+	Visible  bool
+}
+
+// ConnDetails is everything the server knows about a connection.
+type ConnDetails struct {
+	Service     string    `json:"service"`
+	Username    string    `json:"username"`
+	ConnId      string    `json:"connId"`
+	Addr        string    `json:"addr"`
+	Visible     bool      `json:"visible"`
+	ConnectedAt time.Time `json:"connectedAt"`
+
+	// The region of the node holding the connection, if it is set.
+	Region string `json:"region,omitempty"`
+
+	// Zero if the user has not sent any message recently.
+	LastSeen time.Time `json:"lastSeen,omitempty"`
+
+	BytesReceived     int64 `json:"bytesReceived"`
+	BytesSent         int64 `json:"bytesSent"`
+	DigestThreshold   int   `json:"digestThreshold"`
+	CompressThreshold int   `json:"compressThreshold"`
+
+	// Zero if the client did not propose a heartbeat interval.
+	Heartbeat time.Duration `json:"heartbeat"`
+
+	Priority   int       `json:"priority"`
+	LastActive time.Time `json:"lastActive"`
+
+	// Empty if the connection does not use TLS.
+	TLSVersion     string `json:"tlsVersion,omitempty"`
+	TLSCipherSuite string `json:"tlsCipherSuite,omitempty"`
+}
+
+type connDetailsRequest struct {
+	service  string
+	username string
+	uniqId   string
+	resChan  chan<- *ConnDetails
+}
+
+type broadcastRequest struct {
+	service string
+	pred    func(ConnInfo) bool
+	msg     *proto.Message
+	ttl     time.Duration
+	extra   map[string]string
+	resChan chan<- []*Result
 }
 
 type serviceCenter struct {
+	// Accessed atomically. Keep them at the beginning for alignment.
+	nrPendingPushes int64
+	nrPushes        int64
+	nrPushErrors    int64
+
+	// If not empty, it is prefixed to the ids of the connections
+	// reported to the outside world.
+	nodeId string
+	region string
+
+	// Consulted before accepting connections if the service
+	// is of low priority.
+	shed LoadShedder
+
+	connEvents *connEventHub
+
 	serviceName string
 	config      *ServiceConfig
+	auth        server.Authenticator
 	fwdChan     chan<- *server.ForwardRequest
 
-	writeReqChan chan *writeMessageRequest
-	connIn       chan *eventConnIn
-	connLeave    chan *eventConnLeave
-	subReqChan   chan *server.SubscribeRequest
+	writeReqChan   chan *writeMessageRequest
+	connIn         chan *eventConnIn
+	connLeave      chan *eventConnLeave
+	subReqChan     chan *server.SubscribeRequest
+	connListChan   chan *connListRequest
+	drainChan      chan *drainRequest
+	statsChan      chan *statsRequest
+	bcastChan      chan *broadcastRequest
+	cancelWaitChan chan *cancelWaitRequest
+	detailsChan    chan *connDetailsRequest
+	watchReqChan   chan *server.WatchRequest
 
 	pushServiceLock sync.RWMutex
+	lastSeen        *lastSeenMap
+	sessions        *sessionStore
+
+	// The services sharing the goroutine processing this one.
+	group *serviceGroup
 }
 
 var ErrTooManyConns = errors.New("too many connections")
 var ErrInvalidConnType = errors.New("invalid connection type")
+var ErrConnDrained = errors.New("connection drained")
+var ErrAuthExpired = errors.New("authentication expired")
+var ErrMaxLifetime = errors.New("connection lived too long")
+var ErrTooManyMessages = errors.New("connection sent too many messages")
+var ErrBusy = errors.New("too many messages waiting to be routed")
+var ErrForwardNotAllowed = errors.New("forwarding is not allowed in the service")
+var ErrTooManyWatches = errors.New("too many users watched by the connection")
+var ErrExtraTooLarge = errors.New("the extra map is too large")
+var ErrNoCache = errors.New("message cache is required but not configured")
+var ErrQuotaExceeded = errors.New("daily message quota exceeded")
+var ErrDeliveryTimeout = errors.New("message not delivered before timeout")
+var ErrNoConn = errors.New("no such connection")
+var ErrStaleConn = errors.New("stale connection replaced by a new one")
+var ErrBadHeartbeat = errors.New("heartbeat interval out of bounds")
+var ErrNoPushService = errors.New("push service is not configured")
+var ErrPushNotTracked = errors.New("message cache does not track failed pushes")
+var ErrNoSequencer = errors.New("message cache does not assign sequence numbers")
+var ErrNoCacheStats = errors.New("message cache does not report statistics")
 
 func (self *serviceCenter) ReceiveForward(fwdreq *server.ForwardRequest) {
 	shouldFwd := false
+	nrDelivered := 0
+	if fwdreq.Reply != nil {
+		defer func() {
+			fwdreq.Reply(shouldFwd, nrDelivered)
+		}()
+	}
+	if self.config != nil && self.config.DisallowForward {
+		var sender, senderService string
+		if msg := fwdreq.Message; msg != nil {
+			sender, senderService = msg.Sender, msg.SenderService
+		}
+		self.reportError(senderService, sender, "", "", ErrForwardNotAllowed)
+		return
+	}
+	receivers := []string{fwdreq.Receiver}
 	if self.config != nil {
-		if self.config.ForwardRequestHandler != nil {
-			shouldFwd = self.config.ForwardRequestHandler.ShouldForward(fwdreq)
-			maxttl := self.config.ForwardRequestHandler.MaxTTL()
+		if handler := self.config.ForwardRequestHandler; handler != nil {
+			if gh, ok := handler.(evthandler.GroupForwardRequestHandler); ok && gh.IsGroup(fwdreq.Receiver) {
+				receivers = gh.ForwardToGroup(fwdreq)
+				shouldFwd = len(receivers) > 0
+			} else {
+				shouldFwd = handler.ShouldForward(fwdreq)
+			}
+			if shadow := self.shadow(); shadow != nil && shadow.ForwardRequestHandler != nil {
+				fwdcopy := *fwdreq
+				go shadow.ForwardRequestHandler.ShouldForward(&fwdcopy)
+			}
+			maxttl := handler.MaxTTL()
 			if fwdreq.TTL < 1*time.Second || fwdreq.TTL > maxttl {
 				fwdreq.TTL = maxttl
 			}
@@ -111,9 +686,121 @@ func (self *serviceCenter) ReceiveForward(fwdreq *server.ForwardRequest) {
 	if !shouldFwd {
 		return
 	}
-	receiver := fwdreq.Receiver
+	if msg := fwdreq.Message; msg != nil {
+		if id, ok := msg.Header[ClientMsgIdHeader]; ok {
+			// The same message may be forwarded to different receivers.
+			id = fmt.Sprintf("fwd:%v:%v:%v", fwdreq.ReceiverService, fwdreq.Receiver, id)
+			if self.isDuplicate(msg.SenderService, msg.Sender, id) {
+				return
+			}
+		}
+	}
+	if msg := fwdreq.Message; msg != nil {
+		if msg.Header == nil {
+			msg.Header = make(map[string]string, 1)
+		}
+		msg.Header[ForwardedHeader] = "true"
+	}
 	extra := getPushInfo(fwdreq.Message, nil, true)
-	self.SendMessage(receiver, fwdreq.Message, extra, fwdreq.TTL)
+	self.clampExtra(extra)
+	for _, receiver := range receivers {
+		if len(receiver) == 0 || strings.Contains(receiver, ":") || strings.Contains(receiver, "\n") {
+			continue
+		}
+		// Each receiver may push the message separately,
+		// so they should not share the same extra map.
+		res := self.SendMessage(receiver, fwdreq.Message, copyExtra(extra), fwdreq.TTL)
+		nrDelivered += Summarize(res).NrDelivered
+	}
+}
+
+// Keys in the extra map starting with one of these prefixes are
+// reserved. They are set by uniqush-conn itself, like
+// notif.uniqush.msgsize, uniqush.sender and uniqush.sender-service.
+var reservedExtraPrefixes = []string{"uniqush.", "notif.uniqush."}
+
+func isReservedExtra(key string) bool {
+	for _, prefix := range reservedExtraPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkExtra(extra map[string]string) error {
+	for k, _ := range extra {
+		if isReservedExtra(k) {
+			return fmt.Errorf("invalid key %v: keys starting with %v are reserved", k, strings.Join(reservedExtraPrefixes, " or "))
+		}
+	}
+	return nil
+}
+
+// extraSize returns the number of keys in the extra map which are not
+// reserved, and their total length with the values.
+func extraSize(extra map[string]string) (n, size int) {
+	for k, v := range extra {
+		if isReservedExtra(k) {
+			continue
+		}
+		n++
+		size += len(k) + len(v)
+	}
+	return
+}
+
+func (self *serviceCenter) checkExtraSize(extra map[string]string) error {
+	n, size := extraSize(extra)
+	if self.config.MaxNrExtraKeys > 0 && n > self.config.MaxNrExtraKeys {
+		return ErrExtraTooLarge
+	}
+	if self.config.MaxExtraSize > 0 && size > self.config.MaxExtraSize {
+		return ErrExtraTooLarge
+	}
+	return nil
+}
+
+// clampExtra removes keys from the extra map, in the order of the
+// keys, until it is within the limits of the service.
+func (self *serviceCenter) clampExtra(extra map[string]string) {
+	if self.checkExtraSize(extra) == nil {
+		return
+	}
+	keys := make([]string, 0, len(extra))
+	for k, _ := range extra {
+		if !isReservedExtra(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	n, size := 0, 0
+	for _, k := range keys {
+		sz := len(k) + len(extra[k])
+		if (self.config.MaxNrExtraKeys > 0 && n+1 > self.config.MaxNrExtraKeys) ||
+			(self.config.MaxExtraSize > 0 && size+sz > self.config.MaxExtraSize) {
+			delete(extra, k)
+			continue
+		}
+		n++
+		size += sz
+	}
+}
+
+func copyExtra(extra map[string]string) map[string]string {
+	ret := make(map[string]string, len(extra))
+	for k, v := range extra {
+		ret[k] = v
+	}
+	return ret
+}
+
+// isForwarded tells if the message was sent to the user by another user.
+func isForwarded(msg *proto.Message, service, username string) bool {
+	if len(msg.Sender) > 0 && len(msg.SenderService) > 0 {
+		return msg.Sender != username || msg.SenderService != service
+	}
+	return false
 }
 
 func getPushInfo(msg *proto.Message, extra map[string]string, fwd bool) map[string]string {
@@ -133,6 +820,12 @@ func getPushInfo(msg *proto.Message, extra map[string]string, fwd bool) map[stri
 		}
 		extra["uniqush.sender"] = msg.Sender
 		extra["uniqush.sender-service"] = msg.SenderService
+		extra[ForwardedHeader] = "true"
+		if display, ok := extra[DisplaySenderHeader]; ok {
+			delete(extra, DisplaySenderHeader)
+			extra["uniqush.original-sender"] = msg.Sender
+			extra["uniqush.sender"] = display
+		}
 	}
 	if msg.Header != nil {
 		if title, ok := msg.Header["title"]; ok {
@@ -145,10 +838,26 @@ func getPushInfo(msg *proto.Message, extra map[string]string, fwd bool) map[stri
 	return extra
 }
 
+// pushInfo builds the info of the notification of the message,
+// with the PushTemplate of the service if there is one.
+func (self *serviceCenter) pushInfo(msg *proto.Message, extra map[string]string, fwd bool) map[string]string {
+	info := getPushInfo(msg, extra, fwd)
+	if seq, ok := msg.Header[SeqHeader]; ok {
+		info["notif."+SeqHeader] = seq
+	}
+	if self.config != nil && self.config.PushTemplate != nil {
+		info = self.config.PushTemplate.Apply(msg, info)
+	}
+	return info
+}
+
 func (self *serviceCenter) shouldPush(service, username string, msg *proto.Message, extra map[string]string, fwd bool) bool {
 	if self.config != nil {
 		if self.config.PushHandler != nil {
-			info := getPushInfo(msg, extra, fwd)
+			info := self.pushInfo(msg, extra, fwd)
+			if shadow := self.shadow(); shadow != nil && shadow.PushHandler != nil {
+				go shadow.PushHandler.ShouldPush(service, username, copyExtra(info))
+			}
 			return self.config.PushHandler.ShouldPush(service, username, info)
 		}
 	}
@@ -167,174 +876,973 @@ func (self *serviceCenter) subscribe(req *server.SubscribeRequest) {
 				self.config.PushService.Unsubscribe(req.Service, req.Username, req.Params)
 			}
 		}
+		if self.config.SubscriptionStore != nil {
+			var err error
+			if req.Subscribe {
+				err = self.config.SubscriptionStore.Subscribe(req.Service, req.Username, req.Params)
+			} else {
+				err = self.config.SubscriptionStore.Unsubscribe(req.Service, req.Username, req.Params)
+			}
+			if err != nil {
+				self.reportError(req.Service, req.Username, "", "", err)
+			}
+		}
+	}
+}
+
+// ResyncSubscriptions sends all subscriptions in the subscription store
+// to the push service again, and returns the number of subscriptions sent.
+func (self *serviceCenter) ResyncSubscriptions() (n int, err error) {
+	if self.config == nil || self.config.SubscriptionStore == nil || self.config.PushService == nil {
+		return
+	}
+	subs, err := self.config.SubscriptionStore.AllSubscriptions(self.serviceName)
+	if err != nil {
+		return
+	}
+	self.pushServiceLock.RLock()
+	defer self.pushServiceLock.RUnlock()
+	for _, sub := range subs {
+		err = self.config.PushService.Subscribe(sub.Service, sub.Username, sub.Info)
+		if err != nil {
+			return
+		}
+		n++
 	}
+	return
 }
 
 func (self *serviceCenter) nrDeliveryPoints(service, username string) int {
 	n := 0
 	if self.config != nil {
-		if self.config.PushService != nil {
+		if self.config.DeliveryPointCounter != nil {
+			n = self.config.DeliveryPointCounter.NrDeliveryPoints(service, username)
+		} else if self.config.PushService != nil {
 			n = self.config.PushService.NrDeliveryPoints(service, username)
 		}
 	}
 	return n
 }
 
-func (self *serviceCenter) pushNotif(service, username string, msg *proto.Message, extra map[string]string, msgIds []string, fwd bool) {
+func (self *serviceCenter) pushNotif(service, username string, msg *proto.Message, extra map[string]string, msgIds []string, fwd bool) (err error) {
 	if self.config != nil {
 		if self.config.PushService != nil {
-			info := getPushInfo(msg, extra, fwd)
-			err := self.config.PushService.Push(service, username, info, msgIds)
-			if err != nil {
-				self.reportError(service, username, "", "", err)
+			info := self.pushInfo(msg, extra, fwd)
+			if self.config.RewritePushInfo != nil {
+				info = self.config.RewritePushInfo(service, username, info)
 			}
+			err = self.push(service, username, info, msgIds)
 		}
 	}
+	return
+}
+
+// PartialPushError is reported to the ErrorHandler if the push
+// service failed to push a notification to some delivery points of
+// the user, but not to all of them.
+type PartialPushError struct {
+	Service  string
+	Username string
+	NrPoints int
+	Failed   []*push.PushResult
+}
+
+func (self *PartialPushError) Error() string {
+	errs := make([]string, 0, len(self.Failed))
+	for _, r := range self.Failed {
+		errs = append(errs, fmt.Sprintf("%v: %v", r.DeliveryPoint, r.Err))
+	}
+	return fmt.Sprintf("[Service=%v][Username=%v] push failed for %v of %v delivery points: %v",
+		self.Service, self.Username, len(self.Failed), self.NrPoints, strings.Join(errs, "; "))
 }
 
-func (self *serviceCenter) reportError(service, username, connId, addr string, err error) {
-	if self.config != nil {
-		if self.config.ErrorHandler != nil {
-			go self.config.ErrorHandler.OnError(service, username, connId, addr, err)
+// push pushes the notification with the PushService. It returns an
+// error only if the push failed as a whole. If it failed for some of
+// the delivery points, a PartialPushError is reported, and with
+// RetryFailedPushPoints, the messages of those delivery points are
+// marked to be retried.
+func (self *serviceCenter) push(service, username string, info map[string]string, msgIds []string) error {
+	res, err := push.PushDetailed(self.config.PushService, service, username, info, msgIds)
+	atomic.AddInt64(&self.nrPushes, 1)
+	if err == nil && len(res) > 0 {
+		var failed []*push.PushResult
+		for _, r := range res {
+			if r.Err != nil {
+				failed = append(failed, r)
+			}
 		}
+		if len(failed) == len(res) {
+			err = failed[0].Err
+		} else if len(failed) > 0 {
+			self.reportError(service, username, "", "", &PartialPushError{
+				Service:  service,
+				Username: username,
+				NrPoints: len(res),
+				Failed:   failed,
+			})
+			if self.config.RetryFailedPushPoints {
+				ids := make([]string, 0, len(failed))
+				for _, r := range failed {
+					if len(r.MsgId) > 0 {
+						ids = append(ids, r.MsgId)
+					}
+				}
+				if len(ids) > 0 {
+					self.setPushFailed(username, ids, true)
+				}
+			}
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&self.nrPushErrors, 1)
+		self.reportError(service, username, "", "", err)
 	}
+	return err
 }
 
-func (self *serviceCenter) reportLogin(service, username, connId, addr string) {
-	if self.config != nil {
-		if self.config.LoginHandler != nil {
-			go self.config.LoginHandler.OnLogin(service, username, connId, addr)
+func (self *serviceCenter) setPushFailed(username string, msgIds []string, failed bool) {
+	if self.config == nil {
+		return
+	}
+	tracker, ok := self.config.MsgCache.(msgcache.PushTracker)
+	if !ok {
+		return
+	}
+	err := tracker.SetPushFailed(self.serviceName, username, msgIds, failed)
+	if err != nil {
+		self.reportError(self.serviceName, username, "", "", err)
+	}
+}
+
+// PushRetryStats tells the outcome of retrying the failed pushes.
+type PushRetryStats struct {
+	// Number of pushes retried.
+	NrRetried int `json:"nrRetried"`
+
+	// Number of pushes which failed again. They will be retried
+	// by the next call to RetryPendingPushes.
+	NrFailed int `json:"nrFailed"`
+
+	// Number of pushes not retried because their messages have
+	// expired or have been retrieved.
+	NrExpired int `json:"nrExpired"`
+}
+
+// RetryPendingPushes pushes the notifications which failed
+// earlier, e.g. because the push service was down, again.
+func (self *serviceCenter) RetryPendingPushes() (stats *PushRetryStats, err error) {
+	if self.config == nil || self.config.MsgCache == nil {
+		return nil, ErrNoCache
+	}
+	if self.config.PushService == nil {
+		return nil, ErrNoPushService
+	}
+	tracker, ok := self.config.MsgCache.(msgcache.PushTracker)
+	if !ok {
+		return nil, ErrPushNotTracked
+	}
+	getter, ok := self.config.MsgCache.(msgcache.Getter)
+	if !ok {
+		return nil, ErrPushNotTracked
+	}
+	pushes, err := tracker.FailedPushes(self.serviceName)
+	if err != nil {
+		return
+	}
+	stats = new(PushRetryStats)
+	for _, push := range pushes {
+		var msg *proto.Message
+		msgIds := make([]string, 0, len(push.Ids))
+		for _, id := range push.Ids {
+			m, e := getter.Get(self.serviceName, push.Username, id)
+			if e != nil {
+				return stats, e
+			}
+			if m == nil {
+				continue
+			}
+			msg = m
+			msgIds = append(msgIds, id)
+		}
+		if msg == nil {
+			stats.NrExpired++
+			self.setPushFailed(push.Username, push.Ids, false)
+			continue
+		}
+		stats.NrRetried++
+		fwd := isForwarded(msg, self.serviceName, push.Username)
+		if self.pushNotif(self.serviceName, push.Username, msg, nil, msgIds, fwd) != nil {
+			stats.NrFailed++
+			continue
 		}
+		self.setPushFailed(push.Username, push.Ids, false)
 	}
+	return
 }
 
-func (self *serviceCenter) reportMessage(connId string, msg *proto.Message) {
+func (self *serviceCenter) log(event string, fields map[string]string) {
 	if self.config != nil {
-		if self.config.MessageHandler != nil {
-			go self.config.MessageHandler.OnMessage(connId, msg)
+		if self.config.Logger != nil {
+			self.config.Logger.Log(event, fields)
 		}
 	}
 }
 
-func (self *serviceCenter) reportLogout(service, username, connId, addr string, err error) {
+// connId returns the id of the connection seen by the outside world.
+func (self *serviceCenter) connId(conn MinimalConn) string {
+	return namespacedConnId(self.nodeId, conn.UniqId())
+}
+
+func (self *serviceCenter) shadow() *ServiceConfig {
 	if self.config != nil {
-		if self.config.LogoutHandler != nil {
-			go self.config.LogoutHandler.OnLogout(service, username, connId, addr, err)
+		return self.config.Shadow
+	}
+	return nil
+}
+
+func (self *serviceCenter) reportError(service, username, connId, addr string, err error) {
+	for _, config := range []*ServiceConfig{self.config, self.shadow()} {
+		if config != nil {
+			if config.ErrorHandler != nil {
+				go config.ErrorHandler.OnError(service, username, connId, addr, err)
+			}
 		}
 	}
 }
 
-func (self *serviceCenter) cacheMessage(service, username string, msg *proto.Message, ttl time.Duration) (id string, err error) {
-	if self.config != nil {
-		if self.config.MsgCache != nil {
-			id, err = self.config.MsgCache.CacheMessage(service, username, msg, ttl)
+func (self *serviceCenter) reportLogin(service, username, connId, addr string) {
+	for _, config := range []*ServiceConfig{self.config, self.shadow()} {
+		if config != nil {
+			if config.LoginHandler != nil {
+				go config.LoginHandler.OnLogin(service, username, connId, addr)
+			}
 		}
 	}
-	return
 }
 
-type connWriteErr struct {
-	conn server.Conn
-	err  error
+// messageHandler returns the handler of the message
+// from a client according to the message routes.
+func (self *ServiceConfig) messageHandler(msg *proto.Message) evthandler.MessageHandler {
+	if len(self.MessageRouteHeader) > 0 && msg != nil {
+		if h, ok := self.MessageRoutes[msg.Header[self.MessageRouteHeader]]; ok {
+			return h
+		}
+	}
+	return self.MessageHandler
 }
 
-func (self *serviceCenter) process(maxNrConns, maxNrConnsPerUser, maxNrUsers int) {
-	connMap := newTreeBasedConnMap()
-	nrConns := 0
-	for {
+func (self *serviceCenter) reportMessage(connId string, msg *proto.Message) {
+	for _, config := range []*ServiceConfig{self.config, self.shadow()} {
+		if config != nil {
+			if h := config.messageHandler(msg); h != nil {
+				go h.OnMessage(connId, msg)
+			}
+		}
+	}
+}
+
+func (self *serviceCenter) reportFallback(service, username string, msg *proto.Message) {
+	for _, config := range []*ServiceConfig{self.config, self.shadow()} {
+		if config != nil {
+			if config.FallbackHandler != nil {
+				go config.FallbackHandler.OnFallback(service, username, msg)
+			}
+		}
+	}
+}
+
+func (self *serviceCenter) reportDelivery(service, username string, msg *proto.Message, outcome string, nrConns int) {
+	for _, config := range []*ServiceConfig{self.config, self.shadow()} {
+		if config != nil {
+			if config.DeliveryHandler != nil {
+				go config.DeliveryHandler.OnDelivery(service, username, msg, outcome, nrConns)
+			}
+		}
+	}
+}
+
+func (self *serviceCenter) reportLogout(service, username, connId, addr string, err error) {
+	for _, config := range []*ServiceConfig{self.config, self.shadow()} {
+		if config != nil {
+			if config.LogoutHandler != nil {
+				go config.LogoutHandler.OnLogout(service, username, connId, addr, err)
+			}
+		}
+	}
+}
+
+func (self *serviceCenter) cacheMessage(service, username string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	if self.config != nil {
+		if self.config.MsgCache != nil {
+			id, err = self.config.MsgCache.CacheMessage(service, username, msg, ttl)
+		}
+	}
+	return
+}
+
+// cacheTTL clamps the TTL of a message to MaxCacheTTL. A TTL
+// which is not positive means the message never expires.
+func (self *serviceCenter) cacheTTL(ttl time.Duration) time.Duration {
+	if self.config == nil || self.config.MaxCacheTTL <= 0 {
+		return ttl
+	}
+	if ttl <= 0 || ttl > self.config.MaxCacheTTL {
+		return self.config.MaxCacheTTL
+	}
+	return ttl
+}
+
+// isDuplicate tells if the message with the id has
+// been sent by the user within the dedup window.
+func (self *serviceCenter) isDuplicate(service, username, id string) bool {
+	if self.config == nil || self.config.DedupWindow <= 0 || len(id) == 0 {
+		return false
+	}
+	dedup, ok := self.config.MsgCache.(msgcache.Deduplicator)
+	if !ok {
+		return false
+	}
+	seen, err := dedup.SeenBefore(service, username, id, self.config.DedupWindow)
+	if err != nil {
+		self.reportError(service, username, "", "", err)
+		return false
+	}
+	return seen
+}
+
+func (self *serviceCenter) syncCache(service, username string, ids []string) (err error) {
+	if self.config == nil {
+		return
+	}
+	if syncer, ok := self.config.MsgCache.(msgcache.Syncer); ok {
+		err = syncer.Sync(service, username, ids)
+	}
+	return
+}
+
+func (self *serviceCenter) BacklogCount(username string) (n int, err error) {
+	if self.config == nil {
+		return
+	}
+	if counter, ok := self.config.MsgCache.(msgcache.BacklogCounter); ok {
+		n, err = counter.BacklogCount(self.serviceName, username)
+	}
+	return
+}
+
+func (self *serviceCenter) CacheStats() (*msgcache.CacheStats, error) {
+	if self.config == nil || self.config.MsgCache == nil {
+		return nil, ErrNoCache
+	}
+	reporter, ok := self.config.MsgCache.(msgcache.StatsReporter)
+	if !ok {
+		return nil, ErrNoCacheStats
+	}
+	return reporter.CacheStats(self.serviceName)
+}
+
+// withSeq returns a copy of the message carrying the next
+// sequence number of the user, if the service numbers messages.
+func (self *serviceCenter) withSeq(username string, msg *proto.Message) *proto.Message {
+	if self.config == nil || !self.config.SequenceMessages || msg == nil {
+		return msg
+	}
+	seqr, ok := self.config.MsgCache.(msgcache.Sequencer)
+	if !ok {
+		return msg
+	}
+	seq, err := seqr.NextSeq(self.serviceName, username)
+	if err != nil {
+		self.reportError(self.serviceName, username, "", "", err)
+		return msg
+	}
+	ret := new(proto.Message)
+	*ret = *msg
+	ret.Header = make(map[string]string, len(msg.Header)+1)
+	for k, v := range msg.Header {
+		ret.Header[k] = v
+	}
+	ret.Header[SeqHeader] = fmt.Sprint(seq)
+	return ret
+}
+
+// prepareWrite checks the request, numbers its message and counts it
+// against the daily quota of the user before it is queued, so that the
+// goroutine processing the service, which may be shared by other
+// services, does not wait for the message cache. It returns the results
+// if the request is rejected.
+func (self *serviceCenter) prepareWrite(req *writeMessageRequest) []*Result {
+	if err := self.checkExtraSize(req.extra); err != nil {
+		return []*Result{&Result{Err: err, Code: ResultTooLarge}}
+	}
+	req.ttl = self.cacheTTL(req.ttl)
+	if msg := self.withSeq(req.user, req.msg); msg != req.msg {
+		// raw has no sequence number.
+		req.msg = msg
+		req.raw = nil
+	}
+	if self.overQuota(req.user) {
+		if self.config.CacheOverQuota {
+			go func(username string, msg *proto.Message, ttl time.Duration) {
+				_, err := self.cacheMessage(self.serviceName, username, msg, ttl)
+				if err != nil {
+					self.reportDelivery(self.serviceName, username, msg, evthandler.DeliveryFailed, 0)
+					return
+				}
+				self.reportDelivery(self.serviceName, username, msg, evthandler.DeliveryCached, 0)
+			}(req.user, req.msg, req.ttl)
+		} else {
+			self.reportDelivery(self.serviceName, req.user, req.msg, evthandler.DeliveryFailed, 0)
+		}
+		return []*Result{&Result{Err: ErrQuotaExceeded, Code: ResultQuotaExceeded}}
+	}
+	return nil
+}
+
+// CurrentSeq returns the sequence number of the last message sent to
+// the user. See ServiceConfig.SequenceMessages.
+func (self *serviceCenter) CurrentSeq(username string) (seq int64, err error) {
+	if self.config == nil || self.config.MsgCache == nil {
+		return 0, ErrNoCache
+	}
+	seqr, ok := self.config.MsgCache.(msgcache.Sequencer)
+	if !ok {
+		return 0, ErrNoSequencer
+	}
+	return seqr.CurrentSeq(self.serviceName, username)
+}
+
+func (self *serviceCenter) pushWindow() time.Duration {
+	if self.config.PushWindow > 0 {
+		return self.config.PushWindow
+	}
+	return time.Minute
+}
+
+// coalescePush counts a notification pushed to the user and tells if it
+// exceeds MaxPushesPerWindow. The first notification which exceeds the
+// limit schedules a push of their number at the end of the window.
+func (self *serviceCenter) coalescePush(username string, msgIds []string) bool {
+	if self.config == nil || self.config.MaxPushesPerWindow <= 0 {
+		return false
+	}
+	counter, ok := self.config.MsgCache.(msgcache.PushCounter)
+	if !ok {
+		return false
+	}
+	window := self.pushWindow()
+	now := time.Now()
+	n, err := counter.IncrPushCount(self.serviceName, username, window, now)
+	if err != nil {
+		self.reportError(self.serviceName, username, "", "", err)
+		return false
+	}
+	if n <= self.config.MaxPushesPerWindow {
+		return false
+	}
+	if n == self.config.MaxPushesPerWindow+1 {
+		start := now.Truncate(window)
+		time.AfterFunc(start.Add(window).Sub(now), func() {
+			self.pushCoalesced(username, start, msgIds)
+		})
+	}
+	return true
+}
+
+// pushCoalesced pushes a single notification about the messages whose
+// notifications were coalesced within the window starting at start.
+// msgIds are the ids of the first of those messages.
+func (self *serviceCenter) pushCoalesced(username string, start time.Time, msgIds []string) {
+	counter := self.config.MsgCache.(msgcache.PushCounter)
+	n, err := counter.PushCount(self.serviceName, username, self.pushWindow(), start)
+	if err != nil {
+		self.reportError(self.serviceName, username, "", "", err)
+		return
+	}
+	nrMsgs := n - self.config.MaxPushesPerWindow
+	if nrMsgs <= 0 {
+		return
+	}
+	info := map[string]string{
+		"notif.msg":                 fmt.Sprintf("You have %v new messages", nrMsgs),
+		"notif.uniqush.nrcoalesced": fmt.Sprint(nrMsgs),
+	}
+	self.pushServiceLock.RLock()
+	defer self.pushServiceLock.RUnlock()
+	err = self.push(self.serviceName, username, info, msgIds)
+	if err != nil {
+		self.setPushFailed(username, msgIds, true)
+	}
+}
+
+// overQuota counts a message delivered to the user today
+// and tells if the user has exceeded the daily quota.
+func (self *serviceCenter) overQuota(username string) bool {
+	if self.config == nil || self.config.MaxNrMsgsPerDay <= 0 {
+		return false
+	}
+	counter, ok := self.config.MsgCache.(msgcache.QuotaCounter)
+	if !ok {
+		return false
+	}
+	n, err := counter.IncrDailyCount(self.serviceName, username, time.Now())
+	if err != nil {
+		self.reportError(self.serviceName, username, "", "", err)
+		return false
+	}
+	return n > self.config.MaxNrMsgsPerDay
+}
+
+// reapStaleConns pings the connections of the user. The dead ones leave,
+// then the new connection is added again. If none of them is dead, the
+// new connection is rejected.
+func (self *serviceCenter) reapStaleConns(evt *eventConnIn, conns []server.Conn) {
+	reaped := false
+	for _, conn := range conns {
+		if conn.Ping() != nil {
+			self.connLeave <- &eventConnLeave{conn: conn, err: ErrStaleConn}
+			reaped = true
+		}
+	}
+	if !reaped {
+		if evt.errChan != nil {
+			evt.errChan <- ErrTooManyConnForThisUser
+		}
+		return
+	}
+	evt.reaped = true
+	self.connIn <- evt
+}
+
+// isRetryable tells if an error returned by SendMessage is temporary,
+// i.e. the connection is still usable and nothing has been written,
+// like a timeout before any byte of the message is sent. It follows
+// the convention of net.Error.
+func isRetryable(err error) bool {
+	if e, ok := err.(interface {
+		Temporary() bool
+	}); ok {
+		return e.Temporary()
+	}
+	return false
+}
+
+// sendMessage sends the message to the connection, retrying once if
+// the error is retryable. Any other error means the connection is broken.
+func sendMessage(conn server.Conn, msg *proto.Message, extra map[string]string, ttl time.Duration) (id string, err error) {
+	id, err = conn.SendMessage(msg, extra, ttl)
+	if err != nil && isRetryable(err) {
+		id, err = conn.SendMessage(msg, extra, ttl)
+	}
+	return
+}
+
+// sendRawMessage is sendMessage for a marshaled message.
+func sendRawMessage(conn server.Conn, raw []byte, msg *proto.Message, extra map[string]string, ttl time.Duration) (id string, err error) {
+	id, err = conn.SendRawMessage(raw, msg, extra, ttl)
+	if err != nil && isRetryable(err) {
+		id, err = conn.SendRawMessage(raw, msg, extra, ttl)
+	}
+	return
+}
+
+type connWriteErr struct {
+	conn server.Conn
+	err  error
+}
+
+// byWritePriority sorts connections in the order messages
+// are written to them. See server.Conn.SetPriority.
+type byWritePriority []server.Conn
+
+func (self byWritePriority) Len() int {
+	return len(self)
+}
+
+func (self byWritePriority) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+func (self byWritePriority) Less(i, j int) bool {
+	if pi, pj := self[i].Priority(), self[j].Priority(); pi != pj {
+		return pi > pj
+	}
+	return self[i].LastActive().After(self[j].LastActive())
+}
+
+// mostRecentlyActive returns the visible connection active last,
+// or nil if none was active within recent before now.
+func mostRecentlyActive(conns []server.Conn, recent time.Duration, now time.Time) server.Conn {
+	var ret server.Conn
+	for _, conn := range conns {
+		if !conn.Visible() {
+			continue
+		}
+		if ret == nil || conn.LastActive().After(ret.LastActive()) {
+			ret = conn
+		}
+	}
+	if ret == nil || now.Sub(ret.LastActive()) > recent {
+		return nil
+	}
+	return ret
+}
+
+// inWriteOrder returns the server connections among conns
+// in the order messages should be written to them.
+func inWriteOrder(conns []MinimalConn) []server.Conn {
+	ret := make([]server.Conn, 0, len(conns))
+	for _, conn := range conns {
+		if sconn, ok := conn.(server.Conn); ok {
+			ret = append(ret, sconn)
+		}
+	}
+	if len(ret) > 1 {
+		sort.Stable(byWritePriority(ret))
+	}
+	return ret
+}
+
+func (self *serviceCenter) process(maxNrConns, maxNrConnsPerUser, maxNrUsers int) {
+	newConnMap := self.config.NewConnMap
+	if newConnMap == nil {
+		newConnMap = NewTreeBasedConnMap
+	}
+	states := make(map[*serviceCenter]*serviceState, 1)
+	state := func(center *serviceCenter) *serviceState {
+		st, ok := states[center]
+		if !ok {
+			st = newServiceState(newConnMap())
+			states[center] = st
+		}
+		return st
+	}
+
+	leave := func(leaveEvt *eventConnLeave) {
+		center := self.member(leaveEvt.conn.Service())
+		st := state(center)
+		deleted := st.connMap.DelConn(leaveEvt.conn)
+		center.log("conn-leave", map[string]string{
+			"service":  center.serviceName,
+			"username": leaveEvt.conn.Username(),
+			"conn":     center.connId(leaveEvt.conn),
+			"deleted":  fmt.Sprint(deleted),
+		})
+		if leaveEvt.code != proto.CloseUnknown && leaveEvt.err != nil {
+			// Writing the reason may block on a slow client.
+			go leaveEvt.conn.CloseWithReason(leaveEvt.code, leaveEvt.err.Error(), 0)
+		} else {
+			leaveEvt.conn.Close()
+		}
+		if deleted {
+			st.nrConns--
+			st.closedBytesReceived += leaveEvt.conn.BytesReceived()
+			st.closedBytesSent += leaveEvt.conn.BytesSent()
+			conn := leaveEvt.conn
+			st.forget(conn)
+			if !st.isOnline(conn.Username()) {
+				center.notifyPresence(st, conn.Username(), false)
+			}
+			center.saveSession(conn)
+			center.publishConnEvent(ConnEventDisconnect, conn)
+			center.reportLogout(conn.Service(), conn.Username(), center.connId(conn), conn.RemoteAddr().String(), leaveEvt.err)
+		}
+	}
+
+	for {
 		select {
 		case connInEvt := <-self.connIn:
-			if maxNrConns > 0 && nrConns >= maxNrConns {
+			center := self.member(connInEvt.conn.Service())
+			st := state(center)
+			if maxNrConns > 0 && st.nrConns >= maxNrConns {
 				if connInEvt.errChan != nil {
 					connInEvt.errChan <- ErrTooManyConns
 				}
 				continue
 			}
-			err := connMap.AddConn(connInEvt.conn, maxNrConnsPerUser, maxNrUsers)
+			err := st.connMap.AddConn(connInEvt.conn, maxNrConnsPerUser, maxNrUsers)
+			if err == ErrTooManyConnForThisUser && center.config.ReapStaleConns && !connInEvt.reaped {
+				// Pinging a half-dead peer may block. The connection
+				// comes back once the stale ones have left.
+				go center.reapStaleConns(connInEvt, inWriteOrder(st.connMap.GetConn(connInEvt.conn.Username())))
+				continue
+			}
 			if err != nil {
 				if connInEvt.errChan != nil {
 					connInEvt.errChan <- err
 				}
 				continue
 			}
-			nrConns++
+			st.nrConns++
+			center.publishConnEvent(ConnEventConnect, connInEvt.conn)
+			if len(st.connMap.GetConn(connInEvt.conn.Username())) == 1 {
+				center.notifyPresence(st, connInEvt.conn.Username(), true)
+			}
 			if connInEvt.errChan != nil {
 				connInEvt.errChan <- nil
 			}
+			username := connInEvt.conn.Username()
+			for _, waiter := range st.waiters[username] {
+				close(waiter)
+			}
+			delete(st.waiters, username)
+		case cancelreq := <-self.cancelWaitChan:
+			center := self.member(cancelreq.service)
+			st := state(center)
+			ws := st.waiters[cancelreq.username]
+			for i, waiter := range ws {
+				if waiter == cancelreq.waiter {
+					ws = append(ws[:i], ws[i+1:]...)
+					break
+				}
+			}
+			if len(ws) == 0 {
+				delete(st.waiters, cancelreq.username)
+			} else {
+				st.waiters[cancelreq.username] = ws
+			}
 		case leaveEvt := <-self.connLeave:
-			deleted := connMap.DelConn(leaveEvt.conn)
-			fmt.Printf("delete a connection %v under user %v; deleted: %v\n", leaveEvt.conn.UniqId(), leaveEvt.conn.Username(), deleted)
-			leaveEvt.conn.Close()
-			if deleted {
-				nrConns--
-				conn := leaveEvt.conn
-				self.reportLogout(conn.Service(), conn.Username(), conn.UniqId(), conn.RemoteAddr().String(), leaveEvt.err)
+			leave(leaveEvt)
+		case listreq := <-self.connListChan:
+			center := self.member(listreq.service)
+			st := state(center)
+			var conns []MinimalConn
+			if len(listreq.username) == 0 {
+				conns = st.connMap.AllConns()
+			} else {
+				conns = st.connMap.GetConn(listreq.username)
 			}
-		case subreq := <-self.subReqChan:
-			self.pushServiceLock.Lock()
-			self.subscribe(subreq)
-			self.pushServiceLock.Unlock()
-		case wreq := <-self.writeReqChan:
-			conns := connMap.GetConn(wreq.user)
-			res := make([]*Result, 0, len(conns))
-			errConns := make([]*connWriteErr, 0, len(conns))
-			n := 0
+			res := make([]server.Conn, 0, len(conns))
 			for _, conn := range conns {
-				if conn == nil {
+				if sconn, ok := conn.(server.Conn); ok {
+					res = append(res, sconn)
+				}
+			}
+			listreq.resChan <- res
+		case detailsreq := <-self.detailsChan:
+			center := self.member(detailsreq.service)
+			st := state(center)
+			var details *ConnDetails
+			for _, conn := range st.connMap.GetConn(detailsreq.username) {
+				if conn.UniqId() != detailsreq.uniqId {
 					continue
 				}
-				var err error
+				if sconn, ok := conn.(server.Conn); ok {
+					details = center.connDetails(sconn)
+				}
+				break
+			}
+			detailsreq.resChan <- details
+		case statsreq := <-self.statsChan:
+			center := self.member(statsreq.service)
+			st := state(center)
+			stats := st.connMap.Stats()
+			stats.BytesReceived = st.closedBytesReceived
+			stats.BytesSent = st.closedBytesSent
+			for _, conn := range st.connMap.AllConns() {
+				if sconn, ok := conn.(server.Conn); ok {
+					stats.BytesReceived += sconn.BytesReceived()
+					stats.BytesSent += sconn.BytesSent()
+				}
+			}
+			statsreq.resChan <- stats
+		case drainreq := <-self.drainChan:
+			center := self.member(drainreq.service)
+			st := state(center)
+			conns := st.connMap.GetConn(drainreq.username)
+			drained := make([]server.Conn, 0, len(conns))
+			for _, conn := range conns {
+				if sconn, ok := conn.(server.Conn); ok {
+					drained = append(drained, sconn)
+				}
+			}
+			drainreq.resChan <- len(drained)
+
+			// The connections will be removed once we get back to the loop.
+			go func() {
+				for _, conn := range drained {
+					center.connLeave <- &eventConnLeave{conn: conn, err: ErrConnDrained, code: proto.CloseDrained}
+				}
+			}()
+		case bcastreq := <-self.bcastChan:
+			center := self.member(bcastreq.service)
+			st := state(center)
+			if err := center.checkExtraSize(bcastreq.extra); err != nil {
+				bcastreq.resChan <- []*Result{&Result{Err: err, Code: ResultTooLarge}}
+				continue
+			}
+			bcastreq.ttl = center.cacheTTL(bcastreq.ttl)
+			conns := st.connMap.AllConns()
+			res := make([]*Result, 0, len(conns))
+			errConns := make([]*connWriteErr, 0, 16)
+			for _, conn := range conns {
 				sconn, ok := conn.(server.Conn)
 				if !ok {
 					continue
 				}
-				_, err = sconn.SendMessage(wreq.msg, wreq.extra, wreq.ttl)
+				info := ConnInfo{
+					Service:  sconn.Service(),
+					Username: sconn.Username(),
+					ConnId:   center.connId(sconn),
+					Visible:  sconn.Visible(),
+				}
+				if addr := sconn.RemoteAddr(); addr != nil {
+					info.Addr = addr.String()
+				}
+				if !bcastreq.pred(info) {
+					continue
+				}
+				// Each connection may modify the extra map.
+				_, err := sendMessage(sconn, bcastreq.msg, copyExtra(bcastreq.extra), bcastreq.ttl)
+				if err != nil {
+					errConns = append(errConns, &connWriteErr{sconn, err})
+					center.reportError(info.Service, info.Username, info.ConnId, info.Addr, err)
+				} else {
+					center.audit(AuditOutbound, sconn, bcastreq.msg)
+				}
+				res = append(res, &Result{Err: err, ConnId: info.ConnId, Visible: info.Visible, Code: resultCode(err)})
+			}
+			bcastreq.resChan <- res
+
+			go func() {
+				for _, e := range errConns {
+					center.connLeave <- &eventConnLeave{conn: e.conn, err: e.err}
+				}
+			}()
+		case watchreq := <-self.watchReqChan:
+			center := self.member(watchreq.Service)
+			center.processWatch(state(center), watchreq)
+		case subreq := <-self.subReqChan:
+			center := self.member(subreq.Service)
+			center.pushServiceLock.Lock()
+			center.subscribe(subreq)
+			center.pushServiceLock.Unlock()
+		case wreq := <-self.writeReqChan:
+			center := self.member(wreq.service)
+			st := state(center)
+			trace := traceId(wreq.msg)
+			conns := inWriteOrder(st.connMap.GetConn(wreq.user))
+			if wreq.recent > 0 {
+				if active := mostRecentlyActive(conns, wreq.recent, time.Now()); active != nil {
+					conns = []server.Conn{active}
+				}
+			}
+			res := make([]*Result, 0, len(conns))
+			errConns := make([]*connWriteErr, 0, len(conns))
+			n := 0
+			for _, sconn := range conns {
+				var err error
+				if wreq.raw != nil {
+					_, err = sendRawMessage(sconn, wreq.raw, wreq.msg, wreq.extra, wreq.ttl)
+				} else {
+					_, err = sendMessage(sconn, wreq.msg, wreq.extra, wreq.ttl)
+				}
 				if err != nil {
 					errConns = append(errConns, &connWriteErr{sconn, err})
-					res = append(res, &Result{err, sconn.UniqId(), sconn.Visible()})
-					self.reportError(sconn.Service(), sconn.Username(), sconn.UniqId(), sconn.RemoteAddr().String(), err)
+					res = append(res, &Result{Err: err, ConnId: center.connId(sconn), Visible: sconn.Visible(), Code: resultCode(err)})
+					center.reportError(sconn.Service(), sconn.Username(), center.connId(sconn), sconn.RemoteAddr().String(), err)
 					continue
 				} else {
-					res = append(res, &Result{nil, sconn.UniqId(), sconn.Visible()})
+					res = append(res, &Result{ConnId: center.connId(sconn), Visible: sconn.Visible()})
+					center.audit(AuditOutbound, sconn, wreq.msg)
 				}
 				if sconn.Visible() {
 					n++
 				}
 			}
 
-			if n == 0 {
+			// Don't bother an offline user who was active recently.
+			suppressed := n == 0 && wreq.activeWindow > 0 &&
+				center.lastSeen.activeWithin(wreq.user, wreq.activeWindow, time.Now())
+			if wreq.waiter != nil {
+				suppressed = true
+				if len(res) == len(errConns) {
+					st.waiters[wreq.user] = append(st.waiters[wreq.user], wreq.waiter)
+				}
+			}
+			center.log("routed", map[string]string{
+				"trace":      trace,
+				"service":    center.serviceName,
+				"username":   wreq.user,
+				"conns":      fmt.Sprint(len(res)),
+				"visible":    fmt.Sprint(n),
+				"errors":     fmt.Sprint(len(errConns)),
+				"suppressed": fmt.Sprint(suppressed),
+			})
+			if n > 0 {
+				center.reportDelivery(center.serviceName, wreq.user, wreq.msg, evthandler.DeliveredOnline, n)
+			} else if suppressed && wreq.waiter == nil {
+				center.reportDelivery(center.serviceName, wreq.user, wreq.msg, evthandler.DeliveryFailed, 0)
+			}
+
+			if n == 0 && !suppressed {
 				msg := wreq.msg
 				extra := wreq.extra
 				username := wreq.user
-				service := self.serviceName
-				fwd := false
-				if len(msg.Sender) > 0 && len(msg.SenderService) > 0 {
-					if msg.Sender != username || msg.SenderService != service {
-						fwd = true
-					}
-				}
+				service := center.serviceName
+				fwd := isForwarded(msg, service, username)
+				atomic.AddInt64(&center.nrPendingPushes, 1)
 				go func() {
-					should := self.shouldPush(service, username, msg, extra, fwd)
+					defer atomic.AddInt64(&center.nrPendingPushes, -1)
+					should := center.shouldPush(service, username, msg, extra, fwd)
 					if !should {
+						center.reportDelivery(service, username, msg, evthandler.DeliveryFailed, 0)
 						return
 					}
-					self.pushServiceLock.RLock()
-					defer self.pushServiceLock.RUnlock()
-					n := self.nrDeliveryPoints(service, username)
+					center.pushServiceLock.RLock()
+					defer center.pushServiceLock.RUnlock()
+					n := center.nrDeliveryPoints(service, username)
 					if n <= 0 {
+						center.reportFallback(service, username, msg)
+						center.reportDelivery(service, username, msg, evthandler.DeliveryFailed, 0)
 						return
 					}
 					var msgIds []string
 					msgIds = make([]string, n)
 					var e error
 					for i := 0; i < n; i++ {
-						msgIds[i], e = self.cacheMessage(service, username, msg, wreq.ttl)
+						msgIds[i], e = center.cacheMessage(service, username, msg, wreq.ttl)
 						if e != nil {
 							// FIXME: Dark side of the force
+							center.reportDelivery(service, username, msg, evthandler.DeliveryFailed, 0)
 							return
 						}
 					}
-					self.pushNotif(service, username, msg, extra, msgIds, fwd)
+					// Don't tell the user about messages which cannot be fetched yet.
+					e = center.syncCache(service, username, msgIds)
+					if e != nil {
+						center.reportError(service, username, "", "", e)
+						center.reportDelivery(service, username, msg, evthandler.DeliveryFailed, 0)
+						return
+					}
+					center.reportDelivery(service, username, msg, evthandler.DeliveryCached, 0)
+					center.log("cached", map[string]string{
+						"trace":    trace,
+						"service":  service,
+						"username": username,
+						"ids":      strings.Join(msgIds, ","),
+					})
+					if center.coalescePush(username, msgIds) {
+						center.log("coalesced", map[string]string{
+							"trace":    trace,
+							"service":  service,
+							"username": username,
+						})
+						return
+					}
+					e = center.pushNotif(service, username, msg, extra, msgIds, fwd)
+					if e != nil {
+						center.setPushFailed(username, msgIds, true)
+					}
+					fields := map[string]string{
+						"trace":    trace,
+						"service":  service,
+						"username": username,
+					}
+					if e != nil {
+						fields["err"] = e.Error()
+					}
+					center.log("pushed", fields)
 				}()
 			}
 			if wreq.resChan != nil {
@@ -344,8 +1852,7 @@ func (self *serviceCenter) process(maxNrConns, maxNrConnsPerUser, maxNrUsers int
 			// close all connections with error:
 			go func() {
 				for _, e := range errConns {
-					fmt.Printf("Need to remove connection %v\n", e.conn.UniqId())
-					self.connLeave <- &eventConnLeave{conn: e.conn, err: e.err}
+					center.connLeave <- &eventConnLeave{conn: e.conn, err: e.err}
 				}
 			}()
 		}
@@ -353,68 +1860,593 @@ func (self *serviceCenter) process(maxNrConns, maxNrConnsPerUser, maxNrUsers int
 }
 
 func (self *serviceCenter) SendMessage(username string, msg *proto.Message, extra map[string]string, ttl time.Duration) []*Result {
+	return self.SendMessageUnlessActive(username, msg, extra, ttl, 0)
+}
+
+// SendMessageUnlessActive sends the message like SendMessage, but no
+// notification will be pushed if the user has no online connection and
+// was active within the window.
+func (self *serviceCenter) SendMessageUnlessActive(username string, msg *proto.Message, extra map[string]string, ttl time.Duration, window time.Duration) []*Result {
 	req := new(writeMessageRequest)
 	ch := make(chan []*Result)
+	req.service = self.serviceName
 	req.msg = msg
 	req.user = username
 	req.ttl = ttl
 	req.resChan = ch
 	req.extra = extra
+	req.activeWindow = window
+	if res := self.prepareWrite(req); res != nil {
+		return res
+	}
 	self.writeReqChan <- req
 	res := <-ch
 	return res
 }
 
+// SendToActiveConn sends the message only to the connection of the user
+// active most recently, if it was active within recent. Otherwise, it
+// sends the message like SendMessage.
+func (self *serviceCenter) SendToActiveConn(username string, msg *proto.Message, extra map[string]string, ttl time.Duration, recent time.Duration) []*Result {
+	req := new(writeMessageRequest)
+	ch := make(chan []*Result)
+	req.service = self.serviceName
+	req.msg = msg
+	req.user = username
+	req.ttl = ttl
+	req.resChan = ch
+	req.extra = extra
+	req.recent = recent
+	if res := self.prepareWrite(req); res != nil {
+		return res
+	}
+	self.writeReqChan <- req
+	return <-ch
+}
+
+// SendRawMessage sends a marshaled message like SendMessage. raw is
+// written to each connection without being encoded again. msg is raw
+// decoded, for pushing and caching the message.
+func (self *serviceCenter) SendRawMessage(username string, raw []byte, msg *proto.Message, extra map[string]string, ttl time.Duration) []*Result {
+	req := new(writeMessageRequest)
+	ch := make(chan []*Result)
+	req.service = self.serviceName
+	req.msg = msg
+	req.raw = raw
+	req.user = username
+	req.ttl = ttl
+	req.resChan = ch
+	req.extra = extra
+	if res := self.prepareWrite(req); res != nil {
+		return res
+	}
+	self.writeReqChan <- req
+	return <-ch
+}
+
+// TrySendMessage sends the message like SendMessage, but returns
+// ErrBusy instead of waiting if SendBufferSize messages are already
+// waiting to be routed. The message is numbered and counted against the
+// quota before, so a busy service leaves a gap in the sequence numbers
+// of the user.
+func (self *serviceCenter) TrySendMessage(username string, msg *proto.Message, extra map[string]string, ttl time.Duration) ([]*Result, error) {
+	req := new(writeMessageRequest)
+	ch := make(chan []*Result)
+	req.service = self.serviceName
+	req.msg = msg
+	req.user = username
+	req.ttl = ttl
+	req.resChan = ch
+	req.extra = extra
+	if res := self.prepareWrite(req); res != nil {
+		return res, nil
+	}
+	select {
+	case self.writeReqChan <- req:
+	default:
+		return nil, ErrBusy
+	}
+	return <-ch, nil
+}
+
+// SendAndWaitDelivered sends the message to the user. If no connection
+// of the user received the message, it waits for the user to come
+// online and sends it again, until the timeout elapses. It returns the
+// result of the first connection received the message, or
+// ErrDeliveryTimeout. The message will never be pushed.
+func (self *serviceCenter) SendAndWaitDelivered(username string, msg *proto.Message, timeout time.Duration) (*Result, error) {
+	deadline := time.After(timeout)
+	req := new(writeMessageRequest)
+	req.service = self.serviceName
+	req.msg = msg
+	req.user = username
+	// Number and count the message once, however many times it is sent.
+	if res := self.prepareWrite(req); res != nil {
+		return res[0], res[0].Err
+	}
+	for {
+		ch := make(chan []*Result)
+		wreq := *req
+		wreq.resChan = ch
+		wreq.waiter = make(chan bool)
+		self.writeReqChan <- &wreq
+		res := <-ch
+		for _, r := range res {
+			if r.Err == nil && len(r.ConnId) > 0 {
+				return r, nil
+			}
+		}
+		select {
+		case <-wreq.waiter:
+			// A connection of the user arrived. Try again.
+		case <-deadline:
+			self.cancelWaitChan <- &cancelWaitRequest{service: self.serviceName, username: username, waiter: wreq.waiter}
+			return nil, ErrDeliveryTimeout
+		}
+	}
+}
+
+// AllConns returns all connections currently served by this service.
+func (self *serviceCenter) AllConns() []server.Conn {
+	ch := make(chan []server.Conn)
+	self.connListChan <- &connListRequest{service: self.serviceName, resChan: ch}
+	return <-ch
+}
+
+// UserConns returns all connections under the user.
+func (self *serviceCenter) UserConns(username string) []server.Conn {
+	if len(username) == 0 {
+		return nil
+	}
+	ch := make(chan []server.Conn)
+	self.connListChan <- &connListRequest{service: self.serviceName, username: username, resChan: ch}
+	return <-ch
+}
+
+func (self *serviceCenter) connDetails(conn server.Conn) *ConnDetails {
+	ret := &ConnDetails{
+		Service:           conn.Service(),
+		Username:          conn.Username(),
+		ConnId:            self.connId(conn),
+		Visible:           conn.Visible(),
+		ConnectedAt:       conn.ConnectedAt(),
+		Region:            self.region,
+		BytesReceived:     conn.BytesReceived(),
+		BytesSent:         conn.BytesSent(),
+		DigestThreshold:   conn.DigestThreshold(),
+		CompressThreshold: conn.CompressThreshold(),
+		Heartbeat:         conn.Heartbeat(),
+		Priority:          conn.Priority(),
+		LastActive:        conn.LastActive(),
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		ret.Addr = addr.String()
+	}
+	if t, ok := self.lastSeen.get(conn.Username()); ok {
+		ret.LastSeen = t
+	}
+	if state, ok := conn.ConnectionState(); ok {
+		ret.TLSVersion = tlsVersionName(state.Version)
+		ret.TLSCipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	}
+	return ret
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// ConnDetails returns the details of the user's connection with the
+// uniqId, or ErrNoConn if there is no such connection. The uniqId may
+// be prefixed with the node id, as reported in the events.
+func (self *serviceCenter) ConnDetails(username, uniqId string) (*ConnDetails, error) {
+	if len(self.nodeId) > 0 {
+		uniqId = strings.TrimPrefix(uniqId, self.nodeId+":")
+	}
+	ch := make(chan *ConnDetails)
+	self.detailsChan <- &connDetailsRequest{service: self.serviceName, username: username, uniqId: uniqId, resChan: ch}
+	details := <-ch
+	if details == nil {
+		return nil, ErrNoConn
+	}
+	return details, nil
+}
+
+// SetConnPriority sets the priority of the user's connection with the
+// uniqId, or returns ErrNoConn if there is no such connection.
+func (self *serviceCenter) SetConnPriority(username, uniqId string, priority int) error {
+	if len(self.nodeId) > 0 {
+		uniqId = strings.TrimPrefix(uniqId, self.nodeId+":")
+	}
+	for _, conn := range self.UserConns(username) {
+		if conn.UniqId() == uniqId {
+			conn.SetPriority(priority)
+			return nil
+		}
+	}
+	return ErrNoConn
+}
+
+// Stats returns the statistics of the connections under this service.
+func (self *serviceCenter) Stats() *ConnMapStats {
+	ch := make(chan *ConnMapStats)
+	self.statsChan <- &statsRequest{service: self.serviceName, resChan: ch}
+	stats := <-ch
+	stats.NrPendingPushes = atomic.LoadInt64(&self.nrPendingPushes)
+	stats.NrPushes = atomic.LoadInt64(&self.nrPushes)
+	stats.NrPushErrors = atomic.LoadInt64(&self.nrPushErrors)
+	stats.NrDeadLetters = self.nrDeadLetters()
+	stats.NrDroppedConnEvents = self.connEvents.dropped()
+	return stats
+}
+
+// deadLetterCounter is implemented by the event handlers
+// which replay the events failed to be delivered.
+type deadLetterCounter interface {
+	NrDeadLetters() int
+}
+
+func (self *serviceCenter) nrDeadLetters() int {
+	n := 0
+	handlers := []interface{}{
+		self.config.LoginHandler,
+		self.config.LogoutHandler,
+		self.config.MessageHandler,
+		self.config.ErrorHandler,
+		self.config.UnsubscribeHandler,
+		self.config.FallbackHandler,
+		self.config.DeliveryHandler,
+	}
+	for _, h := range self.config.MessageRoutes {
+		handlers = append(handlers, h)
+	}
+	for _, h := range handlers {
+		if c, ok := h.(deadLetterCounter); ok {
+			n += c.NrDeadLetters()
+		}
+	}
+	return n
+}
+
+// DrainUser closes all connections under the user and returns the
+// number of connections being closed. The logout handler will be
+// called with ErrConnDrained as the reason.
+func (self *serviceCenter) DrainUser(username string) int {
+	ch := make(chan int)
+	self.drainChan <- &drainRequest{service: self.serviceName, username: username, resChan: ch}
+	return <-ch
+}
+
+// BroadcastFilter sends the message to all connections under the
+// service for which pred returns true. Offline users will not receive
+// the message later. pred is called inside the service's main loop, so
+// it should return quickly.
+func (self *serviceCenter) BroadcastFilter(pred func(ConnInfo) bool, msg *proto.Message, extra map[string]string, ttl time.Duration) []*Result {
+	ch := make(chan []*Result)
+	self.bcastChan <- &broadcastRequest{
+		service: self.serviceName,
+		pred:    pred,
+		msg:     msg,
+		ttl:     ttl,
+		extra:   extra,
+		resChan: ch,
+	}
+	return <-ch
+}
+
+func (self *serviceCenter) checkHeader(msg *proto.Message) error {
+	for _, h := range self.config.RequiredHeaders {
+		if _, ok := msg.Header[h]; !ok {
+			return fmt.Errorf("header %v is required", h)
+		}
+	}
+	if len(self.config.AllowedHeaders) == 0 {
+		return nil
+	}
+	for k, _ := range msg.Header {
+		allowed := false
+		for _, h := range self.config.AllowedHeaders {
+			if h == k {
+				allowed = true
+				break
+			}
+		}
+		for _, h := range self.config.RequiredHeaders {
+			if h == k {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("header %v is not allowed", k)
+		}
+	}
+	return nil
+}
+
+// reauth re-authenticates the connection periodically until done is closed.
+func (self *serviceCenter) reauth(conn server.Conn, interval time.Duration, done <-chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			ok, err := self.auth.Authenticate(conn.Service(), conn.Username(), conn.AuthToken(), conn.RemoteAddr().String(), conn.Labels())
+			if err != nil || !ok {
+				self.connLeave <- &eventConnLeave{conn: conn, err: ErrAuthExpired, code: proto.CloseAuthExpired}
+				return
+			}
+		}
+	}
+}
+
+// expire closes the connection once it lives longer than a random
+// point within the last tenth of maxLifetime, unless done is closed.
+func (self *serviceCenter) expire(conn server.Conn, maxLifetime time.Duration, done <-chan bool) {
+	lifetime := maxLifetime
+	if jitter := int64(maxLifetime / 10); jitter > 0 {
+		lifetime -= time.Duration(rand.Int63n(jitter))
+	}
+	timer := time.NewTimer(conn.ConnectedAt().Add(lifetime).Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		self.connLeave <- &eventConnLeave{conn: conn, err: ErrMaxLifetime, code: proto.CloseMaxLifetime}
+	}
+}
+
 func (self *serviceCenter) serveConn(conn server.Conn) {
 	conn.SetForwardRequestChannel(self.fwdChan)
 	conn.SetSubscribeRequestChan(self.subReqChan)
+	if self.config.MaxNrWatches > 0 {
+		conn.SetWatchRequestChan(self.watchReqChan)
+	}
+	conn.SetDeleteOnReceipt(self.config.DeleteOnReceipt)
+	conn.SetAckBeforeDelete(self.config.AckBeforeDelete)
+	conn.SetMaxReplayAge(self.config.MaxReplayAge)
+	if self.config.MaxNrSubscribes > 0 {
+		interval := self.config.SubscribeInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		conn.SetSubscribeRateLimit(self.config.MaxNrSubscribes, interval)
+	}
+	msgInterval := self.config.ConnMessageInterval
+	if msgInterval <= 0 {
+		msgInterval = time.Second
+	}
+	var msgWindowStart time.Time
+	nrMsgs := 0
 	var err error
+	done := make(chan bool)
+	defer close(done)
+	if self.auth != nil && self.config.ReAuthInterval > 0 {
+		go self.reauth(conn, self.config.ReAuthInterval, done)
+	}
+	if self.config.MaxConnLifetime > 0 {
+		go self.expire(conn, self.config.MaxConnLifetime, done)
+	}
 	defer func() {
-		self.connLeave <- &eventConnLeave{conn: conn, err: err}
+		evt := &eventConnLeave{conn: conn, err: err}
+		if err == server.ErrTooManySubscribes || err == ErrTooManyMessages {
+			evt.code = proto.CloseRateLimited
+		}
+		self.connLeave <- evt
 	}()
 	for {
 		var msg *proto.Message
 		msg, err = conn.ReadMessage()
 		if err != nil {
+			if _, ok := err.(*proto.DecodeError); ok {
+				self.reportError(conn.Service(), conn.Username(), self.connId(conn), conn.RemoteAddr().String(), err)
+				if self.config.SkipMalformedMessages {
+					continue
+				}
+			}
+			if err == server.ErrTooManySubscribes {
+				self.reportError(conn.Service(), conn.Username(), self.connId(conn), conn.RemoteAddr().String(), err)
+			}
+			return
+		}
+		if self.config.MaxNrConnMessages > 0 {
+			now := time.Now()
+			if now.Sub(msgWindowStart) >= msgInterval {
+				msgWindowStart = now
+				nrMsgs = 0
+			}
+			nrMsgs++
+			if nrMsgs > self.config.MaxNrConnMessages {
+				err = ErrTooManyMessages
+				self.reportError(conn.Service(), conn.Username(), self.connId(conn), conn.RemoteAddr().String(), err)
+				return
+			}
+		}
+		self.lastSeen.update(conn.Username(), time.Now())
+		err = self.checkHeader(msg)
+		if err != nil {
+			self.reportError(conn.Service(), conn.Username(), self.connId(conn), conn.RemoteAddr().String(), err)
 			return
 		}
-		self.reportMessage(conn.UniqId(), msg)
+		if id, ok := msg.Header[ClientMsgIdHeader]; ok {
+			if self.isDuplicate(conn.Service(), conn.Username(), "msg:"+id) {
+				continue
+			}
+		}
+		self.audit(AuditInbound, conn, msg)
+		self.log("received", map[string]string{
+			"trace":    traceId(msg),
+			"service":  conn.Service(),
+			"username": conn.Username(),
+			"conn":     self.connId(conn),
+			"size":     fmt.Sprint(msg.Size()),
+		})
+		self.reportMessage(self.connId(conn), msg)
 	}
 }
 
+// saveSession keeps the state of a closed connection
+// if the client supplied a session id.
+func (self *serviceCenter) saveSession(conn server.Conn) {
+	if self.sessions == nil {
+		return
+	}
+	sessionId := conn.Labels()[SessionIdLabel]
+	if len(sessionId) == 0 {
+		return
+	}
+	self.sessions.save(conn.Username(), sessionId, &sessionState{
+		priority: conn.Priority(),
+		visible:  conn.Visible(),
+		savedAt:  time.Now(),
+	})
+}
+
+// resumeSession restores the state of an earlier connection
+// with the same session id, if there is any.
+func (self *serviceCenter) resumeSession(conn server.Conn) {
+	if self.sessions == nil {
+		return
+	}
+	sessionId := conn.Labels()[SessionIdLabel]
+	if len(sessionId) == 0 {
+		return
+	}
+	state, ok := self.sessions.take(conn.Username(), sessionId, time.Now())
+	if !ok {
+		return
+	}
+	conn.SetPriority(state.priority)
+	conn.SetDefaultVisibility(state.visible)
+}
+
 func (self *serviceCenter) NewConn(conn server.Conn) error {
 	usr := conn.Username()
 	if len(usr) == 0 || strings.Contains(usr, ":") || strings.Contains(usr, "\n") {
-		return fmt.Errorf("[Username=%v] Invalid Username")
+		return fmt.Errorf("[Username=%v] Invalid Username", usr)
+	}
+	if self.config.RequireCache && self.config.MsgCache == nil {
+		return ErrNoCache
+	}
+	if hb := conn.ProposedHeartbeat(); hb > 0 {
+		if !self.heartbeatAllowed(hb) {
+			conn.CloseWithReason(proto.CloseUnknown, ErrBadHeartbeat.Error(), 0)
+			return ErrBadHeartbeat
+		}
+		if err := conn.SetHeartbeat(hb); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if self.config.LowPriority && self.shed != nil && self.shed() {
+		self.reportError(conn.Service(), usr, "", conn.RemoteAddr().String(), ErrLoadShed)
+		self.closeOverCapacity(conn, ErrLoadShed)
+		return ErrLoadShed
 	}
 	evt := new(eventConnIn)
 	ch := make(chan error)
 
 	conn.SetMessageCache(self.config.MsgCache)
+	if self.config.InvisibleByDefault {
+		conn.SetDefaultVisibility(false)
+	}
+	self.resumeSession(conn)
+	if self.config.SendDedupWindow > 0 {
+		conn = newDedupConn(conn, self.config.SendDedupWindow)
+	}
+	if self.config.OutboundQueueSize > 0 {
+		conn = newQueuedConn(conn, self.config.OutboundQueueSize, self.config.OutboundOverflow, self)
+	}
 	evt.conn = conn
 	evt.errChan = ch
 	self.connIn <- evt
 	err := <-ch
 	if err == nil {
 		go self.serveConn(conn)
-		self.reportLogin(conn.Service(), usr, conn.UniqId(), conn.RemoteAddr().String())
+		self.reportLogin(conn.Service(), usr, self.connId(conn), conn.RemoteAddr().String())
+	}
+	switch err {
+	case nil:
+	case ErrTooManyConns, ErrTooManyUsers:
+		self.closeOverCapacity(conn, err)
+	default:
+		if qc, ok := conn.(*queuedConn); ok {
+			qc.stop()
+		}
 	}
 	return err
 }
 
-func newServiceCenter(serviceName string, conf *ServiceConfig, fwdChan chan<- *server.ForwardRequest) *serviceCenter {
-	ret := new(serviceCenter)
-	ret.config = conf
-	if ret.config == nil {
-		ret.config = new(ServiceConfig)
+func (self *serviceCenter) heartbeatAllowed(interval time.Duration) bool {
+	if self.config.MinHeartbeat > 0 && interval < self.config.MinHeartbeat {
+		return false
+	}
+	if self.config.MaxHeartbeat > 0 && interval > self.config.MaxHeartbeat {
+		return false
+	}
+	return true
+}
+
+func (self *serviceCenter) closeOverCapacity(conn server.Conn, reason error) {
+	var retryAfter time.Duration
+	if self.config.RetryAfter > 0 {
+		retryAfter = self.retryAfter()
+	}
+	conn.CloseWithReason(proto.CloseCapacity, reason.Error(), retryAfter)
+}
+
+func (self *serviceCenter) retryAfter() time.Duration {
+	d := self.config.RetryAfter
+	if self.config.RetryAfterJitter > 0 {
+		d += time.Duration(rand.Int63n(int64(self.config.RetryAfterJitter)))
+	}
+	return d
+}
+
+// init sets up the fields which are not shared with other services.
+func (self *serviceCenter) init(serviceName string, conf *ServiceConfig, auth server.Authenticator, fwdChan chan<- *server.ForwardRequest) {
+	self.config = conf
+	if self.config == nil {
+		self.config = new(ServiceConfig)
+	}
+	self.auth = auth
+	self.serviceName = serviceName
+	self.fwdChan = fwdChan
+	self.lastSeen = newLastSeenMap()
+	if self.config.SessionRetention > 0 {
+		self.sessions = newSessionStore(self.config.SessionRetention, self.config.MaxNrSessions)
 	}
-	ret.serviceName = serviceName
-	ret.fwdChan = fwdChan
+	self.connEvents = new(connEventHub)
+}
+
+func newServiceCenter(serviceName string, conf *ServiceConfig, auth server.Authenticator, fwdChan chan<- *server.ForwardRequest) *serviceCenter {
+	ret := new(serviceCenter)
+	ret.init(serviceName, conf, auth, fwdChan)
 
 	ret.connIn = make(chan *eventConnIn)
 	ret.connLeave = make(chan *eventConnLeave)
-	ret.writeReqChan = make(chan *writeMessageRequest)
+	ret.writeReqChan = make(chan *writeMessageRequest, ret.config.SendBufferSize)
 	ret.subReqChan = make(chan *server.SubscribeRequest)
-	go ret.process(conf.MaxNrConns, conf.MaxNrConnsPerUser, conf.MaxNrUsers)
+	ret.connListChan = make(chan *connListRequest)
+	ret.drainChan = make(chan *drainRequest)
+	ret.statsChan = make(chan *statsRequest)
+	ret.bcastChan = make(chan *broadcastRequest)
+	ret.cancelWaitChan = make(chan *cancelWaitRequest)
+	ret.detailsChan = make(chan *connDetailsRequest)
+	ret.watchReqChan = make(chan *server.WatchRequest)
+	ret.group = newServiceGroup(ret)
+	go ret.process(ret.config.MaxNrConns, ret.config.MaxNrConnsPerUser, ret.config.MaxNrUsers)
 	return ret
 }
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/evthandler"
+	"github.com/uniqush/uniqush-conn/msgcache"
+)
+
+var ErrServiceExists = errors.New("service already exists")
+
+// Validate checks the config for settings which cannot work together,
+// e.g. a feature requiring MsgCache without one.
+func (self *ServiceConfig) Validate() error {
+	if self.MaxNrConns < 0 || self.MaxNrUsers < 0 || self.MaxNrConnsPerUser < 0 {
+		return fmt.Errorf("connection limits should not be negative")
+	}
+	if self.MaxNrSubscribes < 0 || self.MaxNrMsgsPerDay < 0 || self.OutboundQueueSize < 0 {
+		return fmt.Errorf("limits should not be negative")
+	}
+	if self.MsgCache == nil {
+		switch {
+		case self.RequireCache:
+			return fmt.Errorf("RequireCache is set but there is no MsgCache")
+		case self.DedupWindow > 0:
+			return fmt.Errorf("DedupWindow is set but there is no MsgCache")
+		case self.MaxNrMsgsPerDay > 0:
+			return fmt.Errorf("MaxNrMsgsPerDay is set but there is no MsgCache")
+		}
+	}
+	if self.HandshakeTimeout < 0 {
+		return fmt.Errorf("HandshakeTimeout should not be negative")
+	}
+	if self.MinHeartbeat > 0 && self.MaxHeartbeat > 0 && self.MinHeartbeat > self.MaxHeartbeat {
+		return fmt.Errorf("MinHeartbeat %v is longer than MaxHeartbeat %v", self.MinHeartbeat, self.MaxHeartbeat)
+	}
+	if self.Shadow == self {
+		return fmt.Errorf("a service cannot shadow itself")
+	}
+	return nil
+}
+
+// ServiceConfigBuilder builds a ServiceConfig in Go, for programs which
+// embed the message center instead of reading a config file.
+type ServiceConfigBuilder struct {
+	config ServiceConfig
+}
+
+func NewServiceConfig() *ServiceConfigBuilder {
+	return new(ServiceConfigBuilder)
+}
+
+// Handler registers h for every kind of event it handles, i.e. every
+// interface in evthandler it implements. A later handler replaces an
+// earlier one for the same kind of event.
+func (self *ServiceConfigBuilder) Handler(h interface{}) *ServiceConfigBuilder {
+	if lh, ok := h.(evthandler.LoginHandler); ok {
+		self.config.LoginHandler = lh
+	}
+	if lh, ok := h.(evthandler.LogoutHandler); ok {
+		self.config.LogoutHandler = lh
+	}
+	if mh, ok := h.(evthandler.MessageHandler); ok {
+		self.config.MessageHandler = mh
+	}
+	if fh, ok := h.(evthandler.ForwardRequestHandler); ok {
+		self.config.ForwardRequestHandler = fh
+	}
+	if eh, ok := h.(evthandler.ErrorHandler); ok {
+		self.config.ErrorHandler = eh
+	}
+	if sh, ok := h.(evthandler.SubscribeHandler); ok {
+		self.config.SubscribeHandler = sh
+	}
+	if uh, ok := h.(evthandler.UnsubscribeHandler); ok {
+		self.config.UnsubscribeHandler = uh
+	}
+	if ph, ok := h.(evthandler.PushHandler); ok {
+		self.config.PushHandler = ph
+	}
+	if fh, ok := h.(evthandler.FallbackHandler); ok {
+		self.config.FallbackHandler = fh
+	}
+	if dh, ok := h.(evthandler.DeliveryHandler); ok {
+		self.config.DeliveryHandler = dh
+	}
+	return self
+}
+
+func (self *ServiceConfigBuilder) Cache(cache msgcache.Cache) *ServiceConfigBuilder {
+	self.config.MsgCache = cache
+	return self
+}
+
+// Set lets f modify the fields without a method of their own.
+func (self *ServiceConfigBuilder) Set(f func(config *ServiceConfig)) *ServiceConfigBuilder {
+	f(&self.config)
+	return self
+}
+
+// Build returns the validated config. The builder may be used
+// again to build other configs.
+func (self *ServiceConfigBuilder) Build() (*ServiceConfig, error) {
+	config := self.config
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
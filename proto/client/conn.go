@@ -31,8 +31,36 @@ type Conn interface {
 	SetDigestChannel(digestChan chan<- *Digest)
 	RequestMessage(id string) error
 	ForwardRequest(receiver, service string, msg *proto.Message, ttl time.Duration) error
+
+	// Like ForwardRequest, but the server will tell the outcome of the
+	// request through the channel set by SetForwardResultChannel.
+	ForwardRequestWithId(id, receiver, service string, msg *proto.Message, ttl time.Duration) error
+	SetForwardResultChannel(resultChan chan<- *ForwardResult)
 	SetVisibility(v bool) error
 	SendMessage(msg *proto.Message) error
+	Subscribe(params map[string]string) error
+	Unsubscribe(params map[string]string) error
+
+	// Send a fresh token to the server. It will be used
+	// when the server re-authenticates the connection.
+	ReAuth(token string) error
+
+	// Tell the server that the message with the id has been
+	// received, so that the server may delete its cached copy.
+	// If the server keeps retrieved messages until they are
+	// acknowledged, it should be sent for each message retrieved
+	// by RequestMessage once the message is processed.
+	SendReceipt(id string) error
+
+	// Tell the server the connection is alive.
+	Heartbeat() error
+
+	// Start or stop watching whether the users of the same service
+	// are online. The server tells the changes through the channel
+	// set by SetPresenceChannel.
+	Watch(usernames []string) error
+	Unwatch(usernames []string) error
+	SetPresenceChannel(presenceChan chan<- *Presence)
 }
 
 type Digest struct {
@@ -43,11 +71,28 @@ type Digest struct {
 	Info          map[string]string
 }
 
+// ForwardResult is the outcome of a forward request.
+type ForwardResult struct {
+	Id       string
+	Accepted bool
+
+	// Number of visible connections which received the message.
+	NrDelivered int
+}
+
+// Presence tells whether a watched user is online.
+type Presence struct {
+	Username string
+	Online   bool
+}
+
 type clientConn struct {
 	proto.Conn
 	cmdio *proto.CommandIO
 
-	digestChan chan<- *Digest
+	digestChan   chan<- *Digest
+	fwdResChan   chan<- *ForwardResult
+	presenceChan chan<- *Presence
 
 	digestThreshold   int
 	compressThreshold int
@@ -64,6 +109,26 @@ func (self *clientConn) SetVisibility(v bool) error {
 	return self.cmdio.WriteCommand(cmd, false)
 }
 
+func (self *clientConn) ReAuth(token string) error {
+	cmd := new(proto.Command)
+	cmd.Type = proto.CMD_REAUTH
+	cmd.Params = []string{token}
+	return self.cmdio.WriteCommand(cmd, false)
+}
+
+func (self *clientConn) SendReceipt(id string) error {
+	cmd := new(proto.Command)
+	cmd.Type = proto.CMD_RECEIPT
+	cmd.Params = []string{id}
+	return self.cmdio.WriteCommand(cmd, false)
+}
+
+func (self *clientConn) Heartbeat() error {
+	cmd := new(proto.Command)
+	cmd.Type = proto.CMD_PING
+	return self.cmdio.WriteCommand(cmd, false)
+}
+
 func (self *clientConn) subscribe(params map[string]string, sub bool) error {
 	cmd := new(proto.Command)
 	cmd.Type = proto.CMD_SUBSCRIPTION
@@ -85,6 +150,34 @@ func (self *clientConn) Unsubscribe(params map[string]string) error {
 	return self.subscribe(params, false)
 }
 
+func (self *clientConn) watch(usernames []string, watch bool) error {
+	cmd := new(proto.Command)
+	cmd.Type = proto.CMD_WATCH
+	if watch {
+		cmd.Params = []string{"1"}
+	} else {
+		cmd.Params = []string{"0"}
+	}
+	cmd.Message = new(proto.Message)
+	cmd.Message.Header = make(map[string]string, len(usernames))
+	for _, username := range usernames {
+		cmd.Message.Header[username] = ""
+	}
+	return self.cmdio.WriteCommand(cmd, false)
+}
+
+func (self *clientConn) Watch(usernames []string) error {
+	return self.watch(usernames, true)
+}
+
+func (self *clientConn) Unwatch(usernames []string) error {
+	return self.watch(usernames, false)
+}
+
+func (self *clientConn) SetPresenceChannel(presenceChan chan<- *Presence) {
+	self.presenceChan = presenceChan
+}
+
 func (self *clientConn) RequestMessage(id string) error {
 	cmd := new(proto.Command)
 	cmd.Type = proto.CMD_MSG_RETRIEVE
@@ -120,15 +213,29 @@ func (self *clientConn) SendMessage(msg *proto.Message) error {
 	return self.WriteMessage(msg, compress)
 }
 
+func (self *clientConn) SetForwardResultChannel(resultChan chan<- *ForwardResult) {
+	self.fwdResChan = resultChan
+}
+
 func (self *clientConn) ForwardRequest(receiver, service string, msg *proto.Message, ttl time.Duration) error {
+	return self.ForwardRequestWithId("", receiver, service, msg, ttl)
+}
+
+func (self *clientConn) ForwardRequestWithId(id, receiver, service string, msg *proto.Message, ttl time.Duration) error {
 	cmd := new(proto.Command)
 	cmd.Type = proto.CMD_FWD_REQ
-	cmd.Params = make([]string, 2, 3)
+	cmd.Params = make([]string, 2, 4)
 	cmd.Params[0] = fmt.Sprintf("%v", ttl)
 	cmd.Params[1] = receiver
 	if len(service) > 0 && service != self.Service() {
 		cmd.Params = append(cmd.Params, service)
 	}
+	if len(id) > 0 {
+		if len(cmd.Params) == 2 {
+			cmd.Params = append(cmd.Params, "")
+		}
+		cmd.Params = append(cmd.Params, id)
+	}
 	cmd.Message = msg
 	sz := msg.Size()
 	compress := false
@@ -170,6 +277,32 @@ func (self *clientConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 			}
 		}
 		self.digestChan <- digest
+	case proto.CMD_FWD_RESULT:
+		if self.fwdResChan == nil {
+			return
+		}
+		if len(cmd.Params) < 3 {
+			err = proto.ErrBadPeerImpl
+			return
+		}
+		res := new(ForwardResult)
+		res.Id = cmd.Params[0]
+		res.Accepted = cmd.Params[1] == "1"
+		res.NrDelivered, err = strconv.Atoi(cmd.Params[2])
+		if err != nil {
+			err = proto.ErrBadPeerImpl
+			return
+		}
+		self.fwdResChan <- res
+	case proto.CMD_PRESENCE:
+		if self.presenceChan == nil {
+			return
+		}
+		if len(cmd.Params) < 2 {
+			err = proto.ErrBadPeerImpl
+			return
+		}
+		self.presenceChan <- &Presence{Username: cmd.Params[0], Online: cmd.Params[1] == "1"}
 	case proto.CMD_FWD:
 		if len(cmd.Params) < 1 {
 			err = proto.ErrBadPeerImpl
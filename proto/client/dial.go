@@ -22,6 +22,7 @@ import (
 	"errors"
 	"github.com/uniqush/uniqush-conn/proto"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -30,6 +31,21 @@ var ErrBadServiceOrUserName = errors.New("service name or user name should not c
 
 // The conn will be closed if any error occur
 func Dial(conn net.Conn, pubkey *rsa.PublicKey, service, username, token string, timeout time.Duration) (c Conn, err error) {
+	return DialWithHeartbeat(conn, pubkey, service, username, token, 0, timeout)
+}
+
+// DialWithHeartbeat is like Dial, but proposes a heartbeat interval to
+// the server. The server may reject an interval outside its bounds.
+// Once connected, the client should call Heartbeat within each
+// interval. The interval is rounded down to seconds.
+func DialWithHeartbeat(conn net.Conn, pubkey *rsa.PublicKey, service, username, token string, heartbeat, timeout time.Duration) (c Conn, err error) {
+	return DialWithLabels(conn, pubkey, service, username, token, nil, heartbeat, timeout)
+}
+
+// DialWithLabels is like DialWithHeartbeat, but also declares labels,
+// e.g. the device type or the app version, which the server passes
+// to its Authenticator.
+func DialWithLabels(conn net.Conn, pubkey *rsa.PublicKey, service, username, token string, labels map[string]string, heartbeat, timeout time.Duration) (c Conn, err error) {
 	if strings.Contains(service, "\n") || strings.Contains(username, "\n") ||
 		strings.Contains(service, ":") || strings.Contains(username, ":") {
 		err = ErrBadServiceOrUserName
@@ -51,10 +67,16 @@ func Dial(conn net.Conn, pubkey *rsa.PublicKey, service, username, token string,
 
 	cmd := new(proto.Command)
 	cmd.Type = proto.CMD_AUTH
-	cmd.Params = make([]string, 3)
+	cmd.Params = make([]string, 3, 4)
 	cmd.Params[0] = service
 	cmd.Params[1] = username
 	cmd.Params[2] = token
+	if heartbeat >= time.Second {
+		cmd.Params = append(cmd.Params, strconv.FormatInt(int64(heartbeat/time.Second), 10))
+	}
+	if len(labels) > 0 {
+		cmd.Message = &proto.Message{Header: labels}
+	}
 
 	// don't compress, but encrypt it
 	cmdio.WriteCommand(cmd, false)
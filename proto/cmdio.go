@@ -24,6 +24,8 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"hash"
 	"io"
 	"sync"
@@ -103,13 +105,32 @@ func (self *CommandIO) readAndCmpHmac(mac []byte) error {
 	return nil
 }
 
+// DecodeError is returned by ReadCommand if a command arrived intact
+// but could not be decoded, e.g. the peer has a bug. Unlike the other
+// errors, the stream is still in sync and the next command can be read.
+type DecodeError struct {
+	Err error
+}
+
+func (self *DecodeError) Error() string {
+	return fmt.Sprintf("cannot decode command: %v", self.Err)
+}
+
 func (self *CommandIO) decodeCommand(data []byte) (cmd *Command, err error) {
+	if len(data) == 0 {
+		err = ErrMalformedCommand
+		return
+	}
 	// Flag: 8 bit
 	// Most significant 5 bits: number of bytes of padding
 	// Least significant bit: compress bit
 	compress := ((data[0] & cmdflag_COMPRESS) != 0)
 	var npadding int
 	npadding = int(data[0] >> 3)
+	if 1+npadding > len(data) {
+		err = ErrMalformedCommand
+		return
+	}
 	data = data[1 : len(data)-npadding]
 	decoded := data
 	if compress {
@@ -130,7 +151,11 @@ func (self *CommandIO) encodeCommand(cmd *Command, compress bool) (data []byte,
 	if err != nil {
 		return
 	}
+	return self.encodeData(bsonEncoded, compress)
+}
 
+// encodeData frames a marshaled command. bsonEncoded is not modified.
+func (self *CommandIO) encodeData(bsonEncoded []byte, compress bool) (data []byte, err error) {
 	data = bsonEncoded
 	if compress {
 		data, err = snappy.Encode(nil, bsonEncoded)
@@ -147,11 +172,10 @@ func (self *CommandIO) encodeCommand(cmd *Command, compress bool) (data []byte,
 	npadding := (nrBlk * blkLen) - (len(data) + 1)
 	flag |= byte((npadding & 0xFF) << 3)
 
-	data = append(data, 0)
-	copy(data[1:], data[:len(data)-1])
-	data[0] = flag
-
-	data = append(data, make([]byte, npadding)...)
+	framed := make([]byte, 1+len(data)+npadding)
+	framed[0] = flag
+	copy(framed[1:], data)
+	data = framed
 	return
 }
 
@@ -161,6 +185,30 @@ func (self *CommandIO) WriteCommand(cmd *Command, compress bool) error {
 	if err != nil {
 		return err
 	}
+	return self.writeFrame(data)
+}
+
+// The length of a frame is 16 bits. Commands are not split into
+// frames, so an encoded command cannot be larger than this.
+const maxFrameLen = 0xFFFF
+
+var ErrCommandTooLarge = errors.New("command too large: 64KB max")
+
+// WriteRawCommand writes a command already marshaled by
+// Command.Marshal, e.g. received from another system, so that it is
+// not decoded and encoded again. data is not modified.
+func (self *CommandIO) WriteRawCommand(data []byte, compress bool) error {
+	data, err := self.encodeData(data, compress)
+	if err != nil {
+		return err
+	}
+	return self.writeFrame(data)
+}
+
+func (self *CommandIO) writeFrame(data []byte) error {
+	if len(data) > maxFrameLen {
+		return ErrCommandTooLarge
+	}
 	var cmdLen uint16
 	cmdLen = uint16(len(data))
 	if cmdLen == 0 {
@@ -168,7 +216,7 @@ func (self *CommandIO) WriteCommand(cmd *Command, compress bool) error {
 	}
 	self.writeLock.Lock()
 	defer self.writeLock.Unlock()
-	err = binary.Write(self.conn, binary.LittleEndian, cmdLen)
+	err := binary.Write(self.conn, binary.LittleEndian, cmdLen)
 	if err != nil {
 		return err
 	}
@@ -201,6 +249,9 @@ func (self *CommandIO) ReadCommand() (cmd *Command, err error) {
 		return
 	}
 	cmd, err = self.decodeCommand(data)
+	if err != nil {
+		err = &DecodeError{Err: err}
+	}
 	return
 }
 
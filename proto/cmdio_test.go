@@ -244,3 +244,84 @@ func BenchmarkExchangingMultiFullCommandOverNetwork(b *testing.B) {
 	}
 	<-done
 }
+
+func TestReadAfterMalformedCommand(t *testing.T) {
+	io1, io2, _, _ := getBufferCommandIOs(t)
+
+	// A data command declaring a parameter which is not there.
+	err := io1.writeFrame([]byte{0, CMD_DATA, 1 << 4, 0, 0})
+	if err != nil {
+		t.Fatalf("Error on write: %v", err)
+	}
+	cmd := randomCommand()
+	err = io1.WriteCommand(cmd, false)
+	if err != nil {
+		t.Fatalf("Error on write: %v", err)
+	}
+
+	_, err = io2.ReadCommand()
+	if _, ok := err.(*DecodeError); !ok {
+		t.Errorf("should get a decode error: %v", err)
+	}
+	recved, err := io2.ReadCommand()
+	if err != nil {
+		t.Fatalf("Error on read: %v", err)
+	}
+	if !cmd.eq(recved) {
+		t.Errorf("the command after the malformed one should be intact")
+	}
+}
+
+func TestWriteTooLargeCommand(t *testing.T) {
+	io1, io2, _, _ := getBufferCommandIOs(t)
+
+	cmd := new(Command)
+	cmd.Type = CMD_DATA
+	cmd.Message = new(Message)
+	cmd.Message.Body = make([]byte, maxFrameLen)
+	io.ReadFull(rand.Reader, cmd.Message.Body)
+	err := io1.WriteCommand(cmd, true)
+	if err != ErrCommandTooLarge {
+		t.Errorf("should get ErrCommandTooLarge: %v", err)
+	}
+
+	// Nothing should be written for the large command.
+	cmd = randomCommand()
+	err = io1.WriteCommand(cmd, false)
+	if err != nil {
+		t.Fatalf("Error on write: %v", err)
+	}
+	recved, err := io2.ReadCommand()
+	if err != nil {
+		t.Fatalf("Error on read: %v", err)
+	}
+	if !cmd.eq(recved) {
+		t.Errorf("the command after the large one should be intact")
+	}
+}
+
+func TestWriteRawCommand(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		io1, io2, _, _ := getBufferCommandIOs(t)
+		cmd := randomCommand()
+		raw, err := cmd.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := append([]byte(nil), raw...)
+		err = io1.WriteRawCommand(raw, compress)
+		if err != nil {
+			t.Fatalf("Error on write: %v", err)
+		}
+		if !bytes.Equal(raw, saved) {
+			t.Errorf("the raw command should not be modified")
+		}
+		recved, err := io2.ReadCommand()
+		if err != nil {
+			t.Fatalf("Error on read: %v", err)
+		}
+		if !cmd.eq(recved) {
+			t.Errorf("the raw command should be received as is")
+		}
+	}
+}
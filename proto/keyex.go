@@ -30,6 +30,10 @@ import (
 
 const currentProtocolVersion byte = 1
 
+// CurrentProtocolVersion is the version of the protocol
+// proposed by clients during the key exchange.
+const CurrentProtocolVersion = currentProtocolVersion
+
 // The authentication here is quite similar with, if not same as, tarsnap's auth algorithm.
 //
 // First, server generate a Diffie-Hellman public key, dhpub1, sign it with
@@ -108,11 +112,11 @@ func ServerKeyExchange(privKey *rsa.PrivateKey, conn net.Conn) (ks *keySet, err
 		return
 	}
 
+	// The version proposed by the client. It is up to the caller
+	// to decide whether it is supported, so that a server could
+	// speak multiple versions after the key exchange.
 	version := keyExPkt[0]
-	if version > currentProtocolVersion {
-		err = ErrImcompatibleProtocol
-		return
-	}
+
 	// First, recover client's DH public key
 	clientpub := dhkx.NewPublicKey(keyExPkt[1 : dhPubkeyLen+1])
 
@@ -133,10 +137,17 @@ func ServerKeyExchange(privKey *rsa.PrivateKey, conn net.Conn) (ks *keySet, err
 	if err != nil {
 		return
 	}
+	ks.version = version
 	return
 }
 
 func ClientKeyExchange(pubKey *rsa.PublicKey, conn net.Conn) (ks *keySet, err error) {
+	return ClientKeyExchangeWithVersion(pubKey, conn, currentProtocolVersion)
+}
+
+// ClientKeyExchangeWithVersion is like ClientKeyExchange, but proposes
+// the version of the protocol spoken after the key exchange.
+func ClientKeyExchangeWithVersion(pubKey *rsa.PublicKey, conn net.Conn, version byte) (ks *keySet, err error) {
 	// Receive the data from server, which contains:
 	// - version
 	// - Server's DH public key: g ^ x
@@ -153,8 +164,7 @@ func ClientKeyExchange(pubKey *rsa.PublicKey, conn net.Conn) (ks *keySet, err er
 		return
 	}
 
-	version := keyExPkt[0]
-	if version != currentProtocolVersion {
+	if keyExPkt[0] != currentProtocolVersion {
 		err = ErrImcompatibleProtocol
 		return
 	}
@@ -193,7 +203,7 @@ func ClientKeyExchange(pubKey *rsa.PublicKey, conn net.Conn) (ks *keySet, err er
 	}
 
 	keyExPkt = keyExPkt[:1+dhPubkeyLen+authKeyLen]
-	keyExPkt[0] = currentProtocolVersion
+	keyExPkt[0] = version
 	copy(keyExPkt[1:], mypub)
 	err = ks.clientHMAC(keyExPkt[:dhPubkeyLen+1], keyExPkt[dhPubkeyLen+1:])
 	if err != nil {
@@ -205,6 +215,9 @@ func ClientKeyExchange(pubKey *rsa.PublicKey, conn net.Conn) (ks *keySet, err er
 	// - Client's DH public key: g ^ y
 	// - HMAC of client's DH public key: HMAC(g ^ y, clientAuthKey)
 	err = writen(conn, keyExPkt)
-
+	if err != nil {
+		return
+	}
+	ks.version = version
 	return
 }
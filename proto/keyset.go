@@ -25,12 +25,19 @@ import (
 )
 
 type keySet struct {
+	// The version of the protocol proposed by the client.
+	version byte
+
 	serverEncrKey []byte
 	serverAuthKey []byte
 	clientEncrKey []byte
 	clientAuthKey []byte
 }
 
+func (self *keySet) Version() byte {
+	return self.version
+}
+
 func (self *keySet) String() string {
 	return fmt.Sprintf("serverEncr: %v; serverAuth: %v\nclientEncr: %v; clientAuth: %v", self.serverEncrKey, self.serverAuthKey, self.clientEncrKey, self.clientAuthKey)
 }
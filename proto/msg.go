@@ -94,9 +94,23 @@ const (
 	// Params
 	// 0. service name
 	// 1. username
+	// 2. token
+	// 3. [optional] The heartbeat interval proposed by the client
+	//    in seconds. The client promises to send something, e.g.
+	//    a CMD_PING, within each interval.
 	CMD_AUTH
 
 	CMD_AUTHOK
+
+	// Sent from server right before it closes the connection.
+	//
+	// Params:
+	// 0. [optional] The reason why the connection is closed
+	// 1. [optional] Number of seconds the client should wait
+	//    before reconnecting. If it is given, the client reads
+	//    a *RetryError instead of io.EOF.
+	// 2. [optional] The reason as a CloseCode in decimal. If it is
+	//    given without param 1, the client reads a *CloseError.
 	CMD_BYE
 
 	// Sent from client.
@@ -139,6 +153,8 @@ const (
 	// 1. Receiver's name
 	// 2. [optional] Receiver's service name.
 	//    If empty, then same service as the client
+	// 3. [optional] An id chosen by the client. If given,
+	//    the server replies a CMD_FWD_RESULT with the id.
 	CMD_FWD_REQ
 
 	// Sent from server.
@@ -206,6 +222,56 @@ const (
 	//     1. was pushed through push service.
 	//     2. and was not retrieved by the client.
 	CMD_REQ_UNREAD_PUSH
+
+	// Sent from client.
+	// Telling the server a fresh token of the user.
+	// The token will be used the next time the server
+	// re-authenticates the connection.
+	//
+	// Params:
+	// 0. The new token
+	CMD_REAUTH
+
+	// Sent from server.
+	// Telling the client the outcome of a CMD_FWD_REQ.
+	//
+	// Params:
+	// 0. The id given in the CMD_FWD_REQ
+	// 1. "1" if the message is forwarded; "0" if it is rejected
+	// 2. Number of visible connections which received the message.
+	//    If it is 0, the message may still be cached and pushed.
+	CMD_FWD_RESULT
+
+	// Sent from server to check if the connection is alive,
+	// or from client as a heartbeat. The receiver ignores it.
+	CMD_PING
+
+	// Sent from client.
+	// Telling the server that the message has been received,
+	// so that its cached copy, if any, could be removed.
+	//
+	// Params:
+	// 0. The id of the message
+	CMD_RECEIPT
+
+	// Sent from client.
+	// Telling the server to start or stop watching whether
+	// other users of the same service are online.
+	//
+	// Params:
+	// 0. "1" means watch; "0" means unwatch.
+	// Message:
+	//   Header: the keys are the usernames; the values are ignored.
+	CMD_WATCH
+
+	// Sent from server.
+	// Telling the client that a user it watches came online
+	// or went offline.
+	//
+	// Params:
+	// 0. The username
+	// 1. "1" if the user is online; "0" if offline
+	CMD_PRESENCE
 )
 
 type Command struct {
@@ -298,6 +364,33 @@ func (self *Command) eq(cmd *Command) bool {
 
 var ErrMalformedCommand = errors.New("malformed command")
 
+// UnmarshalRawMessage decodes a message marshaled as a CMD_DATA
+// command, which is how the server writes a message to the client: the
+// id of the message, if any, is the only parameter. Such a message can
+// be written with CommandIO.WriteRawCommand as is. An empty message is
+// malformed, since it is sent as a CMD_EMPTY instead. The body of the
+// returned message shares the memory of raw.
+func UnmarshalRawMessage(raw []byte) (msg *Message, err error) {
+	if len(raw) < 4 || raw[0] != CMD_DATA || raw[1]>>4 > 1 {
+		err = ErrMalformedCommand
+		return
+	}
+	cmd, err := UnmarshalCommand(raw)
+	if err != nil {
+		return
+	}
+	msg = cmd.Message
+	if msg == nil || msg.IsEmpty() {
+		msg = nil
+		err = ErrMalformedCommand
+		return
+	}
+	if len(cmd.Params) > 0 {
+		msg.Id = cmd.Params[0]
+	}
+	return
+}
+
 func cutString(data []byte) (str, rest []byte, err error) {
 	var idx int
 	var d byte
@@ -80,6 +80,40 @@ func TestCommandMarshal(t *testing.T) {
 	marshalUnmarshal(cmd)
 }
 
+func TestUnmarshalRawMessage(t *testing.T) {
+	cmd := new(Command)
+	cmd.Type = CMD_DATA
+	cmd.Params = []string{"id"}
+	cmd.Message = &Message{Header: map[string]string{"a": "b"}, Body: []byte("body")}
+	raw, err := cmd.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := UnmarshalRawMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != "id" || msg.Header["a"] != "b" || string(msg.Body) != "body" {
+		t.Errorf("bad message: %+v", msg)
+	}
+
+	cmd.Type = CMD_FWD
+	raw, _ = cmd.Marshal()
+	if _, err := UnmarshalRawMessage(raw); err != ErrMalformedCommand {
+		t.Errorf("only CMD_DATA is a raw message: %v", err)
+	}
+	cmd.Type = CMD_DATA
+	cmd.Message = nil
+	raw, _ = cmd.Marshal()
+	if _, err := UnmarshalRawMessage(raw); err != ErrMalformedCommand {
+		t.Errorf("an empty message should be rejected: %v", err)
+	}
+	// A header without its value.
+	if _, err := UnmarshalRawMessage([]byte{CMD_DATA, 0, 0, 1, 'a', 0}); err != ErrMalformedCommand {
+		t.Errorf("a truncated message should be rejected: %v", err)
+	}
+}
+
 func BenchmarkCommandMarshalUnmarshal(b *testing.B) {
 	b.StopTimer()
 	cmds := make([]*Command, b.N)
@@ -18,11 +18,81 @@
 package proto
 
 import (
+	"crypto/tls"
+	"fmt"
 	"github.com/nu7hatch/gouuid"
 	"io"
 	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
+// CloseCode tells the client why the server closed the connection.
+type CloseCode int
+
+const (
+	CloseUnknown CloseCode = iota
+	// The server is shutting down or handing off the connection.
+	// Reconnect, maybe to another server.
+	CloseDrained
+	// Too many connections or users. Reconnect later.
+	CloseCapacity
+	// The token is no longer valid. Authenticate with a new one.
+	CloseAuthExpired
+	// The client sent too many requests.
+	CloseRateLimited
+	// The server does not speak the version of the
+	// protocol proposed by the client.
+	CloseUnsupportedVersion
+	// The connection lived longer than the server allows.
+	// The client should reconnect.
+	CloseMaxLifetime
+)
+
+func (self CloseCode) String() string {
+	switch self {
+	case CloseUnknown:
+		return "unknown"
+	case CloseDrained:
+		return "drained"
+	case CloseCapacity:
+		return "capacity"
+	case CloseAuthExpired:
+		return "auth-expired"
+	case CloseRateLimited:
+		return "rate-limited"
+	case CloseUnsupportedVersion:
+		return "unsupported-version"
+	case CloseMaxLifetime:
+		return "max-lifetime"
+	}
+	return fmt.Sprintf("CloseCode(%d)", int(self))
+}
+
+// RetryError is returned when the server closes the connection and asks
+// the client to wait for RetryAfter before reconnecting.
+type RetryError struct {
+	Code       CloseCode
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (self *RetryError) Error() string {
+	return fmt.Sprintf("connection closed by server: %v; retry after %v", self.Reason, self.RetryAfter)
+}
+
+// CloseError is returned when the server closes the connection
+// with a reason but does not ask the client to wait.
+type CloseError struct {
+	Code   CloseCode
+	Reason string
+}
+
+func (self *CloseError) Error() string {
+	return fmt.Sprintf("connection closed by server (%v): %v", self.Code, self.Reason)
+}
+
 type MessageWriter interface {
 	WriteMessage(msg *Message, compress bool) error
 }
@@ -44,12 +114,19 @@ type Conn interface {
 	MessageReadWriter
 	RemoteAddr() net.Addr
 	Close() error
+
+	// The TLS state of the underlying connection.
+	// ok is false if the connection does not use TLS.
+	ConnectionState() (state tls.ConnectionState, ok bool)
 	Service() string
 	Username() string
 	UniqId() string
 }
 
 type messageIO struct {
+	// Accessed atomically. Keep it at the beginning for alignment.
+	readTimeout int64
+
 	conn     net.Conn
 	cmdio    *CommandIO
 	service  string
@@ -63,14 +140,49 @@ func (self *messageIO) RemoteAddr() net.Addr {
 	return self.conn.RemoteAddr()
 }
 
+func (self *messageIO) ConnectionState() (state tls.ConnectionState, ok bool) {
+	tc, ok := self.conn.(*tls.Conn)
+	if ok {
+		state = tc.ConnectionState()
+	}
+	return
+}
+
 func (self *messageIO) Close() error {
 	return self.conn.Close()
 }
 
+// SetReadTimeout makes reading fail with a timeout error if nothing
+// arrives within d since the last command. Zero means no timeout.
+func (self *messageIO) SetReadTimeout(d time.Duration) error {
+	atomic.StoreInt64(&self.readTimeout, int64(d))
+	return self.setReadDeadline()
+}
+
+func (self *messageIO) setReadDeadline() error {
+	var deadline time.Time
+	if d := time.Duration(atomic.LoadInt64(&self.readTimeout)); d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	return self.conn.SetReadDeadline(deadline)
+}
+
 func (self *messageIO) processCommand(cmd *Command) (msg *Message, err error) {
 	switch cmd.Type {
 	case CMD_BYE:
 		err = io.EOF
+		code := CloseUnknown
+		if len(cmd.Params) > 2 {
+			if c, e := strconv.Atoi(cmd.Params[2]); e == nil {
+				code = CloseCode(c)
+				err = &CloseError{Code: code, Reason: cmd.Params[0]}
+			}
+		}
+		if len(cmd.Params) > 1 {
+			if secs, e := strconv.Atoi(cmd.Params[1]); e == nil && secs >= 0 {
+				err = &RetryError{Code: code, Reason: cmd.Params[0], RetryAfter: time.Duration(secs) * time.Second}
+			}
+		}
 		return
 	}
 	if self.proc == nil {
@@ -90,8 +202,15 @@ func (self *messageIO) collectMessage() {
 				return
 			}
 			self.msgChan <- err
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// The peer is gone.
+				return
+			}
 			continue
 		}
+		if atomic.LoadInt64(&self.readTimeout) > 0 {
+			self.setReadDeadline()
+		}
 		if cmd == nil {
 			continue
 		}
@@ -20,17 +20,52 @@ package server
 import (
 	"crypto/rsa"
 	"errors"
+	"fmt"
 	"github.com/uniqush/uniqush-conn/proto"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Authenticator interface {
-	Authenticate(srv, usr, token, addr string) (bool, error)
+	// labels are declared by the client during the handshake,
+	// e.g. its device type. They may be empty.
+	Authenticate(srv, usr, token, addr string, labels map[string]string) (bool, error)
 }
 
 var ErrAuthFail = errors.New("authentication failed")
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// A Handshake authenticates a client speaking a certain version of
+// the protocol, once the key exchange is done.
+type Handshake func(cmdio *proto.CommandIO, conn net.Conn, auth Authenticator) (c Conn, err error)
+
+var handshakesLock sync.RWMutex
+var handshakes = map[byte]Handshake{
+	proto.CurrentProtocolVersion: handshakeV1,
+}
+
+// RegisterHandshake makes a handshake available for the provided
+// protocol version. It will replace any handshake registered with
+// the same version.
+func RegisterHandshake(version byte, h Handshake) {
+	handshakesLock.Lock()
+	defer handshakesLock.Unlock()
+	handshakes[version] = h
+}
+
+// GetHandshake returns the handshake registered with the version.
+func GetHandshake(version byte) (h Handshake, err error) {
+	handshakesLock.RLock()
+	defer handshakesLock.RUnlock()
+	h, ok := handshakes[version]
+	if !ok {
+		err = ErrUnsupportedVersion
+	}
+	return
+}
 
 // The conn will be closed if any error occur
 func AuthConn(conn net.Conn, privkey *rsa.PrivateKey, auth Authenticator, timeout time.Duration) (c Conn, err error) {
@@ -50,6 +85,25 @@ func AuthConn(conn net.Conn, privkey *rsa.PrivateKey, auth Authenticator, timeou
 		return
 	}
 	cmdio := ks.ServerCommandIO(conn)
+	h, err := GetHandshake(ks.Version())
+	if err != nil {
+		// Tell the client why before hanging up, so that it
+		// does not keep retrying with the same version.
+		cmd := new(proto.Command)
+		cmd.Type = proto.CMD_BYE
+		cmd.Params = []string{
+			fmt.Sprintf("unsupported protocol version: %v", ks.Version()),
+			"",
+			strconv.Itoa(int(proto.CloseUnsupportedVersion)),
+		}
+		cmdio.WriteCommand(cmd, false)
+		conn.Close()
+		return
+	}
+	return h(cmdio, conn, auth)
+}
+
+func handshakeV1(cmdio *proto.CommandIO, conn net.Conn, auth Authenticator) (c Conn, err error) {
 	cmd, err := cmdio.ReadCommand()
 	if err != nil {
 		return
@@ -58,13 +112,22 @@ func AuthConn(conn net.Conn, privkey *rsa.PrivateKey, auth Authenticator, timeou
 		err = ErrAuthFail
 		return
 	}
-	if len(cmd.Params) != 3 {
+	if len(cmd.Params) != 3 && len(cmd.Params) != 4 {
 		err = ErrAuthFail
 		return
 	}
 	service := cmd.Params[0]
 	username := cmd.Params[1]
 	token := cmd.Params[2]
+	var heartbeat time.Duration
+	if len(cmd.Params) > 3 && len(cmd.Params[3]) > 0 {
+		secs, e := strconv.Atoi(cmd.Params[3])
+		if e != nil || secs < 0 {
+			err = ErrAuthFail
+			return
+		}
+		heartbeat = time.Duration(secs) * time.Second
+	}
 
 	// Username and service should not contain "\n"
 	if strings.Contains(service, "\n") || strings.Contains(username, "\n") ||
@@ -73,7 +136,13 @@ func AuthConn(conn net.Conn, privkey *rsa.PrivateKey, auth Authenticator, timeou
 		return
 	}
 
-	ok, err := auth.Authenticate(service, username, token, conn.RemoteAddr().String())
+	// Labels are sent as the header of the message in the auth command.
+	var labels map[string]string
+	if cmd.Message != nil && len(cmd.Message.Header) > 0 {
+		labels = cmd.Message.Header
+	}
+
+	ok, err := auth.Authenticate(service, username, token, conn.RemoteAddr().String(), labels)
 	if err != nil {
 		return
 	}
@@ -89,7 +158,10 @@ func AuthConn(conn net.Conn, privkey *rsa.PrivateKey, auth Authenticator, timeou
 	if err != nil {
 		return
 	}
-	c = NewConn(cmdio, service, username, conn)
+	sc := newServerConn(cmdio, service, username, token, conn)
+	sc.proposedHeartbeat = heartbeat
+	sc.labels = labels
+	c = sc
 	err = nil
 	return
 }
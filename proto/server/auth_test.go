@@ -20,8 +20,10 @@ package server
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/client"
 	"net"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -29,10 +31,14 @@ import (
 
 type singleUserAuth struct {
 	service, username, token string
+
+	// Labels of the last authenticated connection.
+	labels map[string]string
 }
 
-func (self *singleUserAuth) Authenticate(srv, usr, token, addr string) (bool, error) {
+func (self *singleUserAuth) Authenticate(srv, usr, token, addr string, labels map[string]string) (bool, error) {
 	if self.service == srv && self.username == usr && self.token == token {
+		self.labels = labels
 		return true, nil
 	}
 	return false, nil
@@ -130,3 +136,90 @@ func TestAuthFail(t *testing.T) {
 		cliConn.Close()
 	}
 }
+
+func TestUnsupportedVersion(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := new(singleUserAuth)
+
+	errChan := make(chan error)
+	go func() {
+		_, err := getClient(addr, priv, auth, 3*time.Second)
+		errChan <- err
+	}()
+	time.Sleep(1 * time.Second)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ks, err := proto.ClientKeyExchangeWithVersion(&priv.PublicKey, c, proto.CurrentProtocolVersion+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := ks.ClientCommandIO(c).ReadCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Type != proto.CMD_BYE || len(cmd.Params) != 3 {
+		t.Fatalf("should get a bye: %+v", cmd)
+	}
+	if cmd.Params[2] != strconv.Itoa(int(proto.CloseUnsupportedVersion)) {
+		t.Errorf("bad close code: %v", cmd.Params[2])
+	}
+	if err = <-errChan; err != ErrUnsupportedVersion {
+		t.Errorf("bad error: %v", err)
+	}
+}
+
+func TestRegisterHandshake(t *testing.T) {
+	version := proto.CurrentProtocolVersion + 2
+	if _, err := GetHandshake(version); err != ErrUnsupportedVersion {
+		t.Errorf("should not have a handshake: %v", err)
+	}
+	RegisterHandshake(version, handshakeV1)
+	if _, err := GetHandshake(version); err != nil {
+		t.Errorf("should have a handshake: %v", err)
+	}
+}
+
+func TestAuthWithLabels(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &singleUserAuth{service: "service", username: "username", token: "token"}
+	labels := map[string]string{"device": "ios", "version": "1.2"}
+
+	var servConn Conn
+	var es error
+	done := make(chan bool)
+	go func() {
+		servConn, es = getClient(addr, priv, auth, 3*time.Second)
+		close(done)
+	}()
+	time.Sleep(1 * time.Second)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliConn, err := client.DialWithLabels(c, &priv.PublicKey, "service", "username", "token", labels, 0, 3*time.Second)
+	<-done
+	if err != nil || es != nil {
+		t.Fatalf("Error: %v %v", err, es)
+	}
+	defer cliConn.Close()
+	defer servConn.Close()
+
+	for _, got := range []map[string]string{auth.labels, servConn.Labels()} {
+		if len(got) != len(labels) || got["device"] != "ios" || got["version"] != "1.2" {
+			t.Errorf("bad labels: %v", got)
+		}
+	}
+}
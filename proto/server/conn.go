@@ -18,10 +18,12 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -35,11 +37,26 @@ type SubscribeRequest struct {
 	Params    map[string]string
 }
 
+// WatchRequest asks to start or stop telling the connection
+// with ConnId whether Users are online.
+type WatchRequest struct {
+	Watch    bool // false: unwatch; true: watch
+	Service  string
+	Username string
+	ConnId   string
+	Users    []string
+}
+
 type ForwardRequest struct {
 	Receiver        string         `json:"receiver"`
 	ReceiverService string         `json:"service"`
 	TTL             time.Duration  `json:"ttl"`
 	Message         *proto.Message `json:"msg"`
+
+	// If not nil, it is called once the request is processed.
+	// It tells the sender whether the message is forwarded and
+	// how many connections of the receiver(s) received it.
+	Reply func(accepted bool, nrDelivered int) `json:"-"`
 }
 
 type Conn interface {
@@ -48,29 +65,199 @@ type Conn interface {
 	// then send a digest to the client and cache the whole message
 	// in the .
 	SendMessage(msg *proto.Message, extra map[string]string, ttl time.Duration) (id string, err error)
+
+	// SendRawMessage is like SendMessage, but writes raw, the message
+	// marshaled as a CMD_DATA command (see proto.UnmarshalRawMessage),
+	// without encoding it again. msg is raw decoded, which is used
+	// if a digest has to be sent instead.
+	SendRawMessage(raw []byte, msg *proto.Message, extra map[string]string, ttl time.Duration) (id string, err error)
 	SetMessageCache(cache msgcache.Cache)
 	SetForwardRequestChannel(fwdChan chan<- *ForwardRequest)
 	SetSubscribeRequestChan(subChan chan<- *SubscribeRequest)
+	SetWatchRequestChan(watchChan chan<- *WatchRequest)
+
+	// Tell the client that a user it watches came online
+	// or went offline.
+	WritePresence(username string, online bool) error
+
+	// Allow at most n subscribe/unsubscribe requests within each interval.
+	// Exceeding the limit closes the connection with ErrTooManySubscribes.
+	// Non-positive n means no limit.
+	SetSubscribeRateLimit(n int, interval time.Duration)
 	Visible() bool
+
+	// Set the visibility of the connection unless
+	// the client has already set it.
+	SetDefaultVisibility(visible bool)
+
+	// Thresholds negotiated with the client. Messages larger than
+	// them are digested/compressed. Negative means never.
+	DigestThreshold() int
+	CompressThreshold() int
+
+	// The most recent token provided by the client.
+	AuthToken() string
+
+	// Total size of messages received from/sent to the client.
+	BytesReceived() int64
+	BytesSent() int64
+
+	// Write a command which the client ignores. An error
+	// means the connection is dead.
+	Ping() error
+
+	// Tell the client why the connection is closed, then close it.
+	// If retryAfter is positive, the client should wait for it
+	// before reconnecting.
+	CloseWithReason(code proto.CloseCode, reason string, retryAfter time.Duration) error
+
+	// If enabled, the cached copy of a message is deleted once
+	// the client sends a receipt of it.
+	SetDeleteOnReceipt(enabled bool)
+
+	// If enabled, a cached message retrieved by the client is kept
+	// until the client sends a receipt of it, so that it can be
+	// retrieved again if the client fails before processing it.
+	// Otherwise, it is deleted once retrieved. It requires a message
+	// cache which implements msgcache.Getter.
+	SetAckBeforeDelete(enabled bool)
+
+	// A cached message older than maxAge is deleted instead of being
+	// sent when the client retrieves it, as if it had expired. It
+	// requires a message cache which implements msgcache.AgeTracker.
+	// Zero means no limit other than the TTL of the message.
+	SetMaxReplayAge(maxAge time.Duration)
+
+	// The heartbeat interval proposed by the client during the
+	// handshake. Zero if the client did not propose one.
+	ProposedHeartbeat() time.Duration
+
+	// Set the heartbeat interval. If the client sends nothing for
+	// HeartbeatTimeoutFactor intervals, reading from the connection
+	// fails with a timeout error. Zero means no heartbeat.
+	SetHeartbeat(interval time.Duration) error
+	Heartbeat() time.Duration
+
+	// When the connection was established.
+	ConnectedAt() time.Time
+
+	// The labels declared by the client during the handshake.
+	// Nil if there is none.
+	Labels() map[string]string
+
+	// Messages to a user are written to the connections with higher
+	// priorities first. Among those with the same priority, the one
+	// which received a message from its client most recently goes first.
+	SetPriority(priority int)
+	Priority() int
+
+	// When the client sent the last message, or when the connection
+	// was established if the client has not sent any.
+	LastActive() time.Time
 	proto.Conn
 }
 
 type serverConn struct {
+	// Accessed atomically. Keep them at the beginning for alignment.
+	bytesReceived int64
+	bytesSent     int64
+	heartbeat     int64
+	lastActive    int64
+
+	proposedHeartbeat time.Duration
+	connectedAt       time.Time
+	labels            map[string]string
+
 	proto.Conn
 	cmdio             *proto.CommandIO
 	digestThreshold   int32
 	compressThreshold int32
 	visible           int32
+	deleteOnReceipt   int32
+	ackBeforeDelete   int32
+	maxReplayAge      int64
+	priority          int32
 	digestFielsLock   sync.Mutex
 	digestFields      []string
 	mcache            msgcache.Cache
 	fwdChan           chan<- *ForwardRequest
 	subChan           chan<- *SubscribeRequest
+	watchChan         chan<- *WatchRequest
+	tokenLock         sync.Mutex
+	token             string
+
+	subLimitLock   sync.Mutex
+	subLimit       int
+	subInterval    time.Duration
+	subWindowStart time.Time
+	nrSubs         int
+}
+
+var ErrTooManySubscribes = errors.New("too many subscribe requests")
+
+// A connection is considered dead if the client sends nothing
+// for this many heartbeat intervals.
+const HeartbeatTimeoutFactor = 2
+
+// The client has not set the visibility. The connection is visible
+// unless SetDefaultVisibility says otherwise.
+const visibilityUnset = -1
+
+func (self *serverConn) SetSubscribeRateLimit(n int, interval time.Duration) {
+	self.subLimitLock.Lock()
+	defer self.subLimitLock.Unlock()
+	self.subLimit = n
+	self.subInterval = interval
+}
+
+// allowSubscribe counts a subscribe request and tells
+// if it is within the rate limit.
+func (self *serverConn) allowSubscribe() bool {
+	self.subLimitLock.Lock()
+	defer self.subLimitLock.Unlock()
+	if self.subLimit <= 0 {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(self.subWindowStart) >= self.subInterval {
+		self.subWindowStart = now
+		self.nrSubs = 0
+	}
+	self.nrSubs++
+	return self.nrSubs <= self.subLimit
+}
+
+func (self *serverConn) AuthToken() string {
+	self.tokenLock.Lock()
+	defer self.tokenLock.Unlock()
+	return self.token
+}
+
+func (self *serverConn) setAuthToken(token string) {
+	self.tokenLock.Lock()
+	defer self.tokenLock.Unlock()
+	self.token = token
 }
 
 func (self *serverConn) Visible() bool {
 	v := atomic.LoadInt32(&self.visible)
-	return v > 0
+	return v != 0
+}
+
+func (self *serverConn) SetDefaultVisibility(visible bool) {
+	var v int32
+	if visible {
+		v = 1
+	}
+	atomic.CompareAndSwapInt32(&self.visible, visibilityUnset, v)
+}
+
+func (self *serverConn) DigestThreshold() int {
+	return int(atomic.LoadInt32(&self.digestThreshold))
+}
+
+func (self *serverConn) CompressThreshold() int {
+	return int(atomic.LoadInt32(&self.compressThreshold))
 }
 
 func (self *serverConn) SetForwardRequestChannel(fwdChan chan<- *ForwardRequest) {
@@ -81,6 +268,20 @@ func (self *serverConn) SetSubscribeRequestChan(subChan chan<- *SubscribeRequest
 	self.subChan = subChan
 }
 
+func (self *serverConn) SetWatchRequestChan(watchChan chan<- *WatchRequest) {
+	self.watchChan = watchChan
+}
+
+func (self *serverConn) WritePresence(username string, online bool) error {
+	cmd := new(proto.Command)
+	cmd.Type = proto.CMD_PRESENCE
+	cmd.Params = []string{username, "0"}
+	if online {
+		cmd.Params[1] = "1"
+	}
+	return self.cmdio.WriteCommand(cmd, false)
+}
+
 func (self *serverConn) shouldDigest(msg *proto.Message) (sz int, sendDigest bool) {
 	sz = msg.Size()
 	d := atomic.LoadInt32(&self.digestThreshold)
@@ -96,7 +297,51 @@ func (self *serverConn) writeAutoCompress(msg *proto.Message, sz int) error {
 	if c > 0 && c < int32(sz) {
 		compress = true
 	}
-	return self.WriteMessage(msg, compress)
+	err := self.WriteMessage(msg, compress)
+	if err == nil {
+		atomic.AddInt64(&self.bytesSent, int64(sz))
+	}
+	return err
+}
+
+func (self *serverConn) BytesReceived() int64 {
+	return atomic.LoadInt64(&self.bytesReceived)
+}
+
+func (self *serverConn) BytesSent() int64 {
+	return atomic.LoadInt64(&self.bytesSent)
+}
+
+func (self *serverConn) Ping() error {
+	cmd := new(proto.Command)
+	cmd.Type = proto.CMD_PING
+	return self.cmdio.WriteCommand(cmd, false)
+}
+
+func (self *serverConn) CloseWithReason(code proto.CloseCode, reason string, retryAfter time.Duration) error {
+	cmd := new(proto.Command)
+	cmd.Type = proto.CMD_BYE
+	cmd.Params = []string{reason, ""}
+	if retryAfter > 0 {
+		// Round up so that the client never retries too early.
+		secs := int64((retryAfter + time.Second - 1) / time.Second)
+		cmd.Params[1] = strconv.FormatInt(secs, 10)
+	}
+	if code != proto.CloseUnknown {
+		cmd.Params = append(cmd.Params, strconv.Itoa(int(code)))
+	}
+	err := self.cmdio.WriteCommand(cmd, false)
+	self.Close()
+	return err
+}
+
+func (self *serverConn) ReadMessage() (msg *proto.Message, err error) {
+	msg, err = self.Conn.ReadMessage()
+	if err == nil && msg != nil {
+		atomic.AddInt64(&self.bytesReceived, int64(msg.Size()))
+		atomic.StoreInt64(&self.lastActive, time.Now().UnixNano())
+	}
+	return
 }
 
 func (self *serverConn) SendMessage(msg *proto.Message, extra map[string]string, ttl time.Duration) (id string, err error) {
@@ -118,6 +363,23 @@ func (self *serverConn) SendMessage(msg *proto.Message, extra map[string]string,
 	return
 }
 
+func (self *serverConn) SendRawMessage(raw []byte, msg *proto.Message, extra map[string]string, ttl time.Duration) (id string, err error) {
+	sz, sendDigest := self.shouldDigest(msg)
+	if sendDigest {
+		return self.SendMessage(msg, extra, ttl)
+	}
+	compress := false
+	c := atomic.LoadInt32(&self.compressThreshold)
+	if c > 0 && c < int32(sz) {
+		compress = true
+	}
+	err = self.cmdio.WriteRawCommand(raw, compress)
+	if err == nil {
+		atomic.AddInt64(&self.bytesSent, int64(sz))
+	}
+	return
+}
+
 func (self *serverConn) fromServer(msg *proto.Message) bool {
 	if len(msg.Sender) == 0 {
 		return true
@@ -178,9 +440,20 @@ func (self *serverConn) writeDigest(msg *proto.Message, extra map[string]string,
 	if err != nil {
 		return
 	}
+	atomic.AddInt64(&self.bytesSent, int64(dmsg.Size()))
 	return
 }
 
+func (self *serverConn) writeForwardResult(id string, accepted bool, nrDelivered int) error {
+	cmd := new(proto.Command)
+	cmd.Type = proto.CMD_FWD_RESULT
+	cmd.Params = []string{id, "0", strconv.Itoa(nrDelivered)}
+	if accepted {
+		cmd.Params[1] = "1"
+	}
+	return self.cmdio.WriteCommand(cmd, false)
+}
+
 func (self *serverConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message, err error) {
 	if cmd == nil {
 		return
@@ -210,6 +483,10 @@ func (self *serverConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 		} else {
 			return
 		}
+		if !self.allowSubscribe() {
+			err = ErrTooManySubscribes
+			return
+		}
 		req := new(SubscribeRequest)
 		req.Params = cmd.Message.Header
 		req.Service = self.Service()
@@ -217,6 +494,33 @@ func (self *serverConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 		req.Subscribe = sub
 		self.subChan <- req
 
+	case proto.CMD_WATCH:
+		if self.watchChan == nil {
+			return
+		}
+		if len(cmd.Params) < 1 || cmd.Message == nil {
+			err = proto.ErrBadPeerImpl
+			return
+		}
+		req := new(WatchRequest)
+		switch cmd.Params[0] {
+		case "0":
+			req.Watch = false
+		case "1":
+			req.Watch = true
+		default:
+			return
+		}
+		req.Service = self.Service()
+		req.Username = self.Username()
+		req.ConnId = self.UniqId()
+		req.Users = make([]string, 0, len(cmd.Message.Header))
+		for username := range cmd.Message.Header {
+			req.Users = append(req.Users, username)
+		}
+		sort.Strings(req.Users)
+		self.watchChan <- req
+
 	case proto.CMD_SET_VISIBILITY:
 		if len(cmd.Params) < 1 {
 			err = proto.ErrBadPeerImpl
@@ -248,11 +552,17 @@ func (self *serverConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 		cmd.Message.SenderService = self.Service()
 		fwdreq.TTL, _ = time.ParseDuration(cmd.Params[0])
 		fwdreq.Receiver = cmd.Params[1]
-		if len(cmd.Params) > 2 {
+		if len(cmd.Params) > 2 && len(cmd.Params[2]) > 0 {
 			fwdreq.ReceiverService = cmd.Params[2]
 		} else {
 			fwdreq.ReceiverService = self.Service()
 		}
+		if len(cmd.Params) > 3 && len(cmd.Params[3]) > 0 {
+			id := cmd.Params[3]
+			fwdreq.Reply = func(accepted bool, nrDelivered int) {
+				self.writeForwardResult(id, accepted, nrDelivered)
+			}
+		}
 		cmd.Message.Id = ""
 		fwdreq.Message = cmd.Message
 		self.fwdChan <- fwdreq
@@ -289,6 +599,24 @@ func (self *serverConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 				self.digestFields[i] = f
 			}
 		}
+	case proto.CMD_REAUTH:
+		if len(cmd.Params) < 1 {
+			err = proto.ErrBadPeerImpl
+			return
+		}
+		self.setAuthToken(cmd.Params[0])
+	case proto.CMD_RECEIPT:
+		if len(cmd.Params) < 1 {
+			err = proto.ErrBadPeerImpl
+			return
+		}
+		if self.mcache == nil {
+			return
+		}
+		if atomic.LoadInt32(&self.deleteOnReceipt) == 0 && atomic.LoadInt32(&self.ackBeforeDelete) == 0 {
+			return
+		}
+		err = self.deleteCached(cmd.Params[0])
 	case proto.CMD_MSG_RETRIEVE:
 		if len(cmd.Params) < 1 {
 			err = proto.ErrBadPeerImpl
@@ -306,7 +634,18 @@ func (self *serverConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 
 		var rmsg *proto.Message
 
-		rmsg, err = self.mcache.GetThenDel(self.Service(), self.Username(), id)
+		var stale bool
+		stale, err = self.isStale(id)
+		if err != nil {
+			return
+		}
+		if stale {
+			err = self.deleteCached(id)
+		} else if getter, ok := self.mcache.(msgcache.Getter); ok && atomic.LoadInt32(&self.ackBeforeDelete) != 0 {
+			rmsg, err = getter.Get(self.Service(), self.Username(), id)
+		} else {
+			rmsg, err = self.mcache.GetThenDel(self.Service(), self.Username(), id)
+		}
 		if err != nil {
 			return
 		}
@@ -320,18 +659,111 @@ func (self *serverConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 	return
 }
 
+// deleteCached removes the cached message, through GetThenDel if
+// the cache does not implement msgcache.Deleter.
+func (self *serverConn) deleteCached(id string) (err error) {
+	if deleter, ok := self.mcache.(msgcache.Deleter); ok {
+		return deleter.Delete(self.Service(), self.Username(), id)
+	}
+	_, err = self.mcache.GetThenDel(self.Service(), self.Username(), id)
+	return
+}
+
+// isStale tells if the cached message is older than the max replay age.
+func (self *serverConn) isStale(id string) (bool, error) {
+	maxAge := time.Duration(atomic.LoadInt64(&self.maxReplayAge))
+	if maxAge <= 0 {
+		return false, nil
+	}
+	tracker, ok := self.mcache.(msgcache.AgeTracker)
+	if !ok {
+		return false, nil
+	}
+	t, err := tracker.CachedAt(self.Service(), self.Username(), id)
+	if err != nil || t.IsZero() {
+		return false, err
+	}
+	return time.Since(t) > maxAge, nil
+}
+
 func (self *serverConn) SetMessageCache(cache msgcache.Cache) {
 	self.mcache = cache
 }
 
+func (self *serverConn) ProposedHeartbeat() time.Duration {
+	return self.proposedHeartbeat
+}
+
+func (self *serverConn) SetHeartbeat(interval time.Duration) error {
+	atomic.StoreInt64(&self.heartbeat, int64(interval))
+	rt, ok := self.Conn.(interface {
+		SetReadTimeout(d time.Duration) error
+	})
+	if !ok {
+		return nil
+	}
+	return rt.SetReadTimeout(interval * HeartbeatTimeoutFactor)
+}
+
+func (self *serverConn) Heartbeat() time.Duration {
+	return time.Duration(atomic.LoadInt64(&self.heartbeat))
+}
+
+func (self *serverConn) SetDeleteOnReceipt(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&self.deleteOnReceipt, v)
+}
+
+func (self *serverConn) ConnectedAt() time.Time {
+	return self.connectedAt
+}
+
+func (self *serverConn) Labels() map[string]string {
+	return self.labels
+}
+
+func (self *serverConn) SetPriority(priority int) {
+	atomic.StoreInt32(&self.priority, int32(priority))
+}
+
+func (self *serverConn) Priority() int {
+	return int(atomic.LoadInt32(&self.priority))
+}
+
+func (self *serverConn) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&self.lastActive))
+}
+
+func (self *serverConn) SetAckBeforeDelete(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&self.ackBeforeDelete, v)
+}
+
+func (self *serverConn) SetMaxReplayAge(maxAge time.Duration) {
+	atomic.StoreInt64(&self.maxReplayAge, int64(maxAge))
+}
+
 func NewConn(cmdio *proto.CommandIO, service, username string, conn net.Conn) Conn {
+	return newServerConn(cmdio, service, username, "", conn)
+}
+
+func newServerConn(cmdio *proto.CommandIO, service, username, token string, conn net.Conn) *serverConn {
 	sc := new(serverConn)
 	sc.cmdio = cmdio
+	sc.token = token
 	c := proto.NewConn(cmdio, service, username, conn, sc)
 	sc.Conn = c
 	sc.digestThreshold = -1
 	sc.compressThreshold = 512
 	sc.digestFields = make([]string, 0, 10)
-	sc.visible = 1
+	sc.visible = visibilityUnset
+	sc.connectedAt = time.Now()
+	sc.lastActive = sc.connectedAt.UnixNano()
 	return sc
 }
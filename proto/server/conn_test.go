@@ -18,6 +18,7 @@
 package server
 
 import (
+	"bytes"
 	"crypto/rand"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
@@ -25,6 +26,7 @@ import (
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/client"
 	"io"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -36,7 +38,7 @@ func getCache() msgcache.Cache {
 	c.Do("SELECT", db)
 	c.Do("FLUSHDB")
 	c.Close()
-	return msgcache.NewRedisMessageCache("", "", db)
+	return msgcache.NewRedisMessageCache("", "", db, nil, nil)
 }
 
 func sendTestMessages(s2c, c2s proto.Conn, serverToClient bool, msgs ...*proto.Message) error {
@@ -605,6 +607,327 @@ func TestSetVisibility(t *testing.T) {
 
 }
 
+func TestDefaultVisibility(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	if !servConn.Visible() {
+		t.Errorf("should be visible by default")
+	}
+	servConn.SetDefaultVisibility(false)
+	if servConn.Visible() {
+		t.Errorf("should be invisible")
+	}
+
+	cliConn.SetVisibility(true)
+	time.Sleep(100 * time.Millisecond)
+	// The client's choice wins.
+	servConn.SetDefaultVisibility(false)
+	if !servConn.Visible() {
+		t.Errorf("should be visible")
+	}
+}
+
+func TestReAuth(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	if servConn.AuthToken() != token {
+		t.Errorf("Not same token")
+	}
+	token = "new token"
+	cliConn.ReAuth(token)
+	time.Sleep(100 * time.Millisecond)
+	if servConn.AuthToken() != token {
+		t.Errorf("Not same token")
+	}
+}
+
+func TestDeleteOnReceipt(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	servConn.SetMessageCache(cache)
+	srv := servConn.Service()
+	usr := servConn.Username()
+	for _, enabled := range []bool{false, true} {
+		id, err := cache.CacheMessage(srv, usr, randomMessage(), 0*time.Second)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		servConn.SetDeleteOnReceipt(enabled)
+		cliConn.SendReceipt(id)
+		time.Sleep(100 * time.Millisecond)
+		n, err := cache.(msgcache.BacklogCounter).BacklogCount(srv, usr)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		// Only the message acknowledged after enabling it is deleted.
+		if n != 1 {
+			t.Errorf("[DeleteOnReceipt=%v] %v messages left; should be 1", enabled, n)
+		}
+	}
+}
+
+func TestAckBeforeDelete(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	servConn.SetMessageCache(cache)
+	servConn.SetAckBeforeDelete(true)
+	msg := randomMessage()
+	id, err := cache.CacheMessage(servConn.Service(), servConn.Username(), msg, 0*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+
+	// The message is kept until it is acknowledged.
+	for i := 0; i < 2; i++ {
+		cliConn.RequestMessage(id)
+		m, err := cliConn.ReadMessage()
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		if m.Id != id || !bytes.Equal(m.Body, msg.Body) {
+			t.Errorf("should retrieve the message again: %v", m)
+		}
+	}
+	cliConn.SendReceipt(id)
+	cliConn.RequestMessage(id)
+	m, err := cliConn.ReadMessage()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if m.Id != id || len(m.Body) != 0 {
+		t.Errorf("the acknowledged message should be gone: %v", m)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	servConn.SetHeartbeat(time.Second)
+	errChan := make(chan error)
+	go func() {
+		_, err := servConn.ReadMessage()
+		errChan <- err
+	}()
+	for i := 0; i < 6; i++ {
+		cliConn.Heartbeat()
+		select {
+		case err := <-errChan:
+			t.Errorf("should be alive with heartbeats: %v", err)
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	select {
+	case err := <-errChan:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("should time out: %v", err)
+		}
+	case <-time.After(HeartbeatTimeoutFactor*time.Second + time.Second):
+		t.Errorf("should time out without heartbeats")
+	}
+}
+
+func TestTrafficCounters(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	N := 10
+	msgs := make([]*proto.Message, N)
+	sz := int64(0)
+	for i := 0; i < N; i++ {
+		msgs[i] = randomMessage()
+		sz += int64(msgs[i].Size())
+	}
+	err = sendTestMessages(servConn, cliConn, false, msgs...)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if servConn.BytesReceived() != sz {
+		t.Errorf("received %v bytes; should be %v", servConn.BytesReceived(), sz)
+	}
+	for _, msg := range msgs {
+		_, err = servConn.SendMessage(msg, nil, 0*time.Second)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		cliConn.ReadMessage()
+	}
+	if servConn.BytesSent() != sz {
+		t.Errorf("sent %v bytes; should be %v", servConn.BytesSent(), sz)
+	}
+}
+
+func TestSubscribeRateLimit(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	N := 3
+	subChan := make(chan *SubscribeRequest, N+1)
+	servConn.SetSubscribeRequestChan(subChan)
+	servConn.SetSubscribeRateLimit(N, time.Minute)
+	params := map[string]string{"pushservicetype": "gcm", "regid": "regid"}
+	for i := 0; i <= N; i++ {
+		cliConn.Subscribe(params)
+	}
+	_, err = servConn.ReadMessage()
+	if err != ErrTooManySubscribes {
+		t.Errorf("should get ErrTooManySubscribes: %v", err)
+	}
+	if len(subChan) != N {
+		t.Errorf("should receive %v subscribe requests: %v", N, len(subChan))
+	}
+}
+
+func TestWatchPresence(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	watchChan := make(chan *WatchRequest, 1)
+	servConn.SetWatchRequestChan(watchChan)
+	presenceChan := make(chan *client.Presence, 1)
+	cliConn.SetPresenceChannel(presenceChan)
+	go servConn.ReadMessage()
+	go cliConn.ReadMessage()
+
+	err = cliConn.Watch([]string{"carol", "alice"})
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	req := <-watchChan
+	if !req.Watch || req.Username != servConn.Username() || req.ConnId != servConn.UniqId() {
+		t.Errorf("bad watch request: %+v", req)
+	}
+	if len(req.Users) != 2 || req.Users[0] != "alice" || req.Users[1] != "carol" {
+		t.Errorf("bad watched users: %v", req.Users)
+	}
+
+	err = servConn.WritePresence("alice", true)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	p := <-presenceChan
+	if p.Username != "alice" || !p.Online {
+		t.Errorf("bad presence: %+v", p)
+	}
+}
+
+func TestCloseWithRetry(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer cliConn.Close()
+
+	servConn.CloseWithReason(proto.CloseCapacity, "too many connections", 1500*time.Millisecond)
+	_, err = cliConn.ReadMessage()
+	rerr, ok := err.(*proto.RetryError)
+	if !ok {
+		t.Errorf("should get a retry error: %v", err)
+		return
+	}
+	if rerr.RetryAfter != 2*time.Second {
+		t.Errorf("should retry after 2s: %v", rerr.RetryAfter)
+	}
+	if rerr.Reason != "too many connections" {
+		t.Errorf("bad reason: %v", rerr.Reason)
+	}
+}
+
+func TestCloseWithReason(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer cliConn.Close()
+
+	servConn.CloseWithReason(proto.CloseDrained, "server is shutting down", 0)
+	_, err = cliConn.ReadMessage()
+	cerr, ok := err.(*proto.CloseError)
+	if !ok {
+		t.Errorf("should get a close error: %v", err)
+		return
+	}
+	if cerr.Code != proto.CloseDrained || cerr.Reason != "server is shutting down" {
+		t.Errorf("bad close error: %+v", cerr)
+	}
+}
+
 func TestForwardFromServerDifferentService(t *testing.T) {
 	addr := "127.0.0.1:8088"
 	token := "token"
@@ -770,3 +1093,57 @@ func TestForwardRequestSameService(t *testing.T) {
 	}()
 	wg.Wait()
 }
+
+func TestMaxReplayAge(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	servConn.SetMessageCache(cache)
+	servConn.SetMaxReplayAge(500 * time.Millisecond)
+	old := randomMessage()
+	oldId, err := cache.CacheMessage(servConn.Service(), servConn.Username(), old, time.Hour)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	time.Sleep(600 * time.Millisecond)
+	msg := randomMessage()
+	id, err := cache.CacheMessage(servConn.Service(), servConn.Username(), msg, time.Hour)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+
+	// Within the age, the message is replayed.
+	cliConn.RequestMessage(id)
+	m, err := cliConn.ReadMessage()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if m.Id != id || !bytes.Equal(m.Body, msg.Body) {
+		t.Errorf("should retrieve the message: %v", m)
+	}
+
+	// Beyond the age, the message is skipped and deleted.
+	cliConn.RequestMessage(oldId)
+	m, err = cliConn.ReadMessage()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if m.Id != oldId || len(m.Body) != 0 {
+		t.Errorf("the stale message should not be replayed: %v", m)
+	}
+	if m, _ := cache.(msgcache.Getter).Get(servConn.Service(), servConn.Username(), oldId); m != nil {
+		t.Errorf("the stale message should be deleted")
+	}
+}
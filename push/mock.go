@@ -0,0 +1,128 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package push
+
+import (
+	"sync"
+)
+
+// PushCall is a call recorded by MockPush.
+type PushCall struct {
+	Service  string
+	Username string
+	Info     map[string]string
+	MsgIds   []string
+}
+
+// MockPush is an in-process Push which pushes nothing but records
+// the calls, so that the offline flow could be tested without
+// uniqush-push.
+type MockPush struct {
+	lock             sync.Mutex
+	nrDeliveryPoints int
+	subscribes       []*PushCall
+	unsubscribes     []*PushCall
+	pushes           []*PushCall
+}
+
+// NewMockPush returns a MockPush under which each user has
+// nrDeliveryPoints delivery points.
+func NewMockPush(nrDeliveryPoints int) *MockPush {
+	ret := new(MockPush)
+	ret.nrDeliveryPoints = nrDeliveryPoints
+	return ret
+}
+
+func newPushCall(service, username string, info map[string]string, msgIds []string) *PushCall {
+	call := &PushCall{
+		Service:  service,
+		Username: username,
+		Info:     make(map[string]string, len(info)),
+	}
+	for k, v := range info {
+		call.Info[k] = v
+	}
+	if len(msgIds) > 0 {
+		call.MsgIds = make([]string, len(msgIds))
+		copy(call.MsgIds, msgIds)
+	}
+	return call
+}
+
+func (self *MockPush) Subscribe(service, username string, info map[string]string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.subscribes = append(self.subscribes, newPushCall(service, username, info, nil))
+	return nil
+}
+
+func (self *MockPush) Unsubscribe(service, username string, info map[string]string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.unsubscribes = append(self.unsubscribes, newPushCall(service, username, info, nil))
+	return nil
+}
+
+func (self *MockPush) Push(service, username string, info map[string]string, msgIds []string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.pushes = append(self.pushes, newPushCall(service, username, info, msgIds))
+	return nil
+}
+
+func (self *MockPush) NrDeliveryPoints(service, username string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.nrDeliveryPoints
+}
+
+func (self *MockPush) SetNrDeliveryPoints(n int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.nrDeliveryPoints = n
+}
+
+// Subscribes returns the subscribe calls recorded so far.
+func (self *MockPush) Subscribes() []*PushCall {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]*PushCall(nil), self.subscribes...)
+}
+
+// Unsubscribes returns the unsubscribe calls recorded so far.
+func (self *MockPush) Unsubscribes() []*PushCall {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]*PushCall(nil), self.unsubscribes...)
+}
+
+// Pushes returns the push calls recorded so far.
+func (self *MockPush) Pushes() []*PushCall {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]*PushCall(nil), self.pushes...)
+}
+
+// Reset forgets all the calls recorded.
+func (self *MockPush) Reset() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.subscribes = nil
+	self.unsubscribes = nil
+	self.pushes = nil
+}
@@ -19,7 +19,11 @@ package push
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -30,22 +34,86 @@ import (
 
 // TODO: Use decorator pattern to implement an aggregate Push interface
 
+// DeliveryPointCounter counts the delivery points, e.g. the devices,
+// which receive the notifications pushed to the user.
+type DeliveryPointCounter interface {
+	NrDeliveryPoints(service, username string) int
+}
+
 type Push interface {
 	Subscribe(service, username string, info map[string]string) error
 	Unsubscribe(service, username string, info map[string]string) error
 	Push(service, username string, info map[string]string, msgIds []string) error
-	NrDeliveryPoints(service, username string) int
+	DeliveryPointCounter
+}
+
+// PushResult is the outcome of a push to one delivery point.
+type PushResult struct {
+	// The id of the message pushed to the delivery point,
+	// or empty if the push service does not tell.
+	MsgId         string
+	DeliveryPoint string
+	Err           error
+}
+
+// DetailedPush is implemented by a Push which tells the outcome of
+// the push to each delivery point, so that some of them may fail
+// while the others succeed.
+type DetailedPush interface {
+	// PushDetailed returns an error only if the push failed as
+	// a whole. Otherwise, each result tells the outcome of a
+	// delivery point.
+	PushDetailed(service, username string, info map[string]string, msgIds []string) ([]*PushResult, error)
+}
+
+// PushDetailed pushes the notification with p. If p is not a
+// DetailedPush, the error of p.Push is taken as the failure of the
+// whole push, and a nil error as the success of a delivery point
+// for each message id.
+func PushDetailed(p Push, service, username string, info map[string]string, msgIds []string) ([]*PushResult, error) {
+	if dp, ok := p.(DetailedPush); ok {
+		return dp.PushDetailed(service, username, info, msgIds)
+	}
+	err := p.Push(service, username, info, msgIds)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*PushResult, len(msgIds))
+	for i, id := range msgIds {
+		res[i] = &PushResult{MsgId: id}
+	}
+	return res, nil
+}
+
+// Timeouts of the requests to uniqush-push. Zero means no timeout.
+type Timeouts struct {
+	// Subscribe and unsubscribe.
+	Subscribe        time.Duration
+	Push             time.Duration
+	NrDeliveryPoints time.Duration
 }
 
 type uniqushPush struct {
-	addr    string
-	timeout time.Duration
+	addr     string
+	timeouts Timeouts
 }
 
 func NewUniqushPushClient(addr string, timeout time.Duration) Push {
+	return NewUniqushPushClientWithTimeouts(addr, &Timeouts{
+		Subscribe:        timeout,
+		Push:             timeout,
+		NrDeliveryPoints: timeout,
+	})
+}
+
+// NewUniqushPushClientWithTimeouts is like NewUniqushPushClient,
+// except that each kind of requests has its own timeout.
+func NewUniqushPushClientWithTimeouts(addr string, timeouts *Timeouts) Push {
 	ret := new(uniqushPush)
 	ret.addr = addr
-	ret.timeout = timeout
+	if timeouts != nil {
+		ret.timeouts = *timeouts
+	}
 	return ret
 }
 
@@ -62,7 +130,27 @@ func timeoutDialler(ns time.Duration) func(net, addr string) (c net.Conn, err er
 	}
 }
 
-func (self *uniqushPush) postReadLines(path string, data url.Values, nrLines int) (value string, err error) {
+// Responses larger than this are not parsed.
+const maxPushResponseLen = 1 << 20
+
+func (self *uniqushPush) postReadAll(path string, data url.Values, timeout time.Duration) (body []byte, err error) {
+	url := fmt.Sprintf("http://%v/%v", self.addr, path)
+
+	c := http.Client{
+		Transport: &http.Transport{
+			Dial: timeoutDialler(timeout),
+		},
+	}
+	resp, err := c.PostForm(url, data)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxPushResponseLen))
+	return
+}
+
+func (self *uniqushPush) postReadLines(path string, data url.Values, nrLines int, timeout time.Duration) (value string, err error) {
 	if len(path) == 0 {
 		return
 	}
@@ -71,7 +159,7 @@ func (self *uniqushPush) postReadLines(path string, data url.Values, nrLines int
 
 	c := http.Client{
 		Transport: &http.Transport{
-			Dial: timeoutDialler(self.timeout),
+			Dial: timeoutDialler(timeout),
 		},
 	}
 	resp, err := c.PostForm(url, data)
@@ -95,8 +183,8 @@ func (self *uniqushPush) postReadLines(path string, data url.Values, nrLines int
 	return
 }
 
-func (self *uniqushPush) post(path string, data url.Values) error {
-	_, err := self.postReadLines(path, data, 0)
+func (self *uniqushPush) post(path string, data url.Values, timeout time.Duration) error {
+	_, err := self.postReadLines(path, data, 0, timeout)
 	return err
 }
 
@@ -121,7 +209,7 @@ func (self *uniqushPush) subscribe(service, username string, info map[string]str
 	if sub {
 		path = "subscribe"
 	}
-	err := self.post(path, data)
+	err := self.post(path, data, self.timeouts.Subscribe)
 	return err
 }
 
@@ -129,7 +217,7 @@ func (self *uniqushPush) NrDeliveryPoints(service, username string) int {
 	data := url.Values{}
 	data.Add("service", service)
 	data.Add("subscriber", username)
-	v, err := self.postReadLines("nrdp", data, 1)
+	v, err := self.postReadLines("nrdp", data, 1, self.timeouts.NrDeliveryPoints)
 	if err != nil {
 		return 0
 	}
@@ -148,7 +236,9 @@ func (self *uniqushPush) Unsubscribe(service, username string, info map[string]s
 	return self.subscribe(service, username, info, false)
 }
 
-func (self *uniqushPush) Push(service, username string, info map[string]string, msgIds []string) error {
+// PushDetailed pushes the notification with uniqush-push, which
+// replies the outcome of each delivery point.
+func (self *uniqushPush) PushDetailed(service, username string, info map[string]string, msgIds []string) ([]*PushResult, error) {
 	data := url.Values{}
 	data.Add("service", service)
 	data.Add("subscriber", username)
@@ -167,6 +257,65 @@ func (self *uniqushPush) Push(service, username string, info map[string]string,
 	for _, id := range msgIds {
 		data.Add("uniqush.perdp.uniqush.msgid", id)
 	}
-	err := self.post("push", data)
+	body, err := self.postReadAll("push", data, self.timeouts.Push)
+	if err != nil {
+		return nil, err
+	}
+	return parsePushResults(body, msgIds), nil
+}
+
+func (self *uniqushPush) Push(service, username string, info map[string]string, msgIds []string) error {
+	_, err := self.PushDetailed(service, username, info, msgIds)
 	return err
 }
+
+// pushResponse is the JSON reply of uniqush-push to a push request.
+// Each detail is the outcome of a delivery point.
+type pushResponse struct {
+	Details []*struct {
+		DeliveryPoint string
+		Code          string
+		ErrorMsg      string
+	}
+}
+
+const pushSuccessCode = "UNIQUSH_SUCCESS"
+
+// parsePushResults reads the outcome of each delivery point from the
+// reply of uniqush-push. uniqush-push does not tell which message id
+// went to which delivery point, so MsgId is only set if all the
+// delivery points succeeded. A reply without details, e.g. the plain
+// text of older versions, means success for every message id.
+func parsePushResults(body []byte, msgIds []string) []*PushResult {
+	var resp pushResponse
+	if json.Unmarshal(body, &resp) != nil || len(resp.Details) == 0 {
+		res := make([]*PushResult, len(msgIds))
+		for i, id := range msgIds {
+			res[i] = &PushResult{MsgId: id}
+		}
+		return res
+	}
+	res := make([]*PushResult, 0, len(resp.Details))
+	nrFailed := 0
+	for _, d := range resp.Details {
+		if d == nil {
+			continue
+		}
+		r := &PushResult{DeliveryPoint: d.DeliveryPoint}
+		if d.Code != pushSuccessCode {
+			msg := d.ErrorMsg
+			if len(msg) == 0 {
+				msg = d.Code
+			}
+			r.Err = errors.New(msg)
+			nrFailed++
+		}
+		res = append(res, r)
+	}
+	if nrFailed == 0 && len(res) == len(msgIds) {
+		for i, r := range res {
+			r.MsgId = msgIds[i]
+		}
+	}
+	return res
+}
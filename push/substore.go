@@ -0,0 +1,190 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+type Subscription struct {
+	Service  string
+	Username string
+	Info     map[string]string
+}
+
+// SubscriptionStore keeps a local record of the subscriptions sent to
+// the push service, so that they can be replayed if the push service
+// loses its data.
+//
+// A subscription is identified by its info. To remove a subscription,
+// Unsubscribe should be called with the same info used to subscribe.
+type SubscriptionStore interface {
+	Subscribe(service, username string, info map[string]string) error
+	Unsubscribe(service, username string, info map[string]string) error
+
+	// All subscriptions stored under the service.
+	AllSubscriptions(service string) (subs []*Subscription, err error)
+}
+
+type redisSubscriptionStore struct {
+	pool *redis.Pool
+}
+
+func NewRedisSubscriptionStore(addr, password string, db int) SubscriptionStore {
+	if len(addr) == 0 {
+		addr = "localhost:6379"
+	}
+	if db < 0 {
+		db = 0
+	}
+
+	dial := func() (redis.Conn, error) {
+		c, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if len(password) > 0 {
+			if _, err := c.Do("AUTH", password); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+		if _, err := c.Do("SELECT", db); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, err
+	}
+	testOnBorrow := func(c redis.Conn, t time.Time) error {
+		_, err := c.Do("PING")
+		return err
+	}
+
+	ret := new(redisSubscriptionStore)
+	ret.pool = &redis.Pool{
+		MaxIdle:      3,
+		IdleTimeout:  240 * time.Second,
+		Dial:         dial,
+		TestOnBorrow: testOnBorrow,
+	}
+	return ret
+}
+
+// A set of the users who have subscriptions under the service.
+func subUsersKey(service string) string {
+	return fmt.Sprintf("subs-users:%v", service)
+}
+
+// A set of the subscriptions of the user, each encoded in JSON.
+func subKey(service, username string) string {
+	return fmt.Sprintf("subs:%v:%v", service, username)
+}
+
+// The keys of the map are sorted by encoding/json, so the same
+// info is always encoded to the same string.
+func encodeSubInfo(info map[string]string) (string, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (self *redisSubscriptionStore) Subscribe(service, username string, info map[string]string) error {
+	data, err := encodeSubInfo(info)
+	if err != nil {
+		return err
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	err = conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+	err = conn.Send("SADD", subKey(service, username), data)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	err = conn.Send("SADD", subUsersKey(service), username)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (self *redisSubscriptionStore) Unsubscribe(service, username string, info map[string]string) error {
+	data, err := encodeSubInfo(info)
+	if err != nil {
+		return err
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("SREM", subKey(service, username), data)
+	return err
+}
+
+// NrDeliveryPoints counts the subscriptions stored for the user, so
+// that the store can count delivery points without asking the push
+// service. It returns 0 if the store cannot be reached.
+func (self *redisSubscriptionStore) NrDeliveryPoints(service, username string) int {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("SCARD", subKey(service, username)))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func (self *redisSubscriptionStore) AllSubscriptions(service string) (subs []*Subscription, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	users, err := redis.Strings(conn.Do("SMEMBERS", subUsersKey(service)))
+	if err != nil {
+		return
+	}
+	subs = make([]*Subscription, 0, len(users))
+	for _, username := range users {
+		var infos []string
+		infos, err = redis.Strings(conn.Do("SMEMBERS", subKey(service, username)))
+		if err != nil {
+			return
+		}
+		for _, data := range infos {
+			sub := new(Subscription)
+			sub.Service = service
+			sub.Username = username
+			err = json.Unmarshal([]byte(data), &sub.Info)
+			if err != nil {
+				return
+			}
+			subs = append(subs, sub)
+		}
+	}
+	return
+}